@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	nriapi "github.com/containerd/nri/pkg/api"
+	"github.com/containerd/nri/pkg/stub"
+	"github.com/rootless-containers/bypass4netns/pkg/api/daemon/client"
+	"github.com/rootless-containers/bypass4netns/pkg/nriplugin"
+	pkgversion "github.com/rootless-containers/bypass4netns/pkg/version"
+	"github.com/sirupsen/logrus"
+	flag "github.com/spf13/pflag"
+)
+
+var (
+	socketFile    string
+	nriSocketFile string
+	pluginName    string
+	pluginIdx     string
+)
+
+func main() {
+	xdgRuntimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if xdgRuntimeDir == "" {
+		logrus.Fatalf("$XDG_RUNTIME_DIR needs to be set")
+	}
+
+	flag.StringVar(&socketFile, "socket", filepath.Join(xdgRuntimeDir, "bypass4netnsd.sock"), "Socket file of bypass4netnsd")
+	flag.StringVar(&nriSocketFile, "nri-socket", "", "Socket file of NRI (default: the default NRI socket)")
+	flag.StringVar(&pluginName, "name", "bypass4netns", "Plugin name to register to NRI")
+	flag.StringVar(&pluginIdx, "idx", "10", "Plugin index to register to NRI")
+	debug := flag.Bool("debug", false, "Enable debug mode")
+	version := flag.Bool("version", false, "Show version")
+	help := flag.Bool("help", false, "Show help")
+
+	// Parse arguments
+	flag.Parse()
+	if flag.NArg() > 0 {
+		flag.PrintDefaults()
+		logrus.Fatal("Invalid command")
+	}
+
+	if *debug {
+		logrus.Info("Debug mode enabled")
+		logrus.SetLevel(logrus.DebugLevel)
+	} else {
+		logrus.SetLevel(logrus.InfoLevel)
+	}
+
+	if *version {
+		fmt.Printf("bypass4netns-nri version %s\n", strings.TrimPrefix(pkgversion.Version, "v"))
+		os.Exit(0)
+	}
+
+	if *help {
+		flag.Usage()
+		os.Exit(0)
+	}
+
+	c, err := client.New(socketFile)
+	if err != nil {
+		logrus.Fatalf("failed to connect to bypass4netnsd: %s", err)
+	}
+	logrus.Infof("SocketPath: %s", socketFile)
+
+	// the name and the index are given by the runtime when the plugin is launched by the runtime
+	opts := []stub.Option{}
+	if os.Getenv(nriapi.PluginNameEnvVar) == "" {
+		opts = append(opts, stub.WithPluginName(pluginName))
+	}
+	if os.Getenv(nriapi.PluginIdxEnvVar) == "" {
+		opts = append(opts, stub.WithPluginIdx(pluginIdx))
+	}
+	if nriSocketFile != "" {
+		opts = append(opts, stub.WithSocketPath(nriSocketFile))
+	}
+
+	if err := nriplugin.New(c).Run(context.Background(), opts...); err != nil {
+		logrus.Fatalf("NRI plugin exited: %s", err)
+	}
+}
@@ -0,0 +1,274 @@
+// bypass4netns-runc is a wrapper of runc to be registered as a Docker runtime.
+//
+// /etc/docker/daemon.json (or ~/.config/docker/daemon.json for Rootless Docker):
+//
+//	{
+//	  "runtimes": {
+//	    "bypass4netns-runc": {
+//	      "path": "/usr/local/bin/bypass4netns-runc"
+//	    }
+//	  }
+//	}
+//
+// The containers are accelerated when they are started with `--annotation bypass4netns=true`.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/rootless-containers/bypass4netns/pkg/api"
+	"github.com/rootless-containers/bypass4netns/pkg/api/daemon/client"
+	"github.com/rootless-containers/bypass4netns/pkg/oci"
+	"github.com/rootless-containers/bypass4netns/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+const flagPrefix = "--b4nn-"
+
+type config struct {
+	runcPath   string
+	socketPath string
+}
+
+// runc's global flags that take a value
+var runcGlobalValueFlags = map[string]bool{
+	"--root":       true,
+	"--log":        true,
+	"--log-format": true,
+	"--criu":       true,
+	"--rootless":   true,
+}
+
+// runc create/run flags that take a value
+var runcCreateValueFlags = map[string]bool{
+	"--bundle":         true,
+	"-b":               true,
+	"--console-socket": true,
+	"--pid-file":       true,
+	"--pidfd-socket":   true,
+	"--preserve-fds":   true,
+}
+
+func main() {
+	cfg, runcArgs, err := parseWrapperArgs(os.Args[1:])
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	command, cmdArgs := splitCommand(runcArgs)
+	switch command {
+	case "create", "run":
+		if err := handleCreate(cfg, cmdArgs); err != nil {
+			logrus.WithError(err).Fatal("failed to start bypass4netns")
+		}
+	case "delete":
+		if err := handleDelete(cfg, cmdArgs); err != nil {
+			logrus.WithError(err).Warn("failed to stop bypass4netns")
+		}
+	}
+
+	runcPath, err := exec.LookPath(cfg.runcPath)
+	if err != nil {
+		logrus.Fatalf("runc executable not found %s", cfg.runcPath)
+	}
+	argv := append([]string{runcPath}, runcArgs...)
+	if err := syscall.Exec(runcPath, argv, os.Environ()); err != nil {
+		logrus.Fatalf("failed to exec %s: %s", runcPath, err)
+	}
+}
+
+// parseWrapperArgs separates the flags prefixed with "--b4nn-" from runc's arguments.
+func parseWrapperArgs(args []string) (*config, []string, error) {
+	cfg := &config{
+		runcPath: "runc",
+	}
+	if xdgRuntimeDir := os.Getenv("XDG_RUNTIME_DIR"); xdgRuntimeDir != "" {
+		cfg.socketPath = filepath.Join(xdgRuntimeDir, "bypass4netnsd.sock")
+	}
+
+	runcArgs := []string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, flagPrefix) {
+			runcArgs = append(runcArgs, arg)
+			continue
+		}
+		name, value, ok := strings.Cut(strings.TrimPrefix(arg, flagPrefix), "=")
+		if !ok {
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("flag %s needs a value", arg)
+			}
+			i++
+			value = args[i]
+		}
+		switch name {
+		case "runc":
+			cfg.runcPath = value
+		case "socket":
+			cfg.socketPath = value
+		default:
+			return nil, nil, fmt.Errorf("unknown flag %s", arg)
+		}
+	}
+	return cfg, runcArgs, nil
+}
+
+// splitCommand returns runc's subcommand and its arguments.
+func splitCommand(args []string) (string, []string) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") {
+			return arg, args[i+1:]
+		}
+		if runcGlobalValueFlags[arg] {
+			i++
+		}
+	}
+	return "", nil
+}
+
+// parseCreateArgs returns the bundle path and the container ID.
+func parseCreateArgs(args []string) (string, string, error) {
+	bundle := ""
+	id := ""
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") {
+			id = arg
+			continue
+		}
+		name, value, ok := strings.Cut(arg, "=")
+		if !runcCreateValueFlags[name] {
+			continue
+		}
+		if !ok {
+			if i+1 >= len(args) {
+				return "", "", fmt.Errorf("flag %s needs a value", arg)
+			}
+			i++
+			value = args[i]
+		}
+		if name == "--bundle" || name == "-b" {
+			bundle = value
+		}
+	}
+	if id == "" {
+		return "", "", fmt.Errorf("container id is not specified")
+	}
+	if bundle == "" {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return "", "", err
+		}
+		bundle = cwd
+	}
+	return bundle, id, nil
+}
+
+func handleCreate(cfg *config, args []string) error {
+	bundle, id, err := parseCreateArgs(args)
+	if err != nil {
+		return err
+	}
+	logger := logrus.WithFields(logrus.Fields{"ID": util.ShrinkID(id)})
+
+	configPath := filepath.Join(bundle, "config.json")
+	configJSON, err := os.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+	var spec specs.Spec
+	if err := json.Unmarshal(configJSON, &spec); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", configPath, err)
+	}
+
+	enabled, _, err := oci.IsEnabled(spec.Annotations)
+	if err != nil {
+		return err
+	}
+	if !enabled {
+		return nil
+	}
+	if !oci.HasNetworkNamespace(&spec) {
+		logger.Info("the container does not have its own network namespace, skipping bypass4netns")
+		return nil
+	}
+
+	ports := []api.PortSpec{}
+	if v := spec.Annotations[oci.AnnotationPortBindings]; v != "" {
+		ports, err = oci.ParseDockerPortBindings(v)
+		if err != nil {
+			return err
+		}
+	}
+	bSpec, err := oci.NewBypassSpec(id, spec.Annotations, ports)
+	if err != nil {
+		return err
+	}
+	if err := oci.SetStatePaths(bSpec); err != nil {
+		return err
+	}
+
+	c, err := client.New(cfg.socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to connect to bypass4netnsd: %w", err)
+	}
+
+	if err := oci.TranslateSpec(&spec, bSpec.SocketPath); err != nil {
+		return err
+	}
+	configJSON, err = json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(configPath, configJSON, 0o644); err != nil {
+		return err
+	}
+	logger.Infof("rewrote the seccomp profile in %s", configPath)
+
+	if _, err := c.BypassManager().StartBypass(context.TODO(), *bSpec); err != nil {
+		return err
+	}
+	logger.Info("started bypass4netns")
+	return nil
+}
+
+func handleDelete(cfg *config, args []string) error {
+	id := ""
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") {
+			id = arg
+		}
+	}
+	if id == "" {
+		return fmt.Errorf("container id is not specified")
+	}
+
+	c, err := client.New(cfg.socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to connect to bypass4netnsd: %w", err)
+	}
+	bm := c.BypassManager()
+	statuses, err := bm.ListBypass(context.TODO())
+	if err != nil {
+		return err
+	}
+	for _, st := range statuses {
+		if st.ID != id {
+			continue
+		}
+		if err := bm.StopBypass(context.TODO(), id); err != nil {
+			return err
+		}
+		logrus.WithFields(logrus.Fields{"ID": util.ShrinkID(id)}).Info("stopped bypass4netns")
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseWrapperArgs(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", "/run/user/1000")
+	testCases := []struct {
+		args       string
+		runcPath   string
+		socketPath string
+		runcArgs   string
+		err        bool
+	}{
+		{
+			args:       "--root /run/user/1000/docker/runtime-runc/moby --log log.json --log-format json delete --force ID",
+			runcPath:   "runc",
+			socketPath: "/run/user/1000/bypass4netnsd.sock",
+			runcArgs:   "--root /run/user/1000/docker/runtime-runc/moby --log log.json --log-format json delete --force ID",
+		},
+		{
+			// runtimeArgs of daemon.json are placed before runc's arguments
+			args:       "--b4nn-runc=/usr/local/sbin/runc --b4nn-socket /tmp/b4nnd.sock --root R create --bundle B ID",
+			runcPath:   "/usr/local/sbin/runc",
+			socketPath: "/tmp/b4nnd.sock",
+			runcArgs:   "--root R create --bundle B ID",
+		},
+		{
+			args: "--b4nn-runc",
+			err:  true,
+		},
+		{
+			args: "--b4nn-unknown=foo create ID",
+			err:  true,
+		},
+	}
+
+	for _, tc := range testCases {
+		cfg, runcArgs, err := parseWrapperArgs(strings.Fields(tc.args))
+		if tc.err {
+			assert.NotEqual(t, nil, err, tc.args)
+			continue
+		}
+		assert.Equal(t, nil, err, tc.args)
+		assert.Equal(t, tc.runcPath, cfg.runcPath, tc.args)
+		assert.Equal(t, tc.socketPath, cfg.socketPath, tc.args)
+		assert.Equal(t, strings.Fields(tc.runcArgs), runcArgs, tc.args)
+	}
+}
+
+func TestSplitCommand(t *testing.T) {
+	testCases := []struct {
+		args    string
+		command string
+		cmdArgs string
+	}{
+		{
+			// containerd-shim-runc-v2
+			args:    "--root /run/user/1000/docker/runtime-runc/moby --log /run/log.json --log-format json --systemd-cgroup create --bundle B --pid-file P ID",
+			command: "create",
+			cmdArgs: "--bundle B --pid-file P ID",
+		},
+		{
+			args:    "--root=R --log=L --log-format=json --rootless=auto run -d --bundle B ID",
+			command: "run",
+			cmdArgs: "-d --bundle B ID",
+		},
+		{
+			args:    "--debug --rootless true --criu criu delete ID",
+			command: "delete",
+			cmdArgs: "ID",
+		},
+		{
+			args:    "--version",
+			command: "",
+			cmdArgs: "",
+		},
+	}
+
+	for _, tc := range testCases {
+		command, cmdArgs := splitCommand(strings.Fields(tc.args))
+		assert.Equal(t, tc.command, command, tc.args)
+		assert.Equal(t, strings.Fields(tc.cmdArgs), append([]string{}, cmdArgs...), tc.args)
+	}
+}
+
+func TestParseCreateArgs(t *testing.T) {
+	cwd, err := os.Getwd()
+	assert.Equal(t, nil, err)
+	testCases := []struct {
+		args   string
+		bundle string
+		id     string
+		err    bool
+	}{
+		{
+			// containerd-shim-runc-v2
+			args:   "--bundle /run/containerd/io.containerd.runtime.v2.task/moby/ID --pid-file /run/init.pid --console-socket /tmp/pty.sock --no-pivot --no-new-keyring --preserve-fds 2 ID",
+			bundle: "/run/containerd/io.containerd.runtime.v2.task/moby/ID",
+			id:     "ID",
+		},
+		{
+			args:   "-b B --pidfd-socket /tmp/pidfd.sock ID",
+			bundle: "B",
+			id:     "ID",
+		},
+		{
+			args:   "--bundle=B --pid-file=P --preserve-fds=1 ID",
+			bundle: "B",
+			id:     "ID",
+		},
+		{
+			args:   "--detach --keep ID",
+			bundle: cwd,
+			id:     "ID",
+		},
+		{
+			args: "--bundle B",
+			err:  true,
+		},
+		{
+			args: "--bundle B ID --pid-file",
+			err:  true,
+		},
+	}
+
+	for _, tc := range testCases {
+		bundle, id, err := parseCreateArgs(strings.Fields(tc.args))
+		if tc.err {
+			assert.NotEqual(t, nil, err, tc.args)
+			continue
+		}
+		assert.Equal(t, nil, err, tc.args)
+		assert.Equal(t, tc.bundle, bundle, tc.args)
+		assert.Equal(t, tc.id, id, tc.args)
+	}
+}
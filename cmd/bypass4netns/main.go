@@ -11,10 +11,17 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/rootless-containers/bypass4netns/pkg/api/com"
 	"github.com/rootless-containers/bypass4netns/pkg/bypass4netns"
+	"github.com/rootless-containers/bypass4netns/pkg/bypass4netns/helper"
+	"github.com/rootless-containers/bypass4netns/pkg/bypass4netns/nonbypassable"
 	"github.com/rootless-containers/bypass4netns/pkg/bypass4netns/nsagent"
+	"github.com/rootless-containers/bypass4netns/pkg/bypass4netns/registry"
 	"github.com/rootless-containers/bypass4netns/pkg/bypass4netns/tracer"
+	// the agents executed from this executable enter the namespaces in the constructor of nsenter
+	_ "github.com/rootless-containers/bypass4netns/pkg/nsenter"
 	"github.com/rootless-containers/bypass4netns/pkg/oci"
+	"github.com/rootless-containers/bypass4netns/pkg/peercred"
 	pkgversion "github.com/rootless-containers/bypass4netns/pkg/version"
 	seccomp "github.com/seccomp/libseccomp-golang"
 	"github.com/sirupsen/logrus"
@@ -29,6 +36,7 @@ var (
 	logFilePath          string
 	multinodeEtcdAddress string
 	multinodeHostAddress string
+	multinodeRegistryDir string
 	readyFd              int
 	exitFd               int
 )
@@ -46,20 +54,27 @@ func main() {
 	flag.StringVar(&logFilePath, "log-file", "", "Output logs to file")
 	flag.StringVar(&multinodeEtcdAddress, "multinode-etcd-address", "", "Etcd address for multinode communication")
 	flag.StringVar(&multinodeHostAddress, "multinode-host-address", "", "Host address for multinode communication")
+	flag.StringVar(&multinodeRegistryDir, "multinode-registry-dir", "", "Directory shared between the hosts for --multinode-registry=\"file\"")
 	flag.IntVar(&readyFd, "ready-fd", -1, "File descriptor to notify when ready")
 	flag.IntVar(&exitFd, "exit-fd", -1, "File descriptor for terminating bypass4netns")
 	ignoredSubnets := flag.StringSlice("ignore", []string{"127.0.0.0/8"}, "Subnets to ignore in bypass4netns. Can be also set to \"auto\".")
+	ignoredRoutes := flag.String("ignore-routes", string(nonbypassable.DefaultRoutePolicy), "Routes in the container to ignore with --ignore=\"auto\". \"non-default\" (all but the default routes) or \"none\"")
 	fowardPorts := flag.StringArrayP("publish", "p", []string{}, "Publish a container's port(s) to the host")
 	debug := flag.Bool("debug", false, "Enable debug mode")
 	version := flag.Bool("version", false, "Show version")
 	help := flag.Bool("help", false, "Show help")
 	nsagentFlag := flag.Bool("nsagent", false, "(An internal flag. Do not use manually.)")          // TODO: hide
 	tracerAgentFlag := flag.Bool("tracer-agent", false, "(An internal flag. Do not use manually.)") // TODO: hide
-	memNSEnterPid := flag.Int("mem-nsenter-pid", -1, "(An internal flag. Do not use manually.)")    // TODO: hide
+	helperFlag := flag.Bool("helper", false, "(An internal flag. Do not use manually.)")            // TODO: hide
 	handleC2cEnable := flag.Bool("handle-c2c-connections", false, "Handle connections between containers")
 	tracerEnable := flag.Bool("tracer", false, "Enable connection tracer")
+	tracerProbeTimeout := flag.Duration("tracer-probe-timeout", bypass4netns.DefaultTracerProbeTimeout, "Timeout of each connection by the tracer to verify an address of the other containers")
+	tracerVerifyInterval := flag.Duration("tracer-verify-interval", bypass4netns.DefaultTracerVerifyInterval, "Interval to verify the addresses of the other containers again with the tracer")
 	multinodeEnable := flag.Bool("multinode", false, "Enable multinode communication")
+	multinodeRegistry := flag.String("multinode-registry", string(registry.DefaultBackend), "Registry of the container addresses for multinode communication. \"etcd\" or \"file\"")
 	ignoreBind := flag.Bool("ignore-bind", false, "Disable bypassing bind")
+	allowedUIDs := flag.UintSlice("allowed-uids", []uint{}, "UIDs allowed to send seccomp file descriptors (default: the UID of bypass4netns)")
+	allowedRuntimes := flag.StringSlice("allowed-runtimes", oci.DefaultRuntimes, "OCI runtimes allowed to send seccomp file descriptors, as base names or absolute paths (empty to allow any executable)")
 
 	// Parse arguments
 	flag.Parse()
@@ -87,14 +102,6 @@ func main() {
 		os.Exit(0)
 	}
 
-	if *memNSEnterPid > 0 {
-		logrus.SetOutput(os.Stdout)
-		if err := bypass4netns.OpenMemWithNSEnterAgent(uint32(*memNSEnterPid)); err != nil {
-			logrus.Fatal(err)
-		}
-		os.Exit(0)
-	}
-
 	if logFilePath != "" {
 		logFile, err := os.Create(logFilePath)
 		if err != nil {
@@ -119,6 +126,13 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *helperFlag {
+		if err := helper.Main(); err != nil {
+			logrus.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
 	if *handleC2cEnable {
 		if comSocketFile == "" {
 			logrus.Fatal("--com-socket is not specified")
@@ -129,16 +143,26 @@ func main() {
 		if !*handleC2cEnable {
 			logrus.Fatal("--handle-c2c-connections is not enabled")
 		}
+		if *tracerProbeTimeout <= 0 || *tracerVerifyInterval <= 0 {
+			logrus.Fatal("--tracer-probe-timeout and --tracer-verify-interval must be positive")
+		}
 	}
 
+	registryBackend, err := registry.ParseBackend(*multinodeRegistry)
+	if err != nil {
+		logrus.Fatalf("invalid --multinode-registry: %v", err)
+	}
 	if *multinodeEnable {
-		if multinodeEtcdAddress == "" {
+		if registryBackend == registry.BackendEtcd && multinodeEtcdAddress == "" {
 			logrus.Fatal("--multinode-etcd-address is not specified")
 		}
+		if registryBackend == registry.BackendFile && multinodeRegistryDir == "" {
+			logrus.Fatal("--multinode-registry-dir is not specified")
+		}
 		if multinodeHostAddress == "" {
 			logrus.Fatal("--multinode-host-address is not specified")
 		}
-		logrus.WithFields(logrus.Fields{"etcdAddress": multinodeEtcdAddress, "hostAddress": multinodeHostAddress}).Infof("Multinode communication is enabled.")
+		logrus.WithFields(logrus.Fields{"registry": registryBackend, "etcdAddress": multinodeEtcdAddress, "registryDir": multinodeRegistryDir, "hostAddress": multinodeHostAddress}).Infof("Multinode communication is enabled.")
 	}
 
 	if err := os.Remove(socketFile); err != nil && !errors.Is(err, os.ErrNotExist) {
@@ -157,6 +181,18 @@ func main() {
 
 	handler := bypass4netns.NewHandler(socketFile, comSocketFile, strings.Replace(logFilePath, ".log", "-tracer.log", -1), *ignoreBind)
 
+	peerPolicy := &peercred.Policy{Executables: *allowedRuntimes}
+	for _, uid := range *allowedUIDs {
+		peerPolicy.UIDs = append(peerPolicy.UIDs, uint32(uid))
+	}
+	handler.SetPeerPolicy(peerPolicy)
+
+	// the token issued by bypass4netnsd is not inherited by the agents
+	if token, ok := os.LookupEnv(com.TokenEnv); ok {
+		os.Unsetenv(com.TokenEnv)
+		handler.SetComToken(token)
+	}
+
 	subnets := []net.IPNet{}
 	var subnetsAuto bool
 	for _, subnetStr := range *ignoredSubnets {
@@ -177,6 +213,11 @@ func main() {
 		}
 	}
 	handler.SetIgnoredSubnets(subnets, subnetsAuto)
+	routePolicy, err := nonbypassable.ParseRoutePolicy(*ignoredRoutes)
+	if err != nil {
+		logrus.Fatalf("invalid --ignore-routes: %v", err)
+	}
+	handler.SetIgnoredRoutePolicy(routePolicy)
 
 	for _, forwardPortStr := range *fowardPorts {
 		ports := strings.Split(forwardPortStr, ":")
@@ -227,9 +268,11 @@ func main() {
 		}()
 	}
 
+	// the nsagents follow the interfaces via netlink, and SIGHUP is no longer needed to reload the non-bypassable lists
+	signal.Ignore(unix.SIGHUP)
 	go func() {
 		sigCh := make(chan os.Signal, 1)
-		signal.Notify(sigCh, unix.SIGTERM, unix.SIGINT) // SIGHUP is propagated to nsagents for reloading
+		signal.Notify(sigCh, unix.SIGTERM, unix.SIGINT)
 		sig := <-sigCh
 		logrus.Infof("Received signal %v, exiting...", sig)
 		logrus.Infof("Removing socket %q", socketFile)
@@ -247,13 +290,17 @@ func main() {
 	}()
 
 	c2cConfig := &bypass4netns.C2CConnectionHandleConfig{
-		Enable:       *handleC2cEnable,
-		TracerEnable: *tracerEnable,
+		Enable:               *handleC2cEnable,
+		TracerEnable:         *tracerEnable,
+		TracerProbeTimeout:   *tracerProbeTimeout,
+		TracerVerifyInterval: *tracerVerifyInterval,
 	}
 	multinode := &bypass4netns.MultinodeConfig{
 		Enable:      *multinodeEnable,
 		EtcdAddress: multinodeEtcdAddress,
 		HostAddress: multinodeHostAddress,
+		Registry:    registryBackend,
+		RegistryDir: multinodeRegistryDir,
 	}
 	handler.StartHandle(c2cConfig, multinode)
 }
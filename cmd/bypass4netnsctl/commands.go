@@ -0,0 +1,473 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rootless-containers/bypass4netns/pkg/api"
+	"github.com/rootless-containers/bypass4netns/pkg/api/com"
+	"github.com/rootless-containers/bypass4netns/pkg/api/daemon/client"
+	"github.com/rootless-containers/bypass4netns/pkg/oci"
+	"github.com/rootless-containers/bypass4netns/pkg/util"
+)
+
+func runLs(c *cliContext, args []string) error {
+	fs := newFlagSet(c, "ls", "[-q]")
+	quiet := fs.BoolP("quiet", "q", false, "Only show IDs")
+	noTrunc := fs.Bool("no-trunc", false, "Do not truncate IDs")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return usageErrorf("ls does not take arguments")
+	}
+	cl, err := c.client()
+	if err != nil {
+		return err
+	}
+	statuses, err := cl.BypassManager().ListBypass(c.ctx)
+	if err != nil {
+		return err
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].ID < statuses[j].ID
+	})
+	if *quiet {
+		for _, st := range statuses {
+			fmt.Fprintln(c.stdout, st.ID)
+		}
+		return nil
+	}
+	if c.format == formatJSON {
+		return writeJSON(c.stdout, statuses)
+	}
+	t := newTable(c.stdout, "ID", "STATE", "PID", "RESTARTS", "PORTS", "STARTED")
+	for _, st := range statuses {
+		id := st.ID
+		if !*noTrunc {
+			id = util.ShrinkID(id)
+		}
+		t.row(id, st.State, st.Pid, st.Restarts, formatPortMapping(st.Spec.PortMapping), formatSince(st.StartedAt))
+	}
+	return t.flush()
+}
+
+func runInspect(c *cliContext, args []string) error {
+	fs := newFlagSet(c, "inspect", "ID...")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return usageErrorf("inspect requires at least one ID")
+	}
+	cl, err := c.client()
+	if err != nil {
+		return err
+	}
+	bm := cl.BypassManager()
+	infos := []*api.BypassInfo{}
+	var firstErr error
+	for _, arg := range fs.Args() {
+		info, err := resolveAndGet(c, bm, arg)
+		if err != nil {
+			fmt.Fprintf(c.stderr, "error: %v\n", err)
+			firstErr = keepFirst(firstErr, err)
+			continue
+		}
+		infos = append(infos, info)
+	}
+	if err := writeJSON(c.stdout, infos); err != nil {
+		return err
+	}
+	return silent(firstErr)
+}
+
+func runStart(c *cliContext, args []string) error {
+	fs := newFlagSet(c, "start", "[OPTIONS] ID | --spec FILE")
+	specFile := fs.String("spec", "", "JSON file of BypassSpec (\"-\" for stdin). Cannot be combined with the other options")
+	socketPath := fs.String("seccomp-socket", "", "Socket file to receive the seccomp file descriptor (default: under $XDG_RUNTIME_DIR/bypass4netns)")
+	pidFile := fs.String("pid-file", "", "Pid file (default: under $XDG_RUNTIME_DIR/bypass4netns)")
+	logFile := fs.String("log-file", "", "Log file (default: under $XDG_RUNTIME_DIR/bypass4netns)")
+	publish := fs.StringArrayP("publish", "p", []string{}, "Publish a container's port to the host ([PARENT_IP:]PARENT_PORT:CHILD_PORT[/PROTO])")
+	ignore := fs.StringSlice("ignore", oci.DefaultIgnoreSubnets, "Subnets not to be bypassed. Can be also set to \"auto\"")
+	ignoreBind := fs.Bool("ignore-bind", false, "Disable bypassing bind")
+	restart := fs.String("restart", string(api.RestartPolicyNo), "Restart policy (\"no\", \"on-failure[:MAX_RETRIES]\", or \"always\")")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	var spec api.BypassSpec
+	if *specFile != "" {
+		if fs.NFlag() > 1 || fs.NArg() > 0 {
+			return usageErrorf("--spec cannot be combined with the other options and arguments")
+		}
+		if err := readSpec(*specFile, &spec); err != nil {
+			return err
+		}
+	} else {
+		if fs.NArg() != 1 {
+			return usageErrorf("start requires exactly one ID")
+		}
+		spec.ID = fs.Arg(0)
+		spec.SocketPath, spec.PidFilePath, spec.LogFilePath = *socketPath, *pidFile, *logFile
+		if spec.SocketPath == "" || spec.PidFilePath == "" || spec.LogFilePath == "" {
+			defaults := api.BypassSpec{ID: spec.ID}
+			if err := oci.SetStatePaths(&defaults); err != nil {
+				return err
+			}
+			spec.SocketPath = firstNonEmpty(spec.SocketPath, defaults.SocketPath)
+			spec.PidFilePath = firstNonEmpty(spec.PidFilePath, defaults.PidFilePath)
+			spec.LogFilePath = firstNonEmpty(spec.LogFilePath, defaults.LogFilePath)
+		}
+		for _, p := range *publish {
+			port, err := parsePortSpec(p)
+			if err != nil {
+				return &usageError{msg: err.Error()}
+			}
+			spec.PortMapping = append(spec.PortMapping, port)
+		}
+		spec.IgnoreSubnets = *ignore
+		spec.IgnoreBind = *ignoreBind
+		policy, err := parseRestartPolicy(*restart)
+		if err != nil {
+			return &usageError{msg: err.Error()}
+		}
+		spec.RestartPolicy = policy
+	}
+
+	cl, err := c.client()
+	if err != nil {
+		return err
+	}
+	status, err := cl.BypassManager().StartBypass(c.ctx, spec)
+	if err != nil {
+		return err
+	}
+	if c.format == formatJSON {
+		return writeJSON(c.stdout, status)
+	}
+	t := newTable(c.stdout, "ID", "PID", "SECCOMP SOCKET")
+	t.row(status.ID, status.Pid, status.Spec.SocketPath)
+	return t.flush()
+}
+
+func runStop(c *cliContext, args []string) error {
+	fs := newFlagSet(c, "stop", "[--no-wait] ID...")
+	noWait := fs.Bool("no-wait", false, "Do not wait for bypass4netns to exit")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return usageErrorf("stop requires at least one ID")
+	}
+	cl, err := c.client()
+	if err != nil {
+		return err
+	}
+	bm := cl.BypassManager()
+	stopped := []string{}
+	var firstErr error
+	for _, arg := range fs.Args() {
+		id, err := resolveID(c, bm, arg)
+		if err == nil {
+			if *noWait {
+				err = bm.StopBypassAsync(c.ctx, id)
+			} else {
+				err = bm.StopBypass(c.ctx, id)
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(c.stderr, "error: %v\n", err)
+			firstErr = keepFirst(firstErr, err)
+			continue
+		}
+		stopped = append(stopped, id)
+		if c.format == formatTable {
+			fmt.Fprintln(c.stdout, id)
+		}
+	}
+	if c.format == formatJSON {
+		if err := writeJSON(c.stdout, stopped); err != nil {
+			return err
+		}
+	}
+	return silent(firstErr)
+}
+
+func runLogs(c *cliContext, args []string) error {
+	fs := newFlagSet(c, "logs", "[-f] ID")
+	follow := fs.BoolP("follow", "f", false, "Follow the log until bypass4netns is removed")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageErrorf("logs requires exactly one ID")
+	}
+	cl, err := c.client()
+	if err != nil {
+		return err
+	}
+	bm := cl.BypassManager()
+	info, err := resolveAndGet(c, bm, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if info.Spec.LogFilePath == "" {
+		return api.Errorf(api.ErrorCodeNotFound, "bypass4netns %s has no log file", info.ID)
+	}
+	// bypass4netnsctl is expected to run on the same host as bypass4netnsd
+	f, err := os.Open(info.Spec.LogFilePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(c.stdout, f); err != nil {
+		return err
+	}
+	if !*follow {
+		return nil
+	}
+	ticker := time.NewTicker(followInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		if _, err := io.Copy(c.stdout, f); err != nil {
+			return err
+		}
+		if _, err := bm.GetBypass(c.ctx, info.ID); err != nil {
+			if exitCode(err) == exitNotFound {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+const followInterval = 500 * time.Millisecond
+
+func runPorts(c *cliContext, args []string) error {
+	fs := newFlagSet(c, "ports", "[ID]")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return usageErrorf("ports takes at most one ID")
+	}
+	cl, err := c.client()
+	if err != nil {
+		return err
+	}
+	id := ""
+	if fs.NArg() == 1 {
+		if id, err = resolveID(c, cl.BypassManager(), fs.Arg(0)); err != nil {
+			return err
+		}
+	}
+	ports, err := cl.PortManager().ListPorts(c.ctx)
+	if err != nil {
+		var se *client.HTTPStatusError
+		if errors.As(err, &se) && se.StatusCode == http.StatusNotFound {
+			return fmt.Errorf("the port API is not served by bypass4netnsd: %w", err)
+		}
+		return err
+	}
+	res := []api.PortStatus{}
+	for _, p := range ports {
+		if id == "" || p.BypassID == id {
+			res = append(res, p)
+		}
+	}
+	if c.format == formatJSON {
+		return writeJSON(c.stdout, res)
+	}
+	t := newTable(c.stdout, "ID", "PARENT", "CHILD", "PROTOS", "BYPASS", "STATE")
+	for _, p := range res {
+		t.row(p.ID, net.JoinHostPort(p.Spec.ParentIP, strconv.Itoa(p.Spec.ParentPort)),
+			net.JoinHostPort(p.Spec.ChildIP, strconv.Itoa(p.Spec.ChildPort)),
+			strings.Join(p.Spec.Protos, ","), util.ShrinkID(p.BypassID), p.State)
+	}
+	return t.flush()
+}
+
+func runInterfaces(c *cliContext, args []string) error {
+	fs := newFlagSet(c, "interfaces", "[ID]")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return usageErrorf("interfaces takes at most one ID")
+	}
+	cl, err := c.comClient()
+	if err != nil {
+		return err
+	}
+	all, err := cl.ListInterfaces(c.ctx)
+	if err != nil {
+		return err
+	}
+	res := []com.ContainerInterfaces{}
+	if fs.NArg() == 1 {
+		ids := []string{}
+		for id := range all {
+			ids = append(ids, id)
+		}
+		id, err := matchID(ids, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		res = append(res, all[id])
+	} else {
+		for _, ifs := range all {
+			res = append(res, ifs)
+		}
+		sort.Slice(res, func(i, j int) bool {
+			return res[i].ContainerID < res[j].ContainerID
+		})
+	}
+	if c.format == formatJSON {
+		return writeJSON(c.stdout, res)
+	}
+	t := newTable(c.stdout, "ID", "INTERFACE", "HWADDR", "ADDRESSES")
+	for _, ifs := range res {
+		for _, intf := range ifs.Interfaces {
+			if intf.IsLoopback {
+				continue
+			}
+			addrs := []string{}
+			for _, addr := range intf.Addresses {
+				addrs = append(addrs, addr.String())
+			}
+			t.row(util.ShrinkID(ifs.ContainerID), intf.Name, intf.HWAddr, strings.Join(addrs, ","))
+		}
+	}
+	return t.flush()
+}
+
+// resolveID returns the ID of bypass4netns that is arg or starts with arg.
+func resolveID(c *cliContext, bm *client.BypassManager, arg string) (string, error) {
+	statuses, err := bm.ListBypass(c.ctx)
+	if err != nil {
+		return "", err
+	}
+	ids := []string{}
+	for _, st := range statuses {
+		ids = append(ids, st.ID)
+	}
+	return matchID(ids, arg)
+}
+
+func matchID(ids []string, arg string) (string, error) {
+	matched := []string{}
+	for _, id := range ids {
+		if id == arg {
+			return id, nil
+		}
+		if arg != "" && strings.HasPrefix(id, arg) {
+			matched = append(matched, id)
+		}
+	}
+	switch len(matched) {
+	case 0:
+		return "", api.Errorf(api.ErrorCodeNotFound, "bypass4netns %s not found", arg)
+	case 1:
+		return matched[0], nil
+	default:
+		return "", fmt.Errorf("ID %s is ambiguous: %s", arg, strings.Join(matched, ", "))
+	}
+}
+
+func resolveAndGet(c *cliContext, bm *client.BypassManager, arg string) (*api.BypassInfo, error) {
+	id, err := resolveID(c, bm, arg)
+	if err != nil {
+		return nil, err
+	}
+	return bm.GetBypass(c.ctx, id)
+}
+
+func readSpec(p string, spec *api.BypassSpec) error {
+	var r io.Reader = os.Stdin
+	if p != "-" {
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(spec); err != nil {
+		return &usageError{msg: fmt.Sprintf("failed to decode the spec %s: %v", p, err)}
+	}
+	return nil
+}
+
+// parsePortSpec parses [PARENT_IP:]PARENT_PORT:CHILD_PORT[/PROTO].
+func parsePortSpec(s string) (api.PortSpec, error) {
+	var port api.PortSpec
+	mapping, proto, hasProto := strings.Cut(s, "/")
+	if hasProto {
+		port.Protos = []string{proto}
+	}
+	i := strings.LastIndex(mapping, ":")
+	if i < 0 {
+		return port, fmt.Errorf("invalid port %q, expected [PARENT_IP:]PARENT_PORT:CHILD_PORT[/PROTO]", s)
+	}
+	parent, child := mapping[:i], mapping[i+1:]
+	if j := strings.LastIndex(parent, ":"); j >= 0 {
+		port.ParentIP = strings.Trim(parent[:j], "[]")
+		parent = parent[j+1:]
+	}
+	var err error
+	if port.ParentPort, err = strconv.Atoi(parent); err != nil {
+		return port, fmt.Errorf("invalid parent port in %q: %w", s, err)
+	}
+	if port.ChildPort, err = strconv.Atoi(child); err != nil {
+		return port, fmt.Errorf("invalid child port in %q: %w", s, err)
+	}
+	return port, nil
+}
+
+// parseRestartPolicy parses "no", "on-failure[:MAX_RETRIES]", or "always".
+func parseRestartPolicy(s string) (api.RestartPolicy, error) {
+	name, count, hasCount := strings.Cut(s, ":")
+	policy := api.RestartPolicy{Name: name}
+	if hasCount {
+		if policy.Name != api.RestartPolicyOnFailure {
+			return policy, fmt.Errorf("maximum retry count is supported only for %q", api.RestartPolicyOnFailure)
+		}
+		n, err := strconv.Atoi(count)
+		if err != nil {
+			return policy, fmt.Errorf("invalid maximum retry count %q: %w", count, err)
+		}
+		policy.MaximumRetryCount = n
+	}
+	return policy, nil
+}
+
+func firstNonEmpty(a, b string) string {
+	if a != "" {
+		return a
+	}
+	return b
+}
+
+func keepFirst(first, err error) error {
+	if first != nil {
+		return first
+	}
+	return err
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/rootless-containers/bypass4netns/pkg/api"
+	"github.com/rootless-containers/bypass4netns/pkg/api/com"
+	"github.com/rootless-containers/bypass4netns/pkg/api/daemon/client"
+	pkgversion "github.com/rootless-containers/bypass4netns/pkg/version"
+	flag "github.com/spf13/pflag"
+)
+
+// Exit codes
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+	// exitNotFound means that the bypass4netns, the port, or the interfaces are not found
+	exitNotFound = 3
+	// exitConflict means that the ID, the ports, or the paths conflict with another bypass4netns
+	exitConflict = 4
+	// exitUnavailable means that bypass4netnsd is not reachable
+	exitUnavailable = 5
+)
+
+const (
+	formatTable = "table"
+	formatJSON  = "json"
+)
+
+type cliContext struct {
+	ctx       context.Context
+	stdout    io.Writer
+	stderr    io.Writer
+	socket    string
+	comSocket string
+	format    string
+}
+
+type command struct {
+	name  string
+	args  string
+	short string
+	run   func(c *cliContext, args []string) error
+}
+
+var commands = []command{
+	{"ls", "[-q]", "List bypass4netns", runLs},
+	{"inspect", "ID...", "Show the detailed status of bypass4netns in JSON", runInspect},
+	{"start", "[OPTIONS] ID | --spec FILE", "Start bypass4netns", runStart},
+	{"stop", "[--no-wait] ID...", "Stop bypass4netns", runStop},
+	{"logs", "[-f] ID", "Show the log of bypass4netns", runLogs},
+	{"ports", "[ID]", "List the ports forwarded by bypass4netns", runPorts},
+	{"interfaces", "[ID]", "List the interfaces registered by bypass4netns", runInterfaces},
+}
+
+// usageError is reported with exitUsage
+type usageError struct {
+	msg string
+}
+
+func (e *usageError) Error() string {
+	return e.msg
+}
+
+func usageErrorf(format string, a ...interface{}) error {
+	return &usageError{msg: fmt.Sprintf(format, a...)}
+}
+
+func main() {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	code := run(ctx, os.Args[1:], os.Stdout, os.Stderr)
+	cancel()
+	os.Exit(code)
+}
+
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	xdgRuntimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	c := &cliContext{
+		ctx:    ctx,
+		stdout: stdout,
+		stderr: stderr,
+	}
+	fs := flag.NewFlagSet("bypass4netnsctl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.SetInterspersed(false)
+	fs.StringVar(&c.socket, "socket", filepath.Join(xdgRuntimeDir, "bypass4netnsd.sock"), "Socket file of bypass4netnsd")
+	fs.StringVar(&c.comSocket, "com-socket", filepath.Join(xdgRuntimeDir, "bypass4netnsd-com.sock"), "Socket file for communication with bypass4netns, used by \"interfaces\"")
+	fs.StringVar(&c.format, "format", formatTable, "Output format of ls, start, stop, ports, and interfaces. \"table\" or \"json\"")
+	version := fs.Bool("version", false, "Show version")
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: bypass4netnsctl [OPTIONS] COMMAND\n\nCommands:\n")
+		for _, cmd := range commands {
+			fmt.Fprintf(stderr, "  %-11s %s\n", cmd.name, cmd.short)
+		}
+		fmt.Fprintf(stderr, "\nOptions:\n%s", fs.FlagUsages())
+		fmt.Fprintf(stderr, "\nExit codes: 0 (success), 1 (error), 2 (usage), 3 (not found), 4 (conflict), 5 (bypass4netnsd unavailable)\n")
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if *version {
+		fmt.Fprintf(stdout, "bypass4netnsctl version %s\n", strings.TrimPrefix(pkgversion.Version, "v"))
+		return exitOK
+	}
+	if c.format != formatTable && c.format != formatJSON {
+		fmt.Fprintf(stderr, "error: unknown format %q\n", c.format)
+		return exitUsage
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	name := fs.Arg(0)
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
+		}
+		err := cmd.run(c, fs.Args()[1:])
+		if err == nil {
+			return exitOK
+		}
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		var silentErr *silentError
+		if !errors.As(err, &silentErr) {
+			fmt.Fprintf(stderr, "error: %v\n", err)
+		}
+		return exitCode(err)
+	}
+	fmt.Fprintf(stderr, "error: unknown command %q\n", name)
+	fs.Usage()
+	return exitUsage
+}
+
+func exitCode(err error) int {
+	var usageErr *usageError
+	if errors.As(err, &usageErr) {
+		return exitUsage
+	}
+	switch client.ErrorCode(err) {
+	case api.ErrorCodeNotFound:
+		return exitNotFound
+	case api.ErrorCodeIDConflict, api.ErrorCodePortConflict, api.ErrorCodePathConflict:
+		return exitConflict
+	}
+	var apiErr *api.Error
+	if errors.As(err, &apiErr) && apiErr.Code == api.ErrorCodeNotFound {
+		// reported by bypass4netnsctl itself
+		return exitNotFound
+	}
+	var se *client.HTTPStatusError
+	if errors.As(err, &se) && se.StatusCode == 404 {
+		// bypass4netnsd prior to the error codes
+		return exitNotFound
+	}
+	var unavailableErr *unavailableError
+	var opErr *net.OpError
+	if errors.As(err, &unavailableErr) || errors.As(err, &opErr) && opErr.Op == "dial" {
+		return exitUnavailable
+	}
+	return exitError
+}
+
+// silentError is already printed by the command, and only determines the exit code
+type silentError struct {
+	err error
+}
+
+func (e *silentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *silentError) Unwrap() error {
+	return e.err
+}
+
+func silent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &silentError{err: err}
+}
+
+// unavailableError is reported with exitUnavailable
+type unavailableError struct {
+	err error
+}
+
+func (e *unavailableError) Error() string {
+	return fmt.Sprintf("bypass4netnsd is not available: %v", e.err)
+}
+
+func (e *unavailableError) Unwrap() error {
+	return e.err
+}
+
+func (c *cliContext) client() (client.Client, error) {
+	cl, err := client.New(c.socket)
+	if err != nil {
+		return nil, &unavailableError{err: err}
+	}
+	return cl, nil
+}
+
+func (c *cliContext) comClient() (*com.ComClient, error) {
+	cl, err := com.NewComClient(c.comSocket)
+	if err != nil {
+		return nil, &unavailableError{err: err}
+	}
+	return cl, nil
+}
+
+func newFlagSet(c *cliContext, name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(c.stderr, "Usage: bypass4netnsctl %s %s\n", name, args)
+		if fs.HasFlags() {
+			fmt.Fprintf(c.stderr, "\nOptions:\n%s", fs.FlagUsages())
+		}
+	}
+	return fs
+}
+
+// parseFlags returns flag.ErrHelp for --help, and usageError for the other errors.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return &usageError{msg: err.Error()}
+	}
+	return nil
+}
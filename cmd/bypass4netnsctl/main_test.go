@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/rootless-containers/bypass4netns/pkg/api"
+	"github.com/rootless-containers/bypass4netns/pkg/api/daemon/router"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeDriver struct {
+	bypass map[string]api.BypassStatus
+	lock   sync.Mutex
+}
+
+func (d *fakeDriver) ListBypass() []api.BypassStatus {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	res := []api.BypassStatus{}
+	for _, v := range d.bypass {
+		res = append(res, v)
+	}
+	return res
+}
+
+func (d *fakeDriver) GetBypass(id string) (*api.BypassInfo, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	status, ok := d.bypass[id]
+	if !ok {
+		return nil, api.Errorf(api.ErrorCodeNotFound, "child %s not found", id)
+	}
+	return &api.BypassInfo{BypassStatus: status, Alive: true}, nil
+}
+
+func (d *fakeDriver) StartBypass(spec *api.BypassSpec) (*api.BypassStatus, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if _, ok := d.bypass[spec.ID]; ok {
+		return nil, api.Errorf(api.ErrorCodeIDConflict, "child %s already exists", spec.ID)
+	}
+	status := api.BypassStatus{ID: spec.ID, Pid: 1, Spec: *spec, State: api.BypassStateRunning}
+	d.bypass[spec.ID] = status
+	return &status, nil
+}
+
+func (d *fakeDriver) StopBypass(id string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if _, ok := d.bypass[id]; !ok {
+		return api.Errorf(api.ErrorCodeNotFound, "child %s not found", id)
+	}
+	delete(d.bypass, id)
+	return nil
+}
+
+func (d *fakeDriver) StopBypassAsync(id string) error {
+	return d.StopBypass(id)
+}
+
+func startFakeDaemon(t *testing.T, dir string, driver *fakeDriver) string {
+	socketPath := filepath.Join(dir, "bypass4netnsd.sock")
+	r := mux.NewRouter()
+	router.AddRoutes(r, &router.Backend{BypassDriver: driver})
+	l, err := net.Listen("unix", socketPath)
+	assert.Equal(t, nil, err)
+	srv := &http.Server{Handler: r}
+	go func() {
+		_ = srv.Serve(l)
+	}()
+	t.Cleanup(func() { srv.Close() })
+	return socketPath
+}
+
+func runCtl(args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := run(context.Background(), args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestCommands(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_RUNTIME_DIR", dir)
+	driver := &fakeDriver{bypass: map[string]api.BypassStatus{}}
+	socket := "--socket=" + startFakeDaemon(t, dir, driver)
+
+	code, stdout, _ := runCtl(socket, "start", "-p", "8080:80", "-p", "127.0.0.1:8443:443/tcp", "--restart=on-failure:3", "1234567890abcdef")
+	assert.Equal(t, exitOK, code)
+	assert.Contains(t, stdout, filepath.Join(dir, "bypass4netns", "1234567890abcdef.sock"))
+	status := driver.bypass["1234567890abcdef"]
+	assert.Equal(t, []api.PortSpec{
+		{ParentPort: 8080, ChildPort: 80},
+		{Protos: []string{"tcp"}, ParentIP: "127.0.0.1", ParentPort: 8443, ChildPort: 443},
+	}, status.Spec.PortMapping)
+	assert.Equal(t, api.RestartPolicy{Name: api.RestartPolicyOnFailure, MaximumRetryCount: 3}, status.Spec.RestartPolicy)
+
+	code, _, stderr := runCtl(socket, "start", "1234567890abcdef")
+	assert.Equal(t, exitConflict, code)
+	assert.Contains(t, stderr, "already exists")
+
+	code, stdout, _ = runCtl(socket, "ls")
+	assert.Equal(t, exitOK, code)
+	assert.Contains(t, stdout, "1234567890ab ")
+	assert.Contains(t, stdout, "8080->80,127.0.0.1:8443->443")
+
+	code, stdout, _ = runCtl(socket, "--format=json", "ls")
+	assert.Equal(t, exitOK, code)
+	var statuses []api.BypassStatus
+	assert.Equal(t, nil, json.Unmarshal([]byte(stdout), &statuses))
+	assert.Equal(t, 1, len(statuses))
+
+	// the ID can be abbreviated
+	code, stdout, _ = runCtl(socket, "inspect", "123456")
+	assert.Equal(t, exitOK, code)
+	var infos []api.BypassInfo
+	assert.Equal(t, nil, json.Unmarshal([]byte(stdout), &infos))
+	assert.Equal(t, "1234567890abcdef", infos[0].ID)
+
+	code, _, _ = runCtl(socket, "inspect", "123456", "fedcba")
+	assert.Equal(t, exitNotFound, code)
+
+	code, stdout, _ = runCtl(socket, "stop", "123456")
+	assert.Equal(t, exitOK, code)
+	assert.Equal(t, "1234567890abcdef\n", stdout)
+	assert.Equal(t, 0, len(driver.ListBypass()))
+
+	code, _, _ = runCtl(socket, "stop", "123456")
+	assert.Equal(t, exitNotFound, code)
+
+	// the port API is not served by the fake daemon
+	code, _, _ = runCtl(socket, "ports")
+	assert.Equal(t, exitNotFound, code)
+}
+
+func TestExitCodes(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_RUNTIME_DIR", dir)
+
+	code, _, _ := runCtl("--socket="+filepath.Join(dir, "not-exist.sock"), "ls")
+	assert.Equal(t, exitUnavailable, code)
+
+	code, _, stderr := runCtl("unknown")
+	assert.Equal(t, exitUsage, code)
+	assert.Equal(t, true, strings.Contains(stderr, "unknown command"))
+
+	code, _, _ = runCtl("start", "-p", "80", "container0")
+	assert.Equal(t, exitUsage, code)
+
+	code, _, _ = runCtl("start", "--spec=spec.json", "container0")
+	assert.Equal(t, exitUsage, code)
+
+	code, _, _ = runCtl("--format=yaml", "ls")
+	assert.Equal(t, exitUsage, code)
+
+	code, _, _ = runCtl("ls", "--help")
+	assert.Equal(t, exitOK, code)
+}
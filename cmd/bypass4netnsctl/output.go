@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rootless-containers/bypass4netns/pkg/api"
+)
+
+type table struct {
+	w *tabwriter.Writer
+}
+
+func newTable(w io.Writer, header ...string) *table {
+	t := &table{
+		w: tabwriter.NewWriter(w, 0, 8, 3, ' ', 0),
+	}
+	fmt.Fprintln(t.w, strings.Join(header, "\t"))
+	return t
+}
+
+func (t *table) row(cols ...interface{}) {
+	s := make([]string, len(cols))
+	for i, col := range cols {
+		s[i] = fmt.Sprint(col)
+	}
+	fmt.Fprintln(t.w, strings.Join(s, "\t"))
+}
+
+func (t *table) flush() error {
+	return t.w.Flush()
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "    ")
+	return enc.Encode(v)
+}
+
+func formatPortMapping(ports []api.PortSpec) string {
+	s := []string{}
+	for _, p := range ports {
+		parent := fmt.Sprintf("%d", p.ParentPort)
+		if p.ParentIP != "" {
+			parent = fmt.Sprintf("%s:%d", p.ParentIP, p.ParentPort)
+		}
+		s = append(s, fmt.Sprintf("%s->%d", parent, p.ChildPort))
+	}
+	return strings.Join(s, ",")
+}
+
+func formatSince(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return time.Since(t).Truncate(time.Second).String() + " ago"
+}
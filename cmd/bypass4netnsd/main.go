@@ -13,7 +13,13 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/rootless-containers/bypass4netns/pkg/api/com"
 	"github.com/rootless-containers/bypass4netns/pkg/api/daemon/router"
+	"github.com/rootless-containers/bypass4netns/pkg/bypass4netns"
+	"github.com/rootless-containers/bypass4netns/pkg/bypass4netns/nonbypassable"
+	"github.com/rootless-containers/bypass4netns/pkg/bypass4netns/registry"
 	"github.com/rootless-containers/bypass4netns/pkg/bypass4netnsd"
+	"github.com/rootless-containers/bypass4netns/pkg/oci"
+	"github.com/rootless-containers/bypass4netns/pkg/peercred"
+	"github.com/rootless-containers/bypass4netns/pkg/util"
 	pkgversion "github.com/rootless-containers/bypass4netns/pkg/version"
 	"github.com/sirupsen/logrus"
 	flag "github.com/spf13/pflag"
@@ -28,6 +34,10 @@ var (
 	b4nnPath             string
 	multinodeEtcdAddress string
 	multinodeHostAddress string
+	multinodeRegistryDir string
+	rootlesskitAPISocket string
+	portConflictPolicy   string
+	stateDir             string
 )
 
 func main() {
@@ -41,6 +51,10 @@ func main() {
 		logrus.Fatalf("failed to get myself executable path: %s", err)
 	}
 	defaultB4nnPath := filepath.Join(filepath.Dir(exePath), "bypass4netns")
+	defaultRootlesskitAPISocket := ""
+	if stateDir := os.Getenv("ROOTLESSKIT_STATE_DIR"); stateDir != "" {
+		defaultRootlesskitAPISocket = filepath.Join(stateDir, "api.sock")
+	}
 
 	flag.StringVar(&socketFile, "socket", filepath.Join(xdgRuntimeDir, "bypass4netnsd.sock"), "Socket file")
 	flag.StringVar(&comSocketFile, "com-socket", filepath.Join(xdgRuntimeDir, "bypass4netnsd-com.sock"), "Socket file for communication with bypass4netns")
@@ -49,9 +63,24 @@ func main() {
 	flag.StringVar(&b4nnPath, "b4nn-executable", defaultB4nnPath, "Path to bypass4netns executable")
 	flag.StringVar(&multinodeEtcdAddress, "multinode-etcd-address", "", "Etcd address for multinode communication")
 	flag.StringVar(&multinodeHostAddress, "multinode-host-address", "", "Host address for multinode communication")
+	flag.StringVar(&multinodeRegistryDir, "multinode-registry-dir", "", "Directory shared between the hosts for --multinode-registry=\"file\"")
+	flag.StringVar(&stateDir, "state-dir", filepath.Join(xdgRuntimeDir, "bypass4netnsd"), "Directory to persist the state for adopting bypass4netns after restarting bypass4netnsd (empty to disable)")
+	flag.StringVar(&rootlesskitAPISocket, "rootlesskit-api-socket", defaultRootlesskitAPISocket, "Socket file of rootlesskit's API (or a stand-in serving /v1/ports) to check the ports already forwarded")
+	flag.StringVar(&portConflictPolicy, "port-conflict-policy", string(bypass4netnsd.PortConflictPolicyReconcile), "Policy for the ports already forwarded by rootlesskit. \"reject\" or \"reconcile\" (leave them to rootlesskit)")
+	stopGracePeriod := flag.Duration("stop-grace-period", bypass4netnsd.DefaultStopGracePeriod, "Time to wait for bypass4netns to exit after SIGTERM before SIGKILL")
+	interfaceTTL := flag.Duration("interface-ttl", bypass4netnsd.DefaultInterfaceTTL, "Time to keep the interfaces of a container after bypass4netns posts them. bypass4netns renews them before they expire")
+	allowedUIDs := flag.UintSlice("allowed-uids", []uint{}, "UIDs allowed to connect to the sockets (default: the UID of bypass4netnsd)")
+	allowedPIDs := flag.Int32Slice("allowed-pids", []int32{}, "PIDs allowed to connect to the sockets (default: any process of the allowed UIDs)")
+	allowedCgroups := flag.StringSlice("allowed-cgroups", []string{}, "cgroup v2 paths allowed to connect to the sockets, including the descendants (default: any process of the allowed UIDs)")
+	allowedRuntimes := flag.StringSlice("allowed-runtimes", oci.DefaultRuntimes, "OCI runtimes allowed to send seccomp file descriptors to bypass4netns, as base names or absolute paths (empty to allow any executable)")
+	inProcess := flag.Bool("in-process", false, "Run bypass4netns inside bypass4netnsd instead of executing a process per container")
+	ignoredRoutes := flag.String("ignore-routes", string(nonbypassable.DefaultRoutePolicy), "Routes in the containers to ignore with \"auto\" in the subnets to ignore. \"non-default\" (all but the default routes) or \"none\"")
 	tracerEnable := flag.Bool("tracer", false, "Enable connection tracer")
+	tracerProbeTimeout := flag.Duration("tracer-probe-timeout", bypass4netns.DefaultTracerProbeTimeout, "Timeout of each connection by the tracer to verify an address of the other containers")
+	tracerVerifyInterval := flag.Duration("tracer-verify-interval", bypass4netns.DefaultTracerVerifyInterval, "Interval to verify the addresses of the other containers again with the tracer")
 	handleC2cEnable := flag.Bool("handle-c2c-connections", false, "Handle connections between containers")
 	multinodeEnable := flag.Bool("multinode", false, "Enable multinode communication")
+	multinodeRegistry := flag.String("multinode-registry", string(registry.DefaultBackend), "Registry of the container addresses for multinode communication. \"etcd\" or \"file\"")
 	debug := flag.Bool("debug", false, "Enable debug mode")
 	version := flag.Bool("version", false, "Show version")
 	help := flag.Bool("help", false, "Show help")
@@ -115,6 +144,61 @@ func main() {
 
 	b4nsdDriver := bypass4netnsd.NewDriver(b4nnPath, comSocketFile)
 
+	if *stopGracePeriod <= 0 {
+		logrus.Fatalf("--stop-grace-period must be positive")
+	}
+	b4nsdDriver.StopGracePeriod = *stopGracePeriod
+	if *interfaceTTL <= 0 {
+		logrus.Fatalf("--interface-ttl must be positive")
+	}
+	b4nsdDriver.InterfaceTTL = *interfaceTTL
+
+	peerPolicy := &peercred.Policy{
+		PIDs:    *allowedPIDs,
+		Cgroups: *allowedCgroups,
+	}
+	for _, uid := range *allowedUIDs {
+		peerPolicy.UIDs = append(peerPolicy.UIDs, uint32(uid))
+	}
+	// bypass4netns started by bypass4netnsd is not always in the allowed PIDs and cgroups
+	comPeerPolicy := *peerPolicy
+	if comPeerPolicy.Restricted() {
+		b4nnAbsPath, err := filepath.Abs(b4nnPath)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		comPeerPolicy.Executables = []string{b4nnAbsPath}
+	}
+	b4nsdDriver.AllowedUIDs = peerPolicy.UIDs
+	b4nsdDriver.AllowedRuntimes = *allowedRuntimes
+
+	if *inProcess {
+		b4nnAbsPath, err := filepath.Abs(b4nnPath)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		// the agents in the namespaces of the containers are executed from bypass4netns
+		util.SetAgentExecutable(b4nnAbsPath)
+		b4nsdDriver.InProcess = true
+		logrus.Info("Running bypass4netns in-process")
+	}
+
+	switch policy := bypass4netnsd.PortConflictPolicy(portConflictPolicy); policy {
+	case bypass4netnsd.PortConflictPolicyReject, bypass4netnsd.PortConflictPolicyReconcile:
+		b4nsdDriver.PortConflictPolicy = policy
+	default:
+		logrus.Fatalf("unknown --port-conflict-policy %q", portConflictPolicy)
+	}
+	routePolicy, err := nonbypassable.ParseRoutePolicy(*ignoredRoutes)
+	if err != nil {
+		logrus.Fatalf("invalid --ignore-routes: %v", err)
+	}
+	b4nsdDriver.IgnoredRoutePolicy = routePolicy
+	if rootlesskitAPISocket != "" {
+		b4nsdDriver.RootlessKitAPISocketPath = rootlesskitAPISocket
+		logrus.WithFields(logrus.Fields{"socket": rootlesskitAPISocket, "policy": portConflictPolicy}).Info("Checking ports forwarded by rootlesskit")
+	}
+
 	if *handleC2cEnable && *multinodeEnable {
 		logrus.Fatal("--handle-c2c-connections and multinode cannot be enabled at the sametime")
 	}
@@ -128,27 +212,51 @@ func main() {
 		if !*handleC2cEnable {
 			logrus.Fatal("--handle-c2c-connections is not enabled")
 		}
+		if *tracerProbeTimeout <= 0 || *tracerVerifyInterval <= 0 {
+			logrus.Fatal("--tracer-probe-timeout and --tracer-verify-interval must be positive")
+		}
 		logrus.Info("Connection tracer is enabled")
 		b4nsdDriver.TracerEnable = *tracerEnable
+		b4nsdDriver.TracerProbeTimeout = *tracerProbeTimeout
+		b4nsdDriver.TracerVerifyInterval = *tracerVerifyInterval
 	}
 
 	if *multinodeEnable {
-		if multinodeEtcdAddress == "" {
+		registryBackend, err := registry.ParseBackend(*multinodeRegistry)
+		if err != nil {
+			logrus.Fatalf("invalid --multinode-registry: %v", err)
+		}
+		if registryBackend == registry.BackendEtcd && multinodeEtcdAddress == "" {
 			logrus.Fatal("--multinode-etcd-address is not specified")
 		}
+		if registryBackend == registry.BackendFile && multinodeRegistryDir == "" {
+			logrus.Fatal("--multinode-registry-dir is not specified")
+		}
 		if multinodeHostAddress == "" {
 			logrus.Fatal("--multinode-host-address is not specified")
 		}
 		b4nsdDriver.MultinodeEnable = *multinodeEnable
 		b4nsdDriver.MultinodeEtcdAddress = multinodeEtcdAddress
 		b4nsdDriver.MultinodeHostAddress = multinodeHostAddress
-		logrus.WithFields(logrus.Fields{"etcdAddress": multinodeEtcdAddress, "hostAddress": multinodeHostAddress}).Info("Multinode communication is enabled.")
+		b4nsdDriver.MultinodeRegistry = registryBackend
+		b4nsdDriver.MultinodeRegistryDir = multinodeRegistryDir
+		logrus.WithFields(logrus.Fields{"registry": registryBackend, "etcdAddress": multinodeEtcdAddress, "registryDir": multinodeRegistryDir, "hostAddress": multinodeHostAddress}).Info("Multinode communication is enabled.")
+	}
+
+	if stateDir != "" {
+		b4nsdDriver.StateDir = stateDir
+		if err := b4nsdDriver.Restore(); err != nil {
+			logrus.Fatalf("failed to restore the state from %s: %v", stateDir, err)
+		}
+		logrus.Infof("StateDir: %s", stateDir)
 	}
 
 	waitChan := make(chan bool)
 	go func() {
-		err = listenServeNerdctlAPI(socketFile, &router.Backend{
+		err = listenServeNerdctlAPI(socketFile, peerPolicy, &router.Backend{
 			BypassDriver: b4nsdDriver,
+			PortDriver:   b4nsdDriver,
+			Features:     b4nsdDriver.Features(),
 		})
 		if err != nil {
 			logrus.Fatalf("failed to serve nerdctl API: %q", err)
@@ -157,8 +265,9 @@ func main() {
 	}()
 
 	go func() {
-		err = listenServeBypass4netnsAPI(comSocketFile, &com.Backend{
+		err = listenServeBypass4netnsAPI(comSocketFile, &comPeerPolicy, &com.Backend{
 			BypassDriver: b4nsdDriver,
+			Features:     b4nsdDriver.Features(),
 		})
 		if err != nil {
 			logrus.Fatalf("failed to serve bypass4netns: %q", err)
@@ -170,7 +279,7 @@ func main() {
 	logrus.Fatalf("process exited")
 }
 
-func listenServeNerdctlAPI(socketPath string, backend *router.Backend) error {
+func listenServeNerdctlAPI(socketPath string, policy *peercred.Policy, backend *router.Backend) error {
 	r := mux.NewRouter()
 	router.AddRoutes(r, backend)
 	srv := &http.Server{Handler: r}
@@ -183,10 +292,10 @@ func listenServeNerdctlAPI(socketPath string, backend *router.Backend) error {
 		return err
 	}
 	logrus.Infof("Starting nerdctl API to serve on %s", socketPath)
-	return srv.Serve(l)
+	return srv.Serve(peercred.NewListener(l, policy, socketPath))
 }
 
-func listenServeBypass4netnsAPI(sockPath string, backend *com.Backend) error {
+func listenServeBypass4netnsAPI(sockPath string, policy *peercred.Policy, backend *com.Backend) error {
 	r := mux.NewRouter()
 	com.AddRoutes(r, backend)
 	srv := &http.Server{Handler: r}
@@ -199,5 +308,5 @@ func listenServeBypass4netnsAPI(sockPath string, backend *com.Backend) error {
 		return err
 	}
 	logrus.Infof("Starting bypass4netns API to serve on %s", sockPath)
-	return srv.Serve(l)
+	return srv.Serve(peercred.NewListener(l, policy, sockPath))
 }
@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/rootless-containers/bypass4netns/pkg/api"
 	"github.com/rootless-containers/bypass4netns/pkg/api/com"
@@ -24,6 +25,11 @@ func TestNerdctlAPI(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed client.New %s", err)
 	}
+	info, err := client.Info(context.TODO())
+	assert.Equal(t, nil, err)
+	assert.Contains(t, info.APIVersions, "v1")
+	assert.Contains(t, info.Features, api.FeaturePorts)
+
 	bm := client.BypassManager()
 	specs := api.BypassSpec{
 		ID: "1234567890",
@@ -101,33 +107,17 @@ func TestBypass4netnsAPI(t *testing.T) {
 	_, err = client.GetInterface(context.TODO(), containerIf.ContainerID)
 	assert.NotEqual(t, nil, err)
 
-	// Registering interface
-	postedIfs, err := client.PostInterface(context.TODO(), &containerIf)
-	assert.Equal(t, nil, err)
-	assert.Equal(t, postedIfs.ContainerID, containerIf.ContainerID)
-	assert.Equal(t, postedIfs.Interfaces[0].HWAddr, containerIf.Interfaces[0].HWAddr)
+	// the interfaces of the container not managed by bypass4netnsd are rejected
+	_, err = client.PostInterface(context.TODO(), &containerIf)
+	assert.Equal(t, true, com.IsForbidden(err))
+	err = client.DeleteInterface(context.TODO(), containerIf.ContainerID)
+	assert.Equal(t, true, com.IsForbidden(err))
 
 	ifs2, err := client.ListInterfaces(context.TODO())
 	assert.Equal(t, nil, err)
-	assert.Equal(t, 1, len(ifs2))
-	assert.Equal(t, ifs2[cid].ContainerID, containerIf.ContainerID)
-	assert.Equal(t, ifs2[cid].Interfaces[0].HWAddr, containerIf.Interfaces[0].HWAddr)
-	assert.Equal(t, ifs2[cid].ForwardingPorts[5201], 5202)
-
-	ifs3, err := client.GetInterface(context.TODO(), containerIf.ContainerID)
-	assert.Equal(t, nil, err)
-	assert.Equal(t, ifs3.ContainerID, containerIf.ContainerID)
-	assert.Equal(t, ifs3.Interfaces[0].HWAddr, containerIf.Interfaces[0].HWAddr)
-	assert.Equal(t, ifs3.ForwardingPorts[5201], 5202)
+	assert.Equal(t, 0, len(ifs2))
 
-	// Removing interface
-	err = client.DeleteInterface(context.TODO(), containerIf.ContainerID)
-	assert.Equal(t, nil, err)
-
-	ifs4, err := client.ListInterfaces(context.TODO())
+	watch, err := client.WatchInterfaces(context.TODO(), 0, time.Second)
 	assert.Equal(t, nil, err)
-	assert.Equal(t, 0, len(ifs4))
-
-	_, err = client.GetInterface(context.TODO(), containerIf.ContainerID)
-	assert.NotEqual(t, nil, err)
+	assert.Equal(t, 0, len(watch.Snapshot))
 }
@@ -1,9 +1,78 @@
 package api
 
+import (
+	"fmt"
+	"time"
+)
+
+type BypassState string
+
+const (
+	BypassStateRunning    BypassState = "running"
+	BypassStateRestarting BypassState = "restarting"
+	// BypassStateStopping means that bypass4netns is being stopped and will be removed
+	BypassStateStopping BypassState = "stopping"
+	// BypassStateExited means that bypass4netns exited and is not restarted
+	BypassStateExited BypassState = "exited"
+	// BypassStateFailed means that bypass4netns exited after receiving the seccomp file descriptor of the container.
+	// It is not restarted, as a new process cannot receive the file descriptor again. The container needs to be restarted.
+	BypassStateFailed BypassState = "failed"
+)
+
 type BypassStatus struct {
-	ID   string     `json:"id"`
-	Pid  int        `json:"pid"`
-	Spec BypassSpec `json:"spec"`
+	ID string `json:"id"`
+	// Pid is the pid of bypass4netnsd when InProcess is true
+	Pid int `json:"pid"`
+	// InProcess is true when the bypass4netns runs inside bypass4netnsd
+	InProcess bool        `json:"inProcess,omitempty"`
+	Spec      BypassSpec  `json:"spec"`
+	State     BypassState `json:"state"`
+	// Restarts is the number of restarts by the restart policy
+	Restarts int `json:"restarts"`
+	// ExitCode is the exit code of the last exited process. -1 if it is killed by a signal.
+	ExitCode int `json:"exitCode"`
+	// ExitError describes how the last process exited
+	ExitError string `json:"exitError,omitempty"`
+	// StartedAt is the time when the current process is started
+	StartedAt time.Time `json:"startedAt"`
+}
+
+// BypassInfo is the detailed status of bypass4netns
+type BypassInfo struct {
+	BypassStatus
+	// Alive is true when the process is running
+	Alive         bool    `json:"alive"`
+	UptimeSeconds float64 `json:"uptimeSeconds"`
+	// Ports are the ports forwarded by the bypass4netns
+	Ports []BypassPort `json:"ports"`
+	// Tasks and Sockets are reported by the bypass4netns periodically
+	Tasks          []TaskHealth `json:"tasks"`
+	Sockets        *SocketStats `json:"sockets,omitempty"`
+	StatsUpdatedAt *time.Time   `json:"statsUpdatedAt,omitempty"`
+}
+
+type BypassPort struct {
+	PortStatus
+	// Bound is true when the parent port is listened on the host
+	Bound bool `json:"bound"`
+}
+
+// TaskHealth is the health of a background task of bypass4netns
+type TaskHealth struct {
+	Name          string     `json:"name"`
+	LastSuccess   *time.Time `json:"lastSuccess,omitempty"`
+	LastError     string     `json:"lastError,omitempty"`
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"`
+}
+
+// SocketStats counts the sockets handled by bypass4netns since it started
+type SocketStats struct {
+	// Bypassed is the number of sockets replaced by the ones on the host
+	Bypassed uint64 `json:"bypassed"`
+	// NonBypassable is the number of bound or connected sockets that are not bypassed
+	NonBypassable uint64 `json:"nonBypassable"`
+	// Error is the number of sockets that failed to be bypassed
+	Error uint64 `json:"error"`
 }
 
 type BypassSpec struct {
@@ -14,9 +83,29 @@ type BypassSpec struct {
 	PortMapping   []PortSpec `json:"portMapping"`
 	IgnoreSubnets []string   `json:"ignoreSubnets"` // CIDR or "auto"
 	IgnoreBind    bool       `json:"ignoreBind"`
+	// RestartPolicy is applied when bypass4netns exits unexpectedly before receiving the seccomp file descriptor
+	RestartPolicy RestartPolicy `json:"restartPolicy"`
+}
+
+const (
+	// RestartPolicyNo never restarts bypass4netns (default)
+	RestartPolicyNo = "no"
+	// RestartPolicyOnFailure restarts bypass4netns when it exits with non-zero status
+	RestartPolicyOnFailure = "on-failure"
+	// RestartPolicyAlways restarts bypass4netns whenever it exits
+	RestartPolicyAlways = "always"
+)
+
+// RestartPolicy is similar to Docker's one
+type RestartPolicy struct {
+	Name string `json:"name,omitempty"`
+	// MaximumRetryCount limits the number of restarts. 0 means no limit.
+	MaximumRetryCount int `json:"maximumRetryCount,omitempty"`
 }
 
 type PortSpec struct {
+	// Proto is the protocol for the rootlesskit-compatible port API, the first one of Protos
+	Proto      string   `json:"proto,omitempty"`
 	Protos     []string `json:"protos"`
 	ParentIP   string   `json:"parentIP"`
 	ParentPort int      `json:"parentPort"`
@@ -24,6 +113,66 @@ type PortSpec struct {
 	ChildPort  int      `json:"childPort"`
 }
 
+type PortState string
+
+const (
+	// PortStateBypassed means that the port is forwarded by the bypass4netns of BypassID
+	PortStateBypassed PortState = "bypassed"
+	// PortStatePending means that no bypass4netns matches the port's ChildIP yet
+	PortStatePending PortState = "pending"
+)
+
+// PortStatus is compatible with rootlesskit's port.Status
+type PortStatus struct {
+	ID       int       `json:"id"`
+	Spec     PortSpec  `json:"spec"`
+	BypassID string    `json:"bypassID,omitempty"`
+	State    PortState `json:"state"`
+}
+
 type ErrorJSON struct {
 	Message string `json:"message"`
+	// Code is set for the errors that the clients may react to
+	Code ErrorCode `json:"code,omitempty"`
+}
+
+// ErrorCode is a machine-readable error code
+type ErrorCode string
+
+const (
+	// ErrorCodeInvalidRequest means that the request body cannot be decoded
+	ErrorCodeInvalidRequest ErrorCode = "invalid-request"
+	ErrorCodeInvalidID      ErrorCode = "invalid-id"
+	// ErrorCodeIDConflict means that bypass4netns with the ID is already running, starting, or stopping
+	ErrorCodeIDConflict   ErrorCode = "id-conflict"
+	ErrorCodeInvalidPort  ErrorCode = "invalid-port"
+	ErrorCodePortConflict ErrorCode = "port-conflict"
+	// ErrorCodeInvalidSubnet means that an entry of IgnoreSubnets is neither CIDR nor "auto"
+	ErrorCodeInvalidSubnet ErrorCode = "invalid-subnet"
+	// ErrorCodeInvalidPath means that SocketPath, PidFilePath, or LogFilePath cannot be created
+	ErrorCodeInvalidPath ErrorCode = "invalid-path"
+	// ErrorCodePathConflict means that the path is used by another bypass4netns
+	ErrorCodePathConflict         ErrorCode = "path-conflict"
+	ErrorCodeInvalidRestartPolicy ErrorCode = "invalid-restart-policy"
+	ErrorCodeNotFound             ErrorCode = "not-found"
+	// ErrorCodeStartFailed means that the spec is valid but bypass4netns failed to start
+	ErrorCodeStartFailed ErrorCode = "start-failed"
+)
+
+// Error is an error with ErrorCode, returned to the clients as ErrorJSON
+type Error struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Errorf returns *Error with the formatted message.
+func Errorf(code ErrorCode, format string, a ...interface{}) error {
+	return &Error{
+		Code:    code,
+		Message: fmt.Sprintf(format, a...),
+	}
 }
@@ -2,6 +2,11 @@ package com
 
 import (
 	"net"
+	"reflect"
+	"slices"
+	"time"
+
+	"github.com/rootless-containers/bypass4netns/pkg/api"
 )
 
 type ContainerInterfaces struct {
@@ -9,10 +14,87 @@ type ContainerInterfaces struct {
 	Interfaces  []Interface `json:"interfaces"`
 	// key is "container-side" port, value is host-side port
 	ForwardingPorts map[int]int `json:"forwardingPorts"`
+	// Networks identify the networks of the container (e.g. the names of the nerdctl networks).
+	// The connections between containers are bypassed only when they share a network.
+	Networks []string `json:"networks,omitempty"`
+	// NetNS identifies the network namespace of the container, e.g. "net:[4026531840]".
+	// The containers in the same network namespace (e.g. a pod) connect to the ports forwarded by each other.
+	NetNS string `json:"netns,omitempty"`
+	// ExpiresAt is set by bypass4netnsd. The interfaces are removed unless they are posted again before it.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// Equal returns true if the interfaces are the same except ExpiresAt.
+func (c ContainerInterfaces) Equal(o ContainerInterfaces) bool {
+	c.ExpiresAt = nil
+	o.ExpiresAt = nil
+	return reflect.DeepEqual(c, o)
+}
+
+// SharesNetwork returns true if the containers of the networks are connected to the same network.
+// The containers without the networks are regarded as being connected to the same unnamed network.
+func SharesNetwork(a, b []string) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) == len(b)
+	}
+	for _, n := range a {
+		if slices.Contains(b, n) {
+			return true
+		}
+	}
+	return false
 }
+
 type Interface struct {
 	Name       string           `json:"name"`
 	HWAddr     net.HardwareAddr `json:"hwAddr"`
 	Addresses  []net.IPNet      `json:"addresses"`
 	IsLoopback bool             `json:"isLoopback"`
 }
+
+// Stats is reported by bypass4netns periodically
+type Stats struct {
+	ContainerID string           `json:"containerID"`
+	Tasks       []api.TaskHealth `json:"tasks"`
+	Sockets     api.SocketStats  `json:"sockets"`
+}
+
+type InterfacesEventType string
+
+const (
+	// InterfacesEventPut is sent when the interfaces of the container are registered or changed
+	InterfacesEventPut InterfacesEventType = "put"
+	// InterfacesEventDelete is sent when the interfaces of the container are removed
+	InterfacesEventDelete InterfacesEventType = "delete"
+)
+
+// InterfacesEvent is a change of the registered interfaces
+type InterfacesEvent struct {
+	// Revision is the revision after the change
+	Revision    uint64              `json:"revision"`
+	Type        InterfacesEventType `json:"type"`
+	ContainerID string              `json:"containerID"`
+	// Interfaces is set for InterfacesEventPut
+	Interfaces *ContainerInterfaces `json:"interfaces,omitempty"`
+}
+
+// InterfacesWatch is returned by GET /v1/interfaces/watch
+type InterfacesWatch struct {
+	// Revision is the revision to be passed to the next watch
+	Revision uint64 `json:"revision"`
+	// Snapshot is all the registered interfaces, set instead of Events
+	// when the requested revision is 0 or is no longer in the history of bypass4netnsd.
+	// The interfaces not in Snapshot are removed.
+	Snapshot map[string]ContainerInterfaces `json:"snapshot"`
+	// Events are the changes after the requested revision.
+	// Empty when the watch timed out without changes.
+	Events []InterfacesEvent `json:"events,omitempty"`
+}
+
+// PortsWatch is returned by GET /v1/ports/{id}/watch
+type PortsWatch struct {
+	// Revision is the revision to be passed to the next watch
+	Revision uint64 `json:"revision"`
+	// Ports are the ports to be forwarded by the bypass4netns
+	Ports []api.PortSpec `json:"ports"`
+}
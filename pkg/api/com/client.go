@@ -12,15 +12,69 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/rootless-containers/bypass4netns/pkg/api"
 )
 
+// Client is the client of the API for bypass4netns.
+// ComClient talks to bypass4netnsd via HTTP, and DirectClient calls the driver in the same process.
+type Client interface {
+	Ping(ctx context.Context) error
+	ListInterfaces(ctx context.Context) (map[string]ContainerInterfaces, error)
+	// WatchInterfaces returns the changes of the interfaces after the revision, waiting for them at most timeout.
+	// It returns an error satisfying IsNotFound when bypass4netnsd does not support watching.
+	WatchInterfaces(ctx context.Context, revision uint64, timeout time.Duration) (*InterfacesWatch, error)
+	PostInterface(ctx context.Context, ifs *ContainerInterfaces) (*ContainerInterfaces, error)
+	// GetForwardingPorts returns an error satisfying IsNotFound when the bypass4netns is not managed by bypass4netnsd.
+	GetForwardingPorts(ctx context.Context, id string) ([]api.PortSpec, error)
+	// WatchForwardingPorts returns the ports of the bypass4netns when they have changed after the revision,
+	// or the same ports after timeout. It returns an error satisfying IsNotFound when the bypass4netns is not managed
+	// by bypass4netnsd, or when bypass4netnsd does not support watching.
+	WatchForwardingPorts(ctx context.Context, id string, revision uint64, timeout time.Duration) (*PortsWatch, error)
+	PostStats(ctx context.Context, stats *Stats) error
+}
+
+// ErrNotFound is returned by DirectClient when the bypass4netns or the interfaces are not found.
+var ErrNotFound = errors.New("not found")
+
+// ErrForbidden is returned when the token does not match the token of the bypass4netns managed by bypass4netnsd.
+var ErrForbidden = errors.New("forbidden")
+
+// TokenEnv is the environment variable to pass the token to bypass4netns started by bypass4netnsd.
+// The token is required to post the interfaces and the stats of the bypass4netns.
+const TokenEnv = "BYPASS4NETNS_COM_TOKEN"
+
+// IsForbidden returns true if err is ErrForbidden or HTTPStatusError with 403.
+func IsForbidden(err error) bool {
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusForbidden
+	}
+	return errors.Is(err, ErrForbidden)
+}
+
+// IsNotFound returns true if err is ErrNotFound or HTTPStatusError with 404.
+func IsNotFound(err error) bool {
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusNotFound
+	}
+	return errors.Is(err, ErrNotFound)
+}
+
 type ComClient struct {
-	client    *http.Client
-	version   string
-	dummyHost string
+	client *http.Client
+	// version is negotiated on the first request
+	version     string
+	versionLock sync.Mutex
+	dummyHost   string
+	// token is sent as the bearer token
+	token string
 }
 
 func NewComClient(socketPath string) (*ComClient, error) {
@@ -38,11 +92,78 @@ func NewComClient(socketPath string) (*ComClient, error) {
 
 	return &ComClient{
 		client:    hc,
-		version:   "v1",
 		dummyHost: "bypass4netnsd-com",
 	}, nil
 }
 
+// SetToken sets the token issued by bypass4netnsd for posting the interfaces and the stats.
+func (c *ComClient) SetToken(token string) {
+	c.token = token
+}
+
+// authorize sets the token to the request
+func (c *ComClient) authorize(req *http.Request) {
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+}
+
+// Info returns the API versions and the features of bypass4netnsd.
+func (c *ComClient) Info(ctx context.Context) (*api.Info, error) {
+	u := fmt.Sprintf("http://%s/info", c.dummyHost)
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := successful(resp); err != nil {
+		return nil, err
+	}
+	var info api.Info
+	dec := json.NewDecoder(resp.Body)
+	if err := dec.Decode(&info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// apiVersion returns the highest API version supported by both the client and bypass4netnsd.
+// bypass4netnsd without GET /info supports only "v1".
+func (c *ComClient) apiVersion(ctx context.Context) (string, error) {
+	c.versionLock.Lock()
+	defer c.versionLock.Unlock()
+	if c.version != "" {
+		return c.version, nil
+	}
+	info, err := c.Info(ctx)
+	if err != nil {
+		var se *HTTPStatusError
+		if !errors.As(err, &se) || se.StatusCode != http.StatusNotFound {
+			return "", fmt.Errorf("failed to get the API version of bypass4netnsd: %w", err)
+		}
+		info = &api.Info{APIVersions: []string{"v1"}}
+	}
+	v, err := api.NegotiateAPIVersion(api.APIVersions, info.APIVersions)
+	if err != nil {
+		return "", err
+	}
+	c.version = v
+	return v, nil
+}
+
+func (c *ComClient) url(ctx context.Context, path string) (string, error) {
+	v, err := c.apiVersion(ctx)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("http://%s/%s/%s", c.dummyHost, v, path), nil
+}
+
 func readAtMost(r io.Reader, maxBytes int) ([]byte, error) {
 	lr := &io.LimitedReader{
 		R: r,
@@ -101,7 +222,10 @@ func (c *ComClient) Ping(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
-	u := fmt.Sprintf("http://%s/%s/ping", c.dummyHost, c.version)
+	u, err := c.url(ctx, "ping")
+	if err != nil {
+		return err
+	}
 	req, err := http.NewRequest("GET", u, bytes.NewReader(m))
 	if err != nil {
 		return err
@@ -129,7 +253,10 @@ func (c *ComClient) Ping(ctx context.Context) error {
 }
 
 func (c *ComClient) ListInterfaces(ctx context.Context) (map[string]ContainerInterfaces, error) {
-	u := fmt.Sprintf("http://%s/%s/interfaces", c.dummyHost, c.version)
+	u, err := c.url(ctx, "interfaces")
+	if err != nil {
+		return nil, err
+	}
 	req, err := http.NewRequest("GET", u, nil)
 	if err != nil {
 		return nil, err
@@ -153,8 +280,42 @@ func (c *ComClient) ListInterfaces(ctx context.Context) (map[string]ContainerInt
 	return containerIfs, nil
 }
 
+func (c *ComClient) WatchInterfaces(ctx context.Context, revision uint64, timeout time.Duration) (*InterfacesWatch, error) {
+	u, err := c.url(ctx, "interfaces/watch")
+	if err != nil {
+		return nil, err
+	}
+	q := url.Values{}
+	q.Set("revision", strconv.FormatUint(revision, 10))
+	q.Set("timeout", timeout.String())
+	req, err := http.NewRequest("GET", u+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req = req.WithContext(ctx)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := successful(resp); err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(resp.Body)
+	var watch InterfacesWatch
+	if err := dec.Decode(&watch); err != nil {
+		return nil, err
+	}
+
+	return &watch, nil
+}
+
 func (c *ComClient) GetInterface(ctx context.Context, id string) (*ContainerInterfaces, error) {
-	u := fmt.Sprintf("http://%s/%s/interface/%s", c.dummyHost, c.version, id)
+	u, err := c.url(ctx, fmt.Sprintf("interface/%s", id))
+	if err != nil {
+		return nil, err
+	}
 	req, err := http.NewRequest("GET", u, nil)
 	if err != nil {
 		return nil, err
@@ -183,13 +344,17 @@ func (c *ComClient) PostInterface(ctx context.Context, ifs *ContainerInterfaces)
 	if err != nil {
 		return nil, err
 	}
-	u := fmt.Sprintf("http://%s/%s/interface/%s", c.dummyHost, c.version, ifs.ContainerID)
+	u, err := c.url(ctx, fmt.Sprintf("interface/%s", ifs.ContainerID))
+	if err != nil {
+		return nil, err
+	}
 	req, err := http.NewRequest("POST", u, bytes.NewReader(m))
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
 	req = req.WithContext(ctx)
+	c.authorize(req)
 	resp, err := c.client.Do(req)
 	if err != nil {
 		return nil, err
@@ -208,13 +373,105 @@ func (c *ComClient) PostInterface(ctx context.Context, ifs *ContainerInterfaces)
 }
 
 func (c *ComClient) DeleteInterface(ctx context.Context, id string) error {
-	u := fmt.Sprintf("http://%s/%s/interface/%s", c.dummyHost, c.version, id)
+	u, err := c.url(ctx, fmt.Sprintf("interface/%s", id))
+	if err != nil {
+		return err
+	}
 	req, err := http.NewRequest("DELETE", u, nil)
 	if err != nil {
 		return err
 	}
 	req.Header.Set("Content-Type", "application/json")
 	req = req.WithContext(ctx)
+	c.authorize(req)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := successful(resp); err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetForwardingPorts returns the ports to be forwarded by the bypass4netns.
+func (c *ComClient) GetForwardingPorts(ctx context.Context, id string) ([]api.PortSpec, error) {
+	u, err := c.url(ctx, fmt.Sprintf("ports/%s", id))
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req = req.WithContext(ctx)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := successful(resp); err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(resp.Body)
+	var ports []api.PortSpec
+	if err := dec.Decode(&ports); err != nil {
+		return nil, err
+	}
+
+	return ports, nil
+}
+
+func (c *ComClient) WatchForwardingPorts(ctx context.Context, id string, revision uint64, timeout time.Duration) (*PortsWatch, error) {
+	u, err := c.url(ctx, fmt.Sprintf("ports/%s/watch", id))
+	if err != nil {
+		return nil, err
+	}
+	q := url.Values{}
+	q.Set("revision", strconv.FormatUint(revision, 10))
+	q.Set("timeout", timeout.String())
+	req, err := http.NewRequest("GET", u+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req = req.WithContext(ctx)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := successful(resp); err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(resp.Body)
+	var watch PortsWatch
+	if err := dec.Decode(&watch); err != nil {
+		return nil, err
+	}
+
+	return &watch, nil
+}
+
+// PostStats reports the stats of the bypass4netns.
+func (c *ComClient) PostStats(ctx context.Context, stats *Stats) error {
+	m, err := json.Marshal(stats)
+	if err != nil {
+		return err
+	}
+	u, err := c.url(ctx, fmt.Sprintf("stats/%s", stats.ContainerID))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", u, bytes.NewReader(m))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req = req.WithContext(ctx)
+	c.authorize(req)
 	resp, err := c.client.Do(req)
 	if err != nil {
 		return err
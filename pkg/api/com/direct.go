@@ -0,0 +1,91 @@
+package com
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/rootless-containers/bypass4netns/pkg/api"
+)
+
+// DirectClient calls BypassDriver directly instead of via HTTP.
+// It is used by bypass4netns running inside bypass4netnsd.
+type DirectClient struct {
+	driver BypassDriver
+	token  string
+}
+
+var _ Client = (*DirectClient)(nil)
+var _ Client = (*ComClient)(nil)
+
+func NewDirectClient(driver BypassDriver, token string) *DirectClient {
+	return &DirectClient{driver: driver, token: token}
+}
+
+func (c *DirectClient) Ping(ctx context.Context) error {
+	return ctx.Err()
+}
+
+func (c *DirectClient) ListInterfaces(ctx context.Context) (map[string]ContainerInterfaces, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.driver.ListInterfaces(), nil
+}
+
+func (c *DirectClient) WatchInterfaces(ctx context.Context, revision uint64, timeout time.Duration) (*InterfacesWatch, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	watch := c.driver.WatchInterfaces(ctx, revision)
+	// the watch returns without events when ctx is done
+	if err := ctx.Err(); err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		return nil, err
+	}
+	return watch, nil
+}
+
+func (c *DirectClient) PostInterface(ctx context.Context, ifs *ContainerInterfaces) (*ContainerInterfaces, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := c.driver.PostInterface(ifs.ContainerID, c.token, ifs); err != nil {
+		return nil, err
+	}
+	res := c.driver.GetInterface(ifs.ContainerID)
+	if res == nil {
+		return nil, ErrNotFound
+	}
+	return res, nil
+}
+
+func (c *DirectClient) GetForwardingPorts(ctx context.Context, id string) ([]api.PortSpec, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ports, ok := c.driver.GetForwardingPorts(id)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return ports, nil
+}
+
+func (c *DirectClient) WatchForwardingPorts(ctx context.Context, id string, revision uint64, timeout time.Duration) (*PortsWatch, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	watch, ok := c.driver.WatchForwardingPorts(ctx, id, revision)
+	// the watch returns the same ports when ctx is done
+	if err := ctx.Err(); err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return watch, nil
+}
+
+func (c *DirectClient) PostStats(ctx context.Context, stats *Stats) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.driver.PostStats(stats.ContainerID, c.token, stats)
+}
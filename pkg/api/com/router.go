@@ -1,38 +1,69 @@
 package com
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/rootless-containers/bypass4netns/pkg/api"
+	"github.com/rootless-containers/bypass4netns/pkg/version"
 )
 
 type Backend struct {
 	BypassDriver BypassDriver
+	// Features are reported by GET /info
+	Features []string
 }
 
 type BypassDriver interface {
 	ListInterfaces() map[string]ContainerInterfaces
 	GetInterface(id string) *ContainerInterfaces
-	PostInterface(id string, containerIfs *ContainerInterfaces)
-	DeleteInterface(id string)
+	// PostInterface registers or renews the interfaces until their ExpiresAt.
+	// The token must match the token of the bypass4netns managed by bypass4netnsd, otherwise ErrForbidden is returned.
+	PostInterface(id, token string, containerIfs *ContainerInterfaces) error
+	DeleteInterface(id, token string) error
+	GetForwardingPorts(id string) ([]api.PortSpec, bool)
+	PostStats(id, token string, stats *Stats) error
+	// WatchInterfaces returns the changes after the revision.
+	// It blocks until the interfaces are changed or ctx is done.
+	WatchInterfaces(ctx context.Context, revision uint64) *InterfacesWatch
+	// WatchForwardingPorts returns the ports of the bypass4netns when they have changed after the revision.
+	// It blocks until the ports are changed or ctx is done. The second return value is false
+	// when the bypass4netns is not managed by bypass4netnsd.
+	WatchForwardingPorts(ctx context.Context, id string, revision uint64) (*PortsWatch, bool)
 }
 
+const (
+	// DefaultWatchTimeout is the timeout of the watches without the timeout parameter
+	DefaultWatchTimeout = 30 * time.Second
+	maxWatchTimeout     = 5 * time.Minute
+)
+
 func AddRoutes(r *mux.Router, b *Backend) {
+	// not versioned, for negotiating the API version
+	r.Path("/info").Methods("GET").HandlerFunc(b.getInfo)
 	v1 := r.PathPrefix("/v1").Subrouter()
 	_ = v1
 	v1.Path("/ping").Methods("GET").HandlerFunc(b.ping)
 	v1.Path("/interfaces").Methods("GET").HandlerFunc(b.listInterfaces)
+	v1.Path("/interfaces/watch").Methods("GET").HandlerFunc(b.watchInterfaces)
 	v1.Path("/interface/{id}").Methods("GET").HandlerFunc(b.getInterface)
 	v1.Path("/interface/{id}").Methods("POST").HandlerFunc(b.postInterface)
 	v1.Path("/interface/{id}").Methods("DELETE").HandlerFunc(b.deleteInterface)
+	v1.Path("/ports/{id}").Methods("GET").HandlerFunc(b.getForwardingPorts)
+	v1.Path("/ports/{id}/watch").Methods("GET").HandlerFunc(b.watchForwardingPorts)
+	v1.Path("/stats/{id}").Methods("POST").HandlerFunc(b.postStats)
 }
 
 func (b *Backend) onError(w http.ResponseWriter, r *http.Request, err error, ec int) {
-	w.WriteHeader(ec)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(ec)
 	// it is safe to return the err to the client, because the client is reliable
 	e := api.ErrorJSON{
 		Message: err.Error(),
@@ -40,6 +71,36 @@ func (b *Backend) onError(w http.ResponseWriter, r *http.Request, err error, ec
 	_ = json.NewEncoder(w).Encode(e)
 }
 
+// bearerToken returns the token in the Authorization header
+func bearerToken(r *http.Request) string {
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// writeError writes ErrForbidden with 403 and the other errors with 500
+func (b *Backend) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, ErrForbidden) {
+		b.onError(w, r, err, http.StatusForbidden)
+		return
+	}
+	b.onError(w, r, err, http.StatusInternalServerError)
+}
+
+func (b *Backend) getInfo(w http.ResponseWriter, r *http.Request) {
+	info := api.Info{
+		APIVersions: api.APIVersions,
+		Version:     version.Version,
+		Features:    append([]string{}, b.Features...),
+	}
+	m, err := json.Marshal(info)
+	if err != nil {
+		b.onError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(m)
+}
+
 func (b *Backend) ping(w http.ResponseWriter, r *http.Request) {
 	m, err := json.Marshal("pong")
 	if err != nil {
@@ -63,6 +124,58 @@ func (b *Backend) listInterfaces(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(m)
 }
 
+// watchInterfaces is a long poll of the changes after the "revision" parameter.
+// It returns when the interfaces are changed, or with no events after the "timeout" parameter (e.g. "30s").
+func (b *Backend) watchInterfaces(w http.ResponseWriter, r *http.Request) {
+	revision, err := watchRevision(r)
+	if err != nil {
+		b.onError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	ctx, cancel, err := watchContext(r)
+	if err != nil {
+		b.onError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	defer cancel()
+	watch := b.BypassDriver.WatchInterfaces(ctx, revision)
+	m, err := json.Marshal(watch)
+	if err != nil {
+		b.onError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(m)
+}
+
+// watchRevision returns the "revision" parameter of the watches
+func watchRevision(r *http.Request) (uint64, error) {
+	s := r.URL.Query().Get("revision")
+	if s == "" {
+		return 0, nil
+	}
+	revision, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid revision %q", s)
+	}
+	return revision, nil
+}
+
+// watchContext returns the context of the request with the "timeout" parameter of the watches
+func watchContext(r *http.Request) (context.Context, context.CancelFunc, error) {
+	timeout := DefaultWatchTimeout
+	if s := r.URL.Query().Get("timeout"); s != "" {
+		var err error
+		timeout, err = time.ParseDuration(s)
+		if err != nil || timeout < 0 || timeout > maxWatchTimeout {
+			return nil, nil, fmt.Errorf("invalid timeout %q, must be between 0 and %s", s, maxWatchTimeout)
+		}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	return ctx, cancel, nil
+}
+
 func (b *Backend) getInterface(w http.ResponseWriter, r *http.Request) {
 	id, ok := mux.Vars(r)["id"]
 	if !ok {
@@ -99,7 +212,10 @@ func (b *Backend) postInterface(w http.ResponseWriter, r *http.Request) {
 		b.onError(w, r, err, http.StatusBadRequest)
 		return
 	}
-	b.BypassDriver.PostInterface(id, &containerIfs)
+	if err := b.BypassDriver.PostInterface(id, bearerToken(r), &containerIfs); err != nil {
+		b.writeError(w, r, err)
+		return
+	}
 
 	ifs := b.BypassDriver.GetInterface(id)
 	m, err := json.Marshal(ifs)
@@ -119,5 +235,85 @@ func (b *Backend) deleteInterface(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	b.BypassDriver.DeleteInterface(id)
+	if err := b.BypassDriver.DeleteInterface(id, bearerToken(r)); err != nil {
+		b.writeError(w, r, err)
+	}
+}
+
+func (b *Backend) getForwardingPorts(w http.ResponseWriter, r *http.Request) {
+	id, ok := mux.Vars(r)["id"]
+	if !ok {
+		b.onError(w, r, errors.New("id not specified"), http.StatusBadRequest)
+		return
+	}
+
+	ports, ok := b.BypassDriver.GetForwardingPorts(id)
+	if !ok {
+		b.onError(w, r, errors.New("not found"), http.StatusNotFound)
+		return
+	}
+
+	m, err := json.Marshal(ports)
+	if err != nil {
+		b.onError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(m)
+}
+
+// watchForwardingPorts is a long poll of the ports of the bypass4netns.
+// It returns the ports when they have changed after the "revision" parameter, or the same ports after the "timeout" parameter.
+func (b *Backend) watchForwardingPorts(w http.ResponseWriter, r *http.Request) {
+	id, ok := mux.Vars(r)["id"]
+	if !ok {
+		b.onError(w, r, errors.New("id not specified"), http.StatusBadRequest)
+		return
+	}
+	revision, err := watchRevision(r)
+	if err != nil {
+		b.onError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	ctx, cancel, err := watchContext(r)
+	if err != nil {
+		b.onError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	defer cancel()
+
+	watch, ok := b.BypassDriver.WatchForwardingPorts(ctx, id, revision)
+	if !ok {
+		b.onError(w, r, errors.New("not found"), http.StatusNotFound)
+		return
+	}
+	m, err := json.Marshal(watch)
+	if err != nil {
+		b.onError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(m)
+}
+
+func (b *Backend) postStats(w http.ResponseWriter, r *http.Request) {
+	id, ok := mux.Vars(r)["id"]
+	if !ok {
+		b.onError(w, r, errors.New("id not specified"), http.StatusBadRequest)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	var stats Stats
+	if err := decoder.Decode(&stats); err != nil {
+		b.onError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	if err := b.BypassDriver.PostStats(id, bearerToken(r), &stats); err != nil {
+		b.writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
 }
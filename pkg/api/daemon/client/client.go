@@ -13,6 +13,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"sync"
 
 	"github.com/rootless-containers/bypass4netns/pkg/api"
 )
@@ -20,6 +21,9 @@ import (
 type Client interface {
 	HTTPClient() *http.Client
 	BypassManager() *BypassManager
+	PortManager() *PortManager
+	// Info returns the API versions and the features of bypass4netnsd.
+	Info(ctx context.Context) (*api.Info, error)
 }
 
 // New creates a client.
@@ -42,17 +46,16 @@ func New(socketPath string) (Client, error) {
 func NewWithHTTPClient(hc *http.Client) Client {
 	return &client{
 		Client:    hc,
-		version:   "v1",
 		dummyHost: "bypass4netnsd",
 	}
 }
 
 type client struct {
 	*http.Client
-	// version is always "v1"
-	// TODO(AkihiroSuda): negotiate the version
-	version   string
-	dummyHost string
+	// version is negotiated on the first request
+	version     string
+	versionLock sync.Mutex
+	dummyHost   string
 }
 
 func (c *client) HTTPClient() *http.Client {
@@ -65,6 +68,67 @@ func (c *client) BypassManager() *BypassManager {
 	}
 }
 
+func (c *client) PortManager() *PortManager {
+	return &PortManager{
+		client: c,
+	}
+}
+
+func (c *client) Info(ctx context.Context) (*api.Info, error) {
+	u := fmt.Sprintf("http://%s/info", c.dummyHost)
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	resp, err := c.HTTPClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := successful(resp); err != nil {
+		return nil, err
+	}
+	var info api.Info
+	dec := json.NewDecoder(resp.Body)
+	if err := dec.Decode(&info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// apiVersion returns the highest API version supported by both the client and bypass4netnsd.
+// bypass4netnsd without GET /info supports only "v1".
+func (c *client) apiVersion(ctx context.Context) (string, error) {
+	c.versionLock.Lock()
+	defer c.versionLock.Unlock()
+	if c.version != "" {
+		return c.version, nil
+	}
+	info, err := c.Info(ctx)
+	if err != nil {
+		var se *HTTPStatusError
+		if !errors.As(err, &se) || se.StatusCode != http.StatusNotFound {
+			return "", fmt.Errorf("failed to get the API version of bypass4netnsd: %w", err)
+		}
+		info = &api.Info{APIVersions: []string{"v1"}}
+	}
+	v, err := api.NegotiateAPIVersion(api.APIVersions, info.APIVersions)
+	if err != nil {
+		return "", err
+	}
+	c.version = v
+	return v, nil
+}
+
+func (c *client) url(ctx context.Context, path string) (string, error) {
+	v, err := c.apiVersion(ctx)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("http://%s/%s/%s", c.dummyHost, v, path), nil
+}
+
 func readAtMost(r io.Reader, maxBytes int) ([]byte, error) {
 	lr := &io.LimitedReader{
 		R: r,
@@ -104,6 +168,24 @@ func (e *HTTPStatusError) Error() string {
 	return fmt.Sprintf("unexpected HTTP status %s, body=%q", http.StatusText(e.StatusCode), e.Body)
 }
 
+// Code returns api.ErrorJSON.Code if e.Body is a marshalled string of api.ErrorJSON.
+func (e *HTTPStatusError) Code() api.ErrorCode {
+	var ej api.ErrorJSON
+	if json.Unmarshal([]byte(e.Body), &ej) != nil {
+		return ""
+	}
+	return ej.Code
+}
+
+// ErrorCode returns the api.ErrorCode of err, or an empty string.
+func ErrorCode(err error) api.ErrorCode {
+	var se *HTTPStatusError
+	if errors.As(err, &se) {
+		return se.Code()
+	}
+	return ""
+}
+
 func successful(resp *http.Response) error {
 	if resp == nil {
 		return errors.New("nil response")
@@ -127,7 +209,10 @@ func (bm *BypassManager) StartBypass(ctx context.Context, spec api.BypassSpec) (
 	if err != nil {
 		return nil, err
 	}
-	u := fmt.Sprintf("http://%s/%s/bypass", bm.client.dummyHost, bm.client.version)
+	u, err := bm.client.url(ctx, "bypass")
+	if err != nil {
+		return nil, err
+	}
 	req, err := http.NewRequest("POST", u, bytes.NewReader(m))
 	if err != nil {
 		return nil, err
@@ -151,7 +236,10 @@ func (bm *BypassManager) StartBypass(ctx context.Context, spec api.BypassSpec) (
 }
 
 func (bm *BypassManager) ListBypass(ctx context.Context) ([]api.BypassStatus, error) {
-	u := fmt.Sprintf("http://%s/%s/bypass", bm.client.dummyHost, bm.client.version)
+	u, err := bm.client.url(ctx, "bypass")
+	if err != nil {
+		return nil, err
+	}
 	req, err := http.NewRequest("GET", u, nil)
 	if err != nil {
 		return nil, err
@@ -173,8 +261,48 @@ func (bm *BypassManager) ListBypass(ctx context.Context) ([]api.BypassStatus, er
 	return statuses, nil
 }
 
+// GetBypass returns the detailed status of bypass4netns.
+func (bm *BypassManager) GetBypass(ctx context.Context, id string) (*api.BypassInfo, error) {
+	u, err := bm.client.url(ctx, fmt.Sprintf("bypass/%s", id))
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	resp, err := bm.client.HTTPClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := successful(resp); err != nil {
+		return nil, err
+	}
+	var info api.BypassInfo
+	dec := json.NewDecoder(resp.Body)
+	if err := dec.Decode(&info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
 func (bm *BypassManager) StopBypass(ctx context.Context, id string) error {
-	u := fmt.Sprintf("http://%s/%s/bypass/%s", bm.client.dummyHost, bm.client.version, id)
+	return bm.stopBypass(ctx, id, true)
+}
+
+// StopBypassAsync requests to stop bypass4netns without waiting for its exit.
+// The bypass is listed with "stopping" state until it exits.
+func (bm *BypassManager) StopBypassAsync(ctx context.Context, id string) error {
+	return bm.stopBypass(ctx, id, false)
+}
+
+func (bm *BypassManager) stopBypass(ctx context.Context, id string, wait bool) error {
+	u, err := bm.client.url(ctx, fmt.Sprintf("bypass/%s?wait=%t", id, wait))
+	if err != nil {
+		return err
+	}
 	req, err := http.NewRequest("DELETE", u, nil)
 	if err != nil {
 		return err
@@ -190,3 +318,86 @@ func (bm *BypassManager) StopBypass(ctx context.Context, id string) error {
 	}
 	return nil
 }
+
+// PortManager is compatible with rootlesskit's port manager client
+type PortManager struct {
+	*client
+}
+
+func (pm *PortManager) AddPort(ctx context.Context, spec api.PortSpec) (*api.PortStatus, error) {
+	m, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+	u, err := pm.client.url(ctx, "ports")
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", u, bytes.NewReader(m))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req = req.WithContext(ctx)
+	resp, err := pm.client.HTTPClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := successful(resp); err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(resp.Body)
+	var status api.PortStatus
+	if err := dec.Decode(&status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+func (pm *PortManager) ListPorts(ctx context.Context) ([]api.PortStatus, error) {
+	u, err := pm.client.url(ctx, "ports")
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	resp, err := pm.client.HTTPClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := successful(resp); err != nil {
+		return nil, err
+	}
+	var statuses []api.PortStatus
+	dec := json.NewDecoder(resp.Body)
+	if err := dec.Decode(&statuses); err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+func (pm *PortManager) RemovePort(ctx context.Context, id int) error {
+	u, err := pm.client.url(ctx, fmt.Sprintf("ports/%d", id))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("DELETE", u, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	resp, err := pm.client.HTTPClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := successful(resp); err != nil {
+		return err
+	}
+	return nil
+}
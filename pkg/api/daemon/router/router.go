@@ -4,31 +4,81 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
+	"strconv"
 
 	"github.com/gorilla/mux"
 	"github.com/rootless-containers/bypass4netns/pkg/api"
+	"github.com/rootless-containers/bypass4netns/pkg/version"
 )
 
 type Backend struct {
 	BypassDriver BypassDriver
+	// PortDriver is optional. The rootlesskit-compatible port API is served only when PortDriver is set.
+	PortDriver PortDriver
+	// Features are reported by GET /info in addition to the features of the API itself.
+	Features []string
 }
 
 type BypassDriver interface {
 	ListBypass() []api.BypassStatus
+	GetBypass(id string) (*api.BypassInfo, error)
 	StartBypass(*api.BypassSpec) (*api.BypassStatus, error)
 	StopBypass(id string) error
+	StopBypassAsync(id string) error
+}
+
+// PortDriver is compatible with rootlesskit's port.Manager
+type PortDriver interface {
+	ListPorts() []api.PortStatus
+	AddPort(api.PortSpec) (*api.PortStatus, error)
+	RemovePort(id int) error
 }
 
 func (b *Backend) onError(w http.ResponseWriter, r *http.Request, err error, ec int) {
-	w.WriteHeader(ec)
-	w.Header().Set("Content-Type", "application/json")
 	// it is safe to return the err to the client, because the client is reliable
 	e := api.ErrorJSON{
 		Message: err.Error(),
 	}
+	var apiErr *api.Error
+	if errors.As(err, &apiErr) {
+		e.Code = apiErr.Code
+		if code, ok := errorCodeStatus[apiErr.Code]; ok {
+			ec = code
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(ec)
 	_ = json.NewEncoder(w).Encode(e)
 }
 
+// errorCodeStatus overrides the status code of the errors
+var errorCodeStatus = map[api.ErrorCode]int{
+	api.ErrorCodeIDConflict:   http.StatusConflict,
+	api.ErrorCodePortConflict: http.StatusConflict,
+	api.ErrorCodePathConflict: http.StatusConflict,
+	api.ErrorCodeNotFound:     http.StatusNotFound,
+	api.ErrorCodeStartFailed:  http.StatusInternalServerError,
+}
+
+func (b *Backend) GetInfo(w http.ResponseWriter, r *http.Request) {
+	info := api.Info{
+		APIVersions: api.APIVersions,
+		Version:     version.Version,
+		Features:    append([]string{}, b.Features...),
+	}
+	if b.PortDriver != nil {
+		info.Features = append(info.Features, api.FeaturePorts)
+	}
+	m, err := json.Marshal(info)
+	if err != nil {
+		b.onError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(m)
+}
+
 func (b *Backend) GetBypasses(w http.ResponseWriter, r *http.Request) {
 	bs := b.BypassDriver.ListBypass()
 	m, err := json.Marshal(bs)
@@ -41,11 +91,32 @@ func (b *Backend) GetBypasses(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(m)
 }
 
+func (b *Backend) GetBypass(w http.ResponseWriter, r *http.Request) {
+	id, ok := mux.Vars(r)["id"]
+	if !ok {
+		b.onError(w, r, errors.New("id not specified"), http.StatusBadRequest)
+		return
+	}
+	info, err := b.BypassDriver.GetBypass(id)
+	if err != nil {
+		b.onError(w, r, err, http.StatusNotFound)
+		return
+	}
+	m, err := json.Marshal(info)
+	if err != nil {
+		b.onError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(m)
+}
+
 func (b *Backend) PostBypass(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	var bSpec api.BypassSpec
 	if err := decoder.Decode(&bSpec); err != nil {
-		b.onError(w, r, err, http.StatusBadRequest)
+		b.onError(w, r, api.Errorf(api.ErrorCodeInvalidRequest, "failed to decode the spec: %v", err), http.StatusBadRequest)
 		return
 	}
 	bypassStatus, err := b.BypassDriver.StartBypass(&bSpec)
@@ -69,6 +140,24 @@ func (b *Backend) DeleteBypass(w http.ResponseWriter, r *http.Request) {
 		b.onError(w, r, errors.New("id not specified"), http.StatusBadRequest)
 		return
 	}
+	// wait for the exit of bypass4netns unless "wait=false" is specified
+	wait := true
+	if v := r.URL.Query().Get("wait"); v != "" {
+		var err error
+		wait, err = strconv.ParseBool(v)
+		if err != nil {
+			b.onError(w, r, err, http.StatusBadRequest)
+			return
+		}
+	}
+	if !wait {
+		if err := b.BypassDriver.StopBypassAsync(id); err != nil {
+			b.onError(w, r, err, http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
 	if err := b.BypassDriver.StopBypass(id); err != nil {
 		b.onError(w, r, err, http.StatusBadRequest)
 		return
@@ -76,9 +165,70 @@ func (b *Backend) DeleteBypass(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+func (b *Backend) GetPorts(w http.ResponseWriter, r *http.Request) {
+	ports := b.PortDriver.ListPorts()
+	m, err := json.Marshal(ports)
+	if err != nil {
+		b.onError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(m)
+}
+
+func (b *Backend) PostPort(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	var portSpec api.PortSpec
+	if err := decoder.Decode(&portSpec); err != nil {
+		b.onError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	portStatus, err := b.PortDriver.AddPort(portSpec)
+	if err != nil {
+		b.onError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	m, err := json.Marshal(portStatus)
+	if err != nil {
+		b.onError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_, _ = w.Write(m)
+}
+
+func (b *Backend) DeletePort(w http.ResponseWriter, r *http.Request) {
+	idStr, ok := mux.Vars(r)["id"]
+	if !ok {
+		b.onError(w, r, errors.New("id not specified"), http.StatusBadRequest)
+		return
+	}
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		b.onError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	if err := b.PortDriver.RemovePort(id); err != nil {
+		b.onError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
 func AddRoutes(r *mux.Router, b *Backend) {
+	// not versioned, for negotiating the API version
+	r.Path("/info").Methods("GET").HandlerFunc(b.GetInfo)
 	v1 := r.PathPrefix("/v1").Subrouter()
 	v1.Path("/bypass").Methods("GET").HandlerFunc(b.GetBypasses)
 	v1.Path("/bypass").Methods("POST").HandlerFunc(b.PostBypass)
+	v1.Path("/bypass/{id}").Methods("GET").HandlerFunc(b.GetBypass)
 	v1.Path("/bypass/{id}").Methods("DELETE").HandlerFunc(b.DeleteBypass)
+	if b.PortDriver != nil {
+		// compatible with rootlesskit's port API
+		v1.Path("/ports").Methods("GET").HandlerFunc(b.GetPorts)
+		v1.Path("/ports").Methods("POST").HandlerFunc(b.PostPort)
+		v1.Path("/ports/{id}").Methods("DELETE").HandlerFunc(b.DeletePort)
+	}
 }
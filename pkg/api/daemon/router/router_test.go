@@ -0,0 +1,47 @@
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/rootless-containers/bypass4netns/pkg/api"
+	"github.com/stretchr/testify/assert"
+)
+
+type notFoundDriver struct{}
+
+func (notFoundDriver) ListBypass() []api.BypassStatus {
+	return []api.BypassStatus{}
+}
+
+func (notFoundDriver) GetBypass(id string) (*api.BypassInfo, error) {
+	return nil, api.Errorf(api.ErrorCodeNotFound, "child %s not found", id)
+}
+
+func (notFoundDriver) StartBypass(*api.BypassSpec) (*api.BypassStatus, error) {
+	return nil, api.Errorf(api.ErrorCodeInvalidID, "invalid id")
+}
+
+func (notFoundDriver) StopBypass(id string) error {
+	return api.Errorf(api.ErrorCodeNotFound, "child %s not found", id)
+}
+
+func (notFoundDriver) StopBypassAsync(id string) error {
+	return api.Errorf(api.ErrorCodeNotFound, "child %s not found", id)
+}
+
+func TestOnError(t *testing.T) {
+	r := mux.NewRouter()
+	AddRoutes(r, &Backend{BypassDriver: notFoundDriver{}})
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/v1/bypass/container0", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, "application/json", rec.Result().Header.Get("Content-Type"))
+	var e api.ErrorJSON
+	assert.Equal(t, nil, json.NewDecoder(rec.Body).Decode(&e))
+	assert.Equal(t, api.ErrorCodeNotFound, e.Code)
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// APIVersions are the API versions supported by this build
+var APIVersions = []string{"v1"}
+
+// Features reported by Info
+const (
+	// FeatureC2C means that connections between containers are bypassed
+	FeatureC2C = "c2c"
+	// FeatureMultinode means that connections between containers on multiple nodes are bypassed
+	FeatureMultinode = "multinode"
+	// FeatureTracer means that the connection tracer checks the connectivity between containers
+	FeatureTracer = "tracer"
+	// FeaturePorts means that the rootlesskit-compatible port API is served
+	FeaturePorts = "ports"
+)
+
+// Info is returned by GET /info of bypass4netnsd's APIs
+type Info struct {
+	// APIVersions are the API versions supported by bypass4netnsd (e.g. "v1")
+	APIVersions []string `json:"apiVersions"`
+	// Version is the build version of bypass4netnsd
+	Version  string   `json:"version"`
+	Features []string `json:"features"`
+}
+
+// NegotiateAPIVersion returns the highest API version in both supported and remote.
+func NegotiateAPIVersion(supported, remote []string) (string, error) {
+	best, bestNum := "", -1
+	for _, v := range supported {
+		n, ok := parseAPIVersion(v)
+		if !ok || n <= bestNum {
+			continue
+		}
+		for _, r := range remote {
+			if r == v {
+				best, bestNum = v, n
+				break
+			}
+		}
+	}
+	if best == "" {
+		return "", fmt.Errorf("no compatible API version: the client supports %v, bypass4netnsd supports %v", supported, remote)
+	}
+	return best, nil
+}
+
+func parseAPIVersion(v string) (int, bool) {
+	if !strings.HasPrefix(v, "v") {
+		return 0, false
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(v, "v"))
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
@@ -0,0 +1,20 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiateAPIVersion(t *testing.T) {
+	v, err := NegotiateAPIVersion([]string{"v1", "v2"}, []string{"v1"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "v1", v)
+
+	v, err = NegotiateAPIVersion([]string{"v1", "v2", "v10"}, []string{"v10", "v2", "v1"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "v10", v)
+
+	_, err = NegotiateAPIVersion([]string{"v1"}, []string{"v2"})
+	assert.NotEqual(t, nil, err)
+}
@@ -0,0 +1,115 @@
+// Package agentproto implements the protocol between bypass4netns and its agents (tracer agent and nsagent)
+// running in the namespaces of the containers.
+//
+// The messages are Frames encoded in JSON, delimited by newlines, on the stdin and the stdout of the agent.
+// bypass4netns sends the "hello" request first, and the agent replies with its protocol version and name.
+// Each request has an ID unique in the connection, and the agent replies to it with a response of the same ID,
+// with the payload or the error. The agent may send events without IDs at any time.
+package agentproto
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Version is the version of the protocol. It is incremented on incompatible changes.
+const Version = 1
+
+// maxFrameSize is the maximum size of an encoded frame
+const maxFrameSize = 16 * 1024 * 1024
+
+// MethodHello is the method of the handshake
+const MethodHello = "hello"
+
+type FrameType string
+
+const (
+	FrameTypeRequest  FrameType = "request"
+	FrameTypeResponse FrameType = "response"
+	FrameTypeEvent    FrameType = "event"
+)
+
+// Frame is a message of the protocol
+type Frame struct {
+	Type FrameType `json:"type"`
+	// ID is the ID of the request and its response. It is 0 for the events.
+	ID uint64 `json:"id,omitempty"`
+	// Method is the method of the request or the event. It is empty for the responses.
+	Method  string          `json:"method,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	// Error is the error of the request. The payload is empty if it is set.
+	Error string `json:"error,omitempty"`
+}
+
+// Hello is the payload of the hello request and its response
+type Hello struct {
+	Version int `json:"version"`
+	// Agent is the name of the agent, e.g. "tracer". It is empty in the request.
+	Agent string `json:"agent,omitempty"`
+}
+
+// Error is the error replied by the agent
+type Error struct {
+	Method  string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("agent failed to handle %q: %s", e.Method, e.Message)
+}
+
+// conn reads and writes the frames
+type conn struct {
+	scanner *bufio.Scanner
+	w       io.Writer
+	wLock   sync.Mutex
+}
+
+func newConn(r io.Reader, w io.Writer) *conn {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxFrameSize)
+	return &conn{
+		scanner: scanner,
+		w:       w,
+	}
+}
+
+// readFrame returns io.EOF when r is closed
+func (c *conn) readFrame() (*Frame, error) {
+	if !c.scanner.Scan() {
+		if err := c.scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+	var f Frame
+	if err := json.Unmarshal(c.scanner.Bytes(), &f); err != nil {
+		return nil, fmt.Errorf("failed to decode frame %q: %w", c.scanner.Text(), err)
+	}
+	return &f, nil
+}
+
+func (c *conn) writeFrame(f *Frame) error {
+	b, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	if len(b) >= maxFrameSize {
+		return fmt.Errorf("frame is too large (%d bytes)", len(b))
+	}
+	b = append(b, '\n')
+	c.wLock.Lock()
+	defer c.wLock.Unlock()
+	_, err = c.w.Write(b)
+	return err
+}
+
+func marshalPayload(v interface{}) (json.RawMessage, error) {
+	if v == nil {
+		return nil, nil
+	}
+	return json.Marshal(v)
+}
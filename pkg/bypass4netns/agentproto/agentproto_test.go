@@ -0,0 +1,111 @@
+package agentproto
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type echoRequest struct {
+	Message string        `json:"message"`
+	Delay   time.Duration `json:"delay"`
+}
+
+func newTestClient(t *testing.T, agent string) (*Client, *Server) {
+	agentReader, writer := io.Pipe()
+	reader, agentWriter := io.Pipe()
+	s := NewServer(agentReader, agentWriter, agent)
+	s.Handle("echo", func(payload json.RawMessage) (interface{}, error) {
+		var req echoRequest
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return nil, err
+		}
+		time.Sleep(req.Delay)
+		if req.Message == "" {
+			return nil, errors.New("empty message")
+		}
+		return &req, nil
+	})
+	go func() {
+		_ = s.Serve()
+		agentWriter.Close()
+	}()
+	c := NewClient(reader, writer, writer)
+	t.Cleanup(func() {
+		c.Close()
+	})
+	return c, s
+}
+
+func TestHandshake(t *testing.T) {
+	c, _ := newTestClient(t, "test")
+	assert.Equal(t, nil, c.Handshake(context.Background(), "test"))
+
+	c, _ = newTestClient(t, "other")
+	assert.NotEqual(t, nil, c.Handshake(context.Background(), "test"))
+
+	// the agent rejects the other versions
+	c, _ = newTestClient(t, "test")
+	err := c.Call(context.Background(), MethodHello, &Hello{Version: Version + 1}, nil)
+	var agentErr *Error
+	assert.Equal(t, true, errors.As(err, &agentErr))
+}
+
+func TestCall(t *testing.T) {
+	c, _ := newTestClient(t, "test")
+
+	// the responses are matched with the concurrent requests
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := &echoRequest{Message: fmt.Sprint(i), Delay: time.Duration(10-i) * time.Millisecond}
+			var resp echoRequest
+			assert.Equal(t, nil, c.Call(context.Background(), "echo", req, &resp))
+			assert.Equal(t, req.Message, resp.Message)
+		}()
+	}
+	wg.Wait()
+
+	// the errors are replied
+	var agentErr *Error
+	err := c.Call(context.Background(), "echo", &echoRequest{}, nil)
+	assert.Equal(t, true, errors.As(err, &agentErr))
+	assert.Equal(t, "empty message", agentErr.Message)
+	err = c.Call(context.Background(), "unknown", nil, nil)
+	assert.Equal(t, true, errors.As(err, &agentErr))
+
+	// the request is timed out, and the late response is ignored
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = c.Call(ctx, "echo", &echoRequest{Message: "late", Delay: 100 * time.Millisecond}, nil)
+	assert.Equal(t, true, errors.Is(err, context.DeadlineExceeded))
+	var resp echoRequest
+	assert.Equal(t, nil, c.Call(context.Background(), "echo", &echoRequest{Message: "next", Delay: 200 * time.Millisecond}, &resp))
+	assert.Equal(t, "next", resp.Message)
+}
+
+func TestEvents(t *testing.T) {
+	c, s := newTestClient(t, "test")
+	assert.Equal(t, nil, s.Notify("event", &echoRequest{Message: "hello"}))
+	ev := <-c.Events()
+	assert.Equal(t, "event", ev.Method)
+	var req echoRequest
+	assert.Equal(t, nil, json.Unmarshal(ev.Payload, &req))
+	assert.Equal(t, "hello", req.Message)
+
+	// the events and the pending requests are closed with the connection
+	c.Close()
+	_, ok := <-c.Events()
+	assert.Equal(t, false, ok)
+	assert.Equal(t, true, errors.Is(c.Err(), ErrClosed))
+	assert.Equal(t, true, errors.Is(c.Call(context.Background(), "echo", &echoRequest{Message: "closed"}, nil), ErrClosed))
+}
@@ -0,0 +1,184 @@
+package agentproto
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultTimeout is the timeout of the handshake and the requests without the deadline
+const DefaultTimeout = 5 * time.Second
+
+// maxPendingEvents is the number of the events kept until they are received from Events
+const maxPendingEvents = 64
+
+// ErrClosed is returned when the connection to the agent is closed
+var ErrClosed = errors.New("connection to the agent is closed")
+
+// Event is an event sent by the agent
+type Event struct {
+	Method  string
+	Payload json.RawMessage
+}
+
+// Client is the bypass4netns side of the protocol.
+// The requests can be sent concurrently.
+type Client struct {
+	conn   *conn
+	closer io.Closer
+
+	lock    sync.Mutex
+	nextID  uint64
+	pending map[uint64]chan *Frame
+	err     error
+
+	events chan Event
+}
+
+// NewClient starts reading the frames from r. closer is closed by Close to stop the agent, and may be nil.
+func NewClient(r io.Reader, w io.Writer, closer io.Closer) *Client {
+	c := &Client{
+		conn:    newConn(r, w),
+		closer:  closer,
+		nextID:  1,
+		pending: map[uint64]chan *Frame{},
+		events:  make(chan Event, maxPendingEvents),
+	}
+	go c.readLoop()
+	return c
+}
+
+// Handshake checks that the agent is the expected one and speaks the same version of the protocol
+func (c *Client) Handshake(ctx context.Context, agent string) error {
+	var resp Hello
+	if err := c.Call(ctx, MethodHello, &Hello{Version: Version}, &resp); err != nil {
+		return fmt.Errorf("handshake with %s failed: %w", agent, err)
+	}
+	if resp.Version != Version || resp.Agent != agent {
+		return fmt.Errorf("handshake with %s failed: unexpected agent %q (version %d)", agent, resp.Agent, resp.Version)
+	}
+	return nil
+}
+
+// Call sends the request and decodes the payload of the response to resp.
+// DefaultTimeout is applied if ctx does not have the deadline.
+func (c *Client) Call(ctx context.Context, method string, req, resp interface{}) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultTimeout)
+		defer cancel()
+	}
+	payload, err := marshalPayload(req)
+	if err != nil {
+		return err
+	}
+
+	ch := make(chan *Frame, 1)
+	c.lock.Lock()
+	if c.err != nil {
+		c.lock.Unlock()
+		return c.err
+	}
+	id := c.nextID
+	c.nextID++
+	c.pending[id] = ch
+	c.lock.Unlock()
+	defer func() {
+		c.lock.Lock()
+		delete(c.pending, id)
+		c.lock.Unlock()
+	}()
+
+	if err := c.conn.writeFrame(&Frame{Type: FrameTypeRequest, ID: id, Method: method, Payload: payload}); err != nil {
+		return fmt.Errorf("failed to send %q: %w", method, err)
+	}
+	select {
+	case f := <-ch:
+		if f == nil {
+			return c.Err()
+		}
+		if f.Error != "" {
+			return &Error{Method: method, Message: f.Error}
+		}
+		if resp == nil {
+			return nil
+		}
+		if err := json.Unmarshal(f.Payload, resp); err != nil {
+			return fmt.Errorf("invalid response to %q: %w", method, err)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("no response to %q: %w", method, ctx.Err())
+	}
+}
+
+// Events returns the events from the agent. It is closed when the connection is closed.
+// The events are dropped when the channel is full.
+func (c *Client) Events() <-chan Event {
+	return c.events
+}
+
+// Close closes the connection
+func (c *Client) Close() error {
+	if c.closer == nil {
+		return nil
+	}
+	return c.closer.Close()
+}
+
+// Err returns the reason why the connection is closed, or nil if it is not closed
+func (c *Client) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+func (c *Client) readLoop() {
+	var err error
+	for {
+		var f *Frame
+		f, err = c.conn.readFrame()
+		if err != nil {
+			break
+		}
+		switch f.Type {
+		case FrameTypeResponse:
+			c.lock.Lock()
+			ch, ok := c.pending[f.ID]
+			c.lock.Unlock()
+			if !ok {
+				logrus.Debugf("ignoring the response to the request id=%d, which is timed out", f.ID)
+				continue
+			}
+			ch <- f
+		case FrameTypeEvent:
+			select {
+			case c.events <- Event{Method: f.Method, Payload: f.Payload}:
+			default:
+				logrus.Warnf("dropping the event %q from the agent", f.Method)
+			}
+		default:
+			logrus.Warnf("ignoring unexpected frame type %q", f.Type)
+		}
+	}
+
+	if errors.Is(err, io.EOF) {
+		err = ErrClosed
+	} else {
+		err = fmt.Errorf("%w: %w", ErrClosed, err)
+	}
+	c.lock.Lock()
+	c.err = err
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+	c.lock.Unlock()
+	close(c.events)
+}
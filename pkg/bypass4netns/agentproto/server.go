@@ -0,0 +1,105 @@
+package agentproto
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// HandlerFunc handles the payload of a request and returns the payload of the response
+type HandlerFunc func(payload json.RawMessage) (interface{}, error)
+
+// Server is the agent side of the protocol.
+// The requests are handled concurrently.
+type Server struct {
+	conn     *conn
+	agent    string
+	handlers map[string]HandlerFunc
+}
+
+func NewServer(r io.Reader, w io.Writer, agent string) *Server {
+	return &Server{
+		conn:     newConn(r, w),
+		agent:    agent,
+		handlers: map[string]HandlerFunc{},
+	}
+}
+
+// Handle registers the handler of the method. It must be called before Serve.
+func (s *Server) Handle(method string, h HandlerFunc) {
+	s.handlers[method] = h
+}
+
+// Notify sends the event to bypass4netns
+func (s *Server) Notify(method string, v interface{}) error {
+	payload, err := marshalPayload(v)
+	if err != nil {
+		return err
+	}
+	return s.conn.writeFrame(&Frame{Type: FrameTypeEvent, Method: method, Payload: payload})
+}
+
+// Serve handles the requests until r is closed.
+// It returns nil when r is closed.
+func (s *Server) Serve() error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		f, err := s.conn.readFrame()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if f.Type != FrameTypeRequest {
+			logrus.Warnf("ignoring unexpected frame type %q", f.Type)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp := s.handle(f)
+			if err := s.conn.writeFrame(resp); err != nil {
+				logrus.WithError(err).Errorf("failed to reply to %q (id=%d)", f.Method, f.ID)
+			}
+		}()
+	}
+}
+
+func (s *Server) handle(req *Frame) *Frame {
+	resp := &Frame{Type: FrameTypeResponse, ID: req.ID}
+	var (
+		v   interface{}
+		err error
+	)
+	if req.Method == MethodHello {
+		v, err = s.hello(req.Payload)
+	} else if h, ok := s.handlers[req.Method]; ok {
+		v, err = h(req.Payload)
+	} else {
+		err = fmt.Errorf("unknown method %q", req.Method)
+	}
+	if err == nil {
+		resp.Payload, err = marshalPayload(v)
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	return resp
+}
+
+func (s *Server) hello(payload json.RawMessage) (interface{}, error) {
+	var req Hello
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, err
+	}
+	if req.Version != Version {
+		return nil, fmt.Errorf("unsupported protocol version %d, expected %d", req.Version, Version)
+	}
+	return &Hello{Version: Version, Agent: s.agent}, nil
+}
@@ -4,28 +4,35 @@ package bypass4netns
 // The code is licensed under Apache-2.0 License
 
 import (
-	"bytes"
 	gocontext "context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"maps"
 	"net"
 	"os"
-	"os/exec"
+	"reflect"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/rootless-containers/bypass4netns/pkg/api"
 	"github.com/rootless-containers/bypass4netns/pkg/api/com"
-	"github.com/rootless-containers/bypass4netns/pkg/bypass4netns/iproute2"
+	"github.com/rootless-containers/bypass4netns/pkg/bypass4netns/helper"
 	"github.com/rootless-containers/bypass4netns/pkg/bypass4netns/nonbypassable"
+	"github.com/rootless-containers/bypass4netns/pkg/bypass4netns/nsagent"
+	"github.com/rootless-containers/bypass4netns/pkg/bypass4netns/nsagent/types"
+	"github.com/rootless-containers/bypass4netns/pkg/bypass4netns/registry"
 	"github.com/rootless-containers/bypass4netns/pkg/bypass4netns/tracer"
+	"github.com/rootless-containers/bypass4netns/pkg/oci"
+	"github.com/rootless-containers/bypass4netns/pkg/peercred"
 	"github.com/rootless-containers/bypass4netns/pkg/util"
 	libseccomp "github.com/seccomp/libseccomp-golang"
 	"github.com/sirupsen/logrus"
-	clientv3 "go.etcd.io/etcd/client/v3"
 	"golang.org/x/sys/unix"
 )
 
@@ -120,110 +127,24 @@ func (h *notifHandler) openMem(pid int) (int, error) {
 	}
 	memfd, err := unix.Open(fmt.Sprintf("/proc/%d/mem", pid), unix.O_RDWR, 0o777)
 	if err != nil {
-		logrus.WithField("pid", pid).Warn("failed to open mem due to permission error. retrying with agent.")
-		newMemfd, err := openMemWithNSEnter(pid)
+		if !errors.Is(err, os.ErrPermission) {
+			return 0, fmt.Errorf("failed to open mem (pid=%d): %w", pid, err)
+		}
+		logrus.WithField("pid", pid).Debug("failed to open mem due to permission error. retrying with helper.")
+		hp, helperErr := h.getHelper()
+		if helperErr != nil {
+			return 0, fmt.Errorf("failed to open mem (pid=%d): %w (%v)", pid, err, helperErr)
+		}
+		memfd, err = hp.OpenMem(pid)
 		if err != nil {
-			return 0, fmt.Errorf("failed to open mem with agent (pid=%d)", pid)
+			return 0, fmt.Errorf("failed to open mem with helper (pid=%d): %w", pid, err)
 		}
-		logrus.WithField("pid", pid).Info("succeeded to open mem with agent. continue to process")
-		memfd = newMemfd
 	}
 	h.memfds[pid] = memfd
 
 	return memfd, nil
 }
 
-func openMemWithNSEnter(pid int) (int, error) {
-	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
-	if err != nil {
-		return 0, err
-	}
-
-	// configure timeout
-	timeout := &syscall.Timeval{
-		Sec:  0,
-		Usec: 500 * 1000,
-	}
-	err = syscall.SetsockoptTimeval(fds[0], syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, timeout)
-	if err != nil {
-		return 0, fmt.Errorf("failed to set receive timeout")
-	}
-	err = syscall.SetsockoptTimeval(fds[1], syscall.SOL_SOCKET, syscall.SO_SNDTIMEO, timeout)
-	if err != nil {
-		return 0, fmt.Errorf("failed to set send timeout")
-	}
-
-	fd1File := os.NewFile(uintptr(fds[0]), "")
-	defer fd1File.Close()
-	fd1Conn, err := net.FileConn(fd1File)
-	if err != nil {
-		return 0, err
-	}
-	_ = fd1Conn
-
-	selfExe, err := os.Executable()
-	if err != nil {
-		return 0, err
-	}
-	nsenter, err := exec.LookPath("nsenter")
-	if err != nil {
-		return 0, err
-	}
-	nsenterFlags := []string{
-		"-t", strconv.Itoa(int(pid)),
-		"-F",
-	}
-	selfPid := os.Getpid()
-	ok, err := util.SameUserNS(int(pid), selfPid)
-	if err != nil {
-		return 0, fmt.Errorf("failed to check sameUserNS(%d, %d)", pid, selfPid)
-	}
-	if !ok {
-		nsenterFlags = append(nsenterFlags, "-U", "--preserve-credentials")
-	}
-	nsenterFlags = append(nsenterFlags, "--", selfExe, fmt.Sprintf("--mem-nsenter-pid=%d", pid))
-	cmd := exec.CommandContext(gocontext.TODO(), nsenter, nsenterFlags...)
-	cmd.ExtraFiles = []*os.File{os.NewFile(uintptr(fds[1]), "")}
-	stdout := bytes.Buffer{}
-	cmd.Stdout = &stdout
-	err = cmd.Start()
-	if err != nil {
-		return 0, fmt.Errorf("failed to exec mem open agent %q", err)
-	}
-	memfd, recvMsgs, err := util.RecvMsg(fd1Conn)
-	if err != nil {
-		logrus.Infof("stdout=%q", stdout.String())
-		return 0, fmt.Errorf("failed to receive message")
-	}
-	logrus.Debugf("recvMsgs=%s", string(recvMsgs))
-	err = cmd.Wait()
-	if err != nil {
-		return 0, err
-	}
-
-	return memfd, nil
-}
-
-func OpenMemWithNSEnterAgent(pid uint32) error {
-	// fd 3 should be passed socket pair
-	fdFile := os.NewFile(uintptr(3), "")
-	defer fdFile.Close()
-	fdConn, err := net.FileConn(fdFile)
-	if err != nil {
-		logrus.WithError(err).Fatal("failed to open conn")
-	}
-	memPath := fmt.Sprintf("/proc/%d/mem", pid)
-	memfd, err := unix.Open(memPath, unix.O_RDWR, 0o777)
-	if err != nil {
-		logrus.WithError(err).Fatalf("failed to open %s", memPath)
-	}
-	err = util.SendMsg(fdConn, memfd, []byte(fmt.Sprintf("opened %s", memPath)))
-	if err != nil {
-		logrus.WithError(err).Fatal("failed to send message")
-	}
-	return nil
-}
-
 func handleNewMessage(sockfd int) (uintptr, *specs.ContainerProcessState, error) {
 	const maxNameLen = 4096
 	stateBuf := make([]byte, maxNameLen)
@@ -338,6 +259,39 @@ func (h *notifHandler) getPidFdInfo(pid int) (*pidInfo, error) {
 	return &info, nil
 }
 
+// helperRetryInterval is the interval to start the helper again after it failed to start,
+// not to fork on every syscall
+const helperRetryInterval = 1 * time.Second
+
+// getHelper returns the helper running in the namespaces of the container.
+// The helper is started by serveFd, and started again when it has exited or failed to start.
+func (h *notifHandler) getHelper() (*helper.Helper, error) {
+	h.helperLock.Lock()
+	defer h.helperLock.Unlock()
+
+	if h.helper != nil {
+		if !isClosed(h.helper.Done()) {
+			return h.helper, nil
+		}
+		logrus.Warn("helper exited, restarting it")
+		h.helper = nil
+	}
+	if h.helperCtx == nil {
+		return nil, errors.New("helper is not available")
+	}
+	if !h.helperFailedAt.IsZero() && time.Since(h.helperFailedAt) < helperRetryInterval {
+		return nil, errors.New("helper failed to start recently")
+	}
+	hp, err := helper.Start(h.helperCtx, h.state.Pid)
+	if err != nil {
+		h.helperFailedAt = time.Now()
+		logrus.WithError(err).Warn("failed to start helper, the processes not accessible from bypass4netns are not handled")
+		return nil, fmt.Errorf("failed to start helper: %w", err)
+	}
+	h.helper = hp
+	return hp, nil
+}
+
 // getFdInProcess get the file descriptor in other process
 func (h *notifHandler) getFdInProcess(pid, targetFd int) (int, error) {
 	targetPidfd, err := h.getPidFdInfo(pid)
@@ -346,6 +300,14 @@ func (h *notifHandler) getFdInProcess(pid, targetFd int) (int, error) {
 	}
 
 	fd, err := unix.PidfdGetfd(targetPidfd.pidfd, targetFd, 0)
+	if errors.Is(err, unix.EPERM) {
+		// the process is in another user namespace
+		if hp, helperErr := h.getHelper(); helperErr != nil {
+			logrus.WithError(helperErr).Debug("helper is not available")
+		} else {
+			fd, err = hp.GetFd(targetPidfd.tgid, targetFd)
+		}
+	}
 	if err != nil {
 		return 0, fmt.Errorf("pidfd GetFd failed: %s", err)
 	}
@@ -547,14 +509,20 @@ func (h *notifHandler) handleReq(ctx *context) {
 		// sometimes close(2) is not called for the fd.
 		// To handle such condition, re-register fd when connect is called for not bypassable fd.
 		if syscallName == "connect" {
+			counted := sock.counted
 			h.removeSocket(pid, sockfd)
 			sock, err = h.registerSocket(pid, sockfd, syscallName)
 			if err != nil {
 				logrus.Errorf("failed to re-register socket pid %d sockfd %d: %s", pid, sockfd, err)
 				return
 			}
+			// retrying connect(2) on the not bypassable socket is not counted again
+			sock.counted = counted && sock.state == NotBypassable
 		}
 		if sock.state != NotBypassed {
+			if syscallName == "bind" || syscallName == "connect" {
+				h.stats.recordSocket(sock)
+			}
 			return
 		}
 
@@ -570,8 +538,10 @@ func (h *notifHandler) handleReq(ctx *context) {
 	switch syscallName {
 	case "bind":
 		sock.handleSysBind(pid, h, ctx)
+		h.stats.recordSocket(sock)
 	case "connect":
 		sock.handleSysConnect(h, ctx)
+		h.stats.recordSocket(sock)
 	case "setsockopt":
 		sock.handleSysSetsockopt(pid, h, ctx)
 	case "fcntl":
@@ -587,19 +557,24 @@ func (h *notifHandler) handleReq(ctx *context) {
 }
 
 // notifHandler handles seccomp notifications and response to them.
-func (h *notifHandler) handle() {
+// It returns when the processes of the container exit, or on the next notification after stopCtx is done.
+func (h *notifHandler) handle(stopCtx gocontext.Context) {
 	defer unix.Close(int(h.fd))
 	if h.nonBypassableAutoUpdate {
-		go func() {
-			if nbErr := h.nonBypassable.WatchNS(gocontext.TODO(), h.state.Pid); nbErr != nil {
-				logrus.WithError(nbErr).Fatalf("failed to watch NS (PID=%d)", h.state.Pid)
-			}
-		}()
+		if h.nsObserver != nil {
+			go h.nonBypassable.Watch(stopCtx, h.nsObserver)
+		} else {
+			logrus.Errorf("NS (PID=%d) is not observed, the non-bypassable list is not updated", h.state.Pid)
+		}
 	}
 
 	for {
 		req, err := libseccomp.NotifReceive(h.fd)
 		if err != nil {
+			if errors.Is(err, unix.ENOENT) {
+				logrus.Infof("the processes of the container (PID=%d) exited, stopped handling seccomp notifications", h.state.Pid)
+				return
+			}
 			logrus.Errorf("Error in NotifReceive(): %s", err)
 			continue
 		}
@@ -625,7 +600,11 @@ func (h *notifHandler) handle() {
 
 		if err = libseccomp.NotifRespond(h.fd, ctx.resp); err != nil {
 			logrus.Errorf("Error in notification response: %s", err)
-			continue
+		}
+
+		if stopCtx.Err() != nil {
+			logrus.Infof("stopped handling seccomp notifications (PID=%d)", h.state.Pid)
+			return
 		}
 	}
 }
@@ -642,6 +621,18 @@ type Handler struct {
 	ignoredSubnets           []net.IPNet
 	ignoredSubnetsAutoUpdate bool
 	readyFd                  int
+	peerPolicy               *peercred.Policy
+	// comClient is used instead of the client of comSocketPath if set
+	comClient com.Client
+	// comToken is the token issued by bypass4netnsd for posting the interfaces and stats
+	comToken string
+	listener net.Listener
+	// ignoredRoutePolicy decides the routes in the NS that are non-bypassable when ignoredSubnetsAutoUpdate is true
+	ignoredRoutePolicy nonbypassable.RoutePolicy
+
+	// tracers are shared by the seccomp fds in the same network namespace. protected by tracersLock.
+	tracers     map[string]*tracerRef
+	tracersLock sync.Mutex
 
 	// key is child port
 	forwardingPorts map[int]ForwardPortMapping
@@ -657,19 +648,32 @@ func NewHandler(socketPath, comSocketPath, tracerAgentLogPath string, ignoreBind
 		tracerAgentLogPath: tracerAgentLogPath,
 		ignoredSubnets:     []net.IPNet{},
 		forwardingPorts:    map[int]ForwardPortMapping{},
+		tracers:            map[string]*tracerRef{},
 		readyFd:            -1,
+		peerPolicy:         &peercred.Policy{Executables: oci.DefaultRuntimes},
 		ignoreBind:         ignoreBind,
+		ignoredRoutePolicy: nonbypassable.DefaultRoutePolicy,
 	}
 
 	return &handler
 }
 
+// SocketPath returns the socket to receive seccomp file descriptors.
+func (h *Handler) SocketPath() string {
+	return h.socketPath
+}
+
 // SetIgnoreSubnets configures subnets to ignore in bypass4netns.
 func (h *Handler) SetIgnoredSubnets(subnets []net.IPNet, autoUpdate bool) {
 	h.ignoredSubnets = subnets
 	h.ignoredSubnetsAutoUpdate = autoUpdate
 }
 
+// SetIgnoredRoutePolicy configures the routes to ignore in bypass4netns when the subnets are updated automatically.
+func (h *Handler) SetIgnoredRoutePolicy(policy nonbypassable.RoutePolicy) {
+	h.ignoredRoutePolicy = policy
+}
+
 // SetForwardingPort checks and configures port forwarding
 func (h *Handler) SetForwardingPort(mapping ForwardPortMapping) error {
 	for _, fwd := range h.forwardingPorts {
@@ -685,6 +689,21 @@ func (h *Handler) SetForwardingPort(mapping ForwardPortMapping) error {
 	return nil
 }
 
+// SetPeerPolicy sets the policy for the peers sending seccomp file descriptors.
+func (h *Handler) SetPeerPolicy(policy *peercred.Policy) {
+	h.peerPolicy = policy
+}
+
+// SetComClient sets the client to communicate with bypass4netnsd instead of the client of the com socket.
+func (h *Handler) SetComClient(client com.Client) {
+	h.comClient = client
+}
+
+// SetComToken sets the token issued by bypass4netnsd to the client of the com socket.
+func (h *Handler) SetComToken(token string) {
+	h.comToken = token
+}
+
 // SetReadyFd configure ready notification file descriptor
 func (h *Handler) SetReadyFd(fd int) error {
 	if fd < 0 {
@@ -696,16 +715,35 @@ func (h *Handler) SetReadyFd(fd int) error {
 }
 
 type MultinodeConfig struct {
-	Enable           bool
-	EtcdAddress      string
-	HostAddress      string
-	etcdClientConfig clientv3.Config
-	etcdClient       *clientv3.Client
+	Enable      bool
+	EtcdAddress string
+	HostAddress string
+	// Registry is the backend of the registry of the container addresses. registry.DefaultBackend is used if it is empty.
+	Registry registry.Backend
+	// RegistryDir is the shared directory of registry.BackendFile
+	RegistryDir string
+	registry    registry.Registry
+	// cache follows registry for the lookups of the destination addresses
+	cache *registryCache
 }
 
+// multinodeRegistrationTTL is the TTL of the container addresses in the registry. They are registered again every 10 seconds.
+const multinodeRegistrationTTL = 15 * time.Second
+
+const (
+	// DefaultTracerProbeTimeout is the default timeout of each connection by the tracer to verify an address
+	DefaultTracerProbeTimeout = tracer.DefaultConnectTimeout
+	// DefaultTracerVerifyInterval is the default interval to verify the addresses of the other containers again
+	DefaultTracerVerifyInterval = 10 * time.Second
+)
+
 type C2CConnectionHandleConfig struct {
 	Enable       bool
 	TracerEnable bool
+	// TracerProbeTimeout is the timeout of each connection by the tracer. DefaultTracerProbeTimeout is used if it is not positive.
+	TracerProbeTimeout time.Duration
+	// TracerVerifyInterval is the interval to verify the addresses again. DefaultTracerVerifyInterval is used if it is not positive.
+	TracerVerifyInterval time.Duration
 }
 
 type notifHandler struct {
@@ -716,14 +754,42 @@ type notifHandler struct {
 
 	// key is child port
 	forwardingPorts map[int]ForwardPortMapping
+	// forwardingPorts is updated by the port synchronization task
+	forwardingPortsLock sync.RWMutex
+
+	stats *handlerStats
 
 	// key is pid
 	processes map[int]*processStatus
 
-	// key is destination address e.g. "192.168.1.1:1000"
+	// networks identify the networks of the container. only the containers sharing them are in containerInterfaces.
+	networks []string
+	// netns identifies the network namespace of the container. empty if it is unknown.
+	netns string
+	// netnsContainers are the other containers in the network namespace. key is container ID.
+	// protected by containerInterfacesLock.
+	netnsContainers map[string]netnsContainer
+	// key is destination address e.g. "192.168.1.1:1000" or "[2001:db8::1]:1000"
 	containerInterfaces map[string]containerInterface
-	c2cConnections      *C2CConnectionHandleConfig
-	multinode           *MultinodeConfig
+	// containerAddrs is the keys of containerInterfaces for each container ID
+	containerAddrs map[string][]string
+	// containerInterfacesLock protects containerInterfaces and containerAddrs updated by the c2c task
+	containerInterfacesLock sync.RWMutex
+
+	c2cConnections *C2CConnectionHandleConfig
+	multinode      *MultinodeConfig
+	// tracerAgent verifies the connections to the other containers from the network namespace. nil if disabled.
+	tracerAgent *tracer.Tracer
+	// nsObserver follows the interfaces of the container. nil if the nsagent failed to start.
+	nsObserver *nsagent.Observer
+	// helper opens the files in the namespaces of the container. It is started by serveFd,
+	// and restarted by getHelper when it exits. helper, helperCtx, and helperFailedAt are protected by helperLock.
+	helper *helper.Helper
+	// helperCtx stops the helper. nil if the helper is not available.
+	helperCtx gocontext.Context
+	// helperFailedAt is the last time the helper failed to start
+	helperFailedAt time.Time
+	helperLock     sync.Mutex
 
 	// cache /proc/<pid>/mem's fd to reduce latency. key is pid, value is fd
 	memfds map[int]int
@@ -758,12 +824,17 @@ func (h *Handler) newNotifHandler(fd uintptr, state *specs.ContainerProcessState
 		fd:              libseccomp.ScmpFd(fd),
 		state:           state,
 		forwardingPorts: map[int]ForwardPortMapping{},
+		stats:           newHandlerStats(),
 		processes:       map[int]*processStatus{},
 		memfds:          map[int]int{},
 		pidInfos:        map[int]pidInfo{},
 		ignoreBind:      h.ignoreBind,
+
+		containerInterfaces: map[string]containerInterface{},
+		containerAddrs:      map[string][]string{},
+		netnsContainers:     map[string]netnsContainer{},
 	}
-	notifHandler.nonBypassable = nonbypassable.New(h.ignoredSubnets)
+	notifHandler.nonBypassable = nonbypassable.New(h.ignoredSubnets, h.ignoredRoutePolicy)
 	notifHandler.nonBypassableAutoUpdate = h.ignoredSubnetsAutoUpdate
 
 	// Deep copy of map
@@ -777,31 +848,72 @@ func (h *Handler) newNotifHandler(fd uintptr, state *specs.ContainerProcessState
 // StartHandle starts seccomp notif handler
 func (h *Handler) StartHandle(c2cConfig *C2CConnectionHandleConfig, multinodeConfig *MultinodeConfig) {
 	logrus.Info("Waiting for seccomp file descriptors")
-	l, err := net.Listen("unix", h.socketPath)
-	if err != nil {
+	if err := h.Listen(); err != nil {
 		logrus.Fatalf("Cannot listen: %v", err)
 	}
-	defer l.Close()
 
 	if h.readyFd >= 0 {
 		logrus.Infof("notify ready fd=%d", h.readyFd)
-		_, err = syscall.Write(h.readyFd, []byte{1})
+		_, err := syscall.Write(h.readyFd, []byte{1})
 		if err != nil {
 			logrus.Fatalf("failed to notify fd=%d", h.readyFd)
 		}
 		syscall.Close(h.readyFd)
 	}
 
-	// prepare tracer agent
-	var tracerAgent *tracer.Tracer = nil
+	if err := h.Serve(gocontext.Background(), c2cConfig, multinodeConfig); err != nil {
+		logrus.Fatalf("Cannot serve: %v", err)
+	}
+}
+
+// Listen creates the socket to receive seccomp file descriptors.
+func (h *Handler) Listen() error {
+	sl, err := net.Listen("unix", h.socketPath)
+	if err != nil {
+		return err
+	}
+	// other processes of the same user must not inject seccomp file descriptors
+	h.listener = peercred.NewListener(sl, h.peerPolicy, "seccomp")
+	return nil
+}
+
+// Serve handles seccomp file descriptors received on the socket created by Listen.
+// It closes the socket and returns nil when ctx is done.
+// The notifications of the received file descriptors are handled until the next notification after ctx is done,
+// or until the processes of the container exit.
+func (h *Handler) Serve(ctx gocontext.Context, c2cConfig *C2CConnectionHandleConfig, multinodeConfig *MultinodeConfig) error {
+	if h.listener == nil {
+		return errors.New("Listen must be called before Serve")
+	}
+	l := h.listener
+	defer l.Close()
+	stop := gocontext.AfterFunc(ctx, func() {
+		l.Close()
+	})
+	defer stop()
+
+	c2c := *c2cConfig
+	if c2c.TracerProbeTimeout <= 0 {
+		c2c.TracerProbeTimeout = DefaultTracerProbeTimeout
+	}
+	if c2c.TracerVerifyInterval <= 0 {
+		c2c.TracerVerifyInterval = DefaultTracerVerifyInterval
+	}
 
 	for {
 		conn, err := l.Accept()
-		logrus.Info("accept connection")
 		if err != nil {
+			if ctx.Err() != nil {
+				logrus.Info("Stopped waiting for seccomp file descriptors")
+				return nil
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
 			logrus.Errorf("Cannot accept connection: %s", err)
 			continue
 		}
+		logrus.Info("accept connection")
 		socket, err := conn.(*net.UnixConn).File()
 		conn.Close()
 		if err != nil {
@@ -816,189 +928,782 @@ func (h *Handler) StartHandle(c2cConfig *C2CConnectionHandleConfig, multinodeCon
 		}
 
 		logrus.Infof("Received new seccomp fd: %v", newFd)
-		notifHandler := h.newNotifHandler(newFd, state)
-		notifHandler.c2cConnections = c2cConfig
-		notifHandler.multinode = multinodeConfig
-		if notifHandler.multinode.Enable {
-			notifHandler.multinode.etcdClientConfig = clientv3.Config{
-				Endpoints: []string{notifHandler.multinode.EtcdAddress},
-			}
-			notifHandler.multinode.etcdClient, err = clientv3.New(notifHandler.multinode.etcdClientConfig)
-			if err != nil {
-				logrus.WithError(err).Fatal("failed to create etcd client")
-			}
+		if err := h.serveFd(ctx, newFd, state, &c2c, multinodeConfig); err != nil {
+			// the syscalls of the container fail with ENOSYS
+			logrus.WithError(err).Errorf("Cannot handle seccomp fd %v, closing it", newFd)
+			unix.Close(int(newFd))
 		}
+	}
+}
 
-		// not to run multiple tracerAgent.
-		// TODO: prepare only one tracerAgent in Handler
-		if c2cConfig.TracerEnable && !multinodeConfig.Enable && tracerAgent == nil {
-			tracerAgent = tracer.NewTracer(h.tracerAgentLogPath)
-			err = tracerAgent.StartTracer(gocontext.TODO(), state.Pid)
-			if err != nil {
-				logrus.WithError(err).Fatalf("failed to start tracer")
-			}
-			fwdPorts := []int{}
-			for _, v := range notifHandler.forwardingPorts {
-				fwdPorts = append(fwdPorts, v.ChildPort)
-			}
-			err = tracerAgent.RegisterForwardPorts(fwdPorts)
-			if err != nil {
-				logrus.WithError(err).Fatalf("failed to register port")
-			}
-			logrus.WithField("fwdPorts", fwdPorts).Info("registered ports to tracer agent")
-
-			// check tracer agent is ready
-			for _, v := range fwdPorts {
-				dst := fmt.Sprintf("127.0.0.1:%d", v)
-				addr, err := tracerAgent.ConnectToAddress([]string{dst})
-				if err != nil {
-					logrus.WithError(err).Warnf("failed to connect to %s", dst)
-					continue
-				}
-				if len(addr) != 1 || addr[0] != dst {
-					logrus.Fatalf("failed to connect to %s", dst)
-					continue
-				}
-				logrus.Debugf("successfully connected to %s", dst)
-			}
-			logrus.Infof("tracer is ready")
+// serveFd starts the background tasks and the handler of the seccomp fd.
+// The background tasks and the tracer agent are stopped when the processes of the seccomp fd exit.
+func (h *Handler) serveFd(ctx gocontext.Context, fd uintptr, state *specs.ContainerProcessState, c2cConfig *C2CConnectionHandleConfig, multinodeConfig *MultinodeConfig) (retErr error) {
+	ctx, cancel := gocontext.WithCancel(ctx)
+	defer func() {
+		if retErr != nil {
+			cancel()
+		}
+	}()
+	notifHandler := h.newNotifHandler(fd, state)
+	notifHandler.c2cConnections = c2cConfig
+	// the networks annotation is given by the user, and must not break the container
+	if networks, err := oci.Networks(state.State.Annotations); err != nil {
+		logrus.WithError(err).Warn("failed to get the networks of the container, the container is regarded as being on the unnamed network")
+	} else {
+		notifHandler.networks = networks
+	}
+	if netns, err := util.NetNS(state.Pid); err != nil {
+		logrus.WithError(err).Warn("failed to get the network namespace, the ports of the other containers in it are not connected")
+	} else {
+		notifHandler.netns = netns
+	}
+	// the interfaces are registered to bypass4netnsd and etcd, and update the non-bypassable list.
+	// the nsagent is not started when none of them is enabled.
+	if notifHandler.nonBypassableAutoUpdate || c2cConfig.Enable || multinodeConfig.Enable {
+		if o, err := nsagent.StartObserver(ctx, state.Pid); err != nil {
+			logrus.WithError(err).Warn("failed to start nsagent, the interfaces of the container are not followed")
 		} else {
-			logrus.Infof("tracer is disabled")
+			notifHandler.nsObserver = o
+		}
+	}
+	// the helper opens /proc/<pid>/mem and duplicates the fds of the processes in the other user namespace.
+	// it is started before handling the syscalls, not to delay them with starting it.
+	notifHandler.helperCtx = ctx
+	_, _ = notifHandler.getHelper()
+	// each fd has its own registry client
+	multinode := *multinodeConfig
+	notifHandler.multinode = &multinode
+
+	if c2cConfig.TracerEnable && c2cConfig.Enable && !multinodeConfig.Enable {
+		// the tracer is shared by the fds in the network namespace, as it listens on the forwarded ports
+		key := notifHandler.netns
+		if key == "" {
+			key = state.State.ID
+		}
+		t, err := h.acquireTracer(key, state.Pid, notifHandler.listForwardingPorts(), c2cConfig.TracerProbeTimeout)
+		if err != nil {
+			return err
 		}
+		gocontext.AfterFunc(ctx, func() {
+			h.releaseTracer(key)
+		})
+		notifHandler.tracerAgent = t
+	} else {
+		logrus.Infof("tracer is disabled")
+	}
 
-		// TODO: these goroutines shoud be launched only once.
-		ready := make(chan bool, 10)
-		if notifHandler.multinode.Enable {
-			go notifHandler.startBackgroundMultinodeTask(ready)
-		} else if notifHandler.c2cConnections.Enable {
-			go notifHandler.startBackgroundC2CConnectionHandleTask(ready, h.comSocketPath, tracerAgent)
-		} else {
-			ready <- true
+	if multinode.Enable {
+		var err error
+		multinode.registry, err = registry.New(registry.Config{
+			Backend:     multinode.Registry,
+			EtcdAddress: multinode.EtcdAddress,
+			EtcdPrefix:  ETCD_MULTINODE_PREFIX,
+			Dir:         multinode.RegistryDir,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create registry: %w", err)
+		}
+		multinode.cache = newRegistryCache(multinode.registry)
+	}
+
+	// TODO: these goroutines shoud be launched only once.
+	ready := make(chan error, 1)
+	if notifHandler.multinode.Enable {
+		go notifHandler.startBackgroundMultinodeTask(ctx, ready)
+	} else if notifHandler.c2cConnections.Enable {
+		comClient, err := h.newComClient()
+		if err != nil {
+			return fmt.Errorf("failed to create ComClient: %w", err)
+		}
+		go notifHandler.startBackgroundC2CConnectionHandleTask(ctx, ready, comClient)
+	} else {
+		ready <- nil
+	}
+
+	// wait for background tasks becoming ready
+	select {
+	case err := <-ready:
+		if err != nil {
+			return fmt.Errorf("background task failed: %w", err)
 		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	logrus.Info("background task is ready. start to handle")
+	if comClient, err := h.newComClient(); err != nil {
+		logrus.WithError(err).Info("bypass4netnsd is not available, forwarding ports are not synchronized")
+	} else {
+		go notifHandler.startBackgroundPortSyncTask(ctx, comClient)
+		go notifHandler.startBackgroundStatsTask(ctx, comClient)
+	}
+	go func() {
+		notifHandler.handle(ctx)
+		cancel()
+	}()
+	return nil
+}
+
+// tracerRef is a tracer agent shared by the seccomp fds in a network namespace
+type tracerRef struct {
+	tracer *tracer.Tracer
+	refs   int
+	cancel gocontext.CancelFunc
+}
+
+// acquireTracer returns the tracer agent of the key, or starts it in the NS of the pid.
+// releaseTracer must be called when the tracer is no longer used.
+func (h *Handler) acquireTracer(key string, pid int, ports []ForwardPortMapping, probeTimeout time.Duration) (*tracer.Tracer, error) {
+	h.tracersLock.Lock()
+	defer h.tracersLock.Unlock()
 
-		// wait for background tasks becoming ready
-		<-ready
-		logrus.Info("background task is ready. start to handle")
-		go notifHandler.handle()
+	if ref, ok := h.tracers[key]; ok {
+		// the fds of the container may have the ports not registered yet
+		if err := ref.tracer.RegisterForwardPorts(childPorts(ports)); err != nil {
+			return nil, fmt.Errorf("failed to register port: %w", err)
+		}
+		ref.refs++
+		return ref.tracer, nil
 	}
+	ctx, cancel := gocontext.WithCancel(gocontext.Background())
+	t, err := h.startTracer(ctx, pid, ports, probeTimeout)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	h.tracers[key] = &tracerRef{tracer: t, refs: 1, cancel: cancel}
+	return t, nil
 }
 
-func (h *notifHandler) startBackgroundC2CConnectionHandleTask(ready chan bool, comSocketPath string, tracerAgent *tracer.Tracer) {
-	initDone := false
-	logrus.Info("Started bypass4netns background task")
-	comClient, err := com.NewComClient(comSocketPath)
+// releaseTracer stops the tracer agent of the key when it is no longer used.
+func (h *Handler) releaseTracer(key string) {
+	h.tracersLock.Lock()
+	defer h.tracersLock.Unlock()
+
+	ref, ok := h.tracers[key]
+	if !ok {
+		return
+	}
+	ref.refs--
+	if ref.refs == 0 {
+		logrus.Infof("stopping tracer for %s", key)
+		ref.cancel()
+		delete(h.tracers, key)
+	}
+}
+
+func childPorts(ports []ForwardPortMapping) []int {
+	res := []int{}
+	for _, v := range ports {
+		res = append(res, v.ChildPort)
+	}
+	return res
+}
+
+// startTracer starts the tracer agent in the NS of the pid and checks that it can connect to the forwarded ports.
+// The tracer is stopped when ctx is done.
+func (h *Handler) startTracer(ctx gocontext.Context, pid int, ports []ForwardPortMapping, probeTimeout time.Duration) (*tracer.Tracer, error) {
+	tracerAgent := tracer.NewTracer(h.tracerAgentLogPath)
+	err := tracerAgent.StartTracer(ctx, pid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start tracer: %w", err)
+	}
+	fwdPorts := childPorts(ports)
+	err = tracerAgent.RegisterForwardPorts(fwdPorts)
 	if err != nil {
-		logrus.Fatalf("failed to create ComClient: %q", err)
+		return nil, fmt.Errorf("failed to register port: %w", err)
+	}
+	logrus.WithField("fwdPorts", fwdPorts).Info("registered ports to tracer agent")
+
+	// check tracer agent is ready.
+	// the ports not reachable, e.g. the services in the container are still starting, are left unverified
+	// and the container is handled without failing.
+	dsts := []string{}
+	for _, v := range fwdPorts {
+		dsts = append(dsts, net.JoinHostPort("127.0.0.1", strconv.Itoa(v)))
+	}
+	verified := []int{}
+	if len(dsts) > 0 {
+		addrs, err := tracerAgent.ConnectToAddress(dsts, probeTimeout)
+		if err != nil {
+			logrus.WithError(err).Errorf("failed to connect to %v, the ports are unverified", dsts)
+		}
+		for i, v := range fwdPorts {
+			if slices.Contains(addrs, dsts[i]) {
+				verified = append(verified, v)
+			} else {
+				logrus.WithField("port", v).Error("failed to connect to the port, the port is unverified")
+			}
+		}
+		logrus.Debugf("successfully connected to the ports %v", verified)
+	}
+
+	// IPv6 may be disabled in the container
+	ipv6 := true
+	if len(verified) > 0 {
+		dsts6 := []string{}
+		for _, v := range verified {
+			dsts6 = append(dsts6, net.JoinHostPort("::1", strconv.Itoa(v)))
+		}
+		addrs, err := tracerAgent.ConnectToAddress(dsts6, probeTimeout)
+		ipv6 = err == nil && len(addrs) == len(dsts6)
 	}
-	err = comClient.Ping(gocontext.TODO())
+	tracerAgent.SetIPv6(ipv6)
+	if !ipv6 {
+		logrus.Info("tracer cannot connect via IPv6, IPv6 addresses of the other containers are not bypassed")
+	}
+	logrus.Infof("tracer is ready")
+	return tracerAgent, nil
+}
+
+// newComClient returns the client set by SetComClient, or the client of the com socket.
+func (h *Handler) newComClient() (com.Client, error) {
+	if h.comClient != nil {
+		return h.comClient, nil
+	}
+	client, err := com.NewComClient(h.comSocketPath)
 	if err != nil {
-		logrus.Fatalf("failed to connect to bypass4netnsd: %q", err)
+		return nil, err
+	}
+	client.SetToken(h.comToken)
+	return client, nil
+}
+
+// sleepContext waits for d and returns false if ctx is done.
+func sleepContext(ctx gocontext.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// isClosed returns true if ch is closed. nil is not closed.
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// contextWithCancelOn returns the context canceled when ch is closed as well.
+func contextWithCancelOn(ctx gocontext.Context, ch <-chan struct{}) (gocontext.Context, gocontext.CancelFunc) {
+	ctx, cancel := gocontext.WithCancel(ctx)
+	if ch != nil {
+		go func() {
+			select {
+			case <-ch:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+	return ctx, cancel
+}
+
+const (
+	// c2cWatchTimeout is the timeout of watching the interfaces.
+	// The interfaces of the container are re-posted and the tracer re-verifies the addresses at this interval.
+	c2cWatchTimeout = 10 * time.Second
+	// c2cRetryInterval is the interval to retry the addresses not verified by the tracer,
+	// and to poll the interfaces when bypass4netnsd does not support watching.
+	c2cRetryInterval = 1 * time.Second
+	// interfacesPostInterval is the interval to post the interfaces of the container to bypass4netnsd.
+	// It is shortened to renew the interfaces before they expire.
+	interfacesPostInterval = 10 * time.Second
+)
+
+// nextInterfacesPost returns the time to post the interfaces again, before the posted interfaces expire.
+func nextInterfacesPost(posted *com.ContainerInterfaces) time.Time {
+	now := time.Now()
+	interval := interfacesPostInterval
+	if posted != nil && posted.ExpiresAt != nil {
+		interval = min(interval, posted.ExpiresAt.Sub(now)/3)
+	}
+	return now.Add(max(interval, c2cRetryInterval))
+}
+
+// startBackgroundC2CConnectionHandleTask sends the result of the initialization to ready, and runs until ctx is done.
+// It watches the interfaces registered to bypass4netnsd and updates the entries of the changed containers.
+func (h *notifHandler) startBackgroundC2CConnectionHandleTask(ctx gocontext.Context, ready chan<- error, comClient com.Client) {
+	initDone := false
+	logrus.Info("Started bypass4netns background task")
+	err := comClient.Ping(ctx)
+	if err != nil {
+		ready <- fmt.Errorf("failed to connect to bypass4netnsd: %w", err)
+		return
 	}
 	logrus.Infof("Successfully connected to bypass4netnsd")
-	ifLastUpdateUnix := int64(0)
+	nextPost := time.Time{}
+	watcher := &interfacesWatcher{
+		client:     comClient,
+		registered: map[string]com.ContainerInterfaces{},
+		watch:      true,
+	}
+	// unverified is the containers having the addresses not verified by the tracer
+	unverified := map[string]bool{}
+	// ifChanged is closed when the interfaces of the container change after they are posted
+	var ifChanged <-chan struct{}
+	// forbidden is true when bypass4netnsd does not accept the interfaces of the bypass4netns not managed by it
+	forbidden := false
 	for {
-		if ifLastUpdateUnix+10 < time.Now().Unix() {
-			addrs, err := iproute2.GetAddressesInNetNS(gocontext.TODO(), h.state.Pid)
+		if isClosed(ifChanged) {
+			nextPost = time.Time{}
+		}
+		if !forbidden && !time.Now().Before(nextPost) {
+			var containerIfs *com.ContainerInterfaces
+			containerIfs, ifChanged, err = h.getContainerInterfaces()
 			if err != nil {
-				logrus.WithError(err).Errorf("failed to get addresses")
+				logrus.WithError(err).Errorf("failed to get interfaces")
+				if !initDone {
+					ready <- err
+				}
 				return
 			}
-			ifs, err := iproute2AddressesToComInterfaces(addrs)
-			if err != nil {
-				logrus.WithError(err).Errorf("failed to convert addresses")
+			logrus.Debugf("Interfaces = %v", containerIfs)
+			posted, err := comClient.PostInterface(ctx, containerIfs)
+			if com.IsForbidden(err) {
+				logrus.WithError(err).Errorf("bypass4netnsd rejected the interfaces, they are not registered")
+				h.stats.taskFailed(taskC2C, err)
+				forbidden = true
+				ifChanged = nil
+			} else if err != nil {
+				logrus.WithError(err).Errorf("failed to post interfaces")
+				h.stats.taskFailed(taskC2C, err)
+				nextPost = time.Now().Add(c2cRetryInterval)
+			} else {
+				logrus.Debugf("successfully posted interfaces")
+				nextPost = nextInterfacesPost(posted)
+			}
+		}
+
+		timeout := c2cWatchTimeout
+		if len(unverified) > 0 {
+			timeout = c2cRetryInterval
+		}
+		// the entries are verified again after TracerVerifyInterval
+		if h.c2cConnections.TracerEnable {
+			timeout = min(timeout, h.c2cConnections.TracerVerifyInterval)
+		}
+		// the interfaces must be posted again before they expire, or as soon as they change
+		if !forbidden {
+			timeout = max(min(timeout, time.Until(nextPost)), 0)
+		}
+		watchCtx, cancelWatch := contextWithCancelOn(ctx, ifChanged)
+		changed, err := watcher.next(watchCtx, timeout)
+		interrupted := watchCtx.Err() != nil
+		cancelWatch()
+		if err != nil && interrupted && ctx.Err() == nil {
+			err = nil
+		}
+		if err != nil {
+			if ctx.Err() != nil {
 				return
 			}
-			containerIfs := &com.ContainerInterfaces{
-				ContainerID:     h.state.State.ID,
-				Interfaces:      ifs,
-				ForwardingPorts: map[int]int{},
+			logrus.WithError(err).Warn("failed to watch container interfaces")
+			h.stats.taskFailed(taskC2C, err)
+		} else {
+			h.stats.taskSucceeded(taskC2C)
+		}
+		for id := range unverified {
+			changed[id] = true
+		}
+		if h.c2cConnections.TracerEnable {
+			for id := range h.staleContainers(time.Now().Add(-h.c2cConnections.TracerVerifyInterval).Unix()) {
+				changed[id] = true
 			}
-			for _, v := range h.forwardingPorts {
-				containerIfs.ForwardingPorts[v.ChildPort] = v.HostPort
+		}
+		for id := range changed {
+			var cont *com.ContainerInterfaces
+			if v, ok := watcher.registered[id]; ok {
+				cont = &v
 			}
-			logrus.Debugf("Interfaces = %v", containerIfs)
-			_, err = comClient.PostInterface(gocontext.TODO(), containerIfs)
-			if err != nil {
-				logrus.WithError(err).Errorf("failed to post interfaces")
+			if h.updateContainerInterfaces(id, cont) {
+				delete(unverified, id)
 			} else {
-				logrus.Infof("successfully posted updated interfaces")
-				ifLastUpdateUnix = time.Now().Unix()
+				unverified[id] = true
 			}
 		}
-		containerInterfaces, err := comClient.ListInterfaces(gocontext.TODO())
-		if err != nil {
-			logrus.WithError(err).Warn("failed to list container interfaces")
+
+		// once the interfaces are registered, it is ready to handle connections
+		if !initDone {
+			initDone = true
+			ready <- nil
 		}
 
-		containerIf := map[string]containerInterface{}
-		for _, cont := range containerInterfaces {
-			for contPort, hostPort := range cont.ForwardingPorts {
-				for _, intf := range cont.Interfaces {
-					if intf.IsLoopback {
+		// the watch waits for the changes, but polling and retrying after errors do not
+		if !watcher.watch || err != nil {
+			if !sleepContext(ctx, c2cRetryInterval) {
+				return
+			}
+		}
+	}
+}
+
+// interfacesWatcher follows the interfaces registered to bypass4netnsd
+type interfacesWatcher struct {
+	client     com.Client
+	registered map[string]com.ContainerInterfaces
+	revision   uint64
+	// watch is false when bypass4netnsd does not support watching, and the interfaces are polled
+	watch bool
+}
+
+// next waits for the changes of the interfaces, and returns the IDs of the changed containers.
+func (w *interfacesWatcher) next(ctx gocontext.Context, timeout time.Duration) (map[string]bool, error) {
+	changed := map[string]bool{}
+	if w.watch {
+		watch, err := w.client.WatchInterfaces(ctx, w.revision, timeout)
+		if com.IsNotFound(err) {
+			logrus.Info("bypass4netnsd does not support watching the interfaces, polling them")
+			w.watch = false
+		} else if err != nil {
+			return changed, err
+		} else {
+			w.revision = watch.Revision
+			if watch.Snapshot != nil {
+				w.replace(watch.Snapshot, changed)
+			}
+			for _, ev := range watch.Events {
+				changed[ev.ContainerID] = true
+				if ev.Type == com.InterfacesEventPut && ev.Interfaces != nil {
+					w.registered[ev.ContainerID] = *ev.Interfaces
+				} else {
+					delete(w.registered, ev.ContainerID)
+				}
+			}
+			return changed, nil
+		}
+	}
+	containerInterfaces, err := w.client.ListInterfaces(ctx)
+	if err != nil {
+		return changed, err
+	}
+	w.replace(containerInterfaces, changed)
+	return changed, nil
+}
+
+// replace replaces the registered interfaces and adds the IDs of the changed containers to changed.
+func (w *interfacesWatcher) replace(containerInterfaces map[string]com.ContainerInterfaces, changed map[string]bool) {
+	for id := range w.registered {
+		if _, ok := containerInterfaces[id]; !ok {
+			changed[id] = true
+		}
+	}
+	for id, cont := range containerInterfaces {
+		if old, ok := w.registered[id]; !ok || !old.Equal(cont) {
+			changed[id] = true
+		}
+	}
+	w.registered = containerInterfaces
+}
+
+// updateContainerInterfaces replaces the entries of the container with its interfaces.
+// The entries are removed when cont is nil.
+// It returns false when some addresses are not verified by the tracer.
+func (h *notifHandler) updateContainerInterfaces(id string, cont *com.ContainerInterfaces) bool {
+	h.updateNetNSContainer(id, cont)
+	verified := true
+	entries := map[string]containerInterface{}
+	// the containers on the other networks are isolated from the container, and may have the same addresses
+	if cont != nil && !com.SharesNetwork(h.networks, cont.Networks) && !h.inNetNS(cont) {
+		logrus.Debugf("container %s does not share networks with the container (%v, %v)", util.ShrinkID(id), cont.Networks, h.networks)
+		cont = nil
+	}
+	if cont != nil {
+		for contPort, hostPort := range cont.ForwardingPorts {
+			for _, intf := range cont.Interfaces {
+				if intf.IsLoopback {
+					continue
+				}
+				for _, addr := range intf.Addresses {
+					// link-local addresses are not reachable from the other containers without the zone
+					if addr.IP.IsLinkLocalUnicast() {
+						continue
+					}
+					if h.c2cConnections.TracerEnable && addr.IP.To4() == nil && !h.tracerAgent.IPv6() {
 						continue
 					}
-					for _, addr := range intf.Addresses {
-						// ignore ipv6 address
-						if addr.IP.To4() == nil {
-							continue
-						}
-						dstAddr := fmt.Sprintf("%s:%d", addr.IP, contPort)
-						contIf, ok := h.containerInterfaces[dstAddr]
-						if ok && contIf.lastCheckedUnix+10 > time.Now().Unix() {
-							containerIf[dstAddr] = contIf
-							continue
-						}
-						if h.c2cConnections.TracerEnable {
-							addrRes, err := tracerAgent.ConnectToAddress([]string{dstAddr})
-							if err != nil {
-								logrus.WithError(err).Debugf("failed to connect to %s", dstAddr)
-								continue
-							}
-							if len(addrRes) != 1 || addrRes[0] != dstAddr {
-								logrus.Debugf("failed to connect to %s", dstAddr)
-								continue
-							}
-							logrus.Debugf("successfully connected to %s", dstAddr)
-						}
-						containerIf[dstAddr] = containerInterface{
-							containerID:     cont.ContainerID,
-							hostPort:        hostPort,
-							lastCheckedUnix: time.Now().Unix(),
-						}
-						logrus.Infof("%s -> 127.0.0.1:%d is registered", dstAddr, hostPort)
+					dstAddr := net.JoinHostPort(addr.IP.String(), strconv.Itoa(contPort))
+					entries[dstAddr] = containerInterface{
+						containerID:     id,
+						hostPort:        hostPort,
+						lastCheckedUnix: time.Now().Unix(),
 					}
 				}
 			}
 		}
-		h.containerInterfaces = containerIf
+	}
+	if h.c2cConnections.TracerEnable && len(entries) > 0 {
+		verified = h.verifyContainerInterfaces(entries)
+	}
 
-		// once the interfaces are registered, it is ready to handle connections
-		if !initDone {
-			initDone = true
-			ready <- true
+	h.containerInterfacesLock.Lock()
+	defer h.containerInterfacesLock.Unlock()
+	for _, dstAddr := range h.containerAddrs[id] {
+		if old, ok := h.containerInterfaces[dstAddr]; ok && old.containerID == id {
+			if _, ok := entries[dstAddr]; !ok {
+				logrus.Infof("%s -> host port %d is unregistered", dstAddr, old.hostPort)
+			}
+			delete(h.containerInterfaces, dstAddr)
+		}
+	}
+	delete(h.containerAddrs, id)
+	for dstAddr, entry := range entries {
+		if old, ok := h.containerInterfaces[dstAddr]; !ok || old.hostPort != entry.hostPort {
+			logrus.Infof("%s -> host port %d is registered", dstAddr, entry.hostPort)
+		}
+		h.containerInterfaces[dstAddr] = entry
+		h.containerAddrs[id] = append(h.containerAddrs[id], dstAddr)
+	}
+	return verified
+}
+
+// verifyContainerInterfaces removes the entries that the tracer cannot connect to in parallel.
+// It returns false when some entries are removed.
+func (h *notifHandler) verifyContainerInterfaces(entries map[string]containerInterface) bool {
+	dstAddrs := make([]string, 0, len(entries))
+	for dstAddr := range entries {
+		dstAddrs = append(dstAddrs, dstAddr)
+	}
+	connected, err := h.tracerAgent.ConnectToAddress(dstAddrs, h.c2cConnections.TracerProbeTimeout)
+	if err != nil {
+		logrus.WithError(err).Debugf("failed to connect to %v", dstAddrs)
+		clear(entries)
+		return false
+	}
+	ok := map[string]bool{}
+	for _, dstAddr := range connected {
+		ok[dstAddr] = true
+		logrus.Debugf("successfully connected to %s", dstAddr)
+	}
+	for _, dstAddr := range dstAddrs {
+		if !ok[dstAddr] {
+			logrus.Debugf("failed to connect to %s", dstAddr)
+			delete(entries, dstAddr)
+		}
+	}
+	return len(entries) == len(dstAddrs)
+}
+
+// staleContainers returns the IDs of the containers having the entries checked before the time.
+func (h *notifHandler) staleContainers(before int64) map[string]bool {
+	h.containerInterfacesLock.RLock()
+	defer h.containerInterfacesLock.RUnlock()
+	res := map[string]bool{}
+	for _, contIf := range h.containerInterfaces {
+		if contIf.lastCheckedUnix < before {
+			res[contIf.containerID] = true
+		}
+	}
+	return res
+}
+
+// getContainerInterface returns the container having the destination address e.g. "192.168.1.1:1000"
+func (h *notifHandler) getContainerInterface(dstAddr string) (containerInterface, bool) {
+	h.containerInterfacesLock.RLock()
+	defer h.containerInterfacesLock.RUnlock()
+	contIf, ok := h.containerInterfaces[dstAddr]
+	return contIf, ok
+}
+
+// getContainerInterfaces returns the container's interfaces and forwarding ports to be registered to bypass4netnsd,
+// and the channel closed when the interfaces change.
+func (h *notifHandler) getContainerInterfaces() (*com.ContainerInterfaces, <-chan struct{}, error) {
+	if h.nsObserver == nil {
+		return nil, nil, errors.New("the interfaces of the container are not observed")
+	}
+	msg, changed := h.nsObserver.Interfaces()
+	ifs, err := nsagentInterfacesToComInterfaces(msg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to convert addresses: %w", err)
+	}
+	containerIfs := &com.ContainerInterfaces{
+		ContainerID:     h.state.State.ID,
+		Interfaces:      ifs,
+		ForwardingPorts: map[int]int{},
+		Networks:        h.networks,
+		NetNS:           h.netns,
+	}
+	for _, v := range h.listForwardingPorts() {
+		containerIfs.ForwardingPorts[v.ChildPort] = v.HostPort
+	}
+	return containerIfs, changed, nil
+}
+
+// startBackgroundPortSyncTask follows the ports added to bypass4netnsd via the rootlesskit-compatible port API.
+// It watches the ports with the long poll, and returns when the bypass4netns is not managed by bypass4netnsd.
+func (h *notifHandler) startBackgroundPortSyncTask(ctx gocontext.Context, comClient com.Client) {
+	logger := logrus.WithFields(logrus.Fields{"ID": util.ShrinkID(h.state.State.ID)})
+	watcher := &portsWatcher{
+		client: comClient,
+		id:     h.state.State.ID,
+		watch:  true,
+	}
+	for {
+		ports, err := watcher.next(ctx, portSyncWatchTimeout)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if com.IsNotFound(err) {
+				logger.Info("bypass4netns is not managed by bypass4netnsd, forwarding ports are not synchronized")
+				return
+			}
+			logger.WithError(err).Debug("failed to get forwarding ports")
+			h.stats.taskFailed(taskPortSync, err)
+		} else {
+			h.stats.taskSucceeded(taskPortSync)
+			fwdPorts := map[int]ForwardPortMapping{}
+			for _, p := range ports {
+				fwdPorts[p.ChildPort] = ForwardPortMapping{
+					HostPort:  p.ParentPort,
+					ChildPort: p.ChildPort,
+				}
+			}
+			if h.setForwardingPorts(fwdPorts) {
+				logger.Infof("forwarding ports are updated: %v", fwdPorts)
+				if h.tracerAgent != nil {
+					if err := h.tracerAgent.RegisterForwardPorts(childPorts(h.listForwardingPorts())); err != nil {
+						logger.WithError(err).Warn("failed to register ports to tracer agent")
+					}
+				}
+			}
+		}
+
+		// the watch waits for the changes, but polling and retrying after errors do not
+		if !watcher.watch || err != nil {
+			if !sleepContext(ctx, portSyncRetryInterval) {
+				return
+			}
+		}
+	}
+}
+
+// statsPostInterval is the interval to report the stats to bypass4netnsd when they change
+const statsPostInterval = 5 * time.Second
+
+// startBackgroundStatsTask reports the stats to bypass4netnsd when they change, and retries after errors.
+// The first report tells bypass4netnsd that the seccomp fd is received, so that it does not restart the bypass4netns.
+// It returns when bypass4netnsd rejects the stats of the bypass4netns not managed by it.
+func (h *notifHandler) startBackgroundStatsTask(ctx gocontext.Context, comClient com.Client) {
+	logger := logrus.WithFields(logrus.Fields{"ID": util.ShrinkID(h.state.State.ID)})
+	var posted *com.Stats
+	for {
+		stats := h.stats.toComStats(h.state.State.ID)
+		if !reflect.DeepEqual(posted, stats) {
+			err := comClient.PostStats(ctx, stats)
+			if com.IsForbidden(err) || com.IsNotFound(err) {
+				logger.WithError(err).Info("bypass4netnsd rejected the stats, they are not reported")
+				return
+			} else if err != nil {
+				logger.WithError(err).Debug("failed to post stats")
+			} else {
+				posted = stats
+			}
+		}
+		if !sleepContext(ctx, statsPostInterval) {
+			return
 		}
+	}
+}
+
+const (
+	// portSyncWatchTimeout is the timeout of a long poll of the forwarding ports
+	portSyncWatchTimeout = 30 * time.Second
+	// portSyncRetryInterval is the interval to poll the forwarding ports when bypass4netnsd does not support watching them,
+	// and to retry after errors
+	portSyncRetryInterval = 1 * time.Second
+)
 
-		time.Sleep(1 * time.Second)
+// portsWatcher follows the forwarding ports of the bypass4netns registered to bypass4netnsd
+type portsWatcher struct {
+	client   com.Client
+	id       string
+	revision uint64
+	// watch is false when bypass4netnsd does not support watching, and the ports are polled
+	watch bool
+}
+
+// next waits for the changes of the ports, and returns the ports.
+// It returns an error satisfying com.IsNotFound when the bypass4netns is not managed by bypass4netnsd.
+func (w *portsWatcher) next(ctx gocontext.Context, timeout time.Duration) ([]api.PortSpec, error) {
+	if w.watch {
+		watch, err := w.client.WatchForwardingPorts(ctx, w.id, w.revision, timeout)
+		if err == nil {
+			w.revision = watch.Revision
+			return watch.Ports, nil
+		}
+		if !com.IsNotFound(err) {
+			return nil, err
+		}
 	}
+	// the watch is not found either when bypass4netnsd does not support it or when the bypass4netns is not managed
+	ports, err := w.client.GetForwardingPorts(ctx, w.id)
+	if err != nil {
+		return nil, err
+	}
+	if w.watch {
+		logrus.Info("bypass4netnsd does not support watching the forwarding ports, polling them")
+		w.watch = false
+	}
+	return ports, nil
+}
+
+func (h *notifHandler) getForwardingPort(childPort int) (ForwardPortMapping, bool) {
+	h.forwardingPortsLock.RLock()
+	defer h.forwardingPortsLock.RUnlock()
+
+	fwdPort, ok := h.forwardingPorts[childPort]
+	return fwdPort, ok
 }
 
-func iproute2AddressesToComInterfaces(addrs iproute2.Addresses) ([]com.Interface, error) {
+func (h *notifHandler) listForwardingPorts() []ForwardPortMapping {
+	h.forwardingPortsLock.RLock()
+	defer h.forwardingPortsLock.RUnlock()
+
+	res := []ForwardPortMapping{}
+	for _, v := range h.forwardingPorts {
+		res = append(res, v)
+	}
+	return res
+}
+
+// setForwardingPorts replaces the forwarding ports and returns true if they are changed.
+// Already bound sockets are not affected.
+func (h *notifHandler) setForwardingPorts(fwdPorts map[int]ForwardPortMapping) bool {
+	h.forwardingPortsLock.Lock()
+	defer h.forwardingPortsLock.Unlock()
+
+	if maps.Equal(h.forwardingPorts, fwdPorts) {
+		return false
+	}
+	h.forwardingPorts = fwdPorts
+	return true
+}
+
+func nsagentInterfacesToComInterfaces(msg *types.Message) ([]com.Interface, error) {
 	comIntfs := []com.Interface{}
-	for _, intf := range addrs {
+	for _, intf := range msg.Interfaces {
 		comIntf := com.Interface{
-			Name:       intf.IfName,
+			Name:       intf.Name,
 			Addresses:  []net.IPNet{},
-			IsLoopback: intf.LinkType == "loopback",
+			IsLoopback: intf.Loopback,
 		}
-		hwAddr, err := net.ParseMAC(intf.Address)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse HWAddress: %w", err)
+		if intf.HWAddr != "" {
+			hwAddr, err := net.ParseMAC(intf.HWAddr)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse HWAddress: %w", err)
+			}
+			comIntf.HWAddr = hwAddr
 		}
-		comIntf.HWAddr = hwAddr
-		for _, addr := range intf.AddrInfos {
-			ip, ipNet, err := net.ParseCIDR(fmt.Sprintf("%s/%d", addr.Local, addr.PrefixLen))
+		for _, cidr := range intf.CIDRs {
+			ip, ipNet, err := net.ParseCIDR(cidr)
 			if err != nil {
-				return nil, fmt.Errorf("failed to parse addr_info: %w", err)
+				return nil, fmt.Errorf("failed to parse CIDR: %w", err)
 			}
 			ipNet.IP = ip
 			comIntf.Addresses = append(comIntf.Addresses, *ipNet)
@@ -1010,59 +1715,47 @@ func iproute2AddressesToComInterfaces(addrs iproute2.Addresses) ([]com.Interface
 	return comIntfs, nil
 }
 
-func (h *notifHandler) startBackgroundMultinodeTask(ready chan bool) {
+// startBackgroundMultinodeTask sends the result of the initialization to ready, and runs until ctx is done.
+func (h *notifHandler) startBackgroundMultinodeTask(ctx gocontext.Context, ready chan<- error) {
+	defer h.multinode.registry.Close()
+	// registered is the container addresses and their values registered to the registry, removed when the processes exit
+	registered := map[string]string{}
+	defer h.unregisterMultinodeAddresses(registered)
+	// the cache stops following the registry before it is closed
+	watchCtx, cancelWatch := gocontext.WithCancel(ctx)
+	defer cancelWatch()
+	go h.multinode.cache.run(watchCtx)
 	initDone := false
 	ifLastUpdateUnix := int64(0)
+	// ifChanged is closed when the interfaces of the container change after they are registered
+	var ifChanged <-chan struct{}
 	for {
+		if isClosed(ifChanged) {
+			ifLastUpdateUnix = 0
+		}
 		if ifLastUpdateUnix+10 < time.Now().Unix() {
-			ifs, err := iproute2.GetAddressesInNetNS(gocontext.TODO(), h.state.Pid)
+			var containerIfs *com.ContainerInterfaces
+			var err error
+			containerIfs, ifChanged, err = h.getContainerInterfaces()
 			if err != nil {
 				logrus.WithError(err).Errorf("failed to get addresses")
-				return
-			}
-			for _, intf := range ifs {
-				// ignore non-ethernet interface
-				if intf.LinkType != "ether" {
-					continue
-				}
-				for _, addr := range intf.AddrInfos {
-					// ignore non-IPv4 address
-					if addr.Family != "inet" {
-						continue
-					}
-					for _, v := range h.forwardingPorts {
-						containerAddr := fmt.Sprintf("%s:%d", addr.Local, v.ChildPort)
-						hostAddr := fmt.Sprintf("%s:%d", h.multinode.HostAddress, v.HostPort)
-						// Remove entries with timeout
-						// TODO: Remove related entries when exiting.
-						ctx, cancel := gocontext.WithTimeout(gocontext.Background(), 2*time.Second)
-						lease, err := h.multinode.etcdClient.Grant(ctx, 15)
-						cancel()
-						if err != nil {
-							logrus.WithError(err).Errorf("failed to grant lease to register %s -> %s", containerAddr, hostAddr)
-							continue
-						}
-						ctx, cancel = gocontext.WithTimeout(gocontext.Background(), 2*time.Second)
-						_, err = h.multinode.etcdClient.Put(ctx, ETCD_MULTINODE_PREFIX+containerAddr, hostAddr,
-							clientv3.WithLease(lease.ID))
-						cancel()
-						if err != nil {
-							logrus.WithError(err).Errorf("failed to register %s -> %s", containerAddr, hostAddr)
-						} else {
-							logrus.Infof("Registered %s -> %s", containerAddr, hostAddr)
-						}
-					}
+				if !initDone {
+					ready <- err
 				}
+				return
 			}
+			h.registerMultinodeAddresses(ctx, containerIfs, registered)
 			ifLastUpdateUnix = time.Now().Unix()
 
 			// once the interfaces are registered, it is ready to handle connections
 			if !initDone {
 				initDone = true
-				ready <- true
+				ready <- nil
 			}
 		}
 
-		time.Sleep(1 * time.Second)
+		if !sleepContext(ctx, 1*time.Second) {
+			return
+		}
 	}
 }
@@ -0,0 +1,286 @@
+package bypass4netns
+
+import (
+	gocontext "context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/rootless-containers/bypass4netns/pkg/api"
+	"github.com/rootless-containers/bypass4netns/pkg/api/com"
+	"github.com/rootless-containers/bypass4netns/pkg/bypass4netns/nsagent/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeComClient returns the queued watches
+type fakeComClient struct {
+	watches []*com.InterfacesWatch
+	list    map[string]com.ContainerInterfaces
+}
+
+func (c *fakeComClient) Ping(ctx gocontext.Context) error {
+	return nil
+}
+
+func (c *fakeComClient) ListInterfaces(ctx gocontext.Context) (map[string]com.ContainerInterfaces, error) {
+	return c.list, nil
+}
+
+func (c *fakeComClient) WatchInterfaces(ctx gocontext.Context, revision uint64, timeout time.Duration) (*com.InterfacesWatch, error) {
+	if c.watches == nil {
+		return nil, com.ErrNotFound
+	}
+	watch := c.watches[0]
+	c.watches = c.watches[1:]
+	return watch, nil
+}
+
+func (c *fakeComClient) PostInterface(ctx gocontext.Context, ifs *com.ContainerInterfaces) (*com.ContainerInterfaces, error) {
+	return ifs, nil
+}
+
+func (c *fakeComClient) GetForwardingPorts(ctx gocontext.Context, id string) ([]api.PortSpec, error) {
+	return nil, com.ErrNotFound
+}
+
+func (c *fakeComClient) WatchForwardingPorts(ctx gocontext.Context, id string, revision uint64, timeout time.Duration) (*com.PortsWatch, error) {
+	return nil, com.ErrNotFound
+}
+
+func (c *fakeComClient) PostStats(ctx gocontext.Context, stats *com.Stats) error {
+	return nil
+}
+
+func testContainerInterfaces(id, ip string, hostPort int) com.ContainerInterfaces {
+	return com.ContainerInterfaces{
+		ContainerID: id,
+		Interfaces: []com.Interface{{
+			Name:      "eth0",
+			Addresses: []net.IPNet{{IP: net.ParseIP(ip), Mask: net.CIDRMask(24, 32)}},
+		}},
+		ForwardingPorts: map[int]int{80: hostPort},
+	}
+}
+
+func TestInterfacesWatcher(t *testing.T) {
+	cont0 := testContainerInterfaces("container0", "10.4.0.2", 8080)
+	cont1 := testContainerInterfaces("container1", "10.4.0.3", 8081)
+	cont1Moved := testContainerInterfaces("container1", "10.4.0.4", 8081)
+	client := &fakeComClient{
+		watches: []*com.InterfacesWatch{
+			{Revision: 10, Snapshot: map[string]com.ContainerInterfaces{"container0": cont0, "container1": cont1}},
+			{Revision: 12, Events: []com.InterfacesEvent{
+				{Revision: 11, Type: com.InterfacesEventPut, ContainerID: "container1", Interfaces: &cont1Moved},
+				{Revision: 12, Type: com.InterfacesEventDelete, ContainerID: "container0"},
+			}},
+		},
+	}
+	h := &notifHandler{
+		c2cConnections:      &C2CConnectionHandleConfig{Enable: true},
+		containerInterfaces: map[string]containerInterface{},
+		containerAddrs:      map[string][]string{},
+	}
+	w := &interfacesWatcher{client: client, registered: map[string]com.ContainerInterfaces{}, watch: true}
+	update := func() {
+		changed, err := w.next(gocontext.Background(), time.Second)
+		assert.Equal(t, nil, err)
+		for id := range changed {
+			var cont *com.ContainerInterfaces
+			if v, ok := w.registered[id]; ok {
+				cont = &v
+			}
+			assert.Equal(t, true, h.updateContainerInterfaces(id, cont))
+		}
+	}
+
+	update()
+	assert.Equal(t, uint64(10), w.revision)
+	contIf, ok := h.getContainerInterface("10.4.0.2:80")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, 8080, contIf.hostPort)
+	_, ok = h.getContainerInterface("10.4.0.3:80")
+	assert.Equal(t, true, ok)
+
+	update()
+	assert.Equal(t, uint64(12), w.revision)
+	_, ok = h.getContainerInterface("10.4.0.2:80")
+	assert.Equal(t, false, ok)
+	_, ok = h.getContainerInterface("10.4.0.3:80")
+	assert.Equal(t, false, ok)
+	contIf, ok = h.getContainerInterface("10.4.0.4:80")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "container1", contIf.containerID)
+
+	// bypass4netnsd without the watch API is polled
+	client.watches = nil
+	client.list = map[string]com.ContainerInterfaces{"container0": cont0}
+	update()
+	assert.Equal(t, false, w.watch)
+	_, ok = h.getContainerInterface("10.4.0.2:80")
+	assert.Equal(t, true, ok)
+	_, ok = h.getContainerInterface("10.4.0.4:80")
+	assert.Equal(t, false, ok)
+}
+
+func TestC2CNetworks(t *testing.T) {
+	h := &notifHandler{
+		c2cConnections:      &C2CConnectionHandleConfig{Enable: true},
+		networks:            []string{"net0"},
+		containerInterfaces: map[string]containerInterface{},
+		containerAddrs:      map[string][]string{},
+	}
+	// container1 is isolated from the container even though it has the same address as container0
+	cont0 := testContainerInterfaces("container0", "10.4.0.2", 8080)
+	cont0.Networks = []string{"net0", "net1"}
+	cont1 := testContainerInterfaces("container1", "10.4.0.2", 8081)
+	cont1.Networks = []string{"net1"}
+	cont2 := testContainerInterfaces("container2", "10.4.0.3", 8082)
+	assert.Equal(t, true, h.updateContainerInterfaces("container0", &cont0))
+	assert.Equal(t, true, h.updateContainerInterfaces("container1", &cont1))
+	assert.Equal(t, true, h.updateContainerInterfaces("container2", &cont2))
+	contIf, ok := h.getContainerInterface("10.4.0.2:80")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "container0", contIf.containerID)
+	assert.Equal(t, 8080, contIf.hostPort)
+	// the container without the networks is on the unnamed network
+	_, ok = h.getContainerInterface("10.4.0.3:80")
+	assert.Equal(t, false, ok)
+
+	// the container moved to the other network is unregistered
+	cont0.Networks = []string{"net1"}
+	assert.Equal(t, true, h.updateContainerInterfaces("container0", &cont0))
+	_, ok = h.getContainerInterface("10.4.0.2:80")
+	assert.Equal(t, false, ok)
+}
+
+func TestC2CIPv6(t *testing.T) {
+	h := &notifHandler{
+		c2cConnections:      &C2CConnectionHandleConfig{Enable: true},
+		containerInterfaces: map[string]containerInterface{},
+		containerAddrs:      map[string][]string{},
+	}
+	cont := testContainerInterfaces("container0", "10.4.0.2", 8080)
+	cont.Interfaces[0].Addresses = append(cont.Interfaces[0].Addresses,
+		net.IPNet{IP: net.ParseIP("fd00::2"), Mask: net.CIDRMask(64, 128)},
+		net.IPNet{IP: net.ParseIP("fe80::2"), Mask: net.CIDRMask(64, 128)},
+	)
+	assert.Equal(t, true, h.updateContainerInterfaces("container0", &cont))
+	_, ok := h.getContainerInterface("10.4.0.2:80")
+	assert.Equal(t, true, ok)
+	sa := sockaddr{IP: net.ParseIP("fd00::2"), Port: 80}
+	contIf, ok := h.getContainerInterface(sa.String())
+	assert.Equal(t, true, ok)
+	assert.Equal(t, 8080, contIf.hostPort)
+	// link-local address is not registered
+	_, ok = h.getContainerInterface("[fe80::2]:80")
+	assert.Equal(t, false, ok)
+}
+
+func TestNetNSContainers(t *testing.T) {
+	h := &notifHandler{
+		c2cConnections:      &C2CConnectionHandleConfig{Enable: true},
+		state:               &specs.ContainerProcessState{State: specs.State{ID: "container0"}},
+		networks:            []string{"net0"},
+		netns:               "net:[4026532000]",
+		containerInterfaces: map[string]containerInterface{},
+		containerAddrs:      map[string][]string{},
+		netnsContainers:     map[string]netnsContainer{},
+	}
+	// container1 joins the network namespace of container0 and has its own network identifier
+	cont0 := testContainerInterfaces("container0", "10.4.0.2", 8080)
+	cont0.Networks = h.networks
+	cont0.NetNS = h.netns
+	cont1 := testContainerInterfaces("container1", "10.4.0.2", 8081)
+	cont1.ForwardingPorts = map[int]int{81: 8081}
+	cont1.Networks = []string{"container:container0"}
+	cont1.NetNS = h.netns
+	cont2 := testContainerInterfaces("container2", "10.4.0.3", 8082)
+	cont2.Networks = h.networks
+	cont2.NetNS = "net:[4026532001]"
+	for _, cont := range []com.ContainerInterfaces{cont0, cont1, cont2} {
+		assert.Equal(t, true, h.updateContainerInterfaces(cont.ContainerID, &cont))
+	}
+
+	p, ok := h.getNetNSForwardingPort(net.ParseIP("127.0.0.1"), 81)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, 8081, p.HostPort)
+	p, ok = h.getNetNSForwardingPort(net.ParseIP("10.4.0.2"), 81)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, 8081, p.HostPort)
+	_, ok = h.getNetNSForwardingPort(net.ParseIP("10.4.0.3"), 81)
+	assert.Equal(t, false, ok)
+	// the container itself and the containers in the other network namespaces are not included
+	_, ok = h.getNetNSForwardingPort(net.ParseIP("127.0.0.1"), 80)
+	assert.Equal(t, false, ok)
+	// the container in the network namespace is connected via c2c as well
+	contIf, ok := h.getContainerInterface("10.4.0.2:81")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "container1", contIf.containerID)
+
+	h.updateNetNSContainer("container1", nil)
+	_, ok = h.getNetNSForwardingPort(net.ParseIP("127.0.0.1"), 81)
+	assert.Equal(t, false, ok)
+}
+
+func TestNsagentInterfacesToComInterfaces(t *testing.T) {
+	mac, err := net.ParseMAC("ea:1e:d5:cd:e2:ea")
+	assert.Equal(t, nil, err)
+
+	testCases := []struct {
+		intf     types.Interface
+		expected com.Interface
+		err      bool
+	}{
+		{
+			intf: types.Interface{Name: "lo", CIDRs: []string{"127.0.0.1/8", "::1/128"}, Loopback: true},
+			expected: com.Interface{
+				Name: "lo",
+				Addresses: []net.IPNet{
+					{IP: net.ParseIP("127.0.0.1"), Mask: net.CIDRMask(8, 32)},
+					{IP: net.ParseIP("::1"), Mask: net.CIDRMask(128, 128)},
+				},
+				IsLoopback: true,
+			},
+		},
+		{
+			// the address is kept instead of the network address
+			intf: types.Interface{Name: "eth0", CIDRs: []string{"10.4.0.53/24"}, HWAddr: "ea:1e:d5:cd:e2:ea"},
+			expected: com.Interface{
+				Name:      "eth0",
+				HWAddr:    mac,
+				Addresses: []net.IPNet{{IP: net.ParseIP("10.4.0.53"), Mask: net.CIDRMask(24, 32)}},
+			},
+		},
+		{
+			intf:     types.Interface{Name: "eth1", CIDRs: []string{}},
+			expected: com.Interface{Name: "eth1", Addresses: []net.IPNet{}},
+		},
+		{intf: types.Interface{Name: "eth0", HWAddr: "ea:1e:d5"}, err: true},
+		{intf: types.Interface{Name: "eth0", CIDRs: []string{"10.4.0.53"}}, err: true},
+		{intf: types.Interface{Name: "eth0", CIDRs: []string{"10.4.0.53/33"}}, err: true},
+	}
+	for _, tc := range testCases {
+		ifs, err := nsagentInterfacesToComInterfaces(&types.Message{Interfaces: []types.Interface{tc.intf}})
+		if tc.err {
+			assert.NotEqual(t, nil, err, "intf=%+v", tc.intf)
+			continue
+		}
+		assert.Equal(t, nil, err, "intf=%+v", tc.intf)
+		assert.Equal(t, 1, len(ifs))
+		assert.Equal(t, tc.expected.Name, ifs[0].Name)
+		assert.Equal(t, tc.expected.HWAddr, ifs[0].HWAddr)
+		assert.Equal(t, tc.expected.IsLoopback, ifs[0].IsLoopback)
+		assert.Equal(t, len(tc.expected.Addresses), len(ifs[0].Addresses))
+		for i, addr := range tc.expected.Addresses {
+			assert.Equal(t, addr.String(), ifs[0].Addresses[i].String())
+		}
+	}
+
+	// the interfaces are kept in the order of the message
+	ifs, err := nsagentInterfacesToComInterfaces(&types.Message{Interfaces: []types.Interface{{Name: "eth0"}, {Name: "lo", Loopback: true}}})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(ifs))
+	assert.Equal(t, "eth0", ifs[0].Name)
+	assert.Equal(t, "lo", ifs[1].Name)
+}
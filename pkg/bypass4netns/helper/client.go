@@ -0,0 +1,201 @@
+package helper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rootless-containers/bypass4netns/pkg/bypass4netns/agentproto"
+	"github.com/rootless-containers/bypass4netns/pkg/nsenter"
+	"github.com/rootless-containers/bypass4netns/pkg/util"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// DefaultTimeout is the timeout of each request to the helper
+const DefaultTimeout = 1 * time.Second
+
+// Helper is the client of the helper
+type Helper struct {
+	conn    net.Conn
+	timeout time.Duration
+
+	// lock serializes the requests
+	lock   sync.Mutex
+	nextID uint64
+	// done is closed when the helper exits
+	done chan struct{}
+}
+
+// Start starts the helper in the namespaces of the PID.
+// The helper is stopped when ctx is done.
+func Start(ctx context.Context, pid int) (*Helper, error) {
+	selfExe, err := util.AgentExecutable()
+	if err != nil {
+		return nil, err
+	}
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	parent, child := os.NewFile(uintptr(fds[0]), "helper"), os.NewFile(uintptr(fds[1]), "helper")
+	defer parent.Close()
+	defer child.Close()
+	conn, err := net.FileConn(parent)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd, err := nsenter.Command(ctx, pid, unix.CLONE_NEWNET, selfExe, "--helper")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	cmd.SysProcAttr = &unix.SysProcAttr{
+		Pdeathsig: unix.SIGTERM,
+	}
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{child}
+	if err := cmd.Start(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to start %v: %w", cmd.Args, err)
+	}
+	h := newHelper(conn)
+	// the helper is killed by exec.CommandContext
+	go func() {
+		_ = cmd.Wait()
+		conn.Close()
+		close(h.done)
+	}()
+	logrus.Infof("started helper (PID=%d, target PID=%d)", cmd.Process.Pid, pid)
+
+	if err := h.handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+func newHelper(conn net.Conn) *Helper {
+	return &Helper{
+		conn:    conn,
+		timeout: DefaultTimeout,
+		nextID:  1,
+		done:    make(chan struct{}),
+	}
+}
+
+func (h *Helper) handshake() error {
+	var payload json.RawMessage
+	if _, err := h.call(agentproto.MethodHello, &agentproto.Hello{Version: agentproto.Version}, &payload); err != nil {
+		return fmt.Errorf("handshake with %s failed: %w", AgentName, err)
+	}
+	var resp agentproto.Hello
+	if err := json.Unmarshal(payload, &resp); err != nil {
+		return fmt.Errorf("handshake with %s failed: %w", AgentName, err)
+	}
+	if resp.Version != agentproto.Version || resp.Agent != AgentName {
+		return fmt.Errorf("handshake with %s failed: unexpected agent %q (version %d)", AgentName, resp.Agent, resp.Version)
+	}
+	return nil
+}
+
+// OpenMem returns the fd of /proc/<pid>/mem opened in the namespaces of the container
+func (h *Helper) OpenMem(pid int) (int, error) {
+	return h.callFd(MethodOpenMem, &PidRequest{Pid: pid})
+}
+
+// OpenPidfd returns the pidfd of the pid opened in the namespaces of the container
+func (h *Helper) OpenPidfd(pid int) (int, error) {
+	return h.callFd(MethodOpenPidfd, &PidRequest{Pid: pid})
+}
+
+// GetFd returns the duplicate of the fd of the pid, obtained with the capabilities in the namespaces of the container
+func (h *Helper) GetFd(pid, fd int) (int, error) {
+	return h.callFd(MethodGetFd, &GetFdRequest{Pid: pid, Fd: fd})
+}
+
+// OpenNetNS returns the fd of the network namespace of the container
+func (h *Helper) OpenNetNS() (int, error) {
+	return h.callFd(MethodOpenNetNS, nil)
+}
+
+// Close stops the helper
+func (h *Helper) Close() error {
+	return h.conn.Close()
+}
+
+// Done returns the channel closed when the helper exits
+func (h *Helper) Done() <-chan struct{} {
+	return h.done
+}
+
+// callFd calls the method returning a file descriptor
+func (h *Helper) callFd(method string, req interface{}) (int, error) {
+	fds, err := h.call(method, req, nil)
+	if err != nil {
+		return -1, err
+	}
+	if len(fds) != 1 {
+		closeFds(fds)
+		return -1, fmt.Errorf("unexpected number of file descriptors %d in the response to %q", len(fds), method)
+	}
+	return fds[0], nil
+}
+
+// call sends the request and returns the file descriptors in the response.
+// The payload of the response is stored to resp if it is not nil.
+func (h *Helper) call(method string, req interface{}, resp *json.RawMessage) ([]int, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	var payload json.RawMessage
+	if req != nil {
+		var err error
+		payload, err = json.Marshal(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+	id := h.nextID
+	h.nextID++
+	b, err := json.Marshal(&agentproto.Frame{Type: agentproto.FrameTypeRequest, ID: id, Method: method, Payload: payload})
+	if err != nil {
+		return nil, err
+	}
+	if err := h.conn.SetDeadline(time.Now().Add(h.timeout)); err != nil {
+		return nil, err
+	}
+	if err := util.SendMsg(h.conn, nil, b); err != nil {
+		return nil, fmt.Errorf("failed to send %q: %w", method, err)
+	}
+	for {
+		fds, b, err := util.RecvMsg(h.conn)
+		if err != nil {
+			return nil, fmt.Errorf("no response to %q: %w", method, err)
+		}
+		var f agentproto.Frame
+		if err := json.Unmarshal(b, &f); err != nil {
+			closeFds(fds)
+			return nil, fmt.Errorf("invalid response to %q: %w", method, err)
+		}
+		// the response to the request timed out before
+		if f.ID != id {
+			logrus.Debugf("ignoring the response to the request id=%d, which is timed out", f.ID)
+			closeFds(fds)
+			continue
+		}
+		if f.Error != "" {
+			closeFds(fds)
+			return nil, &agentproto.Error{Method: method, Message: f.Error}
+		}
+		if resp != nil {
+			*resp = f.Payload
+		}
+		return fds, nil
+	}
+}
@@ -0,0 +1,166 @@
+// Package helper implements the helper running in the namespaces of the container for the lifetime of the container.
+// It performs the operations that bypass4netns cannot do outside the namespaces, e.g. opening /proc/<pid>/mem
+// of the processes in another user namespace, and returns the file descriptors.
+//
+// The requests and the responses are agentproto.Frame on a SOCK_SEQPACKET socket,
+// and the file descriptors are attached to the responses with SCM_RIGHTS.
+package helper
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"github.com/rootless-containers/bypass4netns/pkg/bypass4netns/agentproto"
+	"github.com/rootless-containers/bypass4netns/pkg/util"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// AgentName is the name of the helper in the handshake
+const AgentName = "helper"
+
+const (
+	// MethodOpenMem opens /proc/<pid>/mem. The payload is PidRequest.
+	MethodOpenMem = "openMem"
+	// MethodOpenPidfd opens the pidfd of the process. The payload is PidRequest.
+	MethodOpenPidfd = "openPidfd"
+	// MethodGetFd duplicates the file descriptor of the process with pidfd_getfd. The payload is GetFdRequest.
+	MethodGetFd = "getFd"
+	// MethodOpenNetNS opens the network namespace of the helper, i.e. the one of the container.
+	MethodOpenNetNS = "openNetNS"
+)
+
+type PidRequest struct {
+	Pid int `json:"pid"`
+}
+
+type GetFdRequest struct {
+	Pid int `json:"pid"`
+	Fd  int `json:"fd"`
+}
+
+// socketFd is the socket passed to the helper as the first extra file
+const socketFd = 3
+
+func Main() error {
+	f := os.NewFile(uintptr(socketFd), "helper")
+	conn, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to open the socket: %w", err)
+	}
+	defer conn.Close()
+	if err := serve(conn); err != nil {
+		return err
+	}
+	logrus.Infof("Exit.")
+	return nil
+}
+
+// serve handles the requests on conn until it is closed.
+// The requests are handled one by one, as they do not block.
+func serve(conn net.Conn) error {
+	for {
+		fds, b, err := util.RecvMsg(conn)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("failed to receive request: %w", err)
+		}
+		closeFds(fds)
+		var req agentproto.Frame
+		if err := json.Unmarshal(b, &req); err != nil {
+			return fmt.Errorf("failed to decode request %q: %w", string(b), err)
+		}
+		resp := agentproto.Frame{Type: agentproto.FrameTypeResponse, ID: req.ID}
+		var respFds []int
+		if req.Method == agentproto.MethodHello {
+			resp.Payload, err = hello(req.Payload)
+		} else {
+			respFds, err = handle(req.Method, req.Payload)
+		}
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		b, err = json.Marshal(&resp)
+		if err != nil {
+			closeFds(respFds)
+			return err
+		}
+		err = util.SendMsg(conn, respFds, b)
+		closeFds(respFds)
+		if err != nil {
+			return fmt.Errorf("failed to reply to %q (id=%d): %w", req.Method, req.ID, err)
+		}
+	}
+}
+
+func hello(payload json.RawMessage) (json.RawMessage, error) {
+	var req agentproto.Hello
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, err
+	}
+	if req.Version != agentproto.Version {
+		return nil, fmt.Errorf("unsupported protocol version %d, expected %d", req.Version, agentproto.Version)
+	}
+	return json.Marshal(&agentproto.Hello{Version: agentproto.Version, Agent: AgentName})
+}
+
+// handle returns the file descriptors to be sent
+func handle(method string, payload json.RawMessage) ([]int, error) {
+	switch method {
+	case MethodOpenMem:
+		var req PidRequest
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return nil, err
+		}
+		fd, err := unix.Open(fmt.Sprintf("/proc/%d/mem", req.Pid), unix.O_RDWR|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open mem (pid=%d): %w", req.Pid, err)
+		}
+		return []int{fd}, nil
+	case MethodOpenPidfd:
+		var req PidRequest
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return nil, err
+		}
+		fd, err := unix.PidfdOpen(req.Pid, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open pidfd (pid=%d): %w", req.Pid, err)
+		}
+		return []int{fd}, nil
+	case MethodGetFd:
+		var req GetFdRequest
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return nil, err
+		}
+		pidfd, err := unix.PidfdOpen(req.Pid, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open pidfd (pid=%d): %w", req.Pid, err)
+		}
+		defer unix.Close(pidfd)
+		fd, err := unix.PidfdGetfd(pidfd, req.Fd, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get fd %d (pid=%d): %w", req.Fd, req.Pid, err)
+		}
+		return []int{fd}, nil
+	case MethodOpenNetNS:
+		fd, err := unix.Open("/proc/thread-self/ns/net", unix.O_RDONLY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open netns: %w", err)
+		}
+		return []int{fd}, nil
+	}
+	return nil, fmt.Errorf("unknown method %q", method)
+}
+
+func closeFds(fds []int) {
+	for _, fd := range fds {
+		unix.Close(fd)
+	}
+}
@@ -0,0 +1,86 @@
+package helper
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"unsafe"
+
+	"github.com/rootless-containers/bypass4netns/pkg/bypass4netns/agentproto"
+	"github.com/rootless-containers/bypass4netns/pkg/util"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func newTestHelper(t *testing.T) *Helper {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET|unix.SOCK_CLOEXEC, 0)
+	assert.Equal(t, nil, err)
+	conns := make([]net.Conn, 2)
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "helper")
+		conns[i], err = net.FileConn(f)
+		f.Close()
+		assert.Equal(t, nil, err)
+	}
+	go func() {
+		_ = serve(conns[1])
+		conns[1].Close()
+	}()
+	h := newHelper(conns[0])
+	t.Cleanup(func() {
+		h.Close()
+	})
+	assert.Equal(t, nil, h.handshake())
+	return h
+}
+
+func TestHelper(t *testing.T) {
+	h := newTestHelper(t)
+
+	// the mem is opened
+	memfd, err := h.OpenMem(os.Getpid())
+	assert.Equal(t, nil, err)
+	defer unix.Close(memfd)
+	b := []byte("bypass4netns")
+	buf := make([]byte, len(b))
+	_, err = unix.Pread(memfd, buf, int64(uintptr(unsafe.Pointer(&b[0]))))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, b, buf)
+
+	// the fd of the process is duplicated
+	r, w, err := os.Pipe()
+	assert.Equal(t, nil, err)
+	defer r.Close()
+	defer w.Close()
+	fd, err := h.GetFd(os.Getpid(), int(w.Fd()))
+	assert.Equal(t, nil, err)
+	_, err = unix.Write(fd, []byte("x"))
+	unix.Close(fd)
+	assert.Equal(t, nil, err)
+	_, err = r.Read(buf[:1])
+	assert.Equal(t, nil, err)
+	assert.Equal(t, byte('x'), buf[0])
+
+	// the netns is the same as the current one in the test
+	nsfd, err := h.OpenNetNS()
+	assert.Equal(t, nil, err)
+	netns, err := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", nsfd))
+	unix.Close(nsfd)
+	assert.Equal(t, nil, err)
+	expected, err := util.NetNS(os.Getpid())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, expected, netns)
+
+	pidfd, err := h.OpenPidfd(os.Getpid())
+	assert.Equal(t, nil, err)
+	unix.Close(pidfd)
+
+	// the errors are replied
+	_, err = h.OpenMem(-1)
+	var agentErr *agentproto.Error
+	assert.Equal(t, true, errors.As(err, &agentErr))
+	_, err = h.callFd("unknown", nil)
+	assert.Equal(t, true, errors.As(err, &agentErr))
+}
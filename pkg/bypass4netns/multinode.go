@@ -0,0 +1,175 @@
+package bypass4netns
+
+import (
+	gocontext "context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rootless-containers/bypass4netns/pkg/api/com"
+	"github.com/rootless-containers/bypass4netns/pkg/bypass4netns/registry"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// multinodeRequestTimeout is the timeout of each request to the registry
+	multinodeRequestTimeout = 2 * time.Second
+	// multinodeWatchRetryInterval is the interval to watch the registry again after the watch stopped
+	multinodeWatchRetryInterval = 1 * time.Second
+)
+
+// registryCache keeps the container addresses of the registry followed by Watch,
+// not to look up the registry on every connect(2).
+// The addresses not in the cache are looked up in the registry, and cached unless they change meanwhile.
+type registryCache struct {
+	registry registry.Registry
+
+	// entries are valid only while watching is true. entries, watching, and revision are protected by lock.
+	entries  map[string]string
+	watching bool
+	// revision is incremented on each event, not to cache the result of Lookup older than the event
+	revision uint64
+	lock     sync.RWMutex
+}
+
+func newRegistryCache(r registry.Registry) *registryCache {
+	return &registryCache{
+		registry: r,
+		entries:  map[string]string{},
+	}
+}
+
+// run follows the registry until ctx is done. The watch is started again when it stops, e.g. etcd is restarted.
+func (c *registryCache) run(ctx gocontext.Context) {
+	for {
+		ch, err := c.registry.Watch(ctx)
+		if err != nil {
+			logrus.WithError(err).Warn("failed to watch the registry, the container addresses are looked up on each connection")
+		} else {
+			c.setWatching(true)
+			for e := range ch {
+				c.apply(e)
+			}
+			c.setWatching(false)
+		}
+		if !sleepContext(ctx, multinodeWatchRetryInterval) {
+			return
+		}
+	}
+}
+
+// setWatching clears the entries, as the events may be lost while not watching
+func (c *registryCache) setWatching(watching bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.watching = watching
+	c.entries = map[string]string{}
+	c.revision++
+}
+
+func (c *registryCache) apply(e registry.Event) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	switch e.Type {
+	case registry.EventTypePut:
+		c.entries[e.Key] = e.Value
+	case registry.EventTypeDelete:
+		delete(c.entries, e.Key)
+	}
+	c.revision++
+}
+
+// lookup returns the value of the key, or registry.ErrNotFound
+func (c *registryCache) lookup(ctx gocontext.Context, key string) (string, error) {
+	c.lock.RLock()
+	v, ok := c.entries[key]
+	watching, revision := c.watching, c.revision
+	c.lock.RUnlock()
+	if ok && watching {
+		return v, nil
+	}
+
+	v, err := c.registry.Lookup(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	if watching {
+		c.lock.Lock()
+		if c.watching && c.revision == revision {
+			c.entries[key] = v
+		}
+		c.lock.Unlock()
+	}
+	return v, nil
+}
+
+// lookupMultinodeAddress returns the host address and port forwarding to the container address on another host.
+// registry.ErrNotFound is returned when the address is not registered.
+func (h *notifHandler) lookupMultinodeAddress(containerAddr string) (net.IP, int, error) {
+	ctx, cancel := gocontext.WithTimeout(gocontext.Background(), multinodeRequestTimeout)
+	defer cancel()
+	hostAddrWithPort, err := h.multinode.cache.lookup(ctx, containerAddr)
+	if err != nil {
+		return nil, 0, err
+	}
+	host, port, err := net.SplitHostPort(hostAddrWithPort)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid address format %q: %w", hostAddrWithPort, err)
+	}
+	hostAddr := net.ParseIP(host)
+	if hostAddr == nil {
+		return nil, 0, fmt.Errorf("invalid address format %q", hostAddrWithPort)
+	}
+	hostPort, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid address format %q: %w", hostAddrWithPort, err)
+	}
+	return hostAddr, hostPort, nil
+}
+
+// registerMultinodeAddresses registers the IPv4 addresses of the container with the forwarded ports.
+// registered is updated with the registered container addresses and their values.
+func (h *notifHandler) registerMultinodeAddresses(ctx gocontext.Context, containerIfs *com.ContainerInterfaces, registered map[string]string) {
+	for _, intf := range containerIfs.Interfaces {
+		// ignore non-ethernet interface, which does not have 48-bit MAC address
+		if intf.IsLoopback || len(intf.HWAddr) != 6 {
+			continue
+		}
+		for _, addr := range intf.Addresses {
+			// ignore non-IPv4 address
+			if addr.IP.To4() == nil {
+				continue
+			}
+			for _, v := range h.listForwardingPorts() {
+				containerAddr := fmt.Sprintf("%s:%d", addr.IP, v.ChildPort)
+				hostAddr := fmt.Sprintf("%s:%d", h.multinode.HostAddress, v.HostPort)
+				// the entries of the processes killed without unregistering them expire
+				ctx, cancel := gocontext.WithTimeout(ctx, multinodeRequestTimeout)
+				err := h.multinode.registry.Register(ctx, containerAddr, hostAddr, multinodeRegistrationTTL)
+				cancel()
+				if err != nil {
+					logrus.WithError(err).Errorf("failed to register %s -> %s", containerAddr, hostAddr)
+					h.stats.taskFailed(taskMultinode, err)
+				} else {
+					logrus.Infof("Registered %s -> %s", containerAddr, hostAddr)
+					registered[containerAddr] = hostAddr
+					h.stats.taskSucceeded(taskMultinode)
+				}
+			}
+		}
+	}
+}
+
+// unregisterMultinodeAddresses removes the container addresses registered by registerMultinodeAddresses.
+// The addresses registered again from another host are kept.
+func (h *notifHandler) unregisterMultinodeAddresses(registered map[string]string) {
+	ctx, cancel := gocontext.WithTimeout(gocontext.Background(), multinodeRequestTimeout)
+	defer cancel()
+	for containerAddr, hostAddr := range registered {
+		if err := h.multinode.registry.Unregister(ctx, containerAddr, hostAddr); err != nil {
+			logrus.WithError(err).Warnf("failed to unregister %s", containerAddr)
+		}
+	}
+}
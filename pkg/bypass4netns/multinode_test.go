@@ -0,0 +1,200 @@
+package bypass4netns
+
+import (
+	gocontext "context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rootless-containers/bypass4netns/pkg/api/com"
+	"github.com/rootless-containers/bypass4netns/pkg/bypass4netns/registry"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRegistry is the registry shared by the hosts in memory
+type fakeRegistry struct {
+	entries map[string]string
+	lookups int
+	events  chan registry.Event
+	lock    sync.Mutex
+}
+
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{entries: map[string]string{}}
+}
+
+func (r *fakeRegistry) Register(ctx gocontext.Context, key, value string, ttl time.Duration) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.entries[key] = value
+	return nil
+}
+
+func (r *fakeRegistry) Lookup(ctx gocontext.Context, key string) (string, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.lookups++
+	v, ok := r.entries[key]
+	if !ok {
+		return "", registry.ErrNotFound
+	}
+	return v, nil
+}
+
+// Watch returns the events sent to r.events. It is not supported if r.events is nil.
+func (r *fakeRegistry) Watch(ctx gocontext.Context) (<-chan registry.Event, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.events == nil {
+		return nil, registry.ErrNotFound
+	}
+	return r.events, nil
+}
+
+func (r *fakeRegistry) Unregister(ctx gocontext.Context, key, value string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.entries[key] == value {
+		delete(r.entries, key)
+	}
+	return nil
+}
+
+func (r *fakeRegistry) Close() error {
+	return nil
+}
+
+func (r *fakeRegistry) lookupCount() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.lookups
+}
+
+func newMultinodeTestHandler(r registry.Registry) *notifHandler {
+	return &notifHandler{
+		forwardingPorts: map[int]ForwardPortMapping{80: {HostPort: 8080, ChildPort: 80}},
+		stats:           newHandlerStats(),
+		multinode: &MultinodeConfig{
+			Enable:      true,
+			HostAddress: "192.168.1.1",
+			registry:    r,
+			cache:       newRegistryCache(r),
+		},
+	}
+}
+
+func TestMultinodeRegistration(t *testing.T) {
+	r := newFakeRegistry()
+	h := newMultinodeTestHandler(r)
+	mac, err := net.ParseMAC("ea:1e:d5:cd:e2:ea")
+	assert.Equal(t, nil, err)
+	containerIfs := &com.ContainerInterfaces{
+		ContainerID: "container0",
+		Interfaces: []com.Interface{
+			{
+				Name:       "lo",
+				Addresses:  []net.IPNet{{IP: net.ParseIP("127.0.0.1"), Mask: net.CIDRMask(8, 32)}},
+				IsLoopback: true,
+			},
+			{
+				Name:   "eth0",
+				HWAddr: mac,
+				Addresses: []net.IPNet{
+					{IP: net.ParseIP("10.4.0.2"), Mask: net.CIDRMask(24, 32)},
+					{IP: net.ParseIP("2001:db8::2"), Mask: net.CIDRMask(64, 128)},
+				},
+			},
+			{
+				Name:      "eth1",
+				HWAddr:    mac,
+				Addresses: []net.IPNet{{IP: net.ParseIP("10.5.0.2"), Mask: net.CIDRMask(24, 32)}},
+			},
+		},
+	}
+
+	// only the IPv4 addresses of the ethernet interfaces are registered
+	registered := map[string]string{}
+	h.registerMultinodeAddresses(gocontext.Background(), containerIfs, registered)
+	expected := map[string]string{"10.4.0.2:80": "192.168.1.1:8080", "10.5.0.2:80": "192.168.1.1:8080"}
+	assert.Equal(t, expected, registered)
+	assert.Equal(t, expected, r.entries)
+
+	// the address registered again from another host is kept
+	assert.Equal(t, nil, r.Register(gocontext.Background(), "10.5.0.2:80", "192.168.1.2:8080", time.Minute))
+	h.unregisterMultinodeAddresses(registered)
+	assert.Equal(t, map[string]string{"10.5.0.2:80": "192.168.1.2:8080"}, r.entries)
+}
+
+func TestLookupMultinodeAddress(t *testing.T) {
+	r := newFakeRegistry()
+	h := newMultinodeTestHandler(r)
+	r.entries["10.4.0.2:80"] = "192.168.1.2:8080"
+	r.entries["10.4.0.3:80"] = "192.168.1.2"
+	r.entries["10.4.0.4:80"] = "host2:8080"
+
+	hostAddr, hostPort, err := h.lookupMultinodeAddress("10.4.0.2:80")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "192.168.1.2", hostAddr.String())
+	assert.Equal(t, 8080, hostPort)
+
+	_, _, err = h.lookupMultinodeAddress("10.4.0.5:80")
+	assert.Equal(t, registry.ErrNotFound, err)
+	_, _, err = h.lookupMultinodeAddress("10.4.0.3:80")
+	assert.NotEqual(t, nil, err)
+	_, _, err = h.lookupMultinodeAddress("10.4.0.4:80")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestRegistryCache(t *testing.T) {
+	r := newFakeRegistry()
+	r.events = make(chan registry.Event)
+	r.entries["10.4.0.2:80"] = "192.168.1.2:8080"
+	c := newRegistryCache(r)
+	ctx, cancel := gocontext.WithCancel(gocontext.Background())
+	done := make(chan struct{})
+	go func() {
+		c.run(ctx)
+		close(done)
+	}()
+
+	// the events are applied one by one, and the following event waits for the previous one
+	r.events <- registry.Event{Type: registry.EventTypePut, Key: "10.4.0.3:80", Value: "192.168.1.2:8081"}
+	r.events <- registry.Event{Type: registry.EventTypePut, Key: "10.4.0.4:80", Value: "192.168.1.2:8082"}
+	v, err := c.lookup(ctx, "10.4.0.3:80")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "192.168.1.2:8081", v)
+	assert.Equal(t, 0, r.lookupCount())
+
+	// the address registered before watching is looked up once
+	for i := 0; i < 2; i++ {
+		v, err = c.lookup(ctx, "10.4.0.2:80")
+		assert.Equal(t, nil, err)
+		assert.Equal(t, "192.168.1.2:8080", v)
+	}
+	assert.Equal(t, 1, r.lookupCount())
+
+	r.events <- registry.Event{Type: registry.EventTypeDelete, Key: "10.4.0.2:80"}
+	r.events <- registry.Event{Type: registry.EventTypeDelete, Key: "10.4.0.3:80"}
+	delete(r.entries, "10.4.0.2:80")
+	_, err = c.lookup(ctx, "10.4.0.2:80")
+	assert.Equal(t, registry.ErrNotFound, err)
+
+	// the cache is not used after the watch stopped
+	r.lock.Lock()
+	close(r.events)
+	r.events = nil
+	r.lock.Unlock()
+	assert.Eventually(t, func() bool {
+		c.lock.RLock()
+		defer c.lock.RUnlock()
+		return !c.watching
+	}, 5*time.Second, 10*time.Millisecond)
+	r.entries["10.4.0.4:80"] = "192.168.1.3:8082"
+	v, err = c.lookup(ctx, "10.4.0.4:80")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "192.168.1.3:8082", v)
+
+	cancel()
+	<-done
+}
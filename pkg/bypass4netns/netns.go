@@ -0,0 +1,79 @@
+package bypass4netns
+
+import (
+	"net"
+
+	"github.com/rootless-containers/bypass4netns/pkg/api/com"
+	"github.com/rootless-containers/bypass4netns/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+// netnsContainer is another container in the network namespace of the container, e.g. in the same pod.
+// Its listeners on the forwarded ports are moved to the host, so the connections to them are bypassed too.
+// The containers are followed by the c2c task, with the interfaces registered to bypass4netnsd.
+type netnsContainer struct {
+	// key is child port, value is host port
+	ports map[int]int
+	// addrs are the addresses of the network namespace
+	addrs []net.IP
+}
+
+// inNetNS returns true if the container of cont is in the network namespace of the container
+func (h *notifHandler) inNetNS(cont *com.ContainerInterfaces) bool {
+	return h.netns != "" && cont.NetNS == h.netns && cont.ContainerID != h.state.State.ID
+}
+
+// updateNetNSContainer records the forwarded ports of the container if it is in the network namespace.
+// The record is removed when cont is nil.
+func (h *notifHandler) updateNetNSContainer(id string, cont *com.ContainerInterfaces) {
+	h.containerInterfacesLock.Lock()
+	defer h.containerInterfacesLock.Unlock()
+
+	_, existed := h.netnsContainers[id]
+	if cont == nil || !h.inNetNS(cont) {
+		if existed {
+			logrus.Infof("container %s in the network namespace is unregistered", util.ShrinkID(id))
+			delete(h.netnsContainers, id)
+		}
+		return
+	}
+	c := netnsContainer{ports: map[int]int{}}
+	for contPort, hostPort := range cont.ForwardingPorts {
+		c.ports[contPort] = hostPort
+	}
+	for _, intf := range cont.Interfaces {
+		if intf.IsLoopback {
+			continue
+		}
+		for _, addr := range intf.Addresses {
+			c.addrs = append(c.addrs, addr.IP)
+		}
+	}
+	if !existed {
+		logrus.Infof("container %s in the network namespace is registered with ports %v", util.ShrinkID(id), c.ports)
+	}
+	h.netnsContainers[id] = c
+}
+
+// getNetNSForwardingPort returns the port forwarded by another container in the network namespace
+// if the destination is the loopback or an address of the network namespace.
+func (h *notifHandler) getNetNSForwardingPort(ip net.IP, port int) (ForwardPortMapping, bool) {
+	h.containerInterfacesLock.RLock()
+	defer h.containerInterfacesLock.RUnlock()
+
+	for _, c := range h.netnsContainers {
+		hostPort, ok := c.ports[port]
+		if !ok {
+			continue
+		}
+		if ip.IsLoopback() {
+			return ForwardPortMapping{HostPort: hostPort, ChildPort: port}, true
+		}
+		for _, addr := range c.addrs {
+			if addr.Equal(ip) {
+				return ForwardPortMapping{HostPort: hostPort, ChildPort: port}, true
+			}
+		}
+	}
+	return ForwardPortMapping{}, false
+}
@@ -0,0 +1,48 @@
+package nonbypassable
+
+import (
+	"net"
+	"testing"
+
+	"github.com/rootless-containers/bypass4netns/pkg/bypass4netns/nsagent/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdateRoutes(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	msg := &types.Message{
+		Interfaces: []types.Interface{
+			{Name: "eth0", CIDRs: []string{"10.4.0.2/24"}},
+		},
+		Routes: []types.Route{
+			{Destination: "0.0.0.0/0", Gateway: "10.4.0.1", Device: "eth0", Table: 254},
+			{Destination: "10.4.0.0/24", Device: "eth0", Table: 254},
+			{Destination: "192.168.100.0/24", Device: "wg0", Table: 1000},
+			{Destination: "::/0", Gateway: "fd00::1", Device: "eth0", Table: 254},
+		},
+	}
+
+	x := New([]net.IPNet{*loopback}, RoutePolicyNonDefault)
+	x.update(msg)
+	assert.Equal(t, true, x.Contains(net.ParseIP("127.0.0.1")))
+	assert.Equal(t, true, x.Contains(net.ParseIP("10.4.0.3")))
+	assert.Equal(t, true, x.Contains(net.ParseIP("192.168.100.1")))
+	// the default routes are not non-bypassable
+	assert.Equal(t, false, x.Contains(net.ParseIP("192.168.200.1")))
+	assert.Equal(t, false, x.Contains(net.ParseIP("2001:db8::1")))
+	// the route duplicated with the interface is not added twice
+	assert.Equal(t, 2, len(x.dynamicList))
+
+	x = New([]net.IPNet{*loopback}, RoutePolicyNone)
+	x.update(msg)
+	assert.Equal(t, true, x.Contains(net.ParseIP("10.4.0.3")))
+	assert.Equal(t, false, x.Contains(net.ParseIP("192.168.100.1")))
+}
+
+func TestParseRoutePolicy(t *testing.T) {
+	p, err := ParseRoutePolicy("none")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, RoutePolicyNone, p)
+	_, err = ParseRoutePolicy("all")
+	assert.NotEqual(t, nil, err)
+}
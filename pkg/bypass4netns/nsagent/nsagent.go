@@ -2,52 +2,143 @@ package nsagent
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"net"
 	"os"
 	"os/signal"
+	"reflect"
 	"sort"
+	"syscall"
 
+	"github.com/rootless-containers/bypass4netns/pkg/bypass4netns/agentproto"
 	"github.com/rootless-containers/bypass4netns/pkg/bypass4netns/nsagent/types"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
 )
 
+// Main serves the requests on stdin until it is closed.
+// The interfaces are sent as an event when the links, the addresses, or the routes change.
 func Main() error {
-	w := os.Stdout
-	if err := inspect(w); err != nil {
+	s := agentproto.NewServer(os.Stdin, os.Stdout, types.AgentName)
+	s.Handle(types.MethodInspect, func(json.RawMessage) (interface{}, error) {
+		return inspect()
+	})
+	fd, err := subscribe()
+	if err != nil {
 		return err
 	}
+	defer unix.Close(fd)
+
+	errCh := make(chan error, 2)
+	go func() {
+		errCh <- s.Serve()
+	}()
+	go func() {
+		errCh <- notifyChanges(s, fd)
+	}()
+
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, unix.SIGHUP, unix.SIGTERM, unix.SIGINT)
-	for sig := range sigCh {
-		switch sig {
-		case unix.SIGHUP:
-			if err := inspect(w); err != nil {
-				return err
-			}
-		case unix.SIGTERM, unix.SIGINT:
-			return nil
+	signal.Notify(sigCh, unix.SIGTERM, unix.SIGINT)
+	select {
+	case err := <-errCh:
+		return err
+	case <-sigCh:
+		return nil
+	}
+}
+
+// subscribe returns the netlink socket receiving the changes of the links, the addresses, and the routes
+func subscribe() (int, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return -1, fmt.Errorf("failed to open netlink socket: %w", err)
+	}
+	sa := &unix.SockaddrNetlink{
+		Family: unix.AF_NETLINK,
+		Groups: unix.RTMGRP_LINK | unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV6_IFADDR |
+			unix.RTMGRP_IPV4_ROUTE | unix.RTMGRP_IPV6_ROUTE,
+	}
+	if err := unix.Bind(fd, sa); err != nil {
+		unix.Close(fd)
+		return -1, fmt.Errorf("failed to subscribe to netlink: %w", err)
+	}
+	return fd, nil
+}
+
+// notifyChanges sends the interfaces when they change
+func notifyChanges(s *agentproto.Server, fd int) error {
+	var last *types.Message
+	buf := make([]byte, 64*1024)
+	for {
+		changed, err := receiveChanges(fd, buf)
+		if err != nil {
+			return err
+		}
+		if !changed {
+			continue
+		}
+		msg, err := inspect()
+		if err != nil {
+			return err
+		}
+		if reflect.DeepEqual(last, msg) {
+			continue
+		}
+		last = msg
+		logrus.Debugf("interfaces changed: %v", msg.Interfaces)
+		if err := s.Notify(types.EventInterfaces, msg); err != nil {
+			return err
 		}
 	}
-	return nil
 }
 
-func inspect(w io.Writer) error {
+// receiveChanges waits for the netlink messages, and returns true if the links, the addresses, or the routes may have changed
+func receiveChanges(fd int, buf []byte) (bool, error) {
+	n, _, err := unix.Recvfrom(fd, buf, 0)
+	if err != nil {
+		if errors.Is(err, unix.EINTR) {
+			return false, nil
+		}
+		// the messages overflowed the socket buffer, and some changes are lost
+		if errors.Is(err, unix.ENOBUFS) {
+			return true, nil
+		}
+		return false, fmt.Errorf("failed to receive netlink messages: %w", err)
+	}
+	msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+	if err != nil {
+		return false, fmt.Errorf("failed to parse netlink messages: %w", err)
+	}
+	for _, m := range msgs {
+		switch m.Header.Type {
+		case unix.RTM_NEWADDR, unix.RTM_DELADDR, unix.RTM_NEWLINK, unix.RTM_DELLINK, unix.RTM_NEWROUTE, unix.RTM_DELROUTE:
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func inspect() (*types.Message, error) {
 	var msg types.Message
 	interfaces, err := net.Interfaces()
 	if err != nil {
-		return fmt.Errorf("failed to enumerate the network interfaces: %w", err)
+		return nil, fmt.Errorf("failed to enumerate the network interfaces: %w", err)
 	}
+	names := map[int]string{}
 	for _, intf := range interfaces {
+		names[intf.Index] = intf.Name
 		addrs, err := intf.Addrs()
 		if err != nil {
 			logrus.Warnf("Failed to get the addresses of the network interface %q: %v", intf.Name, err)
 			continue
 		}
 		entry := types.Interface{
-			Name: intf.Name,
+			Name:     intf.Name,
+			Loopback: intf.Flags&net.FlagLoopback != 0,
+		}
+		if len(intf.HardwareAddr) > 0 {
+			entry.HWAddr = intf.HardwareAddr.String()
 		}
 		for _, addr := range addrs {
 			if ipNet, ok := addr.(*net.IPNet); ok {
@@ -60,11 +151,9 @@ func inspect(w io.Writer) error {
 	sort.Slice(msg.Interfaces, func(i, j int) bool {
 		return msg.Interfaces[i].Name < msg.Interfaces[j].Name
 	})
-	b, err := json.Marshal(msg)
+	msg.Routes, err = listRoutes(names)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	b = append(b, []byte("\n")...)
-	_, err = w.Write(b)
-	return err
+	return &msg, nil
 }
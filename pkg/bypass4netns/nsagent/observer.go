@@ -0,0 +1,112 @@
+package nsagent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/rootless-containers/bypass4netns/pkg/bypass4netns/agentproto"
+	"github.com/rootless-containers/bypass4netns/pkg/bypass4netns/nsagent/types"
+	"github.com/rootless-containers/bypass4netns/pkg/nsenter"
+	"github.com/rootless-containers/bypass4netns/pkg/util"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// Observer follows the interfaces of the NS via the nsagent.
+type Observer struct {
+	client *agentproto.Client
+
+	lock sync.Mutex
+	msg  *types.Message
+	// changed is closed when msg is replaced
+	changed chan struct{}
+}
+
+// StartObserver starts the nsagent in the NS associated with the PID.
+// The nsagent is stopped when ctx is done.
+func StartObserver(ctx context.Context, pid int) (*Observer, error) {
+	selfExe, err := util.AgentExecutable()
+	if err != nil {
+		return nil, err
+	}
+	cmd, err := nsenter.Command(ctx, pid, unix.CLONE_NEWNET, selfExe, "--nsagent")
+	if err != nil {
+		return nil, err
+	}
+	cmd.SysProcAttr = &unix.SysProcAttr{
+		Pdeathsig: unix.SIGTERM,
+	}
+	cmd.Stderr = os.Stderr
+	r, w := io.Pipe()
+	cmd.Stdout = w
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %v: %w", cmd.Args, err)
+	}
+	// the nsagent is killed by exec.CommandContext
+	go func() {
+		_ = cmd.Wait()
+		w.Close()
+	}()
+	logrus.Infof("started NSAgent (PID=%d, target PID=%d)", cmd.Process.Pid, pid)
+	client := agentproto.NewClient(r, stdin, stdin)
+	if err := client.Handshake(ctx, types.AgentName); err != nil {
+		client.Close()
+		return nil, err
+	}
+	o, err := newObserver(ctx, client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return o, nil
+}
+
+func newObserver(ctx context.Context, client *agentproto.Client) (*Observer, error) {
+	var msg types.Message
+	if err := client.Call(ctx, types.MethodInspect, nil, &msg); err != nil {
+		return nil, err
+	}
+	o := &Observer{
+		client:  client,
+		msg:     &msg,
+		changed: make(chan struct{}),
+	}
+	go o.run(ctx)
+	return o, nil
+}
+
+func (o *Observer) run(ctx context.Context) {
+	for ev := range o.client.Events() {
+		if ev.Method != types.EventInterfaces {
+			continue
+		}
+		var msg types.Message
+		if err := json.Unmarshal(ev.Payload, &msg); err != nil {
+			logrus.WithError(err).Warnf("failed to parse nsagent message %q", string(ev.Payload))
+			continue
+		}
+		o.lock.Lock()
+		o.msg = &msg
+		close(o.changed)
+		o.changed = make(chan struct{})
+		o.lock.Unlock()
+	}
+	if ctx.Err() == nil {
+		logrus.WithError(o.client.Err()).Warn("nsagent exited, the interfaces are no longer updated")
+	}
+}
+
+// Interfaces returns the current interfaces of the NS, and the channel closed when they change.
+func (o *Observer) Interfaces() (*types.Message, <-chan struct{}) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.msg, o.changed
+}
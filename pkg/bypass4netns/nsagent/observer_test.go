@@ -0,0 +1,47 @@
+package nsagent
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/rootless-containers/bypass4netns/pkg/bypass4netns/agentproto"
+	"github.com/rootless-containers/bypass4netns/pkg/bypass4netns/nsagent/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestObserver(t *testing.T) {
+	agentReader, writer := io.Pipe()
+	reader, agentWriter := io.Pipe()
+	s := agentproto.NewServer(agentReader, agentWriter, types.AgentName)
+	s.Handle(types.MethodInspect, func(json.RawMessage) (interface{}, error) {
+		return inspect()
+	})
+	go func() {
+		_ = s.Serve()
+		agentWriter.Close()
+	}()
+	client := agentproto.NewClient(reader, writer, writer)
+	defer client.Close()
+	assert.Equal(t, nil, client.Handshake(context.Background(), types.AgentName))
+
+	o, err := newObserver(context.Background(), client)
+	assert.Equal(t, nil, err)
+	msg, changed := o.Interfaces()
+	expected, err := inspect()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, expected, msg)
+
+	// the events replace the interfaces
+	updated := &types.Message{Interfaces: []types.Interface{{Name: "eth0", CIDRs: []string{"10.4.0.2/24"}, HWAddr: "02:42:0a:04:00:02"}}}
+	assert.Equal(t, nil, s.Notify(types.EventInterfaces, updated))
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("interfaces are not updated")
+	}
+	msg, _ = o.Interfaces()
+	assert.Equal(t, updated, msg)
+}
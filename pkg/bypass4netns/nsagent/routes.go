@@ -0,0 +1,89 @@
+package nsagent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"syscall"
+
+	"github.com/rootless-containers/bypass4netns/pkg/bypass4netns/nsagent/types"
+	"golang.org/x/sys/unix"
+)
+
+// listRoutes returns the unicast routes of the NS except the ones in the local table.
+// names maps the interface indexes to the names.
+func listRoutes(names map[int]string) ([]types.Route, error) {
+	b, err := syscall.NetlinkRIB(unix.RTM_GETROUTE, unix.AF_UNSPEC)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump routes: %w", err)
+	}
+	msgs, err := syscall.ParseNetlinkMessage(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse routes: %w", err)
+	}
+	return parseRoutes(msgs, names)
+}
+
+func parseRoutes(msgs []syscall.NetlinkMessage, names map[int]string) ([]types.Route, error) {
+	var routes []types.Route
+	for _, m := range msgs {
+		if m.Header.Type != unix.RTM_NEWROUTE {
+			continue
+		}
+		if len(m.Data) < unix.SizeofRtMsg {
+			return nil, fmt.Errorf("too short route message (%d bytes)", len(m.Data))
+		}
+		// struct rtmsg
+		family, dstLen, table, typ := m.Data[0], m.Data[1], m.Data[4], m.Data[7]
+		if typ != unix.RTN_UNICAST || (family != unix.AF_INET && family != unix.AF_INET6) {
+			continue
+		}
+		attrs, err := syscall.ParseNetlinkRouteAttr(&m)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse route attributes: %w", err)
+		}
+		route := types.Route{Table: int(table)}
+		dst := net.IPv4zero.To4()
+		if family == unix.AF_INET6 {
+			dst = net.IPv6zero
+		}
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case unix.RTA_DST:
+				dst = net.IP(attr.Value)
+			case unix.RTA_GATEWAY:
+				route.Gateway = net.IP(attr.Value).String()
+			case unix.RTA_OIF:
+				if len(attr.Value) == 4 {
+					route.Device = names[int(binary.NativeEndian.Uint32(attr.Value))]
+				}
+			case unix.RTA_TABLE:
+				// the table ID larger than 255 is only in the attribute
+				if len(attr.Value) == 4 {
+					route.Table = int(binary.NativeEndian.Uint32(attr.Value))
+				}
+			}
+		}
+		if route.Table == unix.RT_TABLE_LOCAL {
+			continue
+		}
+		ipNet := net.IPNet{IP: dst, Mask: net.CIDRMask(int(dstLen), len(dst)*8)}
+		route.Destination = ipNet.String()
+		routes = append(routes, route)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		a, b := routes[i], routes[j]
+		if a.Table != b.Table {
+			return a.Table < b.Table
+		}
+		if a.Destination != b.Destination {
+			return a.Destination < b.Destination
+		}
+		if a.Gateway != b.Gateway {
+			return a.Gateway < b.Gateway
+		}
+		return a.Device < b.Device
+	})
+	return routes, nil
+}
@@ -0,0 +1,78 @@
+package nsagent
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/rootless-containers/bypass4netns/pkg/bypass4netns/nsagent/types"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func routeAttr(typ uint16, value []byte) []byte {
+	b := make([]byte, unix.SizeofRtAttr, unix.SizeofRtAttr+len(value)+unix.NLMSG_ALIGNTO)
+	binary.NativeEndian.PutUint16(b[0:2], uint16(unix.SizeofRtAttr+len(value)))
+	binary.NativeEndian.PutUint16(b[2:4], typ)
+	b = append(b, value...)
+	for len(b)%unix.NLMSG_ALIGNTO != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func routeMessage(family, dstLen, table, typ uint8, attrs ...[]byte) syscall.NetlinkMessage {
+	data := make([]byte, unix.SizeofRtMsg)
+	data[0], data[1], data[4], data[7] = family, dstLen, table, typ
+	for _, attr := range attrs {
+		data = append(data, attr...)
+	}
+	return syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: unix.RTM_NEWROUTE, Len: uint32(unix.SizeofNlMsghdr + len(data))},
+		Data:   data,
+	}
+}
+
+func uint32Value(v uint32) []byte {
+	return binary.NativeEndian.AppendUint32(nil, v)
+}
+
+func TestParseRoutes(t *testing.T) {
+	names := map[int]string{1: "lo", 2: "eth0", 3: "wg0"}
+	msgs := []syscall.NetlinkMessage{
+		// default via 10.4.0.1 dev eth0
+		routeMessage(unix.AF_INET, 0, unix.RT_TABLE_MAIN, unix.RTN_UNICAST,
+			routeAttr(unix.RTA_GATEWAY, net.ParseIP("10.4.0.1").To4()),
+			routeAttr(unix.RTA_OIF, uint32Value(2))),
+		// 10.4.0.0/24 dev eth0
+		routeMessage(unix.AF_INET, 24, unix.RT_TABLE_MAIN, unix.RTN_UNICAST,
+			routeAttr(unix.RTA_DST, net.ParseIP("10.4.0.0").To4()),
+			routeAttr(unix.RTA_OIF, uint32Value(2))),
+		// 192.168.100.0/24 dev wg0 table 1000
+		routeMessage(unix.AF_INET, 24, unix.RT_TABLE_COMPAT, unix.RTN_UNICAST,
+			routeAttr(unix.RTA_DST, net.ParseIP("192.168.100.0").To4()),
+			routeAttr(unix.RTA_OIF, uint32Value(3)),
+			routeAttr(unix.RTA_TABLE, uint32Value(1000))),
+		// fd00::/64 dev eth0
+		routeMessage(unix.AF_INET6, 64, unix.RT_TABLE_MAIN, unix.RTN_UNICAST,
+			routeAttr(unix.RTA_DST, net.ParseIP("fd00::")),
+			routeAttr(unix.RTA_OIF, uint32Value(2))),
+		// local 127.0.0.1 dev lo table local
+		routeMessage(unix.AF_INET, 32, unix.RT_TABLE_LOCAL, unix.RTN_LOCAL,
+			routeAttr(unix.RTA_DST, net.ParseIP("127.0.0.1").To4()),
+			routeAttr(unix.RTA_OIF, uint32Value(1))),
+		// broadcast 10.4.0.255 dev eth0 table local
+		routeMessage(unix.AF_INET, 32, unix.RT_TABLE_LOCAL, unix.RTN_BROADCAST,
+			routeAttr(unix.RTA_DST, net.ParseIP("10.4.0.255").To4()),
+			routeAttr(unix.RTA_OIF, uint32Value(2))),
+	}
+	routes, err := parseRoutes(msgs, names)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []types.Route{
+		{Destination: "0.0.0.0/0", Gateway: "10.4.0.1", Device: "eth0", Table: unix.RT_TABLE_MAIN},
+		{Destination: "10.4.0.0/24", Device: "eth0", Table: unix.RT_TABLE_MAIN},
+		{Destination: "fd00::/64", Device: "eth0", Table: unix.RT_TABLE_MAIN},
+		{Destination: "192.168.100.0/24", Device: "wg0", Table: 1000},
+	}, routes)
+}
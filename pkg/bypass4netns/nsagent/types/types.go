@@ -1,10 +1,31 @@
 package types
 
+// AgentName is the name of the nsagent in the handshake
+const AgentName = "nsagent"
+
+const (
+	// MethodInspect returns the Message of the NS
+	MethodInspect = "inspect"
+	// EventInterfaces is sent with the Message when the links, the addresses, or the routes of the NS change
+	EventInterfaces = "interfaces"
+)
+
 type Message struct {
-	Interfaces []Interface `json:"interfaces"` // sorted by Name
+	Interfaces []Interface `json:"interfaces"`       // sorted by Name
+	Routes     []Route     `json:"routes,omitempty"` // sorted by Table, Destination, Gateway, and Device
 }
 
 type Interface struct {
-	Name  string   `json:"name"`  // "lo", "eth0", etc.
-	CIDRs []string `json:"cidrs"` // sorted as strings
+	Name     string   `json:"name"`               // "lo", "eth0", etc.
+	CIDRs    []string `json:"cidrs"`              // sorted as strings
+	HWAddr   string   `json:"hwaddr,omitempty"`   // empty if the interface does not have it, e.g. "lo"
+	Loopback bool     `json:"loopback,omitempty"` // true for "lo"
+}
+
+// Route is a unicast route of the NS. The routes in the local table are not included.
+type Route struct {
+	Destination string `json:"destination"`       // CIDR, "0.0.0.0/0" or "::/0" for the default routes
+	Gateway     string `json:"gateway,omitempty"` // empty if the destination is on the link
+	Device      string `json:"device,omitempty"`  // "eth0", etc.
+	Table       int    `json:"table"`             // 254 for the main table
 }
@@ -0,0 +1,125 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+type etcdRegistry struct {
+	client *clientv3.Client
+	prefix string
+	// leases are the last leases of the keys registered by this registry. protected by lock.
+	leases map[string]clientv3.LeaseID
+	lock   sync.Mutex
+}
+
+// NewEtcd creates the registry storing the keys with the prefix in etcd.
+// The values are attached to the leases of their TTL, and Unregister revokes the lease of the key instead of deleting it,
+// so that the key registered again by another registry with its own lease is kept.
+func NewEtcd(address, prefix string) (Registry, error) {
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints: []string{address},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create etcd client: %w", err)
+	}
+	return &etcdRegistry{
+		client: client,
+		prefix: prefix,
+		leases: map[string]clientv3.LeaseID{},
+	}, nil
+}
+
+func (r *etcdRegistry) Register(ctx context.Context, key, value string, ttl time.Duration) error {
+	// the TTL of the lease is in seconds
+	lease, err := r.client.Grant(ctx, int64((ttl+time.Second-1)/time.Second))
+	if err != nil {
+		return fmt.Errorf("failed to grant lease: %w", err)
+	}
+	if _, err := r.client.Put(ctx, r.prefix+key, value, clientv3.WithLease(lease.ID)); err != nil {
+		return err
+	}
+	r.lock.Lock()
+	prev, ok := r.leases[key]
+	r.leases[key] = lease.ID
+	r.lock.Unlock()
+	// the key is attached to the new lease, and the previous one is no longer used
+	if ok {
+		if err := r.revoke(ctx, prev); err != nil {
+			return fmt.Errorf("failed to revoke the previous lease: %w", err)
+		}
+	}
+	return nil
+}
+
+// revoke ignores the expired lease
+func (r *etcdRegistry) revoke(ctx context.Context, id clientv3.LeaseID) error {
+	if _, err := r.client.Revoke(ctx, id); err != nil && !errors.Is(err, rpctypes.ErrLeaseNotFound) {
+		return err
+	}
+	return nil
+}
+
+func (r *etcdRegistry) Lookup(ctx context.Context, key string) (string, error) {
+	res, err := r.client.Get(ctx, r.prefix+key)
+	if err != nil {
+		return "", err
+	}
+	if len(res.Kvs) == 0 {
+		return "", ErrNotFound
+	}
+	return string(res.Kvs[0].Value), nil
+}
+
+func (r *etcdRegistry) Watch(ctx context.Context) (<-chan Event, error) {
+	ch := make(chan Event)
+	wch := r.client.Watch(ctx, r.prefix, clientv3.WithPrefix())
+	go func() {
+		defer close(ch)
+		for res := range wch {
+			if err := res.Err(); err != nil {
+				return
+			}
+			for _, ev := range res.Events {
+				e := Event{Key: strings.TrimPrefix(string(ev.Kv.Key), r.prefix)}
+				switch ev.Type {
+				case clientv3.EventTypePut:
+					e.Type = EventTypePut
+					e.Value = string(ev.Kv.Value)
+				case clientv3.EventTypeDelete:
+					e.Type = EventTypeDelete
+				default:
+					continue
+				}
+				select {
+				case ch <- e:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func (r *etcdRegistry) Unregister(ctx context.Context, key, _ string) error {
+	r.lock.Lock()
+	id, ok := r.leases[key]
+	delete(r.leases, key)
+	r.lock.Unlock()
+	if !ok {
+		return nil
+	}
+	return r.revoke(ctx, id)
+}
+
+func (r *etcdRegistry) Close() error {
+	return r.client.Close()
+}
@@ -0,0 +1,265 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultWatchInterval is the interval to scan the directory for Watch of the file registry
+const DefaultWatchInterval = 1 * time.Second
+
+const (
+	// sweepInterval is the minimum interval of Register to remove the expired files in the directory
+	sweepInterval = 1 * time.Minute
+	// sweepGracePeriod is the time the files are kept after they expire, for the clocks of the hosts slightly out of sync
+	sweepGracePeriod = 1 * time.Minute
+)
+
+// fileEntry is the content of the file of a key
+type fileEntry struct {
+	Value     string    `json:"value"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// fileRegistry stores each key as a file in the directory shared between the hosts.
+// The files are replaced atomically with rename(2), and the expired files are regarded as removed.
+// The expired files are removed by Register of any host after sweepGracePeriod.
+// The expiration depends on the clocks of the hosts, so they need to be synchronized.
+type fileRegistry struct {
+	dir           string
+	watchInterval time.Duration
+	now           func() time.Time
+
+	// lastSweep is the last time Register removed the expired files. protected by sweepLock.
+	lastSweep time.Time
+	sweepLock sync.Mutex
+}
+
+// NewFile creates the registry in the directory. The directory is created if it does not exist.
+func NewFile(dir string) (Registry, error) {
+	return newFile(dir)
+}
+
+func newFile(dir string) (*fileRegistry, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create registry directory: %w", err)
+	}
+	return &fileRegistry{
+		dir:           dir,
+		watchInterval: DefaultWatchInterval,
+		now:           time.Now,
+	}, nil
+}
+
+// path returns the file of the key. The keys are escaped to be a file name, e.g. "[2001:db8::1]:80".
+func (r *fileRegistry) path(key string) string {
+	return filepath.Join(r.dir, url.PathEscape(key))
+}
+
+func (r *fileRegistry) Register(_ context.Context, key, value string, ttl time.Duration) error {
+	b, err := json.Marshal(&fileEntry{Value: value, ExpiresAt: r.now().Add(ttl)})
+	if err != nil {
+		return err
+	}
+	// the temporary files start with "." to be ignored by Watch
+	f, err := os.CreateTemp(r.dir, "."+url.PathEscape(key)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0o644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), r.path(key)); err != nil {
+		return err
+	}
+	r.sweep()
+	return nil
+}
+
+// sweep removes the files expired before sweepGracePeriod, at most once in sweepInterval.
+// The files of the processes killed without unregistering them would remain otherwise.
+func (r *fileRegistry) sweep() {
+	r.sweepLock.Lock()
+	defer r.sweepLock.Unlock()
+	now := r.now()
+	if now.Sub(r.lastSweep) < sweepInterval {
+		return
+	}
+	r.lastSweep = now
+
+	dirEntries, err := os.ReadDir(r.dir)
+	if err != nil {
+		logrus.WithError(err).Warnf("failed to scan registry directory %q", r.dir)
+		return
+	}
+	for _, de := range dirEntries {
+		if strings.HasPrefix(de.Name(), ".") || !de.Type().IsRegular() {
+			continue
+		}
+		path := filepath.Join(r.dir, de.Name())
+		e, err := r.readEntry(path)
+		if err != nil || now.Before(e.ExpiresAt.Add(sweepGracePeriod)) {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logrus.WithError(err).Warnf("failed to remove expired %q in registry directory", de.Name())
+		}
+	}
+}
+
+func (r *fileRegistry) Lookup(_ context.Context, key string) (string, error) {
+	e, err := r.read(r.path(key))
+	if err != nil {
+		return "", err
+	}
+	return e.Value, nil
+}
+
+// read returns ErrNotFound when the file does not exist or is expired
+func (r *fileRegistry) read(path string) (*fileEntry, error) {
+	e, err := r.readEntry(path)
+	if err != nil {
+		return nil, err
+	}
+	if !r.now().Before(e.ExpiresAt) {
+		return nil, ErrNotFound
+	}
+	return e, nil
+}
+
+// readEntry returns ErrNotFound when the file does not exist. The expired entry is returned as well.
+func (r *fileRegistry) readEntry(path string) (*fileEntry, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	var e fileEntry
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, fmt.Errorf("invalid entry %q: %w", path, err)
+	}
+	return &e, nil
+}
+
+// Watch scans the directory every watchInterval, as the changes on the other hosts are not notified by inotify on NFS
+func (r *fileRegistry) Watch(ctx context.Context) (<-chan Event, error) {
+	entries, err := r.list()
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan Event)
+	go func() {
+		defer close(ch)
+		ticker := time.NewTicker(r.watchInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			newEntries, err := r.list()
+			if err != nil {
+				logrus.WithError(err).Warnf("failed to scan registry directory %q", r.dir)
+				continue
+			}
+			for _, e := range diffEntries(entries, newEntries) {
+				select {
+				case ch <- e:
+				case <-ctx.Done():
+					return
+				}
+			}
+			entries = newEntries
+		}
+	}()
+	return ch, nil
+}
+
+// list returns the values of the keys not expired
+func (r *fileRegistry) list() (map[string]string, error) {
+	dirEntries, err := os.ReadDir(r.dir)
+	if err != nil {
+		return nil, err
+	}
+	entries := map[string]string{}
+	for _, de := range dirEntries {
+		if strings.HasPrefix(de.Name(), ".") || !de.Type().IsRegular() {
+			continue
+		}
+		key, err := url.PathUnescape(de.Name())
+		if err != nil {
+			continue
+		}
+		e, err := r.read(filepath.Join(r.dir, de.Name()))
+		if err != nil {
+			if !errors.Is(err, ErrNotFound) {
+				logrus.WithError(err).Debugf("ignoring %q in registry directory", de.Name())
+			}
+			continue
+		}
+		entries[key] = e.Value
+	}
+	return entries, nil
+}
+
+func diffEntries(prev, cur map[string]string) []Event {
+	var events []Event
+	for k, v := range cur {
+		if prevV, ok := prev[k]; !ok || prevV != v {
+			events = append(events, Event{Type: EventTypePut, Key: k, Value: v})
+		}
+	}
+	for k := range prev {
+		if _, ok := cur[k]; !ok {
+			events = append(events, Event{Type: EventTypeDelete, Key: k})
+		}
+	}
+	return events
+}
+
+// Unregister removes the file only when it has the value.
+// The file replaced by another host between reading and removing it is removed as well,
+// and it is registered again by the host within the TTL.
+func (r *fileRegistry) Unregister(_ context.Context, key, value string) error {
+	path := r.path(key)
+	e, err := r.readEntry(path)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	if e.Value != value {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (r *fileRegistry) Close() error {
+	return nil
+}
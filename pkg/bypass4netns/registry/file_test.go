@@ -0,0 +1,133 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileRegistry(t *testing.T) {
+	r, err := newFile(t.TempDir())
+	assert.Equal(t, nil, err)
+	now := time.Unix(1000, 0)
+	r.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	_, err = r.Lookup(ctx, "10.4.0.2:80")
+	assert.Equal(t, ErrNotFound, err)
+
+	assert.Equal(t, nil, r.Register(ctx, "10.4.0.2:80", "192.168.1.1:8080", 15*time.Second))
+	assert.Equal(t, nil, r.Register(ctx, "[2001:db8::2]:80", "192.168.1.1:8081", 30*time.Second))
+	v, err := r.Lookup(ctx, "10.4.0.2:80")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "192.168.1.1:8080", v)
+	v, err = r.Lookup(ctx, "[2001:db8::2]:80")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "192.168.1.1:8081", v)
+
+	// registering again replaces the value and extends the TTL
+	now = now.Add(10 * time.Second)
+	assert.Equal(t, nil, r.Register(ctx, "10.4.0.2:80", "192.168.1.2:8080", 15*time.Second))
+	now = now.Add(10 * time.Second)
+	v, err = r.Lookup(ctx, "10.4.0.2:80")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "192.168.1.2:8080", v)
+
+	// expired
+	now = now.Add(10 * time.Second)
+	_, err = r.Lookup(ctx, "10.4.0.2:80")
+	assert.Equal(t, ErrNotFound, err)
+
+	// the key registered again by another host is kept
+	assert.Equal(t, nil, r.Register(ctx, "[2001:db8::2]:80", "192.168.1.1:8081", 30*time.Second))
+	assert.Equal(t, nil, r.Unregister(ctx, "[2001:db8::2]:80", "192.168.1.2:8081"))
+	v, err = r.Lookup(ctx, "[2001:db8::2]:80")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "192.168.1.1:8081", v)
+
+	assert.Equal(t, nil, r.Unregister(ctx, "[2001:db8::2]:80", "192.168.1.1:8081"))
+	_, err = r.Lookup(ctx, "[2001:db8::2]:80")
+	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, nil, r.Unregister(ctx, "[2001:db8::2]:80", "192.168.1.1:8081"))
+}
+
+func TestFileRegistrySweep(t *testing.T) {
+	dir := t.TempDir()
+	r, err := newFile(dir)
+	assert.Equal(t, nil, err)
+	now := time.Unix(1000, 0)
+	r.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	assert.Equal(t, nil, r.Register(ctx, "10.4.0.2:80", "192.168.1.1:8080", 15*time.Second))
+	assert.Equal(t, nil, r.Register(ctx, "10.4.0.3:80", "192.168.1.1:8081", sweepInterval+sweepGracePeriod))
+
+	// the expired files are kept for the grace period
+	now = now.Add(sweepInterval)
+	assert.Equal(t, nil, r.Register(ctx, "10.4.0.4:80", "192.168.1.1:8082", time.Hour))
+	_, err = os.Stat(r.path("10.4.0.2:80"))
+	assert.Equal(t, nil, err)
+
+	// the files expired before the grace period are removed by Register
+	now = now.Add(sweepInterval)
+	assert.Equal(t, nil, r.Register(ctx, "10.4.0.4:80", "192.168.1.1:8082", time.Hour))
+	_, err = os.Stat(r.path("10.4.0.2:80"))
+	assert.Equal(t, true, errors.Is(err, os.ErrNotExist))
+	_, err = os.Stat(r.path("10.4.0.3:80"))
+	assert.Equal(t, nil, err)
+	_, err = os.Stat(r.path("10.4.0.4:80"))
+	assert.Equal(t, nil, err)
+}
+
+func TestFileRegistryWatch(t *testing.T) {
+	dir := t.TempDir()
+	r, err := newFile(dir)
+	assert.Equal(t, nil, err)
+	r.watchInterval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the registry on another host sharing the directory
+	other, err := newFile(dir)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, other.Register(ctx, "10.4.0.2:80", "192.168.1.1:8080", time.Minute))
+
+	ch, err := r.Watch(ctx)
+	assert.Equal(t, nil, err)
+
+	// the keys registered before Watch are not sent
+	assert.Equal(t, nil, other.Register(ctx, "10.4.0.3:80", "192.168.1.1:8081", time.Minute))
+	assert.Equal(t, Event{Type: EventTypePut, Key: "10.4.0.3:80", Value: "192.168.1.1:8081"}, receiveEvent(t, ch))
+
+	assert.Equal(t, nil, other.Unregister(ctx, "10.4.0.2:80", "192.168.1.1:8080"))
+	assert.Equal(t, Event{Type: EventTypeDelete, Key: "10.4.0.2:80"}, receiveEvent(t, ch))
+
+	assert.Equal(t, nil, other.Register(ctx, "10.4.0.3:80", "192.168.1.1:8081", 50*time.Millisecond))
+	assert.Equal(t, Event{Type: EventTypeDelete, Key: "10.4.0.3:80"}, receiveEvent(t, ch))
+
+	cancel()
+	for range ch {
+	}
+}
+
+func receiveEvent(t *testing.T, ch <-chan Event) Event {
+	select {
+	case e := <-ch:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+		return Event{}
+	}
+}
+
+func TestParseBackend(t *testing.T) {
+	b, err := ParseBackend("file")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, BackendFile, b)
+	_, err = ParseBackend("consul")
+	assert.NotEqual(t, nil, err)
+}
@@ -0,0 +1,92 @@
+// Package registry implements the registry of the container addresses for multinode communication.
+// Each bypass4netns registers the addresses of its container with the host address forwarding to them,
+// and looks up the addresses of the containers on the other hosts.
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrNotFound is returned by Lookup when the key is not registered or expired
+var ErrNotFound = errors.New("not found in the registry")
+
+// Registry stores the values with TTL, shared between the hosts
+type Registry interface {
+	// Register stores the value. It is removed after ttl unless it is registered again.
+	Register(ctx context.Context, key, value string, ttl time.Duration) error
+	// Lookup returns the value, or ErrNotFound
+	Lookup(ctx context.Context, key string) (string, error)
+	// Watch sends the changes of the keys until ctx is done. The channel is closed when the watch stops.
+	Watch(ctx context.Context) (<-chan Event, error)
+	// Unregister removes the key registered with the value by this registry.
+	// The key is kept when it has been registered again by another one, e.g. a container on another host has the address now.
+	// It is not an error if the key is not registered.
+	Unregister(ctx context.Context, key, value string) error
+	Close() error
+}
+
+type EventType string
+
+const (
+	EventTypePut    EventType = "put"
+	EventTypeDelete EventType = "delete"
+)
+
+type Event struct {
+	Type EventType
+	Key  string
+	// Value is empty for EventTypeDelete
+	Value string
+}
+
+// Backend is the kind of the registry
+type Backend string
+
+const (
+	// BackendEtcd stores the values in etcd, leased for TTL
+	BackendEtcd Backend = "etcd"
+	// BackendFile stores the values as the files in a directory shared between the hosts, e.g. on NFS
+	BackendFile Backend = "file"
+)
+
+// DefaultBackend is the default of Backend
+const DefaultBackend = BackendEtcd
+
+func ParseBackend(s string) (Backend, error) {
+	switch b := Backend(s); b {
+	case BackendEtcd, BackendFile:
+		return b, nil
+	}
+	return "", fmt.Errorf("unknown registry %q, expected %q or %q", s, BackendEtcd, BackendFile)
+}
+
+// Config is the configuration of New
+type Config struct {
+	Backend Backend
+	// EtcdAddress is the address of etcd for BackendEtcd
+	EtcdAddress string
+	// EtcdPrefix is prepended to the keys in etcd
+	EtcdPrefix string
+	// Dir is the shared directory for BackendFile
+	Dir string
+}
+
+// New creates the registry of the backend. DefaultBackend is used if the backend is empty.
+func New(cfg Config) (Registry, error) {
+	switch cfg.Backend {
+	case BackendEtcd, "":
+		if cfg.EtcdAddress == "" {
+			return nil, errors.New("etcd address is not specified")
+		}
+		return NewEtcd(cfg.EtcdAddress, cfg.EtcdPrefix)
+	case BackendFile:
+		if cfg.Dir == "" {
+			return nil, errors.New("registry directory is not specified")
+		}
+		return NewFile(cfg.Dir)
+	}
+	return nil, fmt.Errorf("unknown registry %q", cfg.Backend)
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"net"
+	"strconv"
 	"syscall"
 )
 
@@ -16,8 +17,9 @@ type sockaddr struct {
 	ScopeID  uint32 // sin6_scope_id
 }
 
+// String returns the address in the form of "192.168.1.1:1000" or "[2001:db8::1]:1000"
 func (sa *sockaddr) String() string {
-	return fmt.Sprintf("%s:%d", sa.IP, sa.Port)
+	return net.JoinHostPort(sa.IP.String(), strconv.Itoa(sa.Port))
 }
 
 func newSockaddr(buf []byte) (*sockaddr, error) {
@@ -51,3 +51,13 @@ func TestSerializeDeserializeSockaddr6(t *testing.T) {
 	assert.Equal(t, sa.Flowinfo, uint32(0x12345678))
 	assert.Equal(t, sa.ScopeID, uint32(0x9abcdef0))
 }
+
+func TestSockaddrString(t *testing.T) {
+	sa := sockaddr{IP: net.ParseIP("192.168.1.100").To4(), Port: 80}
+	assert.Equal(t, "192.168.1.100:80", sa.String())
+	sa = sockaddr{IP: net.ParseIP("2001:db8::1"), Port: 80}
+	assert.Equal(t, "[2001:db8::1]:80", sa.String())
+	// IPv4-mapped address is the same as the IPv4 address
+	sa = sockaddr{IP: net.ParseIP("::ffff:192.168.1.100"), Port: 80}
+	assert.Equal(t, "192.168.1.100:80", sa.String())
+}
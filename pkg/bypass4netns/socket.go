@@ -1,14 +1,10 @@
 package bypass4netns
 
 import (
-	gocontext "context"
 	"encoding/binary"
 	"fmt"
 	"net"
-	"strconv"
-	"strings"
 	"syscall"
-	"time"
 	"unsafe"
 
 	"github.com/sirupsen/logrus"
@@ -83,6 +79,8 @@ type socketStatus struct {
 
 	logger     *logrus.Entry
 	ignoreBind bool
+	// counted is true when the socket is counted in the stats
+	counted bool
 }
 
 func newSocketStatus(pid int, sockfd int, sockDomain, sockType, sockProto int, ignoreBind bool) *socketStatus {
@@ -157,6 +155,10 @@ func (ss *socketStatus) handleSysConnect(handler *notifHandler, ctx *context) {
 		newDestAddr[3] = 1
 	case syscall.AF_INET6:
 		newDestAddr = net.IPv6loopback
+		// IPv4-mapped address is connected via IPv4
+		if destAddr.IP.To4() != nil {
+			newDestAddr = net.IPv4(127, 0, 0, 1)
+		}
 		newDestAddr = newDestAddr.To16()
 	default:
 		ss.logger.Errorf("unexpected destination address family %d", destAddr.Family)
@@ -171,53 +173,43 @@ func (ss *socketStatus) handleSysConnect(handler *notifHandler, ctx *context) {
 	var fwdPort ForwardPortMapping
 	if !ss.ignoreBind {
 		var ok bool
-		fwdPort, ok = handler.forwardingPorts[int(destAddr.Port)]
+		fwdPort, ok = handler.getForwardingPort(int(destAddr.Port))
 		if ok {
 			if destAddr.IP.IsLoopback() {
 				ss.logger.Infof("destination address %v is loopback and bypassed", destAddr)
 				connectToLoopback = true
-			} else if contIf, ok := handler.containerInterfaces[destAddr.String()]; ok && contIf.containerID == handler.state.State.ID {
+			} else if contIf, ok := handler.getContainerInterface(destAddr.String()); ok && contIf.containerID == handler.state.State.ID {
 				ss.logger.Infof("destination address %v is interface's address and bypassed", destAddr)
 				connectToInterface = true
 			}
 		}
 	}
+	// the listener of another container in the network namespace is moved to the host
+	if !connectToLoopback && !connectToInterface {
+		if p, ok := handler.getNetNSForwardingPort(destAddr.IP, int(destAddr.Port)); ok {
+			ss.logger.Infof("destination address %v is forwarded by another container in the network namespace and bypassed", destAddr)
+			fwdPort = p
+			if destAddr.IP.IsLoopback() {
+				connectToLoopback = true
+			} else {
+				connectToInterface = true
+			}
+		}
+	}
 
 	if handler.multinode.Enable && destAddr.IP.IsPrivate() {
 		// currently, only private addresses are available in multinode communication.
-		key := ETCD_MULTINODE_PREFIX + destAddr.String()
-		ctx, cancel := gocontext.WithTimeout(gocontext.Background(), 2*time.Second)
-		res, err := handler.multinode.etcdClient.Get(ctx, ETCD_MULTINODE_PREFIX+destAddr.String())
-		cancel()
+		hostAddr, hostPort, err := handler.lookupMultinodeAddress(destAddr.String())
 		if err != nil {
-			ss.logger.WithError(err).Warnf("destination address %q is not registered", key)
+			ss.logger.WithError(err).Warnf("destination address %v is not registered", destAddr)
 		} else {
-			if len(res.Kvs) != 1 {
-				ss.logger.Errorf("invalid len(res.Kvs) %d", len(res.Kvs))
-				ss.state = Error
-				return
-			}
-			hostAddrWithPort := string(res.Kvs[0].Value)
-			hostAddrs := strings.Split(hostAddrWithPort, ":")
-			if len(hostAddrs) != 2 {
-				ss.logger.Errorf("invalid address format %q", hostAddrWithPort)
-				ss.state = Error
-				return
-			}
-			hostAddr := hostAddrs[0]
-			hostPort, err := strconv.Atoi(hostAddrs[1])
-			if err != nil {
-				ss.logger.Errorf("invalid address format %q", hostAddrWithPort)
-				ss.state = Error
-				return
-			}
-			newDestAddr = net.ParseIP(hostAddr)
+			newDestAddr = hostAddr
 			fwdPort.HostPort = hostPort
 			connectToOtherBypassedContainer = true
 			ss.logger.Infof("destination address %v is container address and bypassed via overlay network", destAddr)
 		}
 	} else if handler.c2cConnections.Enable {
-		contIf, ok := handler.containerInterfaces[destAddr.String()]
+		contIf, ok := handler.getContainerInterface(destAddr.String())
 		if ok {
 			ss.logger.Infof("destination address %v is container address and bypassed", destAddr)
 			fwdPort.HostPort = contIf.hostPort
@@ -323,7 +315,7 @@ func (ss *socketStatus) handleSysBind(pid int, handler *notifHandler, ctx *conte
 	ss.logger.Infof("handle port=%d, ip=%v", sa.Port, sa.IP)
 
 	// TODO: get port-fowrad mapping from nerdctl
-	fwdPort, ok := handler.forwardingPorts[int(sa.Port)]
+	fwdPort, ok := handler.getForwardingPort(int(sa.Port))
 	if !ok {
 		ss.logger.Infof("port=%d is not target of port forwarding.", sa.Port)
 		ss.state = NotBypassable
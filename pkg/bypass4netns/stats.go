@@ -0,0 +1,98 @@
+package bypass4netns
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rootless-containers/bypass4netns/pkg/api"
+	"github.com/rootless-containers/bypass4netns/pkg/api/com"
+)
+
+// names of the background tasks reported to bypass4netnsd
+const (
+	taskC2C       = "c2c"
+	taskMultinode = "multinode"
+	taskPortSync  = "portSync"
+)
+
+// handlerStats is reported to bypass4netnsd by the stats task
+type handlerStats struct {
+	bypassed      atomic.Uint64
+	nonBypassable atomic.Uint64
+	errors        atomic.Uint64
+
+	tasksLock sync.Mutex
+	tasks     map[string]api.TaskHealth
+}
+
+func newHandlerStats() *handlerStats {
+	return &handlerStats{
+		tasks: map[string]api.TaskHealth{},
+	}
+}
+
+// recordSocket counts the socket by its state after bind(2) or connect(2).
+// The socket is counted once, when its state is no longer NotBypassed.
+func (s *handlerStats) recordSocket(sock *socketStatus) {
+	if sock.counted {
+		return
+	}
+	switch sock.state {
+	case Bypassed:
+		s.bypassed.Add(1)
+	case NotBypassable:
+		s.nonBypassable.Add(1)
+	case Error:
+		s.errors.Add(1)
+	default:
+		return
+	}
+	sock.counted = true
+}
+
+func (s *handlerStats) taskSucceeded(name string) {
+	s.tasksLock.Lock()
+	defer s.tasksLock.Unlock()
+
+	now := time.Now()
+	task := s.tasks[name]
+	task.Name = name
+	task.LastSuccess = &now
+	s.tasks[name] = task
+}
+
+func (s *handlerStats) taskFailed(name string, err error) {
+	s.tasksLock.Lock()
+	defer s.tasksLock.Unlock()
+
+	now := time.Now()
+	task := s.tasks[name]
+	task.Name = name
+	task.LastError = err.Error()
+	task.LastErrorTime = &now
+	s.tasks[name] = task
+}
+
+func (s *handlerStats) toComStats(containerID string) *com.Stats {
+	stats := &com.Stats{
+		ContainerID: containerID,
+		Tasks:       []api.TaskHealth{},
+		Sockets: api.SocketStats{
+			Bypassed:      s.bypassed.Load(),
+			NonBypassable: s.nonBypassable.Load(),
+			Error:         s.errors.Load(),
+		},
+	}
+
+	s.tasksLock.Lock()
+	defer s.tasksLock.Unlock()
+	for _, task := range s.tasks {
+		stats.Tasks = append(stats.Tasks, task)
+	}
+	sort.Slice(stats.Tasks, func(i, j int) bool {
+		return stats.Tasks[i].Name < stats.Tasks[j].Name
+	})
+	return stats
+}
@@ -0,0 +1,30 @@
+package bypass4netns
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordSocket(t *testing.T) {
+	s := newHandlerStats()
+	sock := newSocketStatus(1, 3, 0, 0, 0, false)
+
+	// the socket is not counted until its state is final
+	s.recordSocket(sock)
+	assert.Equal(t, uint64(0), s.toComStats("container0").Sockets.NonBypassable)
+
+	sock.state = NotBypassable
+	s.recordSocket(sock)
+	s.recordSocket(sock)
+	stats := s.toComStats("container0")
+	assert.Equal(t, uint64(1), stats.Sockets.NonBypassable)
+	assert.Equal(t, uint64(0), stats.Sockets.Bypassed)
+
+	other := newSocketStatus(1, 4, 0, 0, 0, false)
+	other.state = Bypassed
+	s.recordSocket(other)
+	stats = s.toComStats("container0")
+	assert.Equal(t, uint64(1), stats.Sockets.Bypassed)
+	assert.Equal(t, uint64(1), stats.Sockets.NonBypassable)
+}
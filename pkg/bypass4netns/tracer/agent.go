@@ -3,105 +3,153 @@ package tracer
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"sync"
 	"time"
 
+	"github.com/rootless-containers/bypass4netns/pkg/bypass4netns/agentproto"
 	"github.com/sirupsen/logrus"
 )
 
-type TracerCommand struct {
-	Cmd                TracerCmd `json:"tracerCmd"`
-	ForwardingPorts    []int     `json:"forwardingPorts,omitempty"`
-	DestinationAddress []string  `json:"destinationAddress,omitempty"`
+// AgentName is the name of the tracer agent in the handshake
+const AgentName = "tracer"
+
+const (
+	// MethodRegisterForwardPorts listens on the ports. The payload is RegisterForwardPortsRequest.
+	MethodRegisterForwardPorts = "registerForwardPorts"
+	// MethodConnect tries to connect to the addresses. The payload is ConnectRequest and the response is ConnectResponse.
+	MethodConnect = "connect"
+)
+
+type RegisterForwardPortsRequest struct {
+	Ports []int `json:"ports"`
 }
 
-type TracerCmd int
+type ConnectRequest struct {
+	Addresses []string `json:"addresses"`
+	// Timeout is the timeout of each connection to Addresses
+	Timeout time.Duration `json:"timeout,omitempty"`
+}
+
+type ConnectResponse struct {
+	// Addresses are the connected addresses
+	Addresses []string `json:"addresses"`
+}
 
 const (
-	Ok TracerCmd = iota
-	RegisterForwardPorts
-	ConnectToAddress
+	// DefaultConnectTimeout is the timeout of each connection when ConnectRequest.Timeout is not specified
+	DefaultConnectTimeout = 10 * time.Millisecond
+	// maxConcurrentConnections limits the connections tried at the same time
+	maxConcurrentConnections = 32
 )
 
 func Main() error {
-	r := os.Stdin
-	w := os.Stdout
-	dec := json.NewDecoder(r)
-	for {
-		var cmd TracerCommand
-		err := dec.Decode(&cmd)
-		if err != nil {
-			logrus.WithError(err).Errorf("failed to decode")
-			break
-		}
-		logrus.Infof("decoded = %v", cmd)
-		switch cmd.Cmd {
-		case RegisterForwardPorts:
-			for _, p := range cmd.ForwardingPorts {
-				readyChan := make(chan bool)
-				go func(port int, c chan bool) {
-					err := listenLoop(port, c)
-					if err != nil {
-						logrus.WithError(err).Errorf("failed to listen on port %d", port)
-					}
-				}(p, readyChan)
-				<-readyChan
-			}
-			cmd = TracerCommand{
-				Cmd: Ok,
-			}
-		case ConnectToAddress:
-			addrs := []string{}
-			for i := range cmd.DestinationAddress {
-				addr := cmd.DestinationAddress[i]
-				err = tryToConnect(addr)
-				if err != nil {
-					logrus.WithError(err).Warnf("failed to connect to %s", addr)
-					continue
-				}
-				addrs = append(addrs, addr)
-			}
-			cmd = TracerCommand{
-				Cmd:                Ok,
-				DestinationAddress: addrs,
-			}
-		}
+	if err := serve(os.Stdin, os.Stdout); err != nil {
+		return err
+	}
+	logrus.Infof("Exit.")
+	return nil
+}
 
-		m, err := json.Marshal(cmd)
-		if err != nil {
-			logrus.WithError(err).Errorf("failed to encode")
+type agent struct {
+	// key is port
+	listening map[int]bool
+	lock      sync.Mutex
+}
+
+// serve handles the requests from r until r is closed
+func serve(r io.Reader, w io.Writer) error {
+	a := &agent{
+		listening: map[int]bool{},
+	}
+	s := agentproto.NewServer(r, w, AgentName)
+	s.Handle(MethodRegisterForwardPorts, a.registerForwardPorts)
+	s.Handle(MethodConnect, a.connect)
+	return s.Serve()
+}
+
+func (a *agent) registerForwardPorts(payload json.RawMessage) (interface{}, error) {
+	var req RegisterForwardPortsRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, err
+	}
+	logrus.Infof("registering ports %v", req.Ports)
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, p := range req.Ports {
+		if a.listening[p] {
+			continue
 		}
-		_, err = w.Write(m)
+		l, err := net.Listen("tcp", fmt.Sprintf(":%d", p))
 		if err != nil {
-			logrus.WithError(err).Errorf("failed to write")
+			logrus.WithError(err).Errorf("failed to listen on port %d", p)
+			continue
 		}
+		a.listening[p] = true
+		logrus.Infof("started to listen on port %d", p)
+		go acceptLoop(l)
 	}
-
-	logrus.Infof("Exit.")
-	return nil
+	return nil, nil
 }
 
-func listenLoop(port int, readyChan chan bool) error {
-	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
-	if err != nil {
-		return err
+func (a *agent) connect(payload json.RawMessage) (interface{}, error) {
+	var req ConnectRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, err
 	}
-	defer l.Close()
+	timeout := req.Timeout
+	if timeout <= 0 {
+		timeout = DefaultConnectTimeout
+	}
+	return &ConnectResponse{Addresses: tryToConnectAll(req.Addresses, timeout)}, nil
+}
 
-	readyChan <- true
-	logrus.Infof("started to listen on port %d", port)
+func acceptLoop(l net.Listener) {
+	defer l.Close()
 	for {
 		conn, err := l.Accept()
 		if err != nil {
-			return err
+			logrus.WithError(err).Errorf("failed to accept on %s", l.Addr())
+			return
 		}
 		conn.Close()
 	}
 }
 
-func tryToConnect(addr string) error {
-	conn, err := net.DialTimeout("tcp", addr, 10*time.Millisecond)
+// tryToConnectAll tries to connect to the addresses in parallel and returns the connected ones in the given order
+func tryToConnectAll(addrs []string, timeout time.Duration) []string {
+	connected := make([]bool, len(addrs))
+	sem := make(chan struct{}, maxConcurrentConnections)
+	var wg sync.WaitGroup
+	for i, addr := range addrs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := tryToConnect(addr, timeout); err != nil {
+				logrus.WithError(err).Warnf("failed to connect to %s", addr)
+				return
+			}
+			connected[i] = true
+		}()
+	}
+	wg.Wait()
+
+	res := []string{}
+	for i, addr := range addrs {
+		if connected[i] {
+			res = append(res, addr)
+		}
+	}
+	return res
+}
+
+func tryToConnect(addr string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
 	if err != nil {
 		return err
 	}
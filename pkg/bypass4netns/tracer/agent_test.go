@@ -0,0 +1,66 @@
+package tracer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rootless-containers/bypass4netns/pkg/bypass4netns/agentproto"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestTracer(t *testing.T) *Tracer {
+	x := NewTracer("")
+	agentReader, writer := io.Pipe()
+	reader, agentWriter := io.Pipe()
+	go func() {
+		_ = serve(agentReader, agentWriter)
+		agentWriter.Close()
+	}()
+	x.client = agentproto.NewClient(reader, writer, writer)
+	t.Cleanup(func() {
+		x.client.Close()
+	})
+	assert.Equal(t, nil, x.client.Handshake(context.Background(), AgentName))
+	return x
+}
+
+func TestConnectToAddress(t *testing.T) {
+	x := newTestTracer(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	defer l.Close()
+	go acceptLoop(l)
+	// the port is closed
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	closed.Close()
+
+	addrs := []string{closed.Addr().String(), l.Addr().String()}
+	for i := 0; i < 50; i++ {
+		addrs = append(addrs, l.Addr().String())
+	}
+	res, err := x.ConnectToAddress(addrs, 200*time.Millisecond)
+	assert.Equal(t, nil, err)
+	// the connected addresses are returned in the given order
+	assert.Equal(t, addrs[1:], res)
+}
+
+func TestRegisterForwardPorts(t *testing.T) {
+	x := newTestTracer(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	assert.Equal(t, nil, x.RegisterForwardPorts([]int{port}))
+	// registering the port again does not fail
+	assert.Equal(t, nil, x.RegisterForwardPorts([]int{port}))
+	addr := net.JoinHostPort("127.0.0.1", fmt.Sprint(port))
+	res, err := x.ConnectToAddress([]string{addr}, 0)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{addr}, res)
+}
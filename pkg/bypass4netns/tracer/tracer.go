@@ -2,14 +2,15 @@ package tracer
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
-	"strconv"
 	"sync"
+	"time"
 
+	"github.com/rootless-containers/bypass4netns/pkg/bypass4netns/agentproto"
+	"github.com/rootless-containers/bypass4netns/pkg/nsenter"
 	"github.com/rootless-containers/bypass4netns/pkg/util"
 	"golang.org/x/sys/unix"
 )
@@ -17,8 +18,9 @@ import (
 type Tracer struct {
 	logPath   string
 	tracerCmd *exec.Cmd
-	reader    io.Reader
-	writer    io.Writer
+	client    *agentproto.Client
+	// ipv6 is true when the tracer can connect via IPv6
+	ipv6 bool
 
 	lock sync.Mutex
 }
@@ -32,106 +34,74 @@ func NewTracer(logPath string) *Tracer {
 
 // StartTracer starts tracer in NS associated with the PID.
 func (x *Tracer) StartTracer(ctx context.Context, pid int) error {
-	selfExe, err := os.Executable()
+	selfExe, err := util.AgentExecutable()
 	if err != nil {
 		return err
 	}
-	nsenter, err := exec.LookPath("nsenter")
+	x.tracerCmd, err = nsenter.Command(ctx, pid, unix.CLONE_NEWNET, selfExe, "--tracer-agent", "--log-file", x.logPath)
 	if err != nil {
 		return err
 	}
-	nsenterFlags := []string{
-		"-t", strconv.Itoa(pid),
-		"-F",
-		"-n",
-	}
-	selfPid := os.Getpid()
-	ok, err := util.SameUserNS(pid, selfPid)
-	if err != nil {
-		return fmt.Errorf("failed to check sameUserNS(%d, %d)", pid, selfPid)
-	}
-	if !ok {
-		nsenterFlags = append(nsenterFlags, "-U", "--preserve-credentials")
-	}
-	nsenterFlags = append(nsenterFlags, "--", selfExe, "--tracer-agent", "--log-file", x.logPath)
-	x.tracerCmd = exec.CommandContext(ctx, nsenter, nsenterFlags...)
 	x.tracerCmd.SysProcAttr = &unix.SysProcAttr{
 		Pdeathsig: unix.SIGTERM,
 	}
 	x.tracerCmd.Stderr = os.Stderr
-	x.reader, x.tracerCmd.Stdout = io.Pipe()
-	x.tracerCmd.Stdin, x.writer = io.Pipe()
-	if err := x.tracerCmd.Start(); err != nil {
-		return fmt.Errorf("failed to start %v: %w", x.tracerCmd.Args, err)
-	}
-	return nil
-}
-
-func (x *Tracer) RegisterForwardPorts(ports []int) error {
-	cmd := TracerCommand{
-		Cmd:             RegisterForwardPorts,
-		ForwardingPorts: ports,
-	}
-
-	m, err := json.Marshal(cmd)
-	if err != nil {
-		return err
-	}
-
-	writeSize, err := x.writer.Write(m)
+	r, w := io.Pipe()
+	x.tracerCmd.Stdout = w
+	stdin, err := x.tracerCmd.StdinPipe()
 	if err != nil {
 		return err
 	}
-	if writeSize != len(m) {
-		return fmt.Errorf("unexpected written size expected=%d actual=%d", len(m), writeSize)
-	}
-
-	dec := json.NewDecoder(x.reader)
-	var resp TracerCommand
-	err = dec.Decode(&resp)
-	if err != nil {
-		return fmt.Errorf("invalid response: %q", err)
+	if err := x.tracerCmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %v: %w", x.tracerCmd.Args, err)
 	}
-
-	if resp.Cmd != Ok {
-		return fmt.Errorf("unexpected response: %d", resp.Cmd)
+	go func() {
+		_ = x.tracerCmd.Wait()
+		w.Close()
+	}()
+	x.client = agentproto.NewClient(r, stdin, stdin)
+	if err := x.client.Handshake(ctx, AgentName); err != nil {
+		x.client.Close()
+		return err
 	}
-
 	return nil
 }
 
-func (x *Tracer) ConnectToAddress(addrs []string) ([]string, error) {
+// SetIPv6 records whether the tracer can connect via IPv6 in the NS.
+func (x *Tracer) SetIPv6(enabled bool) {
 	x.lock.Lock()
 	defer x.lock.Unlock()
+	x.ipv6 = enabled
+}
 
-	cmd := TracerCommand{
-		Cmd:                ConnectToAddress,
-		DestinationAddress: addrs,
-	}
+// IPv6 returns false when the tracer cannot connect via IPv6, e.g. IPv6 is disabled in the NS.
+func (x *Tracer) IPv6() bool {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	return x.ipv6
+}
 
-	m, err := json.Marshal(cmd)
-	if err != nil {
-		return nil, err
-	}
+// RegisterForwardPorts listens on the ports in the NS, so that the tracers of the other containers can connect to them.
+// The ports already registered are ignored.
+func (x *Tracer) RegisterForwardPorts(ports []int) error {
+	return x.client.Call(context.Background(), MethodRegisterForwardPorts, &RegisterForwardPortsRequest{Ports: ports}, nil)
+}
 
-	writeSize, err := x.writer.Write(m)
-	if err != nil {
-		return nil, err
-	}
-	if writeSize != len(m) {
-		return nil, fmt.Errorf("unexpected written size expected=%d actual=%d", len(m), writeSize)
+// ConnectToAddress tries to connect to the addresses in parallel from the NS, and returns the connected ones.
+// timeout is the timeout of each connection. DefaultConnectTimeout is used if it is not positive.
+func (x *Tracer) ConnectToAddress(addrs []string, timeout time.Duration) ([]string, error) {
+	if timeout <= 0 {
+		timeout = DefaultConnectTimeout
 	}
+	// the agent tries maxConcurrentConnections addresses at the same time
+	batches := (len(addrs) + maxConcurrentConnections - 1) / maxConcurrentConnections
+	ctx, cancel := context.WithTimeout(context.Background(), agentproto.DefaultTimeout+time.Duration(batches)*timeout)
+	defer cancel()
 
-	dec := json.NewDecoder(x.reader)
-	var resp TracerCommand
-	err = dec.Decode(&resp)
+	var resp ConnectResponse
+	err := x.client.Call(ctx, MethodConnect, &ConnectRequest{Addresses: addrs, Timeout: timeout}, &resp)
 	if err != nil {
-		return nil, fmt.Errorf("invalid response: %q", err)
-	}
-
-	if resp.Cmd != Ok {
-		return nil, fmt.Errorf("unexpected response: %d", resp.Cmd)
+		return nil, err
 	}
-
-	return resp.DestinationAddress, nil
+	return resp.Addresses, nil
 }
@@ -5,29 +5,77 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/rootless-containers/bypass4netns/pkg/api"
 	"github.com/rootless-containers/bypass4netns/pkg/api/com"
+	"github.com/rootless-containers/bypass4netns/pkg/bypass4netns/nonbypassable"
+	"github.com/rootless-containers/bypass4netns/pkg/bypass4netns/registry"
 	"github.com/rootless-containers/bypass4netns/pkg/util"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
 )
 
+const DefaultStopGracePeriod = 10 * time.Second
+
 type Driver struct {
 	BypassExecutablePath string
 	ComSocketPath        string
 	bypass               map[string]api.BypassStatus
-	lock                 sync.RWMutex
-	containerInterfaces  map[string]com.ContainerInterfaces
-	interfacesLock       sync.RWMutex
+	// children is protected by lock
+	children map[string]*child
+	// starting is the specs of bypass4netns being spawned. protected by lock.
+	starting            map[string]*api.BypassSpec
+	lock                sync.RWMutex
+	containerInterfaces map[string]com.ContainerInterfaces
+	// interfacesWatch is protected by interfacesLock
+	interfacesWatch interfacesWatch
+	// interfaceLeases expire the interfaces. protected by interfacesLock.
+	interfaceLeases map[string]*time.Timer
+	// InterfaceTTL is the time the interfaces are kept after they are posted
+	InterfaceTTL time.Duration
+	// stats is reported by bypass4netns. protected by interfacesLock.
+	stats          map[string]reportedStats
+	interfacesLock sync.RWMutex
+	// ports added via the rootlesskit-compatible port API and BypassSpec.PortMapping. protected by lock.
+	ports      map[int]*portEntry
+	nextPortID int
+	// portsWatch is protected by lock
+	portsWatch           portsWatch
 	HandleC2CEnable      bool
 	TracerEnable         bool
 	MultinodeEnable      bool
 	MultinodeEtcdAddress string
 	MultinodeHostAddress string
+	// MultinodeRegistry and MultinodeRegistryDir are passed to bypass4netns when they are not empty
+	MultinodeRegistry    registry.Backend
+	MultinodeRegistryDir string
+	// TracerProbeTimeout and TracerVerifyInterval are passed to bypass4netns when they are positive
+	TracerProbeTimeout   time.Duration
+	TracerVerifyInterval time.Duration
+	// IgnoredRoutePolicy is passed to bypass4netns when it is not empty
+	IgnoredRoutePolicy nonbypassable.RoutePolicy
+	// StateDir is the directory to persist the state. The state is not persisted when it is empty.
+	StateDir string
+	// RootlessKitAPISocketPath is the socket of rootlesskit's API to check the ports forwarded by rootlesskit.
+	// The check is disabled when it is empty.
+	RootlessKitAPISocketPath string
+	PortConflictPolicy       PortConflictPolicy
+	// StopGracePeriod is the time to wait for the exit after SIGTERM before SIGKILL
+	StopGracePeriod time.Duration
+	// AllowedUIDs and AllowedRuntimes are passed to bypass4netns for authorizing the senders of seccomp file descriptors.
+	// bypass4netns uses its defaults when they are nil.
+	AllowedUIDs     []uint32
+	AllowedRuntimes []string
+	// InProcess runs bypass4netns as goroutines of bypass4netnsd instead of executing BypassExecutablePath per container.
+	// BypassExecutablePath is still used for the agents in the namespaces of the containers.
+	InProcess          bool
+	restartBackoffBase time.Duration
+	readyTimeout       time.Duration
 }
 
 func NewDriver(execPath string, comSocketPath string) *Driver {
@@ -35,12 +83,41 @@ func NewDriver(execPath string, comSocketPath string) *Driver {
 		BypassExecutablePath: execPath,
 		ComSocketPath:        comSocketPath,
 		bypass:               map[string]api.BypassStatus{},
+		children:             map[string]*child{},
+		starting:             map[string]*api.BypassSpec{},
 		lock:                 sync.RWMutex{},
 		containerInterfaces:  map[string]com.ContainerInterfaces{},
+		interfacesWatch:      newInterfacesWatch(),
+		interfaceLeases:      map[string]*time.Timer{},
+		InterfaceTTL:         DefaultInterfaceTTL,
+		stats:                map[string]reportedStats{},
 		interfacesLock:       sync.RWMutex{},
+		ports:                map[int]*portEntry{},
+		nextPortID:           1,
+		portsWatch:           newPortsWatch(),
 		TracerEnable:         false,
 		MultinodeEnable:      false,
+		PortConflictPolicy:   PortConflictPolicyReconcile,
+		StopGracePeriod:      DefaultStopGracePeriod,
+		restartBackoffBase:   defaultRestartBackoff,
+		readyTimeout:         defaultReadyTimeout,
+	}
+}
+
+// Features returns the features enabled for the bypass4netns started by the driver.
+// UDP is not reported because bypass4netns bypasses only TCP.
+func (d *Driver) Features() []string {
+	features := []string{}
+	if d.HandleC2CEnable {
+		features = append(features, api.FeatureC2C)
+	}
+	if d.TracerEnable {
+		features = append(features, api.FeatureTracer)
+	}
+	if d.MultinodeEnable {
+		features = append(features, api.FeatureMultinode)
 	}
+	return features
 }
 
 func (d *Driver) ListBypass() []api.BypassStatus {
@@ -58,6 +135,67 @@ func (d *Driver) ListBypass() []api.BypassStatus {
 func (d *Driver) StartBypass(spec *api.BypassSpec) (*api.BypassStatus, error) {
 	logger := logrus.WithFields(logrus.Fields{"ID": util.ShrinkID(spec.ID)})
 	logger.Info("Starting bypass")
+	if err := validateSpec(spec); err != nil {
+		return nil, err
+	}
+	if err := d.resolvePortConflicts(spec); err != nil {
+		return nil, err
+	}
+
+	d.lock.Lock()
+	if err := d.checkSpecConflicts(spec); err != nil {
+		d.lock.Unlock()
+		return nil, err
+	}
+	d.starting[spec.ID] = spec
+	d.lock.Unlock()
+	defer func() {
+		d.lock.Lock()
+		delete(d.starting, spec.ID)
+		d.lock.Unlock()
+	}()
+
+	c, err := d.start(spec)
+	if err != nil {
+		return nil, api.Errorf(api.ErrorCodeStartFailed, "failed to start bypass4netns: %v", err)
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if _, ok := d.bypass[spec.ID]; ok {
+		// replacing the exited one
+		d.releasePorts(spec.ID)
+	}
+	status := api.BypassStatus{
+		ID:        spec.ID,
+		Pid:       c.pid(),
+		InProcess: c.proc == nil,
+		Spec:      *spec,
+		State:     api.BypassStateRunning,
+		StartedAt: time.Now(),
+	}
+
+	d.bypass[status.ID] = status
+	d.children[status.ID] = c
+	d.registerSpecPorts(spec)
+	d.saveStatus(status)
+	go d.supervise(status.ID, c)
+	logger.Info("Started bypass")
+
+	return &status, nil
+}
+
+// start starts bypass4netns in-process or as a process.
+func (d *Driver) start(spec *api.BypassSpec) (*child, error) {
+	if d.InProcess {
+		return d.startInProcess(spec)
+	}
+	return d.spawn(spec)
+}
+
+// spawn starts bypass4netns and waits for it to become ready.
+func (d *Driver) spawn(spec *api.BypassSpec) (*child, error) {
+	logger := logrus.WithFields(logrus.Fields{"ID": util.ShrinkID(spec.ID)})
 	b4nnArgs := []string{}
 
 	if logger.Logger.GetLevel() == logrus.DebugLevel {
@@ -87,6 +225,10 @@ func (d *Driver) StartBypass(spec *api.BypassSpec) (*api.BypassStatus, error) {
 		b4nnArgs = append(b4nnArgs, fmt.Sprintf("--ignore=%s", subnet))
 	}
 
+	if d.IgnoredRoutePolicy != "" {
+		b4nnArgs = append(b4nnArgs, fmt.Sprintf("--ignore-routes=%s", d.IgnoredRoutePolicy))
+	}
+
 	if spec.IgnoreBind {
 		b4nnArgs = append(b4nnArgs, "--ignore-bind")
 	}
@@ -97,12 +239,35 @@ func (d *Driver) StartBypass(spec *api.BypassSpec) (*api.BypassStatus, error) {
 	}
 	if d.TracerEnable {
 		b4nnArgs = append(b4nnArgs, "--tracer=true")
+		if d.TracerProbeTimeout > 0 {
+			b4nnArgs = append(b4nnArgs, fmt.Sprintf("--tracer-probe-timeout=%s", d.TracerProbeTimeout))
+		}
+		if d.TracerVerifyInterval > 0 {
+			b4nnArgs = append(b4nnArgs, fmt.Sprintf("--tracer-verify-interval=%s", d.TracerVerifyInterval))
+		}
 	}
 
 	if d.MultinodeEnable {
 		b4nnArgs = append(b4nnArgs, "--multinode=true")
 		b4nnArgs = append(b4nnArgs, fmt.Sprintf("--multinode-etcd-address=%s", d.MultinodeEtcdAddress))
 		b4nnArgs = append(b4nnArgs, fmt.Sprintf("--multinode-host-address=%s", d.MultinodeHostAddress))
+		if d.MultinodeRegistry != "" {
+			b4nnArgs = append(b4nnArgs, fmt.Sprintf("--multinode-registry=%s", d.MultinodeRegistry))
+		}
+		if d.MultinodeRegistryDir != "" {
+			b4nnArgs = append(b4nnArgs, fmt.Sprintf("--multinode-registry-dir=%s", d.MultinodeRegistryDir))
+		}
+	}
+
+	if d.AllowedUIDs != nil {
+		uids := []string{}
+		for _, uid := range d.AllowedUIDs {
+			uids = append(uids, strconv.FormatUint(uint64(uid), 10))
+		}
+		b4nnArgs = append(b4nnArgs, fmt.Sprintf("--allowed-uids=%s", strings.Join(uids, ",")))
+	}
+	if d.AllowedRuntimes != nil {
+		b4nnArgs = append(b4nnArgs, fmt.Sprintf("--allowed-runtimes=%s", strings.Join(d.AllowedRuntimes, ",")))
 	}
 
 	// prepare pipe for ready notification
@@ -117,76 +282,137 @@ func (d *Driver) StartBypass(spec *api.BypassSpec) (*api.BypassStatus, error) {
 	readyFdOption := "--ready-fd=3"
 	b4nnArgs = append(b4nnArgs, readyFdOption)
 
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+
 	logger.Infof("bypass4netns args:%v", b4nnArgs)
 	b4nnCmd := exec.Command(d.BypassExecutablePath, b4nnArgs...)
+	// the token is not passed as an argument, which is visible to the other users
+	b4nnCmd.Env = append(os.Environ(), com.TokenEnv+"="+token)
 	b4nnCmd.ExtraFiles = append(b4nnCmd.ExtraFiles, readyW)
 	err = b4nnCmd.Start()
 	if err != nil {
 		return nil, err
 	}
 
-	err = waitForReadyFD(b4nnCmd.Process.Pid, readyR)
+	err = waitForReadyFD(b4nnCmd.Process.Pid, readyR, d.readyTimeout)
 	if err != nil {
+		// the process may have been reaped by waitForReadyFD
+		_ = b4nnCmd.Process.Kill()
+		_ = b4nnCmd.Wait()
 		return nil, err
 	}
 	logger.Info("bypass4netns successfully started")
 
-	d.lock.Lock()
-	defer d.lock.Unlock()
-	status := api.BypassStatus{
-		ID:   spec.ID,
-		Pid:  b4nnCmd.Process.Pid,
-		Spec: *spec,
-	}
+	return &child{
+		proc:  b4nnCmd.Process,
+		cmd:   b4nnCmd,
+		pidfd: -1,
+		done:  make(chan struct{}),
+		token: token,
+	}, nil
+}
 
-	d.bypass[status.ID] = status
-	logger.Info("Started bypass")
+// StopBypass stops the bypass4netns and waits for its exit.
+func (d *Driver) StopBypass(id string) error {
+	stopped, err := d.stopBypass(id)
+	if err != nil {
+		return err
+	}
+	<-stopped
+	return nil
+}
 
-	return &status, nil
+// StopBypassAsync stops the bypass4netns without waiting for its exit.
+// The state is "stopping" until the process exits.
+func (d *Driver) StopBypassAsync(id string) error {
+	_, err := d.stopBypass(id)
+	return err
 }
 
-func (d *Driver) StopBypass(id string) error {
+// stopBypass sends SIGTERM to the bypass4netns and returns the channel closed when it is stopped.
+// The process is killed if it does not exit in StopGracePeriod.
+func (d *Driver) stopBypass(id string) (<-chan struct{}, error) {
 	logger := logrus.WithFields(logrus.Fields{"ID": util.ShrinkID(id)})
-	logger.Infof("Stopping bypass")
 	d.lock.Lock()
 	defer d.lock.Unlock()
 
 	bStatus, ok := d.bypass[id]
 	if !ok {
-		return fmt.Errorf("child %s not found", id)
+		return nil, api.Errorf(api.ErrorCodeNotFound, "child %s not found", id)
 	}
-
-	proc, err := os.FindProcess(bStatus.Pid)
-	if err != nil {
-		return err
+	c := d.children[id]
+	if c.stopping != nil {
+		logger.Info("bypass is already being stopped")
+		return c.stopping, nil
 	}
-	logger.Debugf("bypass4netns found pid=%d", proc.Pid)
+	logger.Infof("Stopping bypass")
 
-	logger.Infof("Terminating bypass4netns pid=%d", proc.Pid)
-	err = proc.Signal(unix.SIGTERM)
-	if err != nil {
-		return err
+	running := bStatus.State == api.BypassStateRunning
+	bStatus.State = api.BypassStateStopping
+	d.bypass[id] = bStatus
+	d.saveStatus(bStatus)
+	d.stopChild(id, c, running)
+
+	return c.stopping, nil
+}
+
+// stopChild sends SIGTERM to the running child and removes the bypass when it exits.
+// The state of the bypass must be "stopping". d.lock must be held.
+func (d *Driver) stopChild(id string, c *child, running bool) {
+	logger := logrus.WithFields(logrus.Fields{"ID": util.ShrinkID(id)})
+	// the supervisor does not restart the stopped child
+	c.stopped = true
+	c.stopping = make(chan struct{})
+
+	if running && c.proc == nil {
+		logger.Info("Stopping bypass4netns running in-process")
+		c.cancel()
+	} else if running {
+		logger.Infof("Terminating bypass4netns pid=%d", c.proc.Pid)
+		// the process may have exited and been reaped just now
+		if err := c.proc.Signal(unix.SIGTERM); err != nil && !errors.Is(err, os.ErrProcessDone) {
+			logger.WithError(err).Warnf("Failed to send SIGTERM to bypass4netns pid=%d", c.proc.Pid)
+		}
 	}
+	go d.waitForStop(id, c, running)
+}
 
-	// wait for the process exit
-	// TODO: Timeout
-	if _, err := proc.Wait(); err != nil {
-		logrus.Warnf("Failed to terminate bypass4netns pid=%d with SIGTERM, killing...", proc.Pid)
-		err = proc.Kill()
-		if err != nil {
-			return err
+// waitForStop waits for the exit of the child without holding d.lock and removes the bypass.
+func (d *Driver) waitForStop(id string, c *child, running bool) {
+	logger := logrus.WithFields(logrus.Fields{"ID": util.ShrinkID(id)})
+	if running && c.proc == nil {
+		// the in-process bypass4netns stops accepting seccomp file descriptors immediately
+		<-c.done
+	} else if running {
+		// the supervisor reaps the process
+		select {
+		case <-c.done:
+		case <-time.After(d.StopGracePeriod):
+			logger.Warnf("bypass4netns pid=%d did not exit in %s, killing...", c.proc.Pid, d.StopGracePeriod)
+			if err := c.proc.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+				logger.WithError(err).Errorf("Failed to kill bypass4netns pid=%d", c.proc.Pid)
+			}
+			<-c.done
 		}
-		_, _ = proc.Wait()
+		logger.Infof("Terminated bypass4netns pid=%d", c.proc.Pid)
 	}
-	logger.Infof("Terminated bypass4netns pid=%d", proc.Pid)
 
-	delete(d.bypass, id)
+	d.lock.Lock()
+	if d.children[id] == c {
+		delete(d.bypass, id)
+		delete(d.children, id)
+		d.removeStatus(id)
+		d.releasePorts(id)
+	}
+	d.lock.Unlock()
 	logger.Info("Stopped bypass")
 
 	// remove the container's interfaces
-	d.DeleteInterface(id)
-
-	return nil
+	d.deleteInterface(id)
+	close(c.stopping)
 }
 
 func (d *Driver) ListInterfaces() map[string]com.ContainerInterfaces {
@@ -214,25 +440,56 @@ func (d *Driver) GetInterface(id string) *com.ContainerInterfaces {
 	return &ifs
 }
 
-func (d *Driver) PostInterface(id string, containerIfs *com.ContainerInterfaces) {
+// PostInterface registers the interfaces, or renews them if they are not changed.
+// They are removed after InterfaceTTL unless they are posted again.
+func (d *Driver) PostInterface(id, token string, containerIfs *com.ContainerInterfaces) error {
+	if err := d.authorize(id, token); err != nil {
+		return err
+	}
+	ifs := *containerIfs
+	expiresAt := time.Now().Add(d.InterfaceTTL)
+	ifs.ExpiresAt = &expiresAt
+
 	d.interfacesLock.Lock()
-	defer d.interfacesLock.Unlock()
+	changed := d.recordInterfacesEvent(com.InterfacesEventPut, id, &ifs)
+	d.containerInterfaces[id] = ifs
+	d.renewLease(id)
+	if changed {
+		d.saveInterfaces()
+	}
+	d.interfacesLock.Unlock()
+
+	// the pending ports may match the container's addresses
+	d.assignPendingPorts()
+	return nil
+}
 
-	d.containerInterfaces[id] = *containerIfs
+func (d *Driver) DeleteInterface(id, token string) error {
+	if err := d.authorize(id, token); err != nil {
+		return err
+	}
+	d.deleteInterface(id)
+	return nil
 }
 
-func (d *Driver) DeleteInterface(id string) {
+// deleteInterface removes the interfaces and the stats of the stopped bypass4netns
+func (d *Driver) deleteInterface(id string) {
 	d.interfacesLock.Lock()
 	defer d.interfacesLock.Unlock()
 
-	delete(d.containerInterfaces, id)
+	d.removeInterfaces(id)
+	delete(d.stats, id)
 }
 
 // waitForReady is from libpod
 // https://github.com/containers/libpod/blob/e6b843312b93ddaf99d0ef94a7e60ff66bc0eac8/libpod/networking_linux.go#L272-L308
-func waitForReadyFD(cmdPid int, r *os.File) error {
+func waitForReadyFD(cmdPid int, r *os.File, timeout time.Duration) error {
 	b := make([]byte, 16)
+	deadline := time.Now().Add(timeout)
 	for {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("bypass4netns did not become ready in %s", timeout)
+		}
 		if err := r.SetDeadline(time.Now().Add(1 * time.Second)); err != nil {
 			return fmt.Errorf("error setting bypass4netns pipe timeout: %w", err)
 		}
@@ -0,0 +1,161 @@
+package bypass4netnsd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rootless-containers/bypass4netns/pkg/api"
+	"github.com/rootless-containers/bypass4netns/pkg/api/com"
+	"github.com/sirupsen/logrus"
+)
+
+type reportedStats struct {
+	stats      com.Stats
+	receivedAt time.Time
+}
+
+func (d *Driver) PostStats(id, token string, stats *com.Stats) error {
+	if err := d.authorize(id, token); err != nil {
+		return err
+	}
+	d.interfacesLock.Lock()
+	d.stats[id] = reportedStats{
+		stats:      *stats,
+		receivedAt: time.Now(),
+	}
+	d.interfacesLock.Unlock()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if c, ok := d.children[id]; ok && !c.attached {
+		c.attached = true
+		d.saveStatus(d.bypass[id])
+	}
+	return nil
+}
+
+// GetBypass returns the detailed status of the bypass4netns.
+func (d *Driver) GetBypass(id string) (*api.BypassInfo, error) {
+	d.lock.RLock()
+	status, ok := d.bypass[id]
+	if !ok {
+		d.lock.RUnlock()
+		return nil, api.Errorf(api.ErrorCodeNotFound, "child %s not found", id)
+	}
+	info := &api.BypassInfo{
+		BypassStatus: status,
+		Ports:        []api.BypassPort{},
+		Tasks:        []api.TaskHealth{},
+	}
+	c := d.children[id]
+	for _, p := range d.sortedPorts() {
+		if p.status.BypassID == id {
+			info.Ports = append(info.Ports, api.BypassPort{PortStatus: p.status})
+		}
+	}
+	d.lock.RUnlock()
+
+	if status.State == api.BypassStateRunning || status.State == api.BypassStateStopping {
+		info.Alive = c.alive()
+	}
+	if info.Alive && !status.StartedAt.IsZero() {
+		info.UptimeSeconds = time.Since(status.StartedAt).Seconds()
+	}
+
+	listening, err := listeningTCPPorts()
+	if err != nil {
+		logrus.WithError(err).Warn("failed to get listening ports")
+	}
+	for i := range info.Ports {
+		spec := info.Ports[i].Spec
+		for _, ip := range listening[spec.ParentPort] {
+			if sameParentIP(ip.String(), spec.ParentIP) {
+				info.Ports[i].Bound = true
+				break
+			}
+		}
+	}
+
+	d.interfacesLock.RLock()
+	if reported, ok := d.stats[id]; ok {
+		info.Tasks = reported.stats.Tasks
+		sockets := reported.stats.Sockets
+		info.Sockets = &sockets
+		receivedAt := reported.receivedAt
+		info.StatsUpdatedAt = &receivedAt
+	}
+	d.interfacesLock.RUnlock()
+
+	return info, nil
+}
+
+// listeningTCPPorts returns the addresses of the TCP ports listened in the network namespace of bypass4netnsd,
+// where bypass4netns binds the host sockets.
+func listeningTCPPorts() (map[int][]net.IP, error) {
+	res := map[int][]net.IP{}
+	for _, p := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		if err := readListeningPorts(p, res); err != nil && !os.IsNotExist(err) {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// tcpListen is TCP_LISTEN in the "st" column of /proc/net/tcp
+const tcpListen = "0A"
+
+func readListeningPorts(p string, res map[int][]net.IP) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	// skip the header
+	scanner.Scan()
+	for scanner.Scan() {
+		// sl local_address rem_address st ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[3] != tcpListen {
+			continue
+		}
+		ipHex, portHex, ok := strings.Cut(fields[1], ":")
+		if !ok {
+			continue
+		}
+		port, err := strconv.ParseUint(portHex, 16, 16)
+		if err != nil {
+			continue
+		}
+		ip, err := parseProcNetIP(ipHex)
+		if err != nil {
+			continue
+		}
+		res[int(port)] = append(res[int(port)], ip)
+	}
+	return scanner.Err()
+}
+
+// parseProcNetIP parses the address in /proc/net/tcp, printed as the 32-bit words in the host byte order
+func parseProcNetIP(s string) (net.IP, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != net.IPv4len && len(b) != net.IPv6len {
+		return nil, fmt.Errorf("invalid address %q", s)
+	}
+	ip := make(net.IP, len(b))
+	for i := 0; i < len(b); i += 4 {
+		binary.NativeEndian.PutUint32(ip[i:], binary.BigEndian.Uint32(b[i:]))
+	}
+	return ip, nil
+}
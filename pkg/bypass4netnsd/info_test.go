@@ -0,0 +1,48 @@
+package bypass4netnsd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// procNetIP formats the address as the kernel prints it in /proc/net/tcp
+func procNetIP(ip net.IP) string {
+	s := ""
+	for i := 0; i < len(ip); i += 4 {
+		s += fmt.Sprintf("%08X", binary.NativeEndian.Uint32(ip[i:]))
+	}
+	return s
+}
+
+func TestReadListeningPorts(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "tcp")
+	content := "  sl  local_address rem_address   st\n" +
+		fmt.Sprintf("   0: %s:1F90 00000000:0000 0A\n", procNetIP(net.ParseIP("127.0.0.1").To4())) +
+		fmt.Sprintf("   1: %s:20FB 00000000:0000 0A\n", procNetIP(net.IPv4zero.To4())) +
+		// not listening
+		fmt.Sprintf("   2: %s:0050 0100007F:9C40 01\n", procNetIP(net.ParseIP("10.0.0.1").To4())) +
+		fmt.Sprintf("   3: %s:1F90 00000000000000000000000000000000:0000 0A\n", procNetIP(net.ParseIP("::1")))
+	assert.Equal(t, nil, os.WriteFile(p, []byte(content), 0o644))
+
+	res := map[int][]net.IP{}
+	assert.Equal(t, nil, readListeningPorts(p, res))
+	assert.Equal(t, 2, len(res))
+	assert.Equal(t, 2, len(res[8080]))
+	assert.Equal(t, "127.0.0.1", res[8080][0].String())
+	assert.Equal(t, "::1", res[8080][1].String())
+	assert.Equal(t, "0.0.0.0", res[8443][0].String())
+
+	// the port is bound when it is listened on the parent IP or the unspecified address
+	assert.Equal(t, true, sameParentIP(res[8080][0].String(), "127.0.0.1"))
+	assert.Equal(t, false, sameParentIP(res[8080][0].String(), "192.168.0.1"))
+	assert.Equal(t, true, sameParentIP(res[8443][0].String(), "192.168.0.1"))
+
+	_, err := parseProcNetIP("0100")
+	assert.NotEqual(t, nil, err)
+}
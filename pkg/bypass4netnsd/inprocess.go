@@ -0,0 +1,132 @@
+package bypass4netnsd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rootless-containers/bypass4netns/pkg/api"
+	"github.com/rootless-containers/bypass4netns/pkg/api/com"
+	"github.com/rootless-containers/bypass4netns/pkg/bypass4netns"
+	"github.com/rootless-containers/bypass4netns/pkg/oci"
+	"github.com/rootless-containers/bypass4netns/pkg/peercred"
+	"github.com/rootless-containers/bypass4netns/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+// startInProcess starts bypass4netns.Handler as goroutines of bypass4netnsd.
+// The handler talks to the driver directly instead of via the com socket.
+//
+// The agents running in the namespaces of the containers are still executed from BypassExecutablePath.
+// PidFilePath is not written, and the logs are written to the log of bypass4netnsd instead of LogFilePath.
+func (d *Driver) startInProcess(spec *api.BypassSpec) (*child, error) {
+	logger := logrus.WithFields(logrus.Fields{"ID": util.ShrinkID(spec.ID)})
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+	handler, err := d.newHandler(spec, token)
+	if err != nil {
+		return nil, err
+	}
+
+	socketPath := handler.SocketPath()
+	if err := os.Remove(socketPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("cannot cleanup socket file: %w", err)
+	}
+	if err := handler.Listen(); err != nil {
+		return nil, fmt.Errorf("cannot listen: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &child{
+		pidfd:  -1,
+		done:   make(chan struct{}),
+		cancel: cancel,
+		token:  token,
+	}
+	c2cConfig := &bypass4netns.C2CConnectionHandleConfig{
+		Enable:               d.HandleC2CEnable,
+		TracerEnable:         d.TracerEnable,
+		TracerProbeTimeout:   d.TracerProbeTimeout,
+		TracerVerifyInterval: d.TracerVerifyInterval,
+	}
+	multinodeConfig := &bypass4netns.MultinodeConfig{
+		Enable:      d.MultinodeEnable,
+		EtcdAddress: d.MultinodeEtcdAddress,
+		HostAddress: d.MultinodeHostAddress,
+		Registry:    d.MultinodeRegistry,
+		RegistryDir: d.MultinodeRegistryDir,
+	}
+	go func() {
+		c.err = handler.Serve(ctx, c2cConfig, multinodeConfig)
+		if c.err != nil {
+			logger.WithError(c.err).Error("bypass4netns running in-process failed")
+		}
+		cancel()
+		close(c.done)
+	}()
+	logger.Infof("bypass4netns successfully started in-process (socket=%s)", socketPath)
+	return c, nil
+}
+
+// newHandler creates bypass4netns.Handler configured as the flags passed to bypass4netns by spawn.
+func (d *Driver) newHandler(spec *api.BypassSpec, token string) (*bypass4netns.Handler, error) {
+	socketPath := spec.SocketPath
+	if socketPath == "" {
+		socketPath = filepath.Join(os.Getenv("XDG_RUNTIME_DIR"), oci.SocketName)
+	}
+	tracerAgentLogPath := ""
+	if spec.LogFilePath != "" {
+		tracerAgentLogPath = strings.Replace(spec.LogFilePath, ".log", "-tracer.log", -1)
+	}
+	handler := bypass4netns.NewHandler(socketPath, d.ComSocketPath, tracerAgentLogPath, spec.IgnoreBind)
+	handler.SetComClient(com.NewDirectClient(d, token))
+
+	peerPolicy := &peercred.Policy{
+		UIDs:        d.AllowedUIDs,
+		Executables: d.AllowedRuntimes,
+	}
+	if d.AllowedRuntimes == nil {
+		peerPolicy.Executables = oci.DefaultRuntimes
+	}
+	handler.SetPeerPolicy(peerPolicy)
+
+	ignoreSubnets := spec.IgnoreSubnets
+	if len(ignoreSubnets) == 0 {
+		// the default of bypass4netns --ignore
+		ignoreSubnets = []string{"127.0.0.0/8"}
+	}
+	subnets := []net.IPNet{}
+	subnetsAuto := false
+	for _, subnetStr := range ignoreSubnets {
+		if subnetStr == "auto" {
+			subnetsAuto = true
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(subnetStr)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not CIDR format", subnetStr)
+		}
+		subnets = append(subnets, *subnet)
+	}
+	handler.SetIgnoredSubnets(subnets, subnetsAuto)
+	if d.IgnoredRoutePolicy != "" {
+		handler.SetIgnoredRoutePolicy(d.IgnoredRoutePolicy)
+	}
+
+	for _, port := range spec.PortMapping {
+		err := handler.SetForwardingPort(bypass4netns.ForwardPortMapping{
+			HostPort:  port.ParentPort,
+			ChildPort: port.ChildPort,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return handler, nil
+}
@@ -0,0 +1,76 @@
+package bypass4netnsd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rootless-containers/bypass4netns/pkg/api"
+	"github.com/rootless-containers/bypass4netns/pkg/api/com"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStartBypassInProcess(t *testing.T) {
+	d := NewDriver("/bin/false", "com.sock")
+	d.InProcess = true
+	d.StateDir = t.TempDir()
+	assert.Equal(t, nil, d.Restore())
+	dir := t.TempDir()
+
+	spec := &api.BypassSpec{
+		ID:          "container0",
+		SocketPath:  filepath.Join(dir, "container0.sock"),
+		PortMapping: []api.PortSpec{{ParentPort: 8080, ChildPort: 80}},
+	}
+	status, err := d.StartBypass(spec)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, os.Getpid(), status.Pid)
+	assert.Equal(t, true, status.InProcess)
+	_, err = os.Stat(spec.SocketPath)
+	assert.Equal(t, nil, err)
+
+	info, err := d.GetBypass(spec.ID)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, info.Alive)
+
+	// the handler talks to the driver directly
+	client := com.NewDirectClient(d, d.children[spec.ID].token)
+	ports, err := client.GetForwardingPorts(context.Background(), spec.ID)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(ports))
+	_, err = client.GetForwardingPorts(context.Background(), "container1")
+	assert.Equal(t, true, com.IsNotFound(err))
+
+	_, err = d.StartBypass(&api.BypassSpec{ID: "container1", SocketPath: spec.SocketPath})
+	assert.Equal(t, api.ErrorCodePathConflict, errorCode(err))
+
+	assert.Equal(t, nil, d.StopBypass(spec.ID))
+	assert.Equal(t, 0, len(d.ListBypass()))
+	_, err = os.Stat(spec.SocketPath)
+	assert.Equal(t, true, os.IsNotExist(err))
+
+	// the socket can be listened again
+	_, err = d.StartBypass(spec)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, d.StopBypass(spec.ID))
+}
+
+func TestRestoreInProcess(t *testing.T) {
+	stateDir := t.TempDir()
+	dir := t.TempDir()
+	d := NewDriver("/bin/false", "com.sock")
+	d.InProcess = true
+	d.StateDir = stateDir
+	assert.Equal(t, nil, d.Restore())
+	spec := &api.BypassSpec{ID: "container0", SocketPath: filepath.Join(dir, "container0.sock")}
+	_, err := d.StartBypass(spec)
+	assert.Equal(t, nil, err)
+	defer d.StopBypass(spec.ID)
+
+	// the bypass4netns running in-process of another bypass4netnsd is not adopted
+	d2 := NewDriver("/bin/false", "com.sock")
+	d2.StateDir = stateDir
+	assert.Equal(t, nil, d2.Restore())
+	assert.Equal(t, 0, len(d2.ListBypass()))
+}
@@ -0,0 +1,83 @@
+package bypass4netnsd
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/rootless-containers/bypass4netns/pkg/api/com"
+	"github.com/rootless-containers/bypass4netns/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultInterfaceTTL is the time the interfaces are kept after they are posted.
+// bypass4netns posts them again before they expire.
+const DefaultInterfaceTTL = 30 * time.Second
+
+// newToken returns the token issued to a bypass4netns for posting its interfaces and stats
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// authorize checks that the token is the one issued to the bypass4netns of the id.
+// The bypass4netns not managed by the driver are rejected, and only the ones adopted from the state without the token
+// are allowed without the token.
+func (d *Driver) authorize(id, token string) error {
+	d.lock.RLock()
+	c, ok := d.children[id]
+	d.lock.RUnlock()
+	if !ok {
+		return fmt.Errorf("%w: %s is not managed by bypass4netnsd", com.ErrForbidden, id)
+	}
+	if c.token == "" {
+		return nil
+	}
+	if subtle.ConstantTimeCompare([]byte(c.token), []byte(token)) != 1 {
+		return fmt.Errorf("%w: the token does not match the token issued to %s", com.ErrForbidden, id)
+	}
+	return nil
+}
+
+// renewLease extends the lease of the interfaces by InterfaceTTL. d.interfacesLock must be held.
+func (d *Driver) renewLease(id string) {
+	if t, ok := d.interfaceLeases[id]; ok {
+		t.Reset(d.InterfaceTTL)
+		return
+	}
+	d.interfaceLeases[id] = time.AfterFunc(d.InterfaceTTL, func() {
+		d.expireInterfaces(id)
+	})
+}
+
+// expireInterfaces removes the interfaces that are not renewed.
+func (d *Driver) expireInterfaces(id string) {
+	d.interfacesLock.Lock()
+	defer d.interfacesLock.Unlock()
+
+	ifs, ok := d.containerInterfaces[id]
+	// the lease may be renewed while the timer is fired
+	if !ok || ifs.ExpiresAt == nil || time.Now().Before(*ifs.ExpiresAt) {
+		return
+	}
+	logrus.WithFields(logrus.Fields{"ID": util.ShrinkID(id)}).Warnf("the interfaces are not renewed in %s, removing them", d.InterfaceTTL)
+	d.removeInterfaces(id)
+}
+
+// removeInterfaces removes the interfaces and their lease. d.interfacesLock must be held.
+func (d *Driver) removeInterfaces(id string) {
+	changed := d.recordInterfacesEvent(com.InterfacesEventDelete, id, nil)
+	delete(d.containerInterfaces, id)
+	if t, ok := d.interfaceLeases[id]; ok {
+		t.Stop()
+		delete(d.interfaceLeases, id)
+	}
+	if changed {
+		d.saveInterfaces()
+	}
+}
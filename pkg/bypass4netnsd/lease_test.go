@@ -0,0 +1,153 @@
+package bypass4netnsd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rootless-containers/bypass4netns/pkg/api"
+	"github.com/rootless-containers/bypass4netns/pkg/api/com"
+	"github.com/stretchr/testify/assert"
+)
+
+// adoptWithoutToken registers the bypass4netns adopted from the state without the token,
+// which posts its interfaces without the token
+func adoptWithoutToken(d *Driver, id string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.children[id] = &child{pidfd: -1, done: make(chan struct{})}
+}
+
+func TestInterfaceLease(t *testing.T) {
+	d := NewDriver("/bin/false", "com.sock")
+	d.InterfaceTTL = 200 * time.Millisecond
+	adoptWithoutToken(d, "container0")
+	assert.Equal(t, nil, d.PostInterface("container0", "", testInterfaces("container0", "10.4.0.2")))
+	ifs := d.GetInterface("container0")
+	assert.NotEqual(t, nil, ifs)
+	assert.NotEqual(t, nil, ifs.ExpiresAt)
+	rev := d.WatchInterfaces(context.Background(), 0).Revision
+
+	// renewing the lease keeps the interfaces
+	for i := 0; i < 3; i++ {
+		time.Sleep(100 * time.Millisecond)
+		assert.Equal(t, nil, d.PostInterface("container0", "", testInterfaces("container0", "10.4.0.2")))
+	}
+	assert.NotEqual(t, nil, d.GetInterface("container0"))
+
+	// the interfaces not renewed expire
+	watch := d.WatchInterfaces(context.Background(), rev)
+	assert.Equal(t, 1, len(watch.Events))
+	assert.Equal(t, com.InterfacesEventDelete, watch.Events[0].Type)
+	assert.Equal(t, "container0", watch.Events[0].ContainerID)
+	assert.Equal(t, (*com.ContainerInterfaces)(nil), d.GetInterface("container0"))
+}
+
+func TestInterfaceToken(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "bypass4netns")
+	assert.Equal(t, nil, os.WriteFile(p, []byte("#!/bin/sh\necho 1 >&3\nexec 3>&-\nexec sleep 60\n"), 0o755))
+	d := NewDriver(p, "com.sock")
+	_, err := d.StartBypass(&api.BypassSpec{ID: "container0"})
+	assert.Equal(t, nil, err)
+	defer func() {
+		_ = d.StopBypass("container0")
+	}()
+	token := d.children["container0"].token
+	assert.Equal(t, 64, len(token))
+
+	// the interfaces of the managed bypass4netns require its token
+	err = d.PostInterface("container0", "", testInterfaces("container0", "10.4.0.2"))
+	assert.Equal(t, true, errors.Is(err, com.ErrForbidden))
+	err = d.PostInterface("container0", token+"0", testInterfaces("container0", "10.4.0.2"))
+	assert.Equal(t, true, errors.Is(err, com.ErrForbidden))
+	err = d.PostStats("container0", "", &com.Stats{ContainerID: "container0"})
+	assert.Equal(t, true, errors.Is(err, com.ErrForbidden))
+	assert.Equal(t, (*com.ContainerInterfaces)(nil), d.GetInterface("container0"))
+
+	client := com.NewDirectClient(d, token)
+	_, err = client.PostInterface(context.Background(), testInterfaces("container0", "10.4.0.2"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, errors.Is(d.DeleteInterface("container0", "invalid"), com.ErrForbidden))
+	assert.NotEqual(t, nil, d.GetInterface("container0"))
+	assert.Equal(t, nil, d.DeleteInterface("container0", token))
+	assert.Equal(t, (*com.ContainerInterfaces)(nil), d.GetInterface("container0"))
+
+	// the bypass4netns not managed by the driver cannot inject the interfaces
+	err = d.PostInterface("container1", "", testInterfaces("container1", "10.4.0.3"))
+	assert.Equal(t, true, errors.Is(err, com.ErrForbidden))
+	err = d.PostStats("container1", "", &com.Stats{ContainerID: "container1"})
+	assert.Equal(t, true, errors.Is(err, com.ErrForbidden))
+	assert.Equal(t, true, errors.Is(d.DeleteInterface("container1", ""), com.ErrForbidden))
+	assert.Equal(t, (*com.ContainerInterfaces)(nil), d.GetInterface("container1"))
+}
+
+func TestComAPI(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "bypass4netns")
+	assert.Equal(t, nil, os.WriteFile(p, []byte("#!/bin/sh\necho 1 >&3\nexec 3>&-\nexec sleep 60\n"), 0o755))
+	socketPath := filepath.Join(dir, "bypass4netnsd-com.sock")
+	d := NewDriver(p, socketPath)
+	_, err := d.StartBypass(&api.BypassSpec{
+		ID:          "container0",
+		PortMapping: []api.PortSpec{{Protos: []string{"tcp"}, ParentPort: 8080, ChildPort: 80}},
+	})
+	assert.Equal(t, nil, err)
+	defer func() {
+		_ = d.StopBypass("container0")
+	}()
+
+	r := mux.NewRouter()
+	com.AddRoutes(r, &com.Backend{BypassDriver: d})
+	l, err := net.Listen("unix", socketPath)
+	assert.Equal(t, nil, err)
+	srv := &http.Server{Handler: r}
+	go func() {
+		_ = srv.Serve(l)
+	}()
+	defer srv.Close()
+
+	client, err := com.NewComClient(socketPath)
+	assert.Equal(t, nil, err)
+	ctx := context.Background()
+	assert.Equal(t, nil, client.Ping(ctx))
+
+	// the interfaces are rejected without the token
+	_, err = client.PostInterface(ctx, testInterfaces("container0", "10.4.0.2"))
+	assert.Equal(t, true, com.IsForbidden(err))
+
+	// the token is passed to bypass4netns via BYPASS4NETNS_COM_TOKEN
+	client.SetToken(d.children["container0"].token)
+	ifs, err := client.PostInterface(ctx, testInterfaces("container0", "10.4.0.2"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "container0", ifs.ContainerID)
+
+	ifsMap, err := client.ListInterfaces(ctx)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(ifsMap))
+	assert.Equal(t, "10.4.0.2", ifsMap["container0"].Interfaces[0].Addresses[0].IP.String())
+
+	ifs, err = client.GetInterface(ctx, "container0")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "10.4.0.2", ifs.Interfaces[0].Addresses[0].IP.String())
+
+	ports, err := client.GetForwardingPorts(ctx, "container0")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(ports))
+	assert.Equal(t, 8080, ports[0].ParentPort)
+	assert.Equal(t, 80, ports[0].ChildPort)
+
+	assert.Equal(t, nil, client.PostStats(ctx, &com.Stats{ContainerID: "container0"}))
+
+	assert.Equal(t, nil, client.DeleteInterface(ctx, "container0"))
+	ifsMap, err = client.ListInterfaces(ctx)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(ifsMap))
+	_, err = client.GetInterface(ctx, "container0")
+	assert.NotEqual(t, nil, err)
+}
@@ -0,0 +1,287 @@
+package bypass4netnsd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rootless-containers/bypass4netns/pkg/api"
+	"github.com/rootless-containers/bypass4netns/pkg/api/com"
+	"github.com/rootless-containers/bypass4netns/pkg/util"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// The state is persisted under Driver.StateDir as follows.
+//
+//	<StateDir>/bypass/<id>.json:   persistedStatus
+//	<StateDir>/ports.json:         the ports added via the port API
+//	<StateDir>/interfaces.json:    the interfaces registered by the bypass4netns
+const (
+	bypassStateDirName      = "bypass"
+	portsStateFileName      = "ports.json"
+	interfacesStateFileName = "interfaces.json"
+)
+
+// persistedStatus is api.BypassStatus with the token of the bypass4netns,
+// so that the adopted bypass4netns can post its interfaces after bypass4netnsd is restarted.
+// The state directory must not be readable by the other users.
+type persistedStatus struct {
+	api.BypassStatus
+	Token string `json:"token,omitempty"`
+	// Attached is true when the bypass4netns has received the seccomp fd
+	Attached bool `json:"attached,omitempty"`
+}
+
+func (d *Driver) bypassStatePath(id string) string {
+	return filepath.Join(d.StateDir, bypassStateDirName, id+".json")
+}
+
+// saveStatus persists the status and the token of the child. d.lock must be held.
+func (d *Driver) saveStatus(status api.BypassStatus) {
+	if d.StateDir == "" {
+		return
+	}
+	ps := persistedStatus{BypassStatus: status}
+	if c, ok := d.children[status.ID]; ok {
+		ps.Token = c.token
+		ps.Attached = c.attached
+	}
+	if err := writeJSON(d.bypassStatePath(status.ID), ps); err != nil {
+		logrus.WithFields(logrus.Fields{"ID": util.ShrinkID(status.ID)}).WithError(err).Warn("failed to persist the status")
+	}
+}
+
+// removeStatus removes the persisted status. d.lock must be held.
+func (d *Driver) removeStatus(id string) {
+	if d.StateDir == "" {
+		return
+	}
+	if err := os.Remove(d.bypassStatePath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logrus.WithFields(logrus.Fields{"ID": util.ShrinkID(id)}).WithError(err).Warn("failed to remove the persisted status")
+	}
+}
+
+// savePorts persists the ports added via the port API.
+// The ports given by BypassSpec are registered again from the persisted spec.
+// d.lock must be held.
+func (d *Driver) savePorts() {
+	if d.StateDir == "" {
+		return
+	}
+	ports := []api.PortStatus{}
+	for _, p := range d.sortedPorts() {
+		if !p.fromSpec {
+			ports = append(ports, p.status)
+		}
+	}
+	if err := writeJSON(filepath.Join(d.StateDir, portsStateFileName), ports); err != nil {
+		logrus.WithError(err).Warn("failed to persist the ports")
+	}
+}
+
+// saveInterfaces persists the registered interfaces, so that the watchers find them after bypass4netnsd is restarted.
+// d.interfacesLock must be held.
+func (d *Driver) saveInterfaces() {
+	if d.StateDir == "" {
+		return
+	}
+	if err := writeJSON(filepath.Join(d.StateDir, interfacesStateFileName), d.containerInterfaces); err != nil {
+		logrus.WithError(err).Warn("failed to persist the interfaces")
+	}
+}
+
+// restoreInterfaces loads the persisted interfaces of the adopted bypass4netns.
+// They are leased again for InterfaceTTL, as the adopted bypass4netns post them before that.
+// d.lock must be held.
+func (d *Driver) restoreInterfaces() {
+	var containerInterfaces map[string]com.ContainerInterfaces
+	if err := readJSON(filepath.Join(d.StateDir, interfacesStateFileName), &containerInterfaces); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logrus.WithError(err).Warn("failed to load the persisted interfaces")
+	}
+
+	d.interfacesLock.Lock()
+	defer d.interfacesLock.Unlock()
+	for id, ifs := range containerInterfaces {
+		if _, ok := d.bypass[id]; !ok {
+			continue
+		}
+		expiresAt := time.Now().Add(d.InterfaceTTL)
+		ifs.ExpiresAt = &expiresAt
+		d.containerInterfaces[id] = ifs
+		d.renewLease(id)
+	}
+	d.saveInterfaces()
+}
+
+// Restore loads the persisted state and adopts bypass4netns processes that are still running.
+// The files of the processes that are no longer running, and of the bypass4netns that ran in-process, are removed.
+// Restore must be called before serving the APIs.
+func (d *Driver) Restore() error {
+	if d.StateDir == "" {
+		return nil
+	}
+	bypassDir := filepath.Join(d.StateDir, bypassStateDirName)
+	if err := os.MkdirAll(bypassDir, 0o700); err != nil {
+		return err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	var ports []api.PortStatus
+	if err := readJSON(filepath.Join(d.StateDir, portsStateFileName), &ports); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logrus.WithError(err).Warn("failed to load the persisted ports")
+	}
+	for _, p := range ports {
+		d.ports[p.ID] = &portEntry{status: p}
+		d.nextPortID = max(d.nextPortID, p.ID+1)
+	}
+
+	entries, err := os.ReadDir(bypassDir)
+	if err != nil {
+		return err
+	}
+	for _, ent := range entries {
+		statePath := filepath.Join(bypassDir, ent.Name())
+		if !strings.HasSuffix(ent.Name(), ".json") {
+			_ = os.Remove(statePath)
+			continue
+		}
+		var ps persistedStatus
+		if err := readJSON(statePath, &ps); err != nil {
+			logrus.WithError(err).Warnf("removing broken state file %s", statePath)
+			_ = os.Remove(statePath)
+			continue
+		}
+		status := ps.BypassStatus
+		logger := logrus.WithFields(logrus.Fields{"ID": util.ShrinkID(status.ID)})
+		if status.InProcess {
+			logger.Info("bypass4netns ran in-process of the previous bypass4netnsd, removing its files")
+			removeStaleFiles(statePath, &status.Spec)
+			continue
+		}
+		c, err := d.adoptProcess(status.Pid)
+		if err != nil {
+			logger.WithError(err).Infof("bypass4netns pid=%d is not adopted, removing its files", status.Pid)
+			removeStaleFiles(statePath, &status.Spec)
+			continue
+		}
+		c.token = ps.Token
+		c.attached = ps.Attached
+		stopping := status.State == api.BypassStateStopping
+		if !stopping {
+			status.State = api.BypassStateRunning
+		}
+		d.bypass[status.ID] = status
+		d.children[status.ID] = c
+		d.registerSpecPorts(&status.Spec)
+		go d.supervise(status.ID, c)
+		logger.Infof("Adopted bypass4netns pid=%d", status.Pid)
+		if stopping {
+			// the stop accepted by the previous bypass4netnsd is resumed, with the grace period from now
+			logger.Info("Resuming to stop bypass")
+			d.stopChild(status.ID, c, true)
+		}
+	}
+
+	// the ports of the bypass4netns that are not adopted are pending again
+	for _, p := range d.ports {
+		if _, ok := d.bypass[p.status.BypassID]; !ok && !p.fromSpec {
+			p.status.BypassID = ""
+			p.status.State = api.PortStatePending
+		}
+	}
+	d.savePorts()
+	d.restoreInterfaces()
+	return nil
+}
+
+// adoptProcess checks that pid is a running bypass4netns and returns it as a child.
+func (d *Driver) adoptProcess(pid int) (*child, error) {
+	if pid <= 0 {
+		return nil, fmt.Errorf("invalid pid %d", pid)
+	}
+	pidfd, err := unix.PidfdOpen(pid, 0)
+	if err != nil {
+		return nil, fmt.Errorf("process %d is not running: %w", pid, err)
+	}
+	if err := d.checkExecutable(pid); err != nil {
+		unix.Close(pidfd)
+		return nil, err
+	}
+	// the pid may have been reused while checking /proc/<pid>/exe
+	if err := unix.PidfdSendSignal(pidfd, 0, nil, 0); err != nil {
+		unix.Close(pidfd)
+		return nil, fmt.Errorf("process %d is not running: %w", pid, err)
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		unix.Close(pidfd)
+		return nil, err
+	}
+	return &child{
+		proc:  proc,
+		pidfd: pidfd,
+		done:  make(chan struct{}),
+	}, nil
+}
+
+// checkExecutable checks that /proc/<pid>/exe is the bypass4netns executable.
+func (d *Driver) checkExecutable(pid int) error {
+	exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		return err
+	}
+	// the executable may have been replaced by an upgrade
+	exe = strings.TrimSuffix(exe, " (deleted)")
+	expected, err := filepath.Abs(d.BypassExecutablePath)
+	if err != nil {
+		return err
+	}
+	if resolved, err := filepath.EvalSymlinks(expected); err == nil {
+		expected = resolved
+	}
+	if exe != expected {
+		return fmt.Errorf("process %d is %s, not %s", pid, exe, expected)
+	}
+	return nil
+}
+
+// removeStaleFiles removes the files of the bypass4netns that is not adopted.
+// The log is kept for debugging why it exited.
+func removeStaleFiles(statePath string, spec *api.BypassSpec) {
+	for _, p := range []string{spec.SocketPath, spec.PidFilePath, statePath} {
+		if p == "" {
+			continue
+		}
+		if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logrus.WithError(err).Warnf("failed to remove %s", p)
+		}
+	}
+}
+
+func writeJSON(p string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	// write atomically not to leave a broken file
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+func readJSON(p string, v interface{}) error {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
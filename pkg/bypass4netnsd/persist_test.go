@@ -0,0 +1,114 @@
+package bypass4netnsd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rootless-containers/bypass4netns/pkg/api"
+	"github.com/rootless-containers/bypass4netns/pkg/api/com"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRestore(t *testing.T) {
+	dir := t.TempDir()
+	stateDir := filepath.Join(dir, "state")
+	sleepPath, err := exec.LookPath("sleep")
+	assert.Equal(t, nil, err)
+
+	// the process is "sleep" after exec, which is regarded as bypass4netns by the restarted driver
+	script := filepath.Join(dir, "bypass4netns")
+	assert.Equal(t, nil, os.WriteFile(script, []byte("#!/bin/sh\necho 1 >&3\nexec 3>&-\nexec sleep 60\n"), 0o755))
+	d := NewDriver(script, "com.sock")
+	d.StateDir = stateDir
+	assert.Equal(t, nil, d.Restore())
+	status, err := d.StartBypass(&api.BypassSpec{
+		ID:          "container0",
+		PortMapping: []api.PortSpec{{Protos: []string{"tcp"}, ParentPort: 8080, ChildPort: 80}},
+	})
+	assert.Equal(t, nil, err)
+	_, err = d.AddPort(api.PortSpec{Proto: "tcp", ParentPort: 8443, ChildIP: "10.4.0.2", ChildPort: 443})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, d.PostInterface("container0", d.children["container0"].token, testInterfaces("container0", "10.4.0.3")))
+	assert.Equal(t, nil, d.PostStats("container0", d.children["container0"].token, &com.Stats{ContainerID: "container0"}))
+	// the bypass4netns being stopped when bypass4netnsd exits
+	stoppingStatus, err := d.StartBypass(&api.BypassSpec{ID: "container2"})
+	assert.Equal(t, nil, err)
+
+	// the script notifies the readiness before exec
+	sleepExe, err := filepath.EvalSymlinks(sleepPath)
+	assert.Equal(t, nil, err)
+	for _, pid := range []int{status.Pid, stoppingStatus.Pid} {
+		assert.Eventually(t, func() bool {
+			exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+			return err == nil && exe == sleepExe
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	// the state of the dead process
+	staleSocket := filepath.Join(dir, "stale.sock")
+	assert.Equal(t, nil, os.WriteFile(staleSocket, nil, 0o600))
+	staleLog := filepath.Join(dir, "stale.log")
+	assert.Equal(t, nil, os.WriteFile(staleLog, nil, 0o600))
+	assert.Equal(t, nil, writeJSON(filepath.Join(stateDir, bypassStateDirName, "container1.json"), api.BypassStatus{
+		ID:   "container1",
+		Pid:  0x3fffffff,
+		Spec: api.BypassSpec{ID: "container1", SocketPath: staleSocket, LogFilePath: staleLog},
+	}))
+
+	// restart the driver. the old driver stops persisting the state as if it exited.
+	d.lock.Lock()
+	stoppingStatus.State = api.BypassStateStopping
+	d.saveStatus(*stoppingStatus)
+	d.StateDir = ""
+	d.lock.Unlock()
+	d2 := NewDriver(sleepPath, "com.sock")
+	d2.StateDir = stateDir
+	assert.Equal(t, nil, d2.Restore())
+	// the stop is resumed and the bypass is removed
+	assert.Eventually(t, func() bool {
+		return len(d2.ListBypass()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	_, err = os.Stat(d2.bypassStatePath("container2"))
+	assert.Equal(t, true, os.IsNotExist(err))
+	statuses := d2.ListBypass()
+	assert.Equal(t, 1, len(statuses))
+	assert.Equal(t, status.Pid, statuses[0].Pid)
+	assert.Equal(t, api.BypassStateRunning, statuses[0].State)
+	assert.Equal(t, 2, len(d2.ListPorts()))
+	// the adopted bypass4netns keeps its token
+	assert.NotEqual(t, "", d2.children["container0"].token)
+	assert.Equal(t, d.children["container0"].token, d2.children["container0"].token)
+	// the adopted bypass4netns is not restarted as it has already received the seccomp fd
+	assert.Equal(t, true, d2.children["container0"].attached)
+	_, err = os.Stat(staleSocket)
+	assert.Equal(t, true, os.IsNotExist(err))
+	// the log of the dead process is kept for debugging
+	_, err = os.Stat(staleLog)
+	assert.Equal(t, nil, err)
+	// the interfaces of the adopted bypass4netns are restored
+	ifs := d2.GetInterface("container0")
+	assert.NotEqual(t, nil, ifs)
+	assert.Equal(t, "10.4.0.3", ifs.Interfaces[0].Addresses[0].IP.String())
+	assert.Equal(t, true, ifs.ExpiresAt.After(time.Now()))
+
+	assert.Equal(t, nil, d2.StopBypass("container0"))
+	assert.Equal(t, 0, len(d2.ListBypass()))
+	entries, err := os.ReadDir(filepath.Join(stateDir, bypassStateDirName))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(entries))
+
+	// the process is not bypass4netns
+	d3 := NewDriver(script, "com.sock")
+	cmd := exec.Command(sleepPath, "60")
+	assert.Equal(t, nil, cmd.Start())
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+	_, err = d3.adoptProcess(cmd.Process.Pid)
+	assert.NotEqual(t, nil, err)
+}
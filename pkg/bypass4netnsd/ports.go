@@ -0,0 +1,325 @@
+package bypass4netnsd
+
+import (
+	"context"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/rootless-containers/bypass4netns/pkg/api"
+	"github.com/rootless-containers/bypass4netns/pkg/api/com"
+	"github.com/rootless-containers/bypass4netns/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+type portEntry struct {
+	status api.PortStatus
+	// fromSpec is true when the port is given by BypassSpec.PortMapping.
+	// Such ports are removed with the bypass4netns, while the others become pending again.
+	fromSpec bool
+}
+
+// portsWatch is the revision of the ports. protected by Driver.lock.
+type portsWatch struct {
+	// revision starts from the time in nanoseconds, so that the watchers receive the ports of the restarted bypass4netnsd.
+	revision uint64
+	// changed is closed and replaced on each change
+	changed chan struct{}
+}
+
+func newPortsWatch() portsWatch {
+	return portsWatch{
+		revision: uint64(time.Now().UnixNano()),
+		changed:  make(chan struct{}),
+	}
+}
+
+// portsChanged persists the ports and wakes up the watchers. d.lock must be held.
+func (d *Driver) portsChanged() {
+	d.savePorts()
+	w := &d.portsWatch
+	w.revision++
+	close(w.changed)
+	w.changed = make(chan struct{})
+}
+
+// ListPorts returns the ports forwarded by bypass4netns and the pending ports.
+func (d *Driver) ListPorts() []api.PortStatus {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	res := []api.PortStatus{}
+	for _, p := range d.sortedPorts() {
+		res = append(res, p.status)
+	}
+	return res
+}
+
+// AddPort adds the port to the bypass4netns of the container that has spec.ChildIP.
+// If no container has the address yet, the port is kept pending until the container registers its interfaces.
+func (d *Driver) AddPort(spec api.PortSpec) (*api.PortStatus, error) {
+	if err := normalizePortSpec(&spec); err != nil {
+		return nil, err
+	}
+	if err := d.checkRootlessKitPort(spec); err != nil {
+		return nil, err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for _, p := range d.ports {
+		if p.status.Spec.ParentPort == spec.ParentPort && sameParentIP(p.status.Spec.ParentIP, spec.ParentIP) {
+			return nil, api.Errorf(api.ErrorCodePortConflict, "parent port %d is already used by port %d", spec.ParentPort, p.status.ID)
+		}
+	}
+
+	entry := &portEntry{
+		status: api.PortStatus{
+			ID:    d.nextPortID,
+			Spec:  spec,
+			State: api.PortStatePending,
+		},
+	}
+	if id := d.lookupBypassByChildIP(spec.ChildIP); id != "" {
+		if err := d.checkChildPort(id, spec.ChildPort); err != nil {
+			return nil, err
+		}
+		entry.status.BypassID = id
+		entry.status.State = api.PortStateBypassed
+	}
+	d.nextPortID++
+	d.ports[entry.status.ID] = entry
+	d.portsChanged()
+
+	logrus.WithFields(logrus.Fields{"ID": util.ShrinkID(entry.status.BypassID)}).Infof("Added port %d (%s:%d -> %s:%d), state=%s",
+		entry.status.ID, spec.ParentIP, spec.ParentPort, spec.ChildIP, spec.ChildPort, entry.status.State)
+	status := entry.status
+	return &status, nil
+}
+
+// RemovePort removes the port. bypass4netns stops forwarding it on its next synchronization.
+func (d *Driver) RemovePort(id int) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if _, ok := d.ports[id]; !ok {
+		return api.Errorf(api.ErrorCodeNotFound, "port %d not found", id)
+	}
+	delete(d.ports, id)
+	d.portsChanged()
+	logrus.Infof("Removed port %d", id)
+	return nil
+}
+
+// GetForwardingPorts returns the ports to be forwarded by the bypass4netns.
+// The second return value is false when the bypass4netns is not managed by the driver.
+func (d *Driver) GetForwardingPorts(id string) ([]api.PortSpec, bool) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	if _, ok := d.bypass[id]; !ok {
+		return nil, false
+	}
+	return d.forwardingPorts(id), true
+}
+
+// WatchForwardingPorts returns the ports to be forwarded by the bypass4netns when they have changed after the revision.
+// It blocks until the ports are changed, or returns the same ports when ctx is done.
+// The second return value is false when the bypass4netns is not managed by the driver.
+func (d *Driver) WatchForwardingPorts(ctx context.Context, id string, revision uint64) (*com.PortsWatch, bool) {
+	for {
+		d.lock.RLock()
+		current := d.portsWatch.revision
+		changed := d.portsWatch.changed
+		d.lock.RUnlock()
+		if revision != current {
+			break
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	if _, ok := d.bypass[id]; !ok {
+		return nil, false
+	}
+	return &com.PortsWatch{
+		Revision: d.portsWatch.revision,
+		Ports:    d.forwardingPorts(id),
+	}, true
+}
+
+// forwardingPorts returns the ports assigned to the bypass4netns. d.lock must be held.
+func (d *Driver) forwardingPorts(id string) []api.PortSpec {
+	res := []api.PortSpec{}
+	for _, p := range d.sortedPorts() {
+		if p.status.BypassID == id {
+			res = append(res, p.status.Spec)
+		}
+	}
+	return res
+}
+
+// registerSpecPorts registers BypassSpec.PortMapping as ports of the bypass4netns.
+// d.lock must be held.
+func (d *Driver) registerSpecPorts(spec *api.BypassSpec) {
+	for _, port := range spec.PortMapping {
+		if port.Proto == "" && len(port.Protos) > 0 {
+			port.Proto = port.Protos[0]
+		}
+		d.ports[d.nextPortID] = &portEntry{
+			status: api.PortStatus{
+				ID:       d.nextPortID,
+				Spec:     port,
+				BypassID: spec.ID,
+				State:    api.PortStateBypassed,
+			},
+			fromSpec: true,
+		}
+		d.nextPortID++
+	}
+}
+
+// releasePorts removes the ports given by BypassSpec and makes the others pending.
+// d.lock must be held.
+func (d *Driver) releasePorts(id string) {
+	for portID, p := range d.ports {
+		if p.status.BypassID != id {
+			continue
+		}
+		if p.fromSpec {
+			delete(d.ports, portID)
+			continue
+		}
+		p.status.BypassID = ""
+		p.status.State = api.PortStatePending
+	}
+	d.portsChanged()
+}
+
+// assignPendingPorts assigns the pending ports to the bypass4netns whose container has the port's ChildIP.
+func (d *Driver) assignPendingPorts() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	assigned := false
+	for _, p := range d.sortedPorts() {
+		if p.status.State != api.PortStatePending {
+			continue
+		}
+		id := d.lookupBypassByChildIP(p.status.Spec.ChildIP)
+		if id == "" {
+			continue
+		}
+		logger := logrus.WithFields(logrus.Fields{"ID": util.ShrinkID(id)})
+		if err := d.checkChildPort(id, p.status.Spec.ChildPort); err != nil {
+			logger.WithError(err).Warnf("Cannot assign port %d", p.status.ID)
+			continue
+		}
+		p.status.BypassID = id
+		p.status.State = api.PortStateBypassed
+		logger.Infof("Assigned pending port %d", p.status.ID)
+		assigned = true
+	}
+	if assigned {
+		d.portsChanged()
+	}
+}
+
+// lookupBypassByChildIP returns the ID of the bypass4netns whose container has the address.
+// d.lock must be held.
+func (d *Driver) lookupBypassByChildIP(childIP string) string {
+	ip := net.ParseIP(childIP)
+	if ip == nil {
+		return ""
+	}
+
+	d.interfacesLock.RLock()
+	defer d.interfacesLock.RUnlock()
+	for id, contIfs := range d.containerInterfaces {
+		if _, ok := d.bypass[id]; !ok {
+			continue
+		}
+		for _, intf := range contIfs.Interfaces {
+			for _, addr := range intf.Addresses {
+				if addr.IP.Equal(ip) {
+					return id
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// checkChildPort checks that the child port is not forwarded by the bypass4netns yet.
+// d.lock must be held.
+func (d *Driver) checkChildPort(id string, childPort int) error {
+	for _, p := range d.ports {
+		if p.status.BypassID == id && p.status.Spec.ChildPort == childPort {
+			return api.Errorf(api.ErrorCodePortConflict, "child port %d is already forwarded by port %d", childPort, p.status.ID)
+		}
+	}
+	return nil
+}
+
+// sortedPorts returns the ports ordered by the ID.
+// d.lock must be held.
+func (d *Driver) sortedPorts() []*portEntry {
+	res := []*portEntry{}
+	for _, p := range d.ports {
+		res = append(res, p)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].status.ID < res[j].status.ID
+	})
+	return res
+}
+
+// normalizePortSpec converts rootlesskit's PortSpec to bypass4netns's one and validates it.
+func normalizePortSpec(spec *api.PortSpec) error {
+	if len(spec.Protos) == 0 {
+		if spec.Proto == "" {
+			return api.Errorf(api.ErrorCodeInvalidPort, "proto is not specified")
+		}
+		spec.Protos = []string{spec.Proto}
+	}
+	// rootlesskit's clients show Proto
+	if spec.Proto == "" {
+		spec.Proto = spec.Protos[0]
+	}
+	for _, proto := range spec.Protos {
+		switch proto {
+		case "tcp", "tcp4", "tcp6":
+		default:
+			return api.Errorf(api.ErrorCodeInvalidPort, "unsupported proto %q, only TCP is bypassed", proto)
+		}
+	}
+	if spec.ParentPort <= 0 || spec.ParentPort > 65535 {
+		return api.Errorf(api.ErrorCodeInvalidPort, "invalid parent port %d", spec.ParentPort)
+	}
+	if spec.ChildPort <= 0 || spec.ChildPort > 65535 {
+		return api.Errorf(api.ErrorCodeInvalidPort, "invalid child port %d", spec.ChildPort)
+	}
+	if spec.ParentIP != "" && net.ParseIP(spec.ParentIP) == nil {
+		return api.Errorf(api.ErrorCodeInvalidPort, "invalid parent IP %q", spec.ParentIP)
+	}
+	// bypass4netnsd has no way to find the container without the child IP
+	if net.ParseIP(spec.ChildIP) == nil {
+		return api.Errorf(api.ErrorCodeInvalidPort, "invalid child IP %q, the child IP is required to find the container", spec.ChildIP)
+	}
+	return nil
+}
+
+func sameParentIP(a, b string) bool {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	if ipA == nil || ipB == nil || ipA.IsUnspecified() || ipB.IsUnspecified() {
+		return true
+	}
+	return ipA.Equal(ipB)
+}
@@ -0,0 +1,180 @@
+package bypass4netnsd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rootless-containers/bypass4netns/pkg/api"
+	"github.com/rootless-containers/bypass4netns/pkg/api/com"
+	"github.com/rootless-containers/bypass4netns/pkg/api/daemon/router"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPorts(t *testing.T) {
+	d := NewDriver("bypass4netns", "com.sock")
+	spec := api.BypassSpec{
+		ID:          "container0",
+		PortMapping: []api.PortSpec{{Protos: []string{"tcp"}, ParentPort: 8080, ChildPort: 80}},
+	}
+	d.bypass[spec.ID] = api.BypassStatus{ID: spec.ID, Pid: 1, Spec: spec}
+	adoptWithoutToken(d, spec.ID)
+	d.registerSpecPorts(&spec)
+
+	// rootlesskit's PortSpec
+	status, err := d.AddPort(api.PortSpec{Proto: "tcp", ParentPort: 8443, ChildIP: "10.4.0.2", ChildPort: 443})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, api.PortStatePending, status.State)
+	assert.Equal(t, []string{"tcp"}, status.Spec.Protos)
+	assert.Equal(t, "tcp", status.Spec.Proto)
+
+	_, err = d.AddPort(api.PortSpec{Proto: "tcp", ParentPort: 8080, ChildIP: "10.4.0.2", ChildPort: 8080})
+	assert.NotEqual(t, nil, err)
+	_, err = d.AddPort(api.PortSpec{Proto: "udp", ParentPort: 5353, ChildIP: "10.4.0.2", ChildPort: 53})
+	assert.NotEqual(t, nil, err)
+	_, err = d.AddPort(api.PortSpec{Proto: "tcp", ParentPort: 2222, ChildPort: 22})
+	assert.NotEqual(t, nil, err)
+
+	ports, ok := d.GetForwardingPorts(spec.ID)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, 1, len(ports))
+
+	// the pending port is assigned once the container registers its address
+	d.PostInterface(spec.ID, "", &com.ContainerInterfaces{
+		ContainerID: spec.ID,
+		Interfaces: []com.Interface{{
+			Name:      "eth0",
+			Addresses: []net.IPNet{{IP: net.ParseIP("10.4.0.2"), Mask: net.CIDRMask(24, 32)}},
+		}},
+	})
+	statuses := d.ListPorts()
+	assert.Equal(t, 2, len(statuses))
+	assert.Equal(t, api.PortStateBypassed, statuses[1].State)
+	assert.Equal(t, spec.ID, statuses[1].BypassID)
+	// the ports given by the spec have the proto as well
+	assert.Equal(t, "tcp", statuses[0].Spec.Proto)
+	ports, _ = d.GetForwardingPorts(spec.ID)
+	assert.Equal(t, 2, len(ports))
+	assert.Equal(t, 8443, ports[1].ParentPort)
+
+	// the port given by the spec is removed with the bypass, the added one becomes pending again
+	delete(d.bypass, spec.ID)
+	d.releasePorts(spec.ID)
+	statuses = d.ListPorts()
+	assert.Equal(t, 1, len(statuses))
+	assert.Equal(t, api.PortStatePending, statuses[0].State)
+	_, ok = d.GetForwardingPorts(spec.ID)
+	assert.Equal(t, false, ok)
+
+	assert.Equal(t, nil, d.RemovePort(statuses[0].ID))
+	assert.NotEqual(t, nil, d.RemovePort(statuses[0].ID))
+	assert.Equal(t, 0, len(d.ListPorts()))
+}
+
+func TestWatchForwardingPorts(t *testing.T) {
+	d := NewDriver("bypass4netns", "com.sock")
+	spec := api.BypassSpec{
+		ID:          "container0",
+		PortMapping: []api.PortSpec{{Protos: []string{"tcp"}, ParentPort: 8080, ChildPort: 80}},
+	}
+	d.bypass[spec.ID] = api.BypassStatus{ID: spec.ID, Pid: 1, Spec: spec}
+	adoptWithoutToken(d, spec.ID)
+	d.registerSpecPorts(&spec)
+	d.PostInterface(spec.ID, "", testInterfaces(spec.ID, "10.4.0.2"))
+
+	// the first watch returns the ports
+	watch, ok := d.WatchForwardingPorts(context.Background(), spec.ID, 0)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, 1, len(watch.Ports))
+	rev := watch.Revision
+
+	// the watch returns the same ports without changes
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	watch, ok = d.WatchForwardingPorts(ctx, spec.ID, rev)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, rev, watch.Revision)
+	assert.Equal(t, 1, len(watch.Ports))
+
+	// the watch waits for the changes
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_, _ = d.AddPort(api.PortSpec{Proto: "tcp", ParentPort: 8443, ChildIP: "10.4.0.2", ChildPort: 443})
+	}()
+	watch, ok = d.WatchForwardingPorts(context.Background(), spec.ID, rev)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, rev+1, watch.Revision)
+	assert.Equal(t, 2, len(watch.Ports))
+	assert.Equal(t, 8443, watch.Ports[1].ParentPort)
+
+	// the watchers are woken up when the bypass4netns is stopped
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		delete(d.bypass, spec.ID)
+		d.releasePorts(spec.ID)
+	}()
+	_, ok = d.WatchForwardingPorts(context.Background(), spec.ID, watch.Revision)
+	assert.Equal(t, false, ok)
+}
+
+type fakeRootlessKit struct {
+	ports []api.PortStatus
+}
+
+func (f *fakeRootlessKit) ListPorts() []api.PortStatus {
+	return f.ports
+}
+
+func (f *fakeRootlessKit) AddPort(api.PortSpec) (*api.PortStatus, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (f *fakeRootlessKit) RemovePort(int) error {
+	return errors.New("not implemented")
+}
+
+func TestResolvePortConflicts(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "api.sock")
+	r := mux.NewRouter()
+	router.AddRoutes(r, &router.Backend{PortDriver: &fakeRootlessKit{
+		ports: []api.PortStatus{{ID: 1, Spec: api.PortSpec{Proto: "tcp", ParentIP: "0.0.0.0", ParentPort: 8080, ChildPort: 80}}},
+	}})
+	l, err := net.Listen("unix", socketPath)
+	assert.Equal(t, nil, err)
+	srv := &http.Server{Handler: r}
+	go func() {
+		_ = srv.Serve(l)
+	}()
+	defer srv.Close()
+
+	d := NewDriver("bypass4netns", "com.sock")
+	d.RootlessKitAPISocketPath = socketPath
+	newSpec := func() *api.BypassSpec {
+		return &api.BypassSpec{
+			ID: "container0",
+			PortMapping: []api.PortSpec{
+				{Protos: []string{"tcp"}, ParentPort: 8080, ChildPort: 80},
+				{Protos: []string{"tcp"}, ParentPort: 8443, ChildPort: 443},
+			},
+		}
+	}
+
+	d.PortConflictPolicy = PortConflictPolicyReject
+	assert.NotEqual(t, nil, d.resolvePortConflicts(newSpec()))
+
+	d.PortConflictPolicy = PortConflictPolicyReconcile
+	spec := newSpec()
+	assert.Equal(t, nil, d.resolvePortConflicts(spec))
+	assert.Equal(t, 1, len(spec.PortMapping))
+	assert.Equal(t, 8443, spec.PortMapping[0].ParentPort)
+
+	_, err = d.AddPort(api.PortSpec{Proto: "tcp", ParentPort: 8080, ChildIP: "10.4.0.2", ChildPort: 80})
+	assert.NotEqual(t, nil, err)
+}
@@ -0,0 +1,103 @@
+package bypass4netnsd
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/rootless-containers/bypass4netns/pkg/api"
+	"github.com/rootless-containers/bypass4netns/pkg/api/daemon/client"
+	"github.com/rootless-containers/bypass4netns/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+type PortConflictPolicy string
+
+const (
+	// PortConflictPolicyReject rejects the BypassSpec that has a port forwarded by rootlesskit
+	PortConflictPolicyReject PortConflictPolicy = "reject"
+	// PortConflictPolicyReconcile leaves the conflicting ports to rootlesskit and bypasses the others
+	PortConflictPolicyReconcile PortConflictPolicy = "reconcile"
+)
+
+const rootlessKitAPITimeout = 5 * time.Second
+
+// resolvePortConflicts checks spec.PortMapping against the ports forwarded by rootlesskit.
+// The host bind by bypass4netns fails for such ports, so they are rejected or removed from spec
+// according to d.PortConflictPolicy.
+func (d *Driver) resolvePortConflicts(spec *api.BypassSpec) error {
+	if d.RootlessKitAPISocketPath == "" || len(spec.PortMapping) == 0 {
+		return nil
+	}
+	logger := logrus.WithFields(logrus.Fields{"ID": util.ShrinkID(spec.ID)})
+	forwarded, err := d.listRootlessKitPorts()
+	if err != nil {
+		logger.WithError(err).Warn("failed to list ports forwarded by rootlesskit, skipping conflict check")
+		return nil
+	}
+
+	ports := []api.PortSpec{}
+	for _, port := range spec.PortMapping {
+		conflict := conflictingPort(forwarded, port)
+		if conflict == nil {
+			ports = append(ports, port)
+			continue
+		}
+		if d.PortConflictPolicy != PortConflictPolicyReconcile {
+			return api.Errorf(api.ErrorCodePortConflict, "parent port %d is already forwarded by rootlesskit (port %d)", port.ParentPort, conflict.ID)
+		}
+		logger.Warnf("parent port %d is already forwarded by rootlesskit (port %d), leaving it to rootlesskit", port.ParentPort, conflict.ID)
+	}
+	spec.PortMapping = ports
+	return nil
+}
+
+// checkRootlessKitPort returns an error if the port is forwarded by rootlesskit.
+func (d *Driver) checkRootlessKitPort(port api.PortSpec) error {
+	if d.RootlessKitAPISocketPath == "" {
+		return nil
+	}
+	forwarded, err := d.listRootlessKitPorts()
+	if err != nil {
+		logrus.WithError(err).Warn("failed to list ports forwarded by rootlesskit, skipping conflict check")
+		return nil
+	}
+	if conflict := conflictingPort(forwarded, port); conflict != nil {
+		return api.Errorf(api.ErrorCodePortConflict, "parent port %d is already forwarded by rootlesskit (port %d)", port.ParentPort, conflict.ID)
+	}
+	return nil
+}
+
+// listRootlessKitPorts lists the ports with rootlesskit's API, or with a stand-in serving the same API.
+func (d *Driver) listRootlessKitPorts() ([]api.PortStatus, error) {
+	c, err := client.New(d.RootlessKitAPISocketPath)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), rootlessKitAPITimeout)
+	defer cancel()
+	return c.PortManager().ListPorts(ctx)
+}
+
+// conflictingPort returns the forwarded TCP port that has the same parent port as port.
+func conflictingPort(forwarded []api.PortStatus, port api.PortSpec) *api.PortStatus {
+	for i := range forwarded {
+		f := &forwarded[i]
+		if !isTCP(f.Spec) {
+			continue
+		}
+		if f.Spec.ParentPort == port.ParentPort && sameParentIP(f.Spec.ParentIP, port.ParentIP) {
+			return f
+		}
+	}
+	return nil
+}
+
+func isTCP(spec api.PortSpec) bool {
+	for _, proto := range append([]string{spec.Proto}, spec.Protos...) {
+		if strings.HasPrefix(proto, "tcp") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,254 @@
+package bypass4netnsd
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/rootless-containers/bypass4netns/pkg/api"
+	"github.com/rootless-containers/bypass4netns/pkg/util"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// child is a bypass4netns process, or a bypass4netns running in-process, supervised by the driver
+type child struct {
+	// proc is nil for the bypass4netns running in-process
+	proc *os.Process
+	// cmd is nil when the process is adopted after the restart of bypass4netnsd
+	cmd *exec.Cmd
+	// pidfd is used to wait for the adopted process, which cannot be reaped by the driver
+	pidfd int
+	// done is closed when the process exits
+	done chan struct{}
+	// cancel stops the bypass4netns running in-process
+	cancel context.CancelFunc
+	// err is the result of the bypass4netns running in-process. it is set before done is closed.
+	err error
+	// token is issued to the bypass4netns for posting its interfaces and stats.
+	// empty when it is adopted from the state persisted without the token.
+	token string
+	// stopped is set by StopBypass not to restart the process. protected by Driver.lock.
+	stopped bool
+	// stopping is closed when the bypass is stopped. protected by Driver.lock.
+	stopping chan struct{}
+	// attached is set when the bypass4netns reports its stats, as it does so as soon as it receives the seccomp fd.
+	// It is persisted not to restart the adopted process that cannot receive the fd again. protected by Driver.lock.
+	attached bool
+}
+
+const (
+	defaultRestartBackoff = 500 * time.Millisecond
+	maxRestartBackoff     = 30 * time.Second
+	// defaultReadyTimeout is the time to wait for the ready notification of bypass4netns
+	defaultReadyTimeout = 30 * time.Second
+)
+
+func validateRestartPolicy(policy api.RestartPolicy) error {
+	switch policy.Name {
+	case "", api.RestartPolicyNo, api.RestartPolicyOnFailure, api.RestartPolicyAlways:
+	default:
+		return api.Errorf(api.ErrorCodeInvalidRestartPolicy, "unknown restart policy %q", policy.Name)
+	}
+	if policy.MaximumRetryCount < 0 {
+		return api.Errorf(api.ErrorCodeInvalidRestartPolicy, "invalid maximum retry count %d", policy.MaximumRetryCount)
+	}
+	return nil
+}
+
+func shouldRestart(policy api.RestartPolicy, exitCode, restarts int) bool {
+	if policy.MaximumRetryCount > 0 && restarts >= policy.MaximumRetryCount {
+		return false
+	}
+	switch policy.Name {
+	case api.RestartPolicyAlways:
+		return true
+	case api.RestartPolicyOnFailure:
+		return exitCode != 0
+	default:
+		return false
+	}
+}
+
+// restartBackoff doubles the delay for each restart
+func (d *Driver) restartBackoff(restarts int) time.Duration {
+	backoff := d.restartBackoffBase
+	for i := 0; i < restarts && backoff < maxRestartBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxRestartBackoff)
+}
+
+// supervise reaps the child, records its exit status and restarts it according to the restart policy.
+// It returns when the child is stopped by StopBypass or is not restarted any more.
+//
+// NOTE: the restarted bypass4netns cannot receive the seccomp fd of the running container again,
+// so the child that has received it is marked failed instead of being restarted.
+func (d *Driver) supervise(id string, c *child) {
+	logger := logrus.WithFields(logrus.Fields{"ID": util.ShrinkID(id)})
+	exitCode, exitErr := waitChild(c)
+	for {
+		restart, backoff := d.onChildExit(id, c, exitCode, exitErr)
+		if !restart {
+			return
+		}
+		logger.Infof("Restarting bypass4netns in %s", backoff)
+		time.Sleep(backoff)
+
+		next, err := d.restartChild(id, c)
+		if err != nil {
+			logger.WithError(err).Error("Failed to restart bypass4netns")
+			exitCode, exitErr = -1, err
+			continue
+		}
+		if next == nil {
+			return
+		}
+		c = next
+		exitCode, exitErr = waitChild(c)
+	}
+}
+
+// pid returns the pid of the process, or the pid of bypass4netnsd for the bypass4netns running in-process.
+func (c *child) pid() int {
+	if c.proc == nil {
+		return os.Getpid()
+	}
+	return c.proc.Pid
+}
+
+// alive returns true if the process or the in-process bypass4netns is running.
+func (c *child) alive() bool {
+	if c.proc == nil {
+		select {
+		case <-c.done:
+			return false
+		default:
+			return true
+		}
+	}
+	return c.proc.Signal(unix.Signal(0)) == nil
+}
+
+// kill stops the child not supervised yet and reaps it
+func (c *child) kill() {
+	if c.proc == nil {
+		c.cancel()
+		<-c.done
+		return
+	}
+	if err := c.proc.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		logrus.WithError(err).Warnf("Failed to kill bypass4netns pid=%d", c.proc.Pid)
+	}
+	_, _ = waitChild(c)
+}
+
+func waitChild(c *child) (int, error) {
+	if c.proc == nil {
+		// done is closed by the goroutine running the bypass4netns
+		<-c.done
+		if c.err != nil {
+			return 1, c.err
+		}
+		return 0, nil
+	}
+	if c.cmd == nil {
+		err := waitPidfd(c.pidfd)
+		unix.Close(c.pidfd)
+		close(c.done)
+		if err != nil {
+			return -1, err
+		}
+		return -1, errors.New("adopted process exited, the exit status is unknown")
+	}
+	err := c.cmd.Wait()
+	close(c.done)
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return -1, err
+	}
+	return c.cmd.ProcessState.ExitCode(), err
+}
+
+// onChildExit records the exit status and returns whether the child should be restarted.
+func (d *Driver) onChildExit(id string, c *child, exitCode int, exitErr error) (bool, time.Duration) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if c.stopped || d.children[id] != c {
+		return false, 0
+	}
+	logger := logrus.WithFields(logrus.Fields{"ID": util.ShrinkID(id)})
+	status := d.bypass[id]
+	status.ExitCode = exitCode
+	status.ExitError = ""
+	if exitErr != nil {
+		status.ExitError = exitErr.Error()
+	}
+	restart := shouldRestart(status.Spec.RestartPolicy, exitCode, status.Restarts)
+	if c.attached {
+		restart = false
+		status.State = api.BypassStateFailed
+	} else if restart {
+		status.State = api.BypassStateRestarting
+	} else {
+		status.State = api.BypassStateExited
+	}
+	d.bypass[id] = status
+	d.saveStatus(status)
+	logger.Warnf("bypass4netns pid=%d exited unexpectedly (exitCode=%d, restarts=%d, state=%s)", status.Pid, exitCode, status.Restarts, status.State)
+	return restart, d.restartBackoff(status.Restarts)
+}
+
+// restartChild starts the new process of the child.
+// It returns nil without error when the child is stopped while waiting for the backoff or starting.
+// The process is started without holding d.lock, not to block the API while it becomes ready.
+func (d *Driver) restartChild(id string, c *child) (*child, error) {
+	d.lock.Lock()
+	if c.stopped || d.children[id] != c {
+		d.lock.Unlock()
+		return nil, nil
+	}
+	status := d.bypass[id]
+	status.Restarts++
+	d.bypass[id] = status
+	d.saveStatus(status)
+	spec := status.Spec
+	d.lock.Unlock()
+
+	next, err := d.start(&spec)
+	if err != nil {
+		return nil, err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if c.stopped || d.children[id] != c {
+		logrus.WithFields(logrus.Fields{"ID": util.ShrinkID(id)}).Info("bypass4netns is stopped while restarting")
+		next.kill()
+		return nil, nil
+	}
+	status = d.bypass[id]
+	status.Pid = next.pid()
+	status.State = api.BypassStateRunning
+	status.StartedAt = time.Now()
+	d.bypass[id] = status
+	d.children[id] = next
+	d.saveStatus(status)
+	logrus.WithFields(logrus.Fields{"ID": util.ShrinkID(id)}).Infof("Restarted bypass4netns pid=%d (restarts=%d)", status.Pid, status.Restarts)
+	return next, nil
+}
+
+// waitPidfd blocks until the process of pidfd exits
+func waitPidfd(pidfd int) error {
+	fds := []unix.PollFd{{Fd: int32(pidfd), Events: unix.POLLIN}}
+	for {
+		_, err := unix.Poll(fds, -1)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		return err
+	}
+}
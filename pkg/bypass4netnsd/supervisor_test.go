@@ -0,0 +1,173 @@
+package bypass4netnsd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rootless-containers/bypass4netns/pkg/api"
+	"github.com/rootless-containers/bypass4netns/pkg/api/com"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeBypass4netns notifies the readiness and exits with the given code
+func fakeBypass4netns(t *testing.T, exitCode string) string {
+	p := filepath.Join(t.TempDir(), "bypass4netns")
+	script := "#!/bin/sh\necho 1 >&3\nexec 3>&-\nsleep 0.1\nexit " + exitCode + "\n"
+	assert.Equal(t, nil, os.WriteFile(p, []byte(script), 0o755))
+	return p
+}
+
+func waitForState(t *testing.T, d *Driver, id string, state api.BypassState) api.BypassStatus {
+	for i := 0; i < 100; i++ {
+		for _, st := range d.ListBypass() {
+			if st.ID == id && st.State == state {
+				return st
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("bypass %s did not become %s", id, state)
+	return api.BypassStatus{}
+}
+
+func TestSupervisorRestart(t *testing.T) {
+	d := NewDriver(fakeBypass4netns(t, "1"), "com.sock")
+	d.restartBackoffBase = 10 * time.Millisecond
+	spec := &api.BypassSpec{
+		ID: "container0",
+		RestartPolicy: api.RestartPolicy{
+			Name:              api.RestartPolicyOnFailure,
+			MaximumRetryCount: 2,
+		},
+	}
+	_, err := d.StartBypass(spec)
+	assert.Equal(t, nil, err)
+
+	status := waitForState(t, d, spec.ID, api.BypassStateExited)
+	assert.Equal(t, 2, status.Restarts)
+	assert.Equal(t, 1, status.ExitCode)
+
+	// the exited bypass is removed without error
+	assert.Equal(t, nil, d.StopBypass(spec.ID))
+	assert.Equal(t, 0, len(d.ListBypass()))
+}
+
+func TestSupervisorNoRestart(t *testing.T) {
+	d := NewDriver(fakeBypass4netns(t, "0"), "com.sock")
+	spec := &api.BypassSpec{
+		ID:            "container0",
+		RestartPolicy: api.RestartPolicy{Name: api.RestartPolicyOnFailure},
+	}
+	_, err := d.StartBypass(spec)
+	assert.Equal(t, nil, err)
+
+	status := waitForState(t, d, spec.ID, api.BypassStateExited)
+	assert.Equal(t, 0, status.Restarts)
+	assert.Equal(t, 0, status.ExitCode)
+
+	_, err = d.StartBypass(&api.BypassSpec{ID: "container1", RestartPolicy: api.RestartPolicy{Name: "unless-stopped"}})
+	assert.NotEqual(t, nil, err)
+}
+
+func TestSupervisorFailed(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "bypass4netns")
+	script := "#!/bin/sh\necho 1 >&3\nexec 3>&-\nsleep 0.5\nexit 1\n"
+	assert.Equal(t, nil, os.WriteFile(p, []byte(script), 0o755))
+	d := NewDriver(p, "com.sock")
+	d.restartBackoffBase = 10 * time.Millisecond
+	spec := &api.BypassSpec{
+		ID:            "container0",
+		RestartPolicy: api.RestartPolicy{Name: api.RestartPolicyAlways},
+	}
+	_, err := d.StartBypass(spec)
+	assert.Equal(t, nil, err)
+	// bypass4netns reports the stats when it receives the seccomp fd
+	err = d.PostStats(spec.ID, d.children[spec.ID].token, &com.Stats{ContainerID: spec.ID})
+	assert.Equal(t, nil, err)
+
+	// the restarted process cannot receive the fd again
+	status := waitForState(t, d, spec.ID, api.BypassStateFailed)
+	assert.Equal(t, 0, status.Restarts)
+	assert.Equal(t, 1, status.ExitCode)
+	assert.Equal(t, nil, d.StopBypass(spec.ID))
+}
+
+func TestSpawnReadyTimeout(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "bypass4netns")
+	assert.Equal(t, nil, os.WriteFile(p, []byte("#!/bin/sh\nexec sleep 60\n"), 0o755))
+	d := NewDriver(p, "com.sock")
+	d.readyTimeout = 100 * time.Millisecond
+
+	begin := time.Now()
+	_, err := d.StartBypass(&api.BypassSpec{ID: "container0"})
+	assert.NotEqual(t, nil, err)
+	assert.Less(t, time.Since(begin), 5*time.Second)
+	assert.Equal(t, 0, len(d.ListBypass()))
+}
+
+func TestStopBypassAsync(t *testing.T) {
+	// bypass4netns that ignores SIGTERM
+	p := filepath.Join(t.TempDir(), "bypass4netns")
+	script := "#!/bin/sh\ntrap '' TERM\necho 1 >&3\nexec 3>&-\nwhile :; do sleep 0.1; done\n"
+	assert.Equal(t, nil, os.WriteFile(p, []byte(script), 0o755))
+	d := NewDriver(p, "com.sock")
+	d.StopGracePeriod = 500 * time.Millisecond
+
+	_, err := d.StartBypass(&api.BypassSpec{ID: "container0"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, d.StopBypassAsync("container0"))
+	// the driver is not blocked while stopping
+	statuses := d.ListBypass()
+	assert.Equal(t, 1, len(statuses))
+	assert.Equal(t, api.BypassStateStopping, statuses[0].State)
+	_, err = d.StartBypass(&api.BypassSpec{ID: "container0"})
+	assert.NotEqual(t, nil, err)
+
+	// killed after the grace period
+	begin := time.Now()
+	assert.Equal(t, nil, d.StopBypass("container0"))
+	assert.Equal(t, 0, len(d.ListBypass()))
+	assert.Less(t, time.Since(begin), 5*time.Second)
+}
+
+func TestGetBypass(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "bypass4netns")
+	assert.Equal(t, nil, os.WriteFile(p, []byte("#!/bin/sh\necho 1 >&3\nexec 3>&-\nexec sleep 60\n"), 0o755))
+	d := NewDriver(p, "com.sock")
+
+	// listen on a host port as bypass4netns does
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	defer l.Close()
+	boundPort := l.Addr().(*net.TCPAddr).Port
+
+	_, err = d.StartBypass(&api.BypassSpec{
+		ID: "container0",
+		PortMapping: []api.PortSpec{
+			{Protos: []string{"tcp"}, ParentIP: "127.0.0.1", ParentPort: boundPort, ChildPort: 80},
+		},
+	})
+	assert.Equal(t, nil, err)
+	defer func() {
+		_ = d.StopBypass("container0")
+	}()
+	err = d.PostStats("container0", d.children["container0"].token, &com.Stats{
+		ContainerID: "container0",
+		Sockets:     api.SocketStats{Bypassed: 2, NonBypassable: 3},
+	})
+	assert.Equal(t, nil, err)
+
+	info, err := d.GetBypass("container0")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, info.Alive)
+	assert.Equal(t, 1, len(info.Ports))
+	assert.Equal(t, true, info.Ports[0].Bound)
+	assert.Equal(t, uint64(2), info.Sockets.Bypassed)
+	assert.Equal(t, uint64(3), info.Sockets.NonBypassable)
+
+	_, err = d.GetBypass("container1")
+	assert.NotEqual(t, nil, err)
+}
@@ -0,0 +1,159 @@
+package bypass4netnsd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rootless-containers/bypass4netns/pkg/api"
+	"golang.org/x/sys/unix"
+)
+
+// maxSocketPathLen is the size of sockaddr_un.sun_path without the terminating null
+const maxSocketPathLen = 107
+
+// validateID validates the ID, which is used as a file name in the state directory
+func validateID(id string) error {
+	if id == "" || id == "." || id == ".." || strings.ContainsAny(id, "/\x00") {
+		return api.Errorf(api.ErrorCodeInvalidID, "invalid id %q", id)
+	}
+	return nil
+}
+
+// validateSpec validates the spec before spawning bypass4netns,
+// as the errors of bypass4netns are reported only as its exit.
+func validateSpec(spec *api.BypassSpec) error {
+	if err := validateID(spec.ID); err != nil {
+		return err
+	}
+	if err := validateSpecPorts(spec.PortMapping); err != nil {
+		return err
+	}
+	for _, subnet := range spec.IgnoreSubnets {
+		if subnet == "auto" {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(subnet); err != nil {
+			return api.Errorf(api.ErrorCodeInvalidSubnet, "invalid subnet %q, expected CIDR or \"auto\"", subnet)
+		}
+	}
+	if len(spec.SocketPath) > maxSocketPathLen {
+		return api.Errorf(api.ErrorCodeInvalidPath, "socket path %q is longer than %d bytes", spec.SocketPath, maxSocketPathLen)
+	}
+	for _, p := range []struct{ name, path string }{
+		{"socket path", spec.SocketPath},
+		{"pid file path", spec.PidFilePath},
+		{"log file path", spec.LogFilePath},
+	} {
+		if err := validatePath(p.path); err != nil {
+			return api.Errorf(api.ErrorCodeInvalidPath, "invalid %s %q: %v", p.name, p.path, err)
+		}
+	}
+	return validateRestartPolicy(spec.RestartPolicy)
+}
+
+func validateSpecPorts(ports []api.PortSpec) error {
+	for i, port := range ports {
+		if port.ParentPort <= 0 || port.ParentPort > 65535 {
+			return api.Errorf(api.ErrorCodeInvalidPort, "invalid parent port %d", port.ParentPort)
+		}
+		if port.ChildPort <= 0 || port.ChildPort > 65535 {
+			return api.Errorf(api.ErrorCodeInvalidPort, "invalid child port %d", port.ChildPort)
+		}
+		if port.ParentIP != "" && net.ParseIP(port.ParentIP) == nil {
+			return api.Errorf(api.ErrorCodeInvalidPort, "invalid parent IP %q", port.ParentIP)
+		}
+		for _, other := range ports[:i] {
+			if other.ParentPort == port.ParentPort && sameParentIP(other.ParentIP, port.ParentIP) {
+				return api.Errorf(api.ErrorCodePortConflict, "parent port %d is specified multiple times", port.ParentPort)
+			}
+			// bypass4netns looks up the forwarded ports by the child port
+			if other.ChildPort == port.ChildPort {
+				return api.Errorf(api.ErrorCodePortConflict, "child port %d is specified multiple times", port.ChildPort)
+			}
+		}
+	}
+	return nil
+}
+
+// validatePath checks that bypass4netns can create the file at p.
+// An empty path is valid, as bypass4netns does not create the file or uses its default.
+func validatePath(p string) error {
+	if p == "" {
+		return nil
+	}
+	if !filepath.IsAbs(p) {
+		return fmt.Errorf("not an absolute path")
+	}
+	if st, err := os.Stat(p); err == nil && st.IsDir() {
+		return fmt.Errorf("is a directory")
+	}
+	dir := filepath.Dir(p)
+	st, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !st.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	if err := unix.Access(dir, unix.W_OK); err != nil {
+		return fmt.Errorf("%s is not writable: %w", dir, err)
+	}
+	return nil
+}
+
+// checkSpecConflicts checks the spec against the running and starting bypass4netns.
+// The exited bypass4netns does not conflict, and the one with the same ID is replaced.
+// d.lock must be held.
+func (d *Driver) checkSpecConflicts(spec *api.BypassSpec) error {
+	if old, ok := d.bypass[spec.ID]; ok {
+		switch old.State {
+		case api.BypassStateExited:
+		case api.BypassStateStopping:
+			return api.Errorf(api.ErrorCodeIDConflict, "child %s is being stopped", spec.ID)
+		default:
+			return api.Errorf(api.ErrorCodeIDConflict, "child %s already exists", spec.ID)
+		}
+	}
+	if _, ok := d.starting[spec.ID]; ok {
+		return api.Errorf(api.ErrorCodeIDConflict, "child %s is being started", spec.ID)
+	}
+
+	others := []*api.BypassSpec{}
+	for id := range d.bypass {
+		status := d.bypass[id]
+		if status.State != api.BypassStateExited {
+			others = append(others, &status.Spec)
+		}
+	}
+	for _, other := range d.starting {
+		others = append(others, other)
+	}
+	for _, other := range others {
+		for _, p := range []string{spec.SocketPath, spec.PidFilePath, spec.LogFilePath} {
+			if p == "" {
+				continue
+			}
+			if p == other.SocketPath || p == other.PidFilePath || p == other.LogFilePath {
+				return api.Errorf(api.ErrorCodePathConflict, "%s is used by child %s", p, other.ID)
+			}
+		}
+		for _, port := range spec.PortMapping {
+			for _, otherPort := range other.PortMapping {
+				if otherPort.ParentPort == port.ParentPort && sameParentIP(otherPort.ParentIP, port.ParentIP) {
+					return api.Errorf(api.ErrorCodePortConflict, "parent port %d is used by child %s", port.ParentPort, other.ID)
+				}
+			}
+		}
+	}
+	for _, port := range spec.PortMapping {
+		for _, p := range d.ports {
+			if !p.fromSpec && p.status.Spec.ParentPort == port.ParentPort && sameParentIP(p.status.Spec.ParentIP, port.ParentIP) {
+				return api.Errorf(api.ErrorCodePortConflict, "parent port %d is used by port %d", port.ParentPort, p.status.ID)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package bypass4netnsd
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rootless-containers/bypass4netns/pkg/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func errorCode(err error) api.ErrorCode {
+	var apiErr *api.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code
+	}
+	return ""
+}
+
+func TestValidateSpec(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	assert.Equal(t, nil, os.WriteFile(file, nil, 0o600))
+
+	testCases := []struct {
+		spec api.BypassSpec
+		code api.ErrorCode
+	}{
+		{api.BypassSpec{ID: "container0", SocketPath: filepath.Join(dir, "b4nn.sock"), IgnoreSubnets: []string{"127.0.0.0/8", "auto"}}, ""},
+		{api.BypassSpec{ID: ""}, api.ErrorCodeInvalidID},
+		{api.BypassSpec{ID: "../container0"}, api.ErrorCodeInvalidID},
+		{api.BypassSpec{ID: "container0", PortMapping: []api.PortSpec{{ParentPort: 0, ChildPort: 80}}}, api.ErrorCodeInvalidPort},
+		{api.BypassSpec{ID: "container0", PortMapping: []api.PortSpec{{ParentPort: 8080, ChildPort: 65536}}}, api.ErrorCodeInvalidPort},
+		{api.BypassSpec{ID: "container0", PortMapping: []api.PortSpec{{ParentIP: "localhost", ParentPort: 8080, ChildPort: 80}}}, api.ErrorCodeInvalidPort},
+		{api.BypassSpec{ID: "container0", PortMapping: []api.PortSpec{{ParentPort: 8080, ChildPort: 80}, {ParentPort: 8080, ChildPort: 81}}}, api.ErrorCodePortConflict},
+		{api.BypassSpec{ID: "container0", PortMapping: []api.PortSpec{{ParentPort: 8080, ChildPort: 80}, {ParentPort: 8081, ChildPort: 80}}}, api.ErrorCodePortConflict},
+		{api.BypassSpec{ID: "container0", PortMapping: []api.PortSpec{{ParentIP: "127.0.0.1", ParentPort: 8080, ChildPort: 80}, {ParentIP: "127.0.0.2", ParentPort: 8080, ChildPort: 81}}}, ""},
+		{api.BypassSpec{ID: "container0", IgnoreSubnets: []string{"10.0.0.1"}}, api.ErrorCodeInvalidSubnet},
+		{api.BypassSpec{ID: "container0", SocketPath: "b4nn.sock"}, api.ErrorCodeInvalidPath},
+		{api.BypassSpec{ID: "container0", SocketPath: "/" + strings.Repeat("a", maxSocketPathLen)}, api.ErrorCodeInvalidPath},
+		{api.BypassSpec{ID: "container0", PidFilePath: filepath.Join(dir, "not-exist", "b4nn.pid")}, api.ErrorCodeInvalidPath},
+		{api.BypassSpec{ID: "container0", LogFilePath: filepath.Join(file, "b4nn.log")}, api.ErrorCodeInvalidPath},
+		{api.BypassSpec{ID: "container0", LogFilePath: dir}, api.ErrorCodeInvalidPath},
+		{api.BypassSpec{ID: "container0", RestartPolicy: api.RestartPolicy{Name: "sometimes"}}, api.ErrorCodeInvalidRestartPolicy},
+	}
+	for _, tc := range testCases {
+		err := validateSpec(&tc.spec)
+		assert.Equal(t, tc.code, errorCode(err), "spec=%+v, err=%v", tc.spec, err)
+	}
+}
+
+func TestStartBypassConflicts(t *testing.T) {
+	exe := filepath.Join(t.TempDir(), "bypass4netns")
+	assert.Equal(t, nil, os.WriteFile(exe, []byte("#!/bin/sh\necho 1 >&3\nexec 3>&-\nexec sleep 10\n"), 0o755))
+	d := NewDriver(exe, "com.sock")
+	dir := t.TempDir()
+
+	spec := &api.BypassSpec{
+		ID:          "container0",
+		SocketPath:  filepath.Join(dir, "container0.sock"),
+		PortMapping: []api.PortSpec{{ParentPort: 8080, ChildPort: 80}},
+	}
+	_, err := d.StartBypass(spec)
+	assert.Equal(t, nil, err)
+	defer d.StopBypass(spec.ID)
+
+	_, err = d.StartBypass(&api.BypassSpec{ID: "container0"})
+	assert.Equal(t, api.ErrorCodeIDConflict, errorCode(err))
+
+	_, err = d.StartBypass(&api.BypassSpec{ID: "container1", SocketPath: spec.SocketPath})
+	assert.Equal(t, api.ErrorCodePathConflict, errorCode(err))
+
+	_, err = d.StartBypass(&api.BypassSpec{ID: "container1", PortMapping: []api.PortSpec{{ParentPort: 8080, ChildPort: 8080}}})
+	assert.Equal(t, api.ErrorCodePortConflict, errorCode(err))
+
+	err = d.StopBypass("container1")
+	assert.Equal(t, api.ErrorCodeNotFound, errorCode(err))
+	assert.Equal(t, 1, len(d.ListBypass()))
+}
@@ -0,0 +1,108 @@
+package bypass4netnsd
+
+import (
+	"context"
+	"time"
+
+	"github.com/rootless-containers/bypass4netns/pkg/api/com"
+)
+
+// maxInterfacesEvents is the number of the events kept for WatchInterfaces.
+// The watchers older than them receive the snapshot.
+const maxInterfacesEvents = 1024
+
+// interfacesWatch is the revision and the history of the registered interfaces. protected by Driver.interfacesLock.
+type interfacesWatch struct {
+	// revision starts from the time in nanoseconds, so that the revisions of the watchers are older than
+	// the history of the restarted bypass4netnsd and they receive the snapshot.
+	revision uint64
+	events   []com.InterfacesEvent
+	// changed is closed and replaced on each change
+	changed chan struct{}
+}
+
+func newInterfacesWatch() interfacesWatch {
+	return interfacesWatch{
+		revision: uint64(time.Now().UnixNano()),
+		changed:  make(chan struct{}),
+	}
+}
+
+// recordInterfacesEvent records the change of the interfaces and wakes up the watchers.
+// Re-posting the same interfaces is not recorded, and false is returned. d.interfacesLock must be held.
+func (d *Driver) recordInterfacesEvent(typ com.InterfacesEventType, id string, ifs *com.ContainerInterfaces) bool {
+	old, ok := d.containerInterfaces[id]
+	switch typ {
+	case com.InterfacesEventPut:
+		if ok && old.Equal(*ifs) {
+			return false
+		}
+	case com.InterfacesEventDelete:
+		if !ok {
+			return false
+		}
+	}
+	w := &d.interfacesWatch
+	w.revision++
+	ev := com.InterfacesEvent{
+		Revision:    w.revision,
+		Type:        typ,
+		ContainerID: id,
+	}
+	if ifs != nil {
+		copied := *ifs
+		ev.Interfaces = &copied
+	}
+	w.events = append(w.events, ev)
+	if len(w.events) > maxInterfacesEvents {
+		w.events = append([]com.InterfacesEvent{}, w.events[len(w.events)-maxInterfacesEvents:]...)
+	}
+	close(w.changed)
+	w.changed = make(chan struct{})
+	return true
+}
+
+// WatchInterfaces returns the changes of the interfaces after the revision.
+// It blocks until the interfaces are changed, or returns no events when ctx is done.
+func (d *Driver) WatchInterfaces(ctx context.Context, revision uint64) *com.InterfacesWatch {
+	for {
+		d.interfacesLock.RLock()
+		watch := d.interfacesSince(revision)
+		changed := d.interfacesWatch.changed
+		d.interfacesLock.RUnlock()
+		if watch != nil {
+			return watch
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return &com.InterfacesWatch{Revision: revision}
+		}
+	}
+}
+
+// interfacesSince returns nil when there is no change after the revision. d.interfacesLock must be held.
+func (d *Driver) interfacesSince(revision uint64) *com.InterfacesWatch {
+	w := &d.interfacesWatch
+	if revision == w.revision {
+		return nil
+	}
+	// the history has the events after the revision
+	if revision != 0 && revision < w.revision && len(w.events) > 0 && w.events[0].Revision <= revision+1 {
+		res := &com.InterfacesWatch{Revision: w.revision}
+		for _, ev := range w.events {
+			if ev.Revision > revision {
+				res.Events = append(res.Events, ev)
+			}
+		}
+		return res
+	}
+	snapshot := map[string]com.ContainerInterfaces{}
+	for k, v := range d.containerInterfaces {
+		snapshot[k] = v
+	}
+	return &com.InterfacesWatch{
+		Revision: w.revision,
+		Snapshot: snapshot,
+	}
+}
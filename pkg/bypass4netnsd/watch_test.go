@@ -0,0 +1,77 @@
+package bypass4netnsd
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rootless-containers/bypass4netns/pkg/api/com"
+	"github.com/stretchr/testify/assert"
+)
+
+func testInterfaces(id, ip string) *com.ContainerInterfaces {
+	return &com.ContainerInterfaces{
+		ContainerID: id,
+		Interfaces: []com.Interface{{
+			Name:      "eth0",
+			Addresses: []net.IPNet{{IP: net.ParseIP(ip), Mask: net.CIDRMask(24, 32)}},
+		}},
+		ForwardingPorts: map[int]int{80: 8080},
+	}
+}
+
+func TestWatchInterfaces(t *testing.T) {
+	d := NewDriver("/bin/false", "com.sock")
+	adoptWithoutToken(d, "container0")
+	adoptWithoutToken(d, "container1")
+	d.PostInterface("container0", "", testInterfaces("container0", "10.4.0.2"))
+
+	// the first watch returns the snapshot
+	watch := d.WatchInterfaces(context.Background(), 0)
+	assert.Equal(t, 1, len(watch.Snapshot))
+	rev := watch.Revision
+
+	// re-posting the same interfaces does not wake up the watchers
+	d.PostInterface("container0", "", testInterfaces("container0", "10.4.0.2"))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	watch = d.WatchInterfaces(ctx, rev)
+	cancel()
+	assert.Equal(t, rev, watch.Revision)
+	assert.Equal(t, 0, len(watch.Events))
+
+	// the watch waits for the changes
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		d.PostInterface("container1", "", testInterfaces("container1", "10.4.0.3"))
+		d.DeleteInterface("container0", "")
+	}()
+	watch = d.WatchInterfaces(context.Background(), rev)
+	assert.Equal(t, rev+1, watch.Events[0].Revision)
+	assert.Equal(t, com.InterfacesEventPut, watch.Events[0].Type)
+	assert.Equal(t, "container1", watch.Events[0].ContainerID)
+	for watch.Revision < rev+2 {
+		next := d.WatchInterfaces(context.Background(), watch.Revision)
+		watch.Events = append(watch.Events, next.Events...)
+		watch.Revision = next.Revision
+	}
+	assert.Equal(t, com.InterfacesEventDelete, watch.Events[1].Type)
+	assert.Equal(t, "container0", watch.Events[1].ContainerID)
+
+	// the revision not in the history receives the snapshot
+	for i := 0; i < maxInterfacesEvents; i++ {
+		d.DeleteInterface("container1", "")
+		d.PostInterface("container1", "", testInterfaces("container1", "10.4.0.3"))
+	}
+	watch = d.WatchInterfaces(context.Background(), rev)
+	assert.Equal(t, 0, len(watch.Events))
+	assert.Equal(t, 1, len(watch.Snapshot))
+	_, ok := watch.Snapshot["container1"]
+	assert.Equal(t, true, ok)
+
+	// the revision of the previous bypass4netnsd
+	d2 := NewDriver("/bin/false", "com.sock")
+	watch = d2.WatchInterfaces(context.Background(), rev)
+	assert.Equal(t, 0, len(watch.Snapshot))
+	assert.NotEqual(t, nil, watch.Snapshot)
+}
@@ -0,0 +1,164 @@
+package nriplugin
+
+import (
+	"context"
+	"fmt"
+
+	nriapi "github.com/containerd/nri/pkg/api"
+	"github.com/containerd/nri/pkg/stub"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/rootless-containers/bypass4netns/pkg/api"
+	"github.com/rootless-containers/bypass4netns/pkg/api/daemon/client"
+	"github.com/rootless-containers/bypass4netns/pkg/oci"
+	"github.com/rootless-containers/bypass4netns/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+// Plugin is an NRI plugin that starts and stops bypass4netns via bypass4netnsd.
+// Containers are accelerated when the pod or the container has the "bypass4netns=true" annotation.
+// The other annotations are read from the container.
+type Plugin struct {
+	client client.Client
+}
+
+func New(c client.Client) *Plugin {
+	return &Plugin{
+		client: c,
+	}
+}
+
+// Run registers the plugin to the runtime and serves until the connection is closed.
+func (p *Plugin) Run(ctx context.Context, opts ...stub.Option) error {
+	s, err := stub.New(p, opts...)
+	if err != nil {
+		return fmt.Errorf("failed to create NRI stub: %w", err)
+	}
+	return s.Run(ctx)
+}
+
+// CreateContainer configures the seccomp listener path of the container and starts bypass4netns.
+// bypass4netns needs to be listening before the runtime creates the container.
+// When the creation fails after this, the runtime undoes it with StopContainer and RemoveContainer.
+func (p *Plugin) CreateContainer(ctx context.Context, pod *nriapi.PodSandbox, ctr *nriapi.Container) (*nriapi.ContainerAdjustment, []*nriapi.ContainerUpdate, error) {
+	logger := logrus.WithFields(logrus.Fields{"ID": util.ShrinkID(ctr.Id)})
+	annotations := mergeAnnotations(pod, ctr)
+	enabled, _, err := oci.IsEnabled(annotations)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !enabled {
+		return nil, nil, nil
+	}
+	if !hasNetworkNamespace(ctr) {
+		logger.Info("the container does not have its own network namespace, skipping bypass4netns")
+		return nil, nil, nil
+	}
+
+	ports := []api.PortSpec{}
+	if v := annotations[oci.AnnotationPortBindings]; v != "" {
+		ports, err = oci.ParseDockerPortBindings(v)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	bSpec, err := oci.NewBypassSpec(ctr.Id, annotations, ports)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := oci.SetStatePaths(bSpec); err != nil {
+		return nil, nil, err
+	}
+
+	sc := &specs.LinuxSeccomp{
+		DefaultAction: specs.ActAllow,
+	}
+	if policy := ctr.GetLinux().GetSeccompPolicy(); policy != nil {
+		sc = toOCILinuxSeccomp(policy)
+	}
+	sc, err = oci.TranslateSeccompProfile(*sc, bSpec.SocketPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if _, err := p.client.BypassManager().StartBypass(ctx, *bSpec); err != nil {
+		return nil, nil, fmt.Errorf("failed to start bypass4netns: %w", err)
+	}
+	logger.Info("started bypass4netns")
+
+	adjust := &nriapi.ContainerAdjustment{}
+	adjust.SetLinuxSeccompPolicy(nriapi.FromOCILinuxSeccomp(sc))
+	return adjust, nil, nil
+}
+
+// StopContainer stops bypass4netns for the container.
+func (p *Plugin) StopContainer(ctx context.Context, _ *nriapi.PodSandbox, ctr *nriapi.Container) ([]*nriapi.ContainerUpdate, error) {
+	return nil, p.stopBypass(ctx, ctr.Id)
+}
+
+// RemoveContainer stops bypass4netns for the container if it is not stopped yet.
+func (p *Plugin) RemoveContainer(ctx context.Context, _ *nriapi.PodSandbox, ctr *nriapi.Container) error {
+	return p.stopBypass(ctx, ctr.Id)
+}
+
+func (p *Plugin) stopBypass(ctx context.Context, id string) error {
+	bm := p.client.BypassManager()
+	statuses, err := bm.ListBypass(ctx)
+	if err != nil {
+		return err
+	}
+	for _, st := range statuses {
+		if st.ID != id {
+			continue
+		}
+		if err := bm.StopBypass(ctx, id); err != nil {
+			return err
+		}
+		logrus.WithFields(logrus.Fields{"ID": util.ShrinkID(id)}).Info("stopped bypass4netns")
+	}
+	return nil
+}
+
+// mergeAnnotations returns the container annotations with the enable flag of the pod.
+// The other annotations, e.g. the port bindings, are not taken from the pod,
+// as they would be applied to every container in the pod.
+func mergeAnnotations(pod *nriapi.PodSandbox, ctr *nriapi.Container) map[string]string {
+	res := map[string]string{}
+	for k, v := range ctr.GetAnnotations() {
+		res[k] = v
+	}
+	if _, ok := res[oci.Annotation]; !ok {
+		if v, ok := pod.GetAnnotations()[oci.Annotation]; ok {
+			res[oci.Annotation] = v
+		}
+	}
+	return res
+}
+
+func hasNetworkNamespace(ctr *nriapi.Container) bool {
+	for _, ns := range ctr.GetLinux().GetNamespaces() {
+		if ns.Type == string(specs.NetworkNamespace) {
+			return true
+		}
+	}
+	return false
+}
+
+func toOCILinuxSeccomp(o *nriapi.LinuxSeccomp) *specs.LinuxSeccomp {
+	sc := &specs.LinuxSeccomp{
+		DefaultAction:    specs.LinuxSeccompAction(o.DefaultAction),
+		ListenerPath:     o.ListenerPath,
+		ListenerMetadata: o.ListenerMetadata,
+		Syscalls:         nriapi.ToOCILinuxSyscalls(o.Syscalls),
+	}
+	if o.DefaultErrno != nil {
+		errno := uint(o.DefaultErrno.Value)
+		sc.DefaultErrnoRet = &errno
+	}
+	for _, arch := range o.Architectures {
+		sc.Architectures = append(sc.Architectures, specs.Arch(arch))
+	}
+	for _, flag := range o.Flags {
+		sc.Flags = append(sc.Flags, specs.LinuxSeccompFlag(flag))
+	}
+	return sc
+}
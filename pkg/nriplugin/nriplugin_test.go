@@ -0,0 +1,214 @@
+package nriplugin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerd/nri/pkg/adaptation"
+	nriapi "github.com/containerd/nri/pkg/api"
+	"github.com/containerd/nri/pkg/stub"
+	"github.com/gorilla/mux"
+	"github.com/rootless-containers/bypass4netns/pkg/api"
+	"github.com/rootless-containers/bypass4netns/pkg/api/daemon/client"
+	"github.com/rootless-containers/bypass4netns/pkg/api/daemon/router"
+	"github.com/rootless-containers/bypass4netns/pkg/oci"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeDriver struct {
+	bypass map[string]api.BypassStatus
+	lock   sync.Mutex
+}
+
+func (d *fakeDriver) ListBypass() []api.BypassStatus {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	res := []api.BypassStatus{}
+	for _, v := range d.bypass {
+		res = append(res, v)
+	}
+	return res
+}
+
+func (d *fakeDriver) GetBypass(id string) (*api.BypassInfo, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	status, ok := d.bypass[id]
+	if !ok {
+		return nil, fmt.Errorf("child %s not found", id)
+	}
+	return &api.BypassInfo{BypassStatus: status, Alive: true}, nil
+}
+
+func (d *fakeDriver) StartBypass(spec *api.BypassSpec) (*api.BypassStatus, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	status := api.BypassStatus{ID: spec.ID, Pid: 1, Spec: *spec}
+	d.bypass[spec.ID] = status
+	return &status, nil
+}
+
+func (d *fakeDriver) StopBypass(id string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if _, ok := d.bypass[id]; !ok {
+		return fmt.Errorf("child %s not found", id)
+	}
+	delete(d.bypass, id)
+	return nil
+}
+
+func (d *fakeDriver) StopBypassAsync(id string) error {
+	return d.StopBypass(id)
+}
+
+func startFakeDaemon(t *testing.T, dir string, driver *fakeDriver) client.Client {
+	socketPath := filepath.Join(dir, "bypass4netnsd.sock")
+	r := mux.NewRouter()
+	router.AddRoutes(r, &router.Backend{BypassDriver: driver})
+	l, err := net.Listen("unix", socketPath)
+	assert.Equal(t, nil, err)
+	srv := &http.Server{Handler: r}
+	go func() {
+		_ = srv.Serve(l)
+	}()
+	t.Cleanup(func() { srv.Close() })
+
+	c, err := client.New(socketPath)
+	assert.Equal(t, nil, err)
+	return c
+}
+
+func TestPluginWithStubRuntime(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_RUNTIME_DIR", dir)
+	driver := &fakeDriver{bypass: map[string]api.BypassStatus{}}
+	c := startFakeDaemon(t, dir, driver)
+
+	synced := make(chan struct{}, 1)
+	syncFn := func(ctx context.Context, cb adaptation.SyncCB) error {
+		_, err := cb(ctx, nil, nil)
+		synced <- struct{}{}
+		return err
+	}
+	updateFn := func(context.Context, []*adaptation.ContainerUpdate) ([]*adaptation.ContainerUpdate, error) {
+		return nil, nil
+	}
+	nriSocket := filepath.Join(dir, "nri.sock")
+	runtime, err := adaptation.New("stub-runtime", "0.0.1", syncFn, updateFn,
+		adaptation.WithPluginPath(filepath.Join(dir, "plugins")),
+		adaptation.WithPluginConfigPath(filepath.Join(dir, "conf.d")),
+		adaptation.WithSocketPath(nriSocket),
+	)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, runtime.Start())
+	defer runtime.Stop()
+	// synchronization of the pre-installed plugins
+	<-synced
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = New(c).Run(ctx, stub.WithPluginName("bypass4netns"), stub.WithPluginIdx("10"), stub.WithSocketPath(nriSocket))
+	}()
+	select {
+	case <-synced:
+	case <-time.After(10 * time.Second):
+		t.Fatal("plugin is not registered")
+	}
+	// wait for the plugin to be fully registered
+	runtime.BlockPluginSync().Unblock()
+
+	pod := &nriapi.PodSandbox{
+		Id: "pod0",
+		Annotations: map[string]string{
+			oci.Annotation: "true",
+			// not applied to the containers
+			oci.AnnotationPortBindings: `{"443/tcp":[{"HostIp":"","HostPort":"8443"}]}`,
+		},
+	}
+	ctr := &nriapi.Container{
+		Id:           "1234567890abcdef",
+		PodSandboxId: pod.Id,
+		Annotations: map[string]string{
+			oci.AnnotationPortBindings: `{"80/tcp":[{"HostIp":"","HostPort":"8080"}]}`,
+		},
+		Linux: &nriapi.LinuxContainer{
+			Namespaces: []*nriapi.LinuxNamespace{{Type: "network"}},
+		},
+	}
+	resp, err := runtime.CreateContainer(ctx, &nriapi.CreateContainerRequest{Pod: pod, Container: ctr})
+	assert.Equal(t, nil, err)
+	policy := resp.GetAdjust().GetLinux().GetSeccompPolicy()
+	assert.NotEqual(t, nil, policy)
+	assert.Equal(t, filepath.Join(dir, "bypass4netns", "1234567890abcdef.sock"), policy.ListenerPath)
+	assert.Equal(t, oci.SyscallsToBeNotified, policy.Syscalls[0].Names)
+
+	statuses := driver.ListBypass()
+	assert.Equal(t, 1, len(statuses))
+	assert.Equal(t, ctr.Id, statuses[0].ID)
+	assert.Equal(t, 1, len(statuses[0].Spec.PortMapping))
+	assert.Equal(t, 8080, statuses[0].Spec.PortMapping[0].ParentPort)
+	assert.Equal(t, 80, statuses[0].Spec.PortMapping[0].ChildPort)
+
+	_, err = runtime.StopContainer(ctx, &nriapi.StopContainerRequest{Pod: pod, Container: ctr})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(driver.ListBypass()))
+
+	// the runtime undoes the failed creation with RemoveContainer
+	ctr3 := &nriapi.Container{
+		Id:           "fedcba0987654321",
+		PodSandboxId: pod.Id,
+		Linux: &nriapi.LinuxContainer{
+			Namespaces: []*nriapi.LinuxNamespace{{Type: "network"}},
+		},
+	}
+	_, err = runtime.CreateContainer(ctx, &nriapi.CreateContainerRequest{Pod: pod, Container: ctr3})
+	assert.Equal(t, nil, err)
+	statuses = driver.ListBypass()
+	assert.Equal(t, 1, len(statuses))
+	assert.Equal(t, 0, len(statuses[0].Spec.PortMapping))
+	err = runtime.RemoveContainer(ctx, &nriapi.RemoveContainerRequest{Pod: pod, Container: ctr3})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(driver.ListBypass()))
+
+	// the container without the annotation is not modified
+	ctr2 := &nriapi.Container{
+		Id:           "abcdef1234567890",
+		PodSandboxId: "pod1",
+		Linux: &nriapi.LinuxContainer{
+			Namespaces: []*nriapi.LinuxNamespace{{Type: "network"}},
+		},
+	}
+	resp, err = runtime.CreateContainer(ctx, &nriapi.CreateContainerRequest{Pod: &nriapi.PodSandbox{Id: "pod1"}, Container: ctr2})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, (*nriapi.LinuxSeccomp)(nil), resp.GetAdjust().GetLinux().GetSeccompPolicy())
+	assert.Equal(t, 0, len(driver.ListBypass()))
+}
+
+func TestMergeAnnotations(t *testing.T) {
+	pod := &nriapi.PodSandbox{Annotations: map[string]string{
+		oci.Annotation:             "true",
+		oci.AnnotationPortBindings: `{"80/tcp":[{"HostIp":"","HostPort":"8080"}]}`,
+		oci.AnnotationIgnoreBind:   "true",
+	}}
+	ctr := &nriapi.Container{Annotations: map[string]string{
+		oci.AnnotationIgnoreSubnets: `["192.168.0.0/16"]`,
+	}}
+	assert.Equal(t, map[string]string{
+		oci.Annotation:              "true",
+		oci.AnnotationIgnoreSubnets: `["192.168.0.0/16"]`,
+	}, mergeAnnotations(pod, ctr))
+
+	// the container annotation takes precedence
+	ctr.Annotations[oci.Annotation] = "false"
+	assert.Equal(t, "false", mergeAnnotations(pod, ctr)[oci.Annotation])
+
+	assert.Equal(t, map[string]string{}, mergeAnnotations(&nriapi.PodSandbox{}, &nriapi.Container{}))
+}
@@ -0,0 +1,52 @@
+#define _GNU_SOURCE
+#include <errno.h>
+#include <sched.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <sys/syscall.h>
+#include <sys/types.h>
+#include <unistd.h>
+
+#ifndef SYS_pidfd_open
+#define SYS_pidfd_open 434
+#endif
+
+#define NSENTER_ENV "_BYPASS4NETNS_NSENTER"
+
+static void nsenter_fail(const char *msg, const char *env)
+{
+	fprintf(stderr, "nsenter: %s (%s=%s): %s\n", msg, NSENTER_ENV, env, strerror(errno));
+	_exit(1);
+}
+
+/*
+ * nsenter enters the namespaces specified as "<pid>:<nstype>" in NSENTER_ENV.
+ * It runs before the Go runtime starts the threads, because a multi-threaded process cannot enter a user namespace.
+ */
+__attribute__((constructor)) static void nsenter(void)
+{
+	const char *env = getenv(NSENTER_ENV);
+	char *end;
+	long pid, nstype;
+	int pidfd;
+
+	if (env == NULL)
+		return;
+	errno = EINVAL;
+	pid = strtol(env, &end, 10);
+	if (end == env || *end != ':' || pid <= 0)
+		nsenter_fail("invalid value", env);
+	nstype = strtol(end + 1, &end, 10);
+	if (*end != '\0')
+		nsenter_fail("invalid value", env);
+
+	pidfd = syscall(SYS_pidfd_open, (pid_t)pid, 0);
+	if (pidfd < 0)
+		nsenter_fail("failed to open pidfd", env);
+	/* the user namespace is entered first, so the other namespaces are entered with its capabilities */
+	if (setns(pidfd, (int)nstype) < 0)
+		nsenter_fail("failed to enter namespaces", env);
+	close(pidfd);
+	unsetenv(NSENTER_ENV);
+}
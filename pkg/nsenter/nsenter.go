@@ -0,0 +1,41 @@
+// Package nsenter executes the commands in the namespaces of a process without the nsenter binary.
+//
+// The namespaces are entered by the C constructor of this package in the executed process,
+// so the executable must import this package.
+package nsenter
+
+// #cgo CFLAGS: -Wall
+import "C"
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/rootless-containers/bypass4netns/pkg/util"
+	"golang.org/x/sys/unix"
+)
+
+// envName must be the same as NSENTER_ENV in nsenter.c
+const envName = "_BYPASS4NETNS_NSENTER"
+
+// Command returns the command executing name in the namespaces of the pid.
+// nstype is the namespaces to enter, e.g. unix.CLONE_NEWNET, or 0.
+// The user namespace of the pid is entered as well when it is different from the current one,
+// and the credentials are preserved like `nsenter --preserve-credentials`.
+func Command(ctx context.Context, pid int, nstype int, name string, arg ...string) (*exec.Cmd, error) {
+	selfPid := os.Getpid()
+	ok, err := util.SameUserNS(pid, selfPid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check sameUserNS(%d, %d)", pid, selfPid)
+	}
+	if !ok {
+		nstype |= unix.CLONE_NEWUSER
+	}
+	cmd := exec.CommandContext(ctx, name, arg...)
+	if nstype != 0 {
+		cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%d:%d", envName, pid, nstype))
+	}
+	return cmd, nil
+}
@@ -0,0 +1,53 @@
+package nsenter
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/rootless-containers/bypass4netns/pkg/util"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+const helperEnv = "_BYPASS4NETNS_NSENTER_TEST_HELPER"
+
+// TestHelper prints the network namespace of the process executed by TestCommand
+func TestHelper(t *testing.T) {
+	if os.Getenv(helperEnv) == "" {
+		t.Skip("executed by TestCommand")
+	}
+	netns, err := util.NetNS(os.Getpid())
+	assert.Equal(t, nil, err)
+	// the variable is removed after entering the namespaces
+	fmt.Printf("%s%s\n", netns, os.Getenv(envName))
+}
+
+func TestCommand(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires CAP_SYS_ADMIN to enter the network namespace")
+	}
+	self, err := os.Executable()
+	assert.Equal(t, nil, err)
+	netns, err := util.NetNS(os.Getpid())
+	assert.Equal(t, nil, err)
+
+	// the user namespace is not entered as it is the same
+	cmd, err := Command(context.Background(), os.Getpid(), unix.CLONE_NEWNET, self, "-test.run=^TestHelper$")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, fmt.Sprintf("%s=%d:%d", envName, os.Getpid(), unix.CLONE_NEWNET), cmd.Env[len(cmd.Env)-1])
+	cmd.Env = append(cmd.Env, helperEnv+"=1")
+	out, err := cmd.Output()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, netns, strings.SplitN(string(out), "\n", 2)[0])
+
+	// the process exits before the Go runtime starts when it fails to enter the namespaces
+	cmd, err = Command(context.Background(), os.Getpid(), unix.CLONE_NEWNET, self, "-test.run=^TestHelper$")
+	assert.Equal(t, nil, err)
+	cmd.Env[len(cmd.Env)-1] = envName + "=0:0"
+	out, err = cmd.CombinedOutput()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, true, strings.HasPrefix(string(out), "nsenter: invalid value"))
+}
@@ -0,0 +1,223 @@
+package oci
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/rootless-containers/bypass4netns/pkg/api"
+)
+
+const (
+	// Annotation enables bypass4netns for the container ("bypass4netns=true").
+	Annotation = "bypass4netns"
+
+	// AnnotationIgnoreSubnets is a JSON of []string that is appended to
+	// the `bypass4netns --ignore` list.
+	AnnotationIgnoreSubnets = Annotation + "-ignore-subnets"
+
+	// AnnotationIgnoreBind disables acceleration for bind.
+	AnnotationIgnoreBind = Annotation + "-ignore-bind"
+
+	// AnnotationPortBindings is a JSON of Docker's HostConfig.PortBindings
+	// (e.g. `{"80/tcp":[{"HostIp":"","HostPort":"8080"}]}`).
+	AnnotationPortBindings = Annotation + "-port-bindings"
+
+	// AnnotationNetworks is a JSON of []string identifying the networks of the container.
+	// Connections between containers are bypassed only when they share a network.
+	// Defaults to NerdctlAnnotationNetworks.
+	AnnotationNetworks = Annotation + "-networks"
+
+	// NerdctlAnnotationNetworks is a JSON of []string with the names of the networks, set by nerdctl.
+	NerdctlAnnotationNetworks = "nerdctl/networks"
+)
+
+// DefaultIgnoreSubnets is used for the containers started by the integrations.
+// 10.0.2.0/24 is the default CIDR of slirp4netns.
+var DefaultIgnoreSubnets = []string{"127.0.0.0/8", "10.0.2.0/24", "auto"}
+
+// IsEnabled returns whether bypass4netns is enabled and bind(2) is accelerated by the annotations.
+func IsEnabled(annotations map[string]string) (enabled, bindEnabled bool, err error) {
+	b4nn, ok := annotations[Annotation]
+	if !ok {
+		return false, false, nil
+	}
+	enabled, err = strconv.ParseBool(b4nn)
+	if err != nil {
+		return false, false, fmt.Errorf("failed to parse annotation %q: %w", Annotation, err)
+	}
+	bindEnabled = enabled
+	if s, ok := annotations[AnnotationIgnoreBind]; ok {
+		bindDisabled, err := strconv.ParseBool(s)
+		if err != nil {
+			return false, false, fmt.Errorf("failed to parse annotation %q: %w", AnnotationIgnoreBind, err)
+		}
+		bindEnabled = !bindDisabled
+	}
+	return enabled, bindEnabled, nil
+}
+
+type dockerPortBinding struct {
+	HostIP   string `json:"HostIp"`
+	HostPort string `json:"HostPort"`
+}
+
+// ParseDockerPortBindings converts Docker's HostConfig.PortBindings to PortSpecs.
+// Only TCP ports are returned because bypass4netns does not handle other protocols.
+func ParseDockerPortBindings(s string) ([]api.PortSpec, error) {
+	var bindings map[string][]dockerPortBinding
+	if err := json.Unmarshal([]byte(s), &bindings); err != nil {
+		return nil, fmt.Errorf("failed to parse port bindings %q: %w", s, err)
+	}
+	res := []api.PortSpec{}
+	for containerPort, hostBindings := range bindings {
+		portStr, proto, _ := strings.Cut(containerPort, "/")
+		if proto == "" {
+			proto = "tcp"
+		}
+		if proto != "tcp" {
+			continue
+		}
+		childPort, err := strconv.Atoi(portStr)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported container port %q", containerPort)
+		}
+		for _, b := range hostBindings {
+			// the ephemeral port is chosen by Docker for `-p 80`, which is not known here
+			if b.HostPort == "" || b.HostPort == "0" {
+				continue
+			}
+			hostPort, err := strconv.Atoi(b.HostPort)
+			if err != nil {
+				return nil, fmt.Errorf("unsupported host port %q for container port %q", b.HostPort, containerPort)
+			}
+			res = append(res, api.PortSpec{
+				Protos:     []string{proto},
+				ParentIP:   b.HostIP,
+				ParentPort: hostPort,
+				ChildPort:  childPort,
+			})
+		}
+	}
+	return res, nil
+}
+
+// Networks returns the identifiers of the networks of the container from its annotations.
+// It returns nil when the annotations do not specify the networks.
+func Networks(annotations map[string]string) ([]string, error) {
+	for _, k := range []string{AnnotationNetworks, NerdctlAnnotationNetworks} {
+		v, ok := annotations[k]
+		if !ok {
+			continue
+		}
+		var networks []string
+		if err := json.Unmarshal([]byte(v), &networks); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal annotation %q: %q: %w", k, v, err)
+		}
+		return networks, nil
+	}
+	return nil, nil
+}
+
+// NewBypassSpec creates BypassSpec for the container from its annotations.
+func NewBypassSpec(id string, annotations map[string]string, ports []api.PortSpec) (*api.BypassSpec, error) {
+	_, bindEnabled, err := IsEnabled(annotations)
+	if err != nil {
+		return nil, err
+	}
+	ignoreSubnets := append([]string{}, DefaultIgnoreSubnets...)
+	if v := annotations[AnnotationIgnoreSubnets]; v != "" {
+		var subnets []string
+		if err := json.Unmarshal([]byte(v), &subnets); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal annotation %q: %q: %w", AnnotationIgnoreSubnets, v, err)
+		}
+		ignoreSubnets = append(ignoreSubnets, subnets...)
+	}
+	spec := &api.BypassSpec{
+		ID:            id,
+		IgnoreSubnets: ignoreSubnets,
+		IgnoreBind:    !bindEnabled,
+	}
+	if bindEnabled {
+		spec.PortMapping = ports
+	}
+	return spec, nil
+}
+
+// StateDir returns the directory for the sockets, pid files and logs of bypass4netns started by the integrations.
+func StateDir() (string, error) {
+	xdgRuntimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if xdgRuntimeDir == "" {
+		return "", fmt.Errorf("$XDG_RUNTIME_DIR needs to be set")
+	}
+	dir := filepath.Join(xdgRuntimeDir, "bypass4netns")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// maxSocketPathLen is the maximum length of the socket path, excluding the trailing NUL of sun_path
+const maxSocketPathLen = 107
+
+// SetStatePaths fills SocketPath, PidFilePath and LogFilePath of the spec with paths under StateDir.
+// The file names are the full ID, so that the containers with the same prefix do not share the paths.
+// When the socket path is longer than sun_path, the file names are the hash of the ID instead.
+func SetStatePaths(spec *api.BypassSpec) error {
+	dir, err := StateDir()
+	if err != nil {
+		return err
+	}
+	name := spec.ID
+	if name == "" || strings.ContainsRune(name, '/') {
+		return fmt.Errorf("invalid ID %q", name)
+	}
+	if len(filepath.Join(dir, name+".sock")) > maxSocketPathLen {
+		sum := sha256.Sum256([]byte(spec.ID))
+		name = hex.EncodeToString(sum[:16])
+	}
+	spec.SocketPath = filepath.Join(dir, name+".sock")
+	if len(spec.SocketPath) > maxSocketPathLen {
+		return fmt.Errorf("socket path %q is longer than %d bytes", spec.SocketPath, maxSocketPathLen)
+	}
+	spec.PidFilePath = filepath.Join(dir, name+".pid")
+	spec.LogFilePath = filepath.Join(dir, name+".log")
+	return nil
+}
+
+// TranslateSpec configures the seccomp profile of the OCI spec to notify the syscalls to listenerPath.
+func TranslateSpec(s *specs.Spec, listenerPath string) error {
+	if s.Linux == nil {
+		return fmt.Errorf("the spec does not have linux section")
+	}
+	if s.Linux.Seccomp == nil {
+		s.Linux.Seccomp = GetDefaultSeccompProfile(listenerPath)
+		return nil
+	}
+	sc, err := TranslateSeccompProfile(*s.Linux.Seccomp, listenerPath)
+	if err != nil {
+		return err
+	}
+	s.Linux.Seccomp = sc
+	return nil
+}
+
+// HasNetworkNamespace returns whether the container has its own network namespace.
+// Containers sharing the host network namespace do not need bypass4netns.
+func HasNetworkNamespace(s *specs.Spec) bool {
+	if s.Linux == nil {
+		return false
+	}
+	for _, ns := range s.Linux.Namespaces {
+		if ns.Type == specs.NetworkNamespace {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package oci
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rootless-containers/bypass4netns/pkg/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDockerPortBindings(t *testing.T) {
+	ports, err := ParseDockerPortBindings(`{"80/tcp":[{"HostIp":"","HostPort":"8080"}],"53/udp":[{"HostIp":"","HostPort":"5353"}]}`)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(ports))
+	assert.Equal(t, 8080, ports[0].ParentPort)
+	assert.Equal(t, 80, ports[0].ChildPort)
+	assert.Equal(t, []string{"tcp"}, ports[0].Protos)
+
+	// the ephemeral ports of `-p 80` are ignored
+	ports, err = ParseDockerPortBindings(`{"80/tcp":[{"HostIp":"","HostPort":""}],"443/tcp":[{"HostIp":"","HostPort":"8443"}]}`)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(ports))
+	assert.Equal(t, 8443, ports[0].ParentPort)
+	assert.Equal(t, 443, ports[0].ChildPort)
+
+	_, err = ParseDockerPortBindings(`{"80/tcp":[{"HostIp":"","HostPort":"http"}]}`)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestSetStatePaths(t *testing.T) {
+	// t.TempDir() is too long for sun_path
+	tmp, err := os.MkdirTemp("", "b4nn")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(tmp)
+	t.Setenv("XDG_RUNTIME_DIR", tmp)
+
+	id := "6d9bcda7cebd551ddc9e3173d2139386e21b56b241f8459c950ef58e036f6bd8"
+	spec := &api.BypassSpec{ID: id}
+	assert.Equal(t, nil, SetStatePaths(spec))
+	assert.Equal(t, id+".sock", filepath.Base(spec.SocketPath))
+	assert.Equal(t, id+".pid", filepath.Base(spec.PidFilePath))
+
+	// the IDs with the same prefix do not share the paths
+	other := &api.BypassSpec{ID: id[:15] + "0"}
+	assert.Equal(t, nil, SetStatePaths(other))
+	assert.NotEqual(t, spec.SocketPath, other.SocketPath)
+
+	// the hash of the ID is used when the socket path is too long
+	t.Setenv("XDG_RUNTIME_DIR", filepath.Join(tmp, strings.Repeat("x", 30)))
+	long := &api.BypassSpec{ID: id}
+	assert.Equal(t, nil, SetStatePaths(long))
+	assert.Equal(t, true, len(long.SocketPath) <= maxSocketPathLen)
+	longOther := &api.BypassSpec{ID: id[:63] + "0"}
+	assert.Equal(t, nil, SetStatePaths(longOther))
+	assert.NotEqual(t, long.SocketPath, longOther.SocketPath)
+
+	assert.NotEqual(t, nil, SetStatePaths(&api.BypassSpec{ID: "../foo"}))
+}
@@ -11,6 +11,9 @@ const (
 	SocketName = "bypass4netns.sock"
 )
 
+// DefaultRuntimes are the OCI runtimes allowed to send seccomp file descriptors to bypass4netns
+var DefaultRuntimes = []string{"runc", "crun", "youki"}
+
 var SyscallsToBeNotified = []string{"bind", "close", "connect", "setsockopt", "fcntl", "_exit", "exit_group", "getpeername"}
 
 func GetDefaultSeccompProfile(listenerPath string) *specs.LinuxSeccomp {
@@ -0,0 +1,176 @@
+// Package peercred authorizes the peers of UNIX sockets with SO_PEERCRED.
+package peercred
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// Policy specifies the peers allowed to connect.
+type Policy struct {
+	// UIDs are the allowed UIDs. Empty means the effective UID of the current process.
+	UIDs []uint32
+	// PIDs, Cgroups, and Executables restrict the peers of the UIDs.
+	// A peer is allowed when it matches any of them. All empty means any peer of the UIDs.
+	PIDs []int32
+	// Cgroups are the allowed cgroup v2 paths (e.g. "/user.slice/user-1000.slice/user@1000.service").
+	// The descendant cgroups are also allowed.
+	Cgroups []string
+	// Executables are the allowed executables of the peers.
+	// An absolute path is compared with /proc/<pid>/exe, and the others with its base name.
+	Executables []string
+}
+
+// Restricted returns true when the policy restricts the peers by PIDs, Cgroups, or Executables.
+func (p *Policy) Restricted() bool {
+	return len(p.PIDs) > 0 || len(p.Cgroups) > 0 || len(p.Executables) > 0
+}
+
+// Check returns an error if the peer is not allowed.
+func (p *Policy) Check(cred *unix.Ucred) error {
+	uids := p.UIDs
+	if len(uids) == 0 {
+		uids = []uint32{uint32(os.Geteuid())}
+	}
+	if !slices.Contains(uids, cred.Uid) {
+		return fmt.Errorf("uid %d is not allowed", cred.Uid)
+	}
+	if !p.Restricted() {
+		return nil
+	}
+	if slices.Contains(p.PIDs, cred.Pid) {
+		return nil
+	}
+	if len(p.Cgroups) > 0 {
+		cg, err := cgroupOf(cred.Pid)
+		if err != nil {
+			return fmt.Errorf("failed to get the cgroup of pid %d: %w", cred.Pid, err)
+		}
+		for _, allowed := range p.Cgroups {
+			if inCgroup(cg, allowed) {
+				return nil
+			}
+		}
+	}
+	if len(p.Executables) > 0 {
+		exe, err := executableOf(cred.Pid)
+		if err != nil {
+			return fmt.Errorf("failed to get the executable of pid %d: %w", cred.Pid, err)
+		}
+		for _, allowed := range p.Executables {
+			if filepath.IsAbs(allowed) && exe == filepath.Clean(allowed) || !filepath.IsAbs(allowed) && filepath.Base(exe) == allowed {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("pid %d is not allowed", cred.Pid)
+}
+
+// Get returns the credential of the peer.
+func Get(conn *net.UnixConn) (*unix.Ucred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		cred    *unix.Ucred
+		credErr error
+	)
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil {
+		return nil, err
+	}
+	return cred, credErr
+}
+
+// Listener closes the connections whose peers are not allowed by Policy.
+type Listener struct {
+	net.Listener
+	Policy *Policy
+	// Name is used for logging the denied connections
+	Name string
+}
+
+// NewListener wraps l, which must be a UNIX socket listener.
+func NewListener(l net.Listener, policy *Policy, name string) *Listener {
+	return &Listener{
+		Listener: l,
+		Policy:   policy,
+		Name:     name,
+	}
+}
+
+// Accept returns the next connection whose peer is allowed.
+func (l *Listener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		uc, ok := conn.(*net.UnixConn)
+		if !ok {
+			conn.Close()
+			return nil, fmt.Errorf("%s: expected *net.UnixConn, got %T", l.Name, conn)
+		}
+		cred, err := Get(uc)
+		if err == nil {
+			err = l.Policy.Check(cred)
+		}
+		if err != nil {
+			fields := logrus.Fields{"socket": l.Name}
+			if cred != nil {
+				fields["pid"] = cred.Pid
+				fields["uid"] = cred.Uid
+				if exe, exeErr := executableOf(cred.Pid); exeErr == nil {
+					fields["exe"] = exe
+				}
+			}
+			logrus.WithFields(fields).WithError(err).Warn("denied connection")
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
+
+func executableOf(pid int32) (string, error) {
+	exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		return "", err
+	}
+	// the executable may have been replaced by an upgrade
+	return strings.TrimSuffix(exe, " (deleted)"), nil
+}
+
+// cgroupOf returns the cgroup v2 path of the process.
+func cgroupOf(pid int32) (string, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if cg, ok := strings.CutPrefix(scanner.Text(), "0::"); ok {
+			return cg, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("cgroup v2 is not found in /proc/%d/cgroup", pid)
+}
+
+func inCgroup(cg, allowed string) bool {
+	allowed = strings.TrimSuffix(allowed, "/")
+	return cg == allowed || strings.HasPrefix(cg, allowed+"/") || allowed == ""
+}
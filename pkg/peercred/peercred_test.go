@@ -0,0 +1,67 @@
+package peercred
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestCheck(t *testing.T) {
+	self := &unix.Ucred{Pid: int32(os.Getpid()), Uid: uint32(os.Geteuid())}
+	exe, err := os.Executable()
+	assert.Equal(t, nil, err)
+	cg, err := cgroupOf(self.Pid)
+	if err != nil {
+		t.Skipf("cgroup v2 is not available: %v", err)
+	}
+
+	assert.Equal(t, nil, (&Policy{}).Check(self))
+	assert.NotEqual(t, nil, (&Policy{UIDs: []uint32{self.Uid + 1}}).Check(self))
+	assert.Equal(t, nil, (&Policy{PIDs: []int32{self.Pid}}).Check(self))
+	assert.NotEqual(t, nil, (&Policy{PIDs: []int32{self.Pid + 1}}).Check(self))
+	assert.Equal(t, nil, (&Policy{Cgroups: []string{cg}}).Check(self))
+	assert.Equal(t, nil, (&Policy{Cgroups: []string{filepath.Dir(cg)}}).Check(self))
+	assert.NotEqual(t, nil, (&Policy{Cgroups: []string{cg + "-not-exist"}}).Check(self))
+	assert.Equal(t, nil, (&Policy{Executables: []string{filepath.Base(exe)}}).Check(self))
+	assert.Equal(t, nil, (&Policy{Executables: []string{"runc", exe}}).Check(self))
+	assert.NotEqual(t, nil, (&Policy{Executables: []string{"runc", "crun"}}).Check(self))
+	// the peer is allowed when it matches any of the restrictions
+	assert.Equal(t, nil, (&Policy{PIDs: []int32{self.Pid + 1}, Executables: []string{filepath.Base(exe)}}).Check(self))
+}
+
+func TestListener(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "test.sock")
+	ul, err := net.Listen("unix", socketPath)
+	assert.Equal(t, nil, err)
+	defer ul.Close()
+
+	accept := func(policy *Policy) bool {
+		l := NewListener(ul, policy, "test")
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			conn, err := l.Accept()
+			if err == nil {
+				accepted <- conn
+			}
+		}()
+		conn, err := net.Dial("unix", socketPath)
+		assert.Equal(t, nil, err)
+		defer conn.Close()
+		select {
+		case c := <-accepted:
+			c.Close()
+			return true
+		case <-time.After(time.Second):
+			// unblock the pending Accept
+			ul.(*net.UnixListener).SetDeadline(time.Now())
+			return false
+		}
+	}
+	assert.Equal(t, true, accept(&Policy{PIDs: []int32{int32(os.Getpid())}}))
+	assert.Equal(t, false, accept(&Policy{UIDs: []uint32{uint32(os.Geteuid()) + 1}}))
+}
@@ -2,11 +2,36 @@ package util
 
 import (
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"sync"
 	"syscall"
 )
 
+var (
+	agentExecutable     string
+	agentExecutableLock sync.RWMutex
+)
+
+// SetAgentExecutable sets the bypass4netns executable to run the agents (nsagent, tracer agent, and mem agent).
+// bypass4netnsd running bypass4netns in-process sets it, because bypass4netnsd itself cannot run the agents.
+func SetAgentExecutable(path string) {
+	agentExecutableLock.Lock()
+	defer agentExecutableLock.Unlock()
+	agentExecutable = path
+}
+
+// AgentExecutable returns the executable set by SetAgentExecutable, or the executable of the current process.
+func AgentExecutable() (string, error) {
+	agentExecutableLock.RLock()
+	defer agentExecutableLock.RUnlock()
+	if agentExecutable != "" {
+		return agentExecutable, nil
+	}
+	return os.Executable()
+}
+
 // shrinkID shrinks id to short(12 chars) id
 // 6d9bcda7cebd551ddc9e3173d2139386e21b56b241f8459c950ef58e036f6bd8
 // to
@@ -33,55 +58,83 @@ func SameUserNS(pidX, pidY int) (bool, error) {
 	return nsXResolved == nsYResolved, nil
 }
 
-// copied from https://github.com/pfnet-research/meta-fuse-csi-plugin/blob/437dbbbbf16e5b02f9a508e3403d044b0a9dff89/pkg/util/fdchannel.go#L29
+// NetNS returns the identifier of the network namespace of the pid, e.g. "net:[4026531840]"
+func NetNS(pid int) (string, error) {
+	return os.Readlink(fmt.Sprintf("/proc/%d/ns/net", pid))
+}
+
+// maxRecvFds is the maximum number of the file descriptors received by RecvMsg at once
+const maxRecvFds = 16
+
+// maxRecvMsgSize is the maximum size of the message received by RecvMsg
+const maxRecvMsgSize = 64 * 1024
+
+// SendMsg sends msg with the file descriptors via SCM_RIGHTS.
+// based on https://github.com/pfnet-research/meta-fuse-csi-plugin/blob/437dbbbbf16e5b02f9a508e3403d044b0a9dff89/pkg/util/fdchannel.go#L29
 // which is licensed under apache 2.0
-func SendMsg(via net.Conn, fd int, msg []byte) error {
+func SendMsg(via net.Conn, fds []int, msg []byte) error {
 	conn, ok := via.(*net.UnixConn)
 	if !ok {
 		return fmt.Errorf("failed to cast via to *net.UnixConn")
 	}
-	connf, err := conn.File()
+	if len(fds) > maxRecvFds {
+		return fmt.Errorf("too many file descriptors (%d)", len(fds))
+	}
+	var oob []byte
+	if len(fds) > 0 {
+		oob = syscall.UnixRights(fds...)
+	}
+	n, oobn, err := conn.WriteMsgUnix(msg, oob, nil)
 	if err != nil {
 		return err
 	}
-	socket := int(connf.Fd())
-	defer connf.Close()
-
-	rights := syscall.UnixRights(fd)
-
-	return syscall.Sendmsg(socket, msg, rights, nil, 0)
+	if n != len(msg) || oobn != len(oob) {
+		return fmt.Errorf("unexpected written size expected=(%d, %d) actual=(%d, %d)", len(msg), len(oob), n, oobn)
+	}
+	return nil
 }
 
-func RecvMsg(via net.Conn) (int, []byte, error) {
+// RecvMsg receives the message and the file descriptors sent by SendMsg.
+// It returns io.EOF when the peer of the SOCK_SEQPACKET socket is closed.
+func RecvMsg(via net.Conn) ([]int, []byte, error) {
 	conn, ok := via.(*net.UnixConn)
 	if !ok {
-		return 0, nil, fmt.Errorf("failed to cast via to *net.UnixConn")
+		return nil, nil, fmt.Errorf("failed to cast via to *net.UnixConn")
 	}
-	connf, err := conn.File()
+	b := make([]byte, maxRecvMsgSize)
+	oob := make([]byte, syscall.CmsgSpace(4*maxRecvFds))
+	n, oobn, flags, _, err := conn.ReadMsgUnix(b, oob)
 	if err != nil {
-		return 0, nil, err
+		return nil, nil, err
 	}
-	socket := int(connf.Fd())
-	defer connf.Close()
 
-	buf := make([]byte, syscall.CmsgSpace(4))
-	b := make([]byte, 500)
-	//nolint:dogsled
-	n, _, _, _, err := syscall.Recvmsg(socket, b, buf, 0)
-	if err != nil {
-		return 0, nil, err
+	var fds []int
+	if oobn > 0 {
+		msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			return nil, nil, err
+		}
+		for i := range msgs {
+			rights, err := syscall.ParseUnixRights(&msgs[i])
+			if err != nil {
+				closeFds(fds)
+				return nil, nil, err
+			}
+			fds = append(fds, rights...)
+		}
 	}
-
-	var msgs []syscall.SocketControlMessage
-	msgs, err = syscall.ParseSocketControlMessage(buf)
-	if err != nil {
-		return 0, nil, err
+	if flags&(syscall.MSG_TRUNC|syscall.MSG_CTRUNC) != 0 {
+		closeFds(fds)
+		return nil, nil, fmt.Errorf("message is truncated (flags=0x%x)", flags)
 	}
-
-	fds, err := syscall.ParseUnixRights(&msgs[0])
-	if err != nil {
-		return 0, nil, err
+	if n == 0 && len(fds) == 0 {
+		return nil, nil, io.EOF
 	}
+	return fds, b[:n], nil
+}
 
-	return fds[0], b[:n], err
+func closeFds(fds []int) {
+	for _, fd := range fds {
+		syscall.Close(fd)
+	}
 }